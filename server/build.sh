@@ -9,11 +9,17 @@ go build github.com/alexeyknyshev/cpsrv
 #go build github.com/alexeyknyshev/server
 #go build github.com/alexeyknyshev/tools/server_sqlite_to_redis
 go build github.com/alexeyknyshev/tools/server_sqlite_to_tarantool
+go build github.com/alexeyknyshev/tools/cpcheck
+go build github.com/alexeyknyshev/tools/cpbundle
 go install github.com/alexeyknyshev/cpsrv
 #go install github.com/alexeyknyshev/server
 #go install github.com/alexeyknyshev/tools/server_sqlite_to_redis
 go install github.com/alexeyknyshev/tools/server_sqlite_to_tarantool
+go install github.com/alexeyknyshev/tools/cpcheck
+go install github.com/alexeyknyshev/tools/cpbundle
 [ -e "$SCRIPT_DIR/cpsrv" ] && rm "$SCRIPT_DIR/cpsrv"
 #[ -e "$SCRIPT_DIR/server" ] && rm "$SCRIPT_DIR/server"
 #[ -e "$SCRIPT_DIR/server_sqlite_to_redis" ] && rm "$SCRIPT_DIR/server_sqlite_to_redis"
 [ -e "$SCRIPT_DIR/server_sqlite_to_tarantool" ] && rm "$SCRIPT_DIR/server_sqlite_to_tarantool"
+[ -e "$SCRIPT_DIR/cpcheck" ] && rm "$SCRIPT_DIR/cpcheck"
+[ -e "$SCRIPT_DIR/cpbundle" ] && rm "$SCRIPT_DIR/cpbundle"
@@ -11,6 +11,8 @@ fi
 
 
 cd "$SCRIPT_DIR"
+# run handler tests against tarantool instead of in-memory backend
+export CPSRV_TEST_TARANTOOL=1
 
 Timeout=15
 while [[ `nc -z 0 3302; echo $?` -ne 0 ]]; do
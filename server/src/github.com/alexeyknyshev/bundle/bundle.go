@@ -0,0 +1,364 @@
+package bundle
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/alexeyknyshev/models"
+	_ "github.com/mattn/go-sqlite3"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Bundle is a self-contained sqlite database with data of one town.
+// Tables banks, partners, towns, regions and cp have the same schema as
+// in-memory database of client. Bundle hash is computed over contents only,
+// so bundles of unchanged data have the same hash.
+
+// Has to be increased on every schema change
+const FORMAT_VERSION = 1
+
+var ErrNoSuchTown = errors.New("no such town")
+
+var SCHEMA = []string{
+	`CREATE TABLE banks (id integer primary key, name text, licence integer,
+	                     name_tr text, town text, rating integer,
+	                     name_tr_alt text, tel text, ico_path text, mine integer)`,
+	`CREATE TABLE partners (id integer, partner_id integer)`,
+	`CREATE TABLE towns (id integer primary key, name text, name_tr text,
+	                     region_id integer, regional_center integer, mine integer,
+	                     cord_lon real, cord_lat real, zoom real)`,
+	`CREATE TABLE regions (id integer primary key, name text)`,
+	`CREATE TABLE cp (id integer primary key, type text, bank_id integer,
+	                  town_id integer, cord_lon real, cord_lat real, address text,
+	                  address_comment text, metro_name text, main_office integer,
+	                  without_weekend integer, round_the_clock integer,
+	                  works_as_shop integer, free_access integer, currency text,
+	                  cash_in integer, timestamp integer, approved integer,
+	                  schedule text, patch_count integer)`,
+	`CREATE TABLE metro (id integer primary key, town_id integer, branch_id integer,
+	                     station_name text, station_exit_name text,
+	                     cord_lon real, cord_lat real)`,
+	`CREATE TABLE clusters (quadkey text primary key, zoom integer,
+	                        cord_lon real, cord_lat real, size integer, members text)`,
+	`CREATE TABLE bank_ico (bank_id integer primary key, ico_data text)`,
+	`CREATE TABLE bundle_info (key text primary key, value text)`,
+}
+
+type Info struct {
+	FormatVersion int    `json:"format_version"`
+	TownId        uint32 `json:"town_id"`
+	Hash          string `json:"hash"`
+	Created       string `json:"created"`
+	DataTimestamp uint64 `json:"data_timestamp"` // max cashpoint timestamp
+	Cashpoints    int    `json:"cashpoints"`
+	Banks         int    `json:"banks"`
+	Metro         int    `json:"metro"`
+	Clusters      int    `json:"clusters"`
+	Icons         int    `json:"icons"`
+}
+
+type Options struct {
+	// Directory with bank icons named <bank id>.svg, icons are skipped if empty
+	IcoDir string
+}
+
+// Writes every inserted row into bundle hash
+type writer struct {
+	tx   *sql.Tx
+	hash hash.Hash
+}
+
+func (w *writer) insert(table string, values ...interface{}) error {
+	query := "INSERT INTO " + table + " VALUES (?"
+	for i := 1; i < len(values); i++ {
+		query += ", ?"
+	}
+	query += ")"
+
+	_, err := w.tx.Exec(query, values...)
+	if err != nil {
+		return err
+	}
+
+	row, err := json.Marshal(append([]interface{}{table}, values...))
+	if err != nil {
+		return err
+	}
+	w.hash.Write(row)
+	w.hash.Write([]byte{'\n'})
+	return nil
+}
+
+func boolToInt(val bool) int {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+type cashpointList []*models.Cashpoint
+
+func (l cashpointList) Len() int           { return len(l) }
+func (l cashpointList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l cashpointList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+type bankList []*models.Bank
+
+func (l bankList) Len() int           { return len(l) }
+func (l bankList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l bankList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+type metroList []*models.Metro
+
+func (l metroList) Len() int           { return len(l) }
+func (l metroList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l metroList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+func writeTown(w *writer, town *models.Town, region *models.Region) error {
+	err := w.insert("towns", town.Id, town.Name, town.NameTr,
+		town.RegionId, boolToInt(town.RegionalCenter), 0,
+		town.Longitude, town.Latitude, town.Zoom)
+	if err != nil || region == nil {
+		return err
+	}
+	return w.insert("regions", region.Id, region.Name)
+}
+
+func writeCashpoints(w *writer, cashpoints []*models.Cashpoint) error {
+	for _, cp := range cashpoints {
+		currency := cp.Currency
+		if currency == nil {
+			currency = []uint32{}
+		}
+		currencyJson, _ := json.Marshal(currency)
+		scheduleJson, err := json.Marshal(cp.Schedule)
+		if err != nil {
+			return err
+		}
+
+		err = w.insert("cp", cp.Id, cp.Type, cp.BankId,
+			cp.TownId, cp.Longitude, cp.Latitude, cp.Address,
+			cp.AddressComment, cp.MetroName, boolToInt(cp.MainOffice),
+			boolToInt(cp.WithoutWeekend), boolToInt(cp.RoundTheClock),
+			boolToInt(cp.WorksAsShop), boolToInt(cp.FreeAccess), string(currencyJson),
+			boolToInt(cp.CashIn), cp.Timestamp, boolToInt(cp.Approved),
+			string(scheduleJson), cp.PatchCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeBanks(w *writer, banks []*models.Bank, opts Options) (int, error) {
+	icons := 0
+	for _, bank := range banks {
+		icoData := ""
+		if opts.IcoDir != "" {
+			data, err := ioutil.ReadFile(path.Join(opts.IcoDir, strconv.FormatUint(uint64(bank.Id), 10)+".svg"))
+			if err == nil {
+				icoData = string(data)
+			} else if !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+
+		var icoPath interface{} // NULL if there is no icon
+		if icoData != "" {
+			// same path as client uses for downloaded icons
+			icoPath = "ico/bank/" + strconv.FormatUint(uint64(bank.Id), 10)
+		}
+
+		err := w.insert("banks", bank.Id, bank.Name, bank.Licence,
+			bank.NameTr, bank.Town, bank.Rating,
+			bank.NameTrAlt, bank.Tel, icoPath, 0)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, partnerId := range bank.Partners {
+			err = w.insert("partners", bank.Id, partnerId)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if icoData != "" {
+			err = w.insert("bank_ico", bank.Id, icoData)
+			if err != nil {
+				return 0, err
+			}
+			icons++
+		}
+	}
+	return icons, nil
+}
+
+func writeMetro(w *writer, metro []*models.Metro) error {
+	for _, m := range metro {
+		err := w.insert("metro", m.Id, m.TownId, m.BranchId,
+			m.StationName, m.StationExitName,
+			m.Longitude, m.Latitude)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clusters of the town are built from its cashpoints only
+func writeClusters(w *writer, cashpoints []*models.Cashpoint) (int, error) {
+	points := make([]cluster.Point, 0, len(cashpoints))
+	for _, cp := range cashpoints {
+		points = append(points, cluster.Point{Id: cp.Id, Longitude: cp.Longitude, Latitude: cp.Latitude})
+	}
+	clusters := cluster.BuildAll(points)
+
+	quadKeys := make([]string, 0, len(clusters))
+	for quadKey := range clusters {
+		quadKeys = append(quadKeys, quadKey)
+	}
+	sort.Strings(quadKeys)
+
+	for _, quadKey := range quadKeys {
+		c := clusters[quadKey]
+		membersJson, _ := json.Marshal(c.Members)
+		err := w.insert("clusters", quadKey, len(quadKey), c.Longitude, c.Latitude, c.Size(), string(membersJson))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(clusters), nil
+}
+
+func writeInfo(tx *sql.Tx, info *Info) error {
+	values := map[string]string{
+		"format_version": strconv.Itoa(info.FormatVersion),
+		"town_id":        strconv.FormatUint(uint64(info.TownId), 10),
+		"hash":           info.Hash,
+		"created":        info.Created,
+		"data_timestamp": strconv.FormatUint(info.DataTimestamp, 10),
+	}
+	for key, value := range values {
+		_, err := tx.Exec("INSERT INTO bundle_info VALUES (?, ?)", key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes bundle of town into new sqlite database file
+func Build(src Source, townId uint32, filePath string, opts Options) (*Info, error) {
+	town, err := src.Town(townId)
+	if err != nil {
+		return nil, err
+	}
+	if town == nil {
+		return nil, ErrNoSuchTown
+	}
+
+	var region *models.Region
+	if town.RegionId != 0 {
+		region, err = src.Region(town.RegionId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cashpoints, err := src.TownCashpoints(townId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(cashpointList(cashpoints))
+
+	bankSet := make(map[uint32]bool)
+	for _, cp := range cashpoints {
+		bankSet[cp.BankId] = true
+	}
+	bankIds := make([]uint32, 0, len(bankSet))
+	for id := range bankSet {
+		bankIds = append(bankIds, id)
+	}
+	banks, err := src.Banks(bankIds)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(bankList(banks))
+
+	metro, err := src.TownMetro(townId)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(metroList(metro))
+
+	os.Remove(filePath)
+	db, err := sql.Open("sqlite3", filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	for _, query := range SCHEMA {
+		_, err = db.Exec(query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	info := &Info{
+		FormatVersion: FORMAT_VERSION,
+		TownId:        townId,
+		Created:       time.Now().UTC().Format(time.RFC3339),
+		Cashpoints:    len(cashpoints),
+		Banks:         len(banks),
+		Metro:         len(metro),
+	}
+	for _, cp := range cashpoints {
+		if cp.Timestamp > info.DataTimestamp {
+			info.DataTimestamp = cp.Timestamp
+		}
+	}
+
+	w := &writer{tx: tx, hash: sha256.New()}
+	w.hash.Write([]byte(strconv.Itoa(FORMAT_VERSION) + "\n"))
+
+	err = writeTown(w, town, region)
+	if err == nil {
+		err = writeCashpoints(w, cashpoints)
+	}
+	if err == nil {
+		info.Icons, err = writeBanks(w, banks, opts)
+	}
+	if err == nil {
+		err = writeMetro(w, metro)
+	}
+	if err == nil {
+		info.Clusters, err = writeClusters(w, cashpoints)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.Hash = hex.EncodeToString(w.hash.Sum(nil))
+	err = writeInfo(tx, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, tx.Commit()
+}
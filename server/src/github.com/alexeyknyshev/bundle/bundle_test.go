@@ -0,0 +1,173 @@
+package bundle
+
+import (
+	"database/sql"
+	"github.com/alexeyknyshev/models"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testSource struct {
+	towns      map[uint32]*models.Town
+	regions    map[uint32]*models.Region
+	cashpoints []*models.Cashpoint
+	banks      map[uint32]*models.Bank
+	metro      []*models.Metro
+}
+
+func (s *testSource) Town(id uint32) (*models.Town, error) {
+	return s.towns[id], nil
+}
+
+func (s *testSource) Region(id uint32) (*models.Region, error) {
+	return s.regions[id], nil
+}
+
+func (s *testSource) TownCashpoints(townId uint32) ([]*models.Cashpoint, error) {
+	result := make([]*models.Cashpoint, 0)
+	for _, cp := range s.cashpoints {
+		if cp.TownId == townId {
+			result = append(result, cp)
+		}
+	}
+	return result, nil
+}
+
+func (s *testSource) Banks(ids []uint32) ([]*models.Bank, error) {
+	result := make([]*models.Bank, 0)
+	for _, id := range ids {
+		if bank, ok := s.banks[id]; ok {
+			result = append(result, bank)
+		}
+	}
+	return result, nil
+}
+
+func (s *testSource) TownMetro(townId uint32) ([]*models.Metro, error) {
+	result := make([]*models.Metro, 0)
+	for _, m := range s.metro {
+		if m.TownId == townId {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func getTestSource() *testSource {
+	return &testSource{
+		towns: map[uint32]*models.Town{
+			4: {Id: 4, Name: "Москва", NameTr: "Moskva", RegionId: 3, Longitude: 37.61, Latitude: 55.75, Zoom: 10, Big: true},
+		},
+		regions: map[uint32]*models.Region{
+			3: {Id: 3, Name: "Москва", NameTr: "Moskva", Longitude: 37.61, Latitude: 55.75, Zoom: 9},
+		},
+		cashpoints: []*models.Cashpoint{
+			{CashpointData: models.CashpointData{Id: 7, Type: "atm", BankId: 322, TownId: 4, Longitude: 37.64, Latitude: 55.75,
+				Schedule: models.Schedule{Mon: &models.ScheduleDay{From: 0, To: 1440}},
+				Currency: []uint32{643, 840}}, Timestamp: 100, Approved: true},
+			{CashpointData: models.CashpointData{Id: 3, Type: "office", BankId: 325, TownId: 4, Longitude: 37.62, Latitude: 55.76}, Approved: true},
+			{CashpointData: models.CashpointData{Id: 5, Type: "atm", BankId: 1, TownId: 5, Longitude: 30.31, Latitude: 59.93}}, // other town
+		},
+		banks: map[uint32]*models.Bank{
+			322: {Id: 322, Name: "Сбербанк России", Partners: []uint32{325}},
+			325: {Id: 325, Name: "ВТБ 24"},
+			1:   {Id: 1, Name: "Other"},
+		},
+		metro: []*models.Metro{
+			{Id: 1, TownId: 4, StationName: "Охотный ряд", Longitude: 37.61, Latitude: 55.75},
+		},
+	}
+}
+
+func queryCount(t *testing.T, db *sql.DB, query string) int {
+	var count int
+	if err := db.QueryRow(query).Scan(&count); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return count
+}
+
+func TestBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	icoDir := path.Join(dir, "ico")
+	os.Mkdir(icoDir, 0755)
+	ioutil.WriteFile(path.Join(icoDir, "322.svg"), []byte("<svg/>"), 0644)
+
+	src := getTestSource()
+	filePath := path.Join(dir, "4.sqlite")
+	info, err := Build(src, 4, filePath, Options{IcoDir: icoDir})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if info.Cashpoints != 2 || info.Banks != 2 || info.Metro != 1 || info.Icons != 1 || info.DataTimestamp != 100 {
+		t.Errorf("Unexpected bundle info: %+v", info)
+	}
+
+	db, err := sql.Open("sqlite3", filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if count := queryCount(t, db, "SELECT COUNT(*) FROM cp"); count != 2 {
+		t.Errorf("Expected 2 cashpoints but got %d", count)
+	}
+	if count := queryCount(t, db, "SELECT COUNT(*) FROM clusters WHERE size = 2"); count == 0 {
+		t.Errorf("Expected cluster of both cashpoints")
+	}
+	if count := queryCount(t, db, "SELECT COUNT(*) FROM partners WHERE id = 322 AND partner_id = 325"); count != 1 {
+		t.Errorf("Expected bank partners in bundle")
+	}
+
+	var regionName string
+	err = db.QueryRow("SELECT r.name FROM towns t JOIN regions r ON r.id = t.region_id WHERE t.id = 4").Scan(&regionName)
+	if err != nil || regionName != "Москва" {
+		t.Errorf("Expected region of town in bundle but got %s %v", regionName, err)
+	}
+
+	var currency, schedule, icoPath, hash string
+	err = db.QueryRow("SELECT currency, schedule FROM cp WHERE id = 7").Scan(&currency, &schedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currency != "[643,840]" || schedule != `{"mon":{"f":0,"t":1440}}` {
+		t.Errorf("Unexpected cashpoint currency %s or schedule %s", currency, schedule)
+	}
+	err = db.QueryRow("SELECT ico_path FROM banks WHERE id = 322").Scan(&icoPath)
+	if err != nil || icoPath != "ico/bank/322" {
+		t.Errorf("Unexpected ico path: %s %v", icoPath, err)
+	}
+	err = db.QueryRow("SELECT value FROM bundle_info WHERE key = 'hash'").Scan(&hash)
+	if err != nil || hash != info.Hash {
+		t.Errorf("Expected hash %s in bundle info but got %s %v", info.Hash, hash, err)
+	}
+
+	// same data => same hash
+	again, err := Build(src, 4, path.Join(dir, "4_again.sqlite"), Options{IcoDir: icoDir})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if again.Hash != info.Hash {
+		t.Errorf("Expected same hash for same data: %s != %s", again.Hash, info.Hash)
+	}
+
+	src.cashpoints[0].Address = "Тверская, 1"
+	changed, err := Build(src, 4, path.Join(dir, "4_changed.sqlite"), Options{IcoDir: icoDir})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	if changed.Hash == info.Hash {
+		t.Errorf("Expected different hash for changed data")
+	}
+
+	if _, err = Build(src, 100, path.Join(dir, "100.sqlite"), Options{}); err != ErrNoSuchTown {
+		t.Errorf("Expected ErrNoSuchTown but got %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package bundle
+
+import (
+	"github.com/alexeyknyshev/models"
+)
+
+// Provides data of bundle
+type Source interface {
+	// Returns nil if there is no such town
+	Town(id uint32) (*models.Town, error)
+	// Returns nil if there is no such region
+	Region(id uint32) (*models.Region, error)
+	TownCashpoints(townId uint32) ([]*models.Cashpoint, error)
+	Banks(ids []uint32) ([]*models.Bank, error)
+	TownMetro(townId uint32) ([]*models.Metro, error)
+}
+
+// Bundles are built of tarantool data with models.NewRepository(tnt)
+var _ Source = (*models.Repository)(nil)
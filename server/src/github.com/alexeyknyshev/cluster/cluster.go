@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"github.com/alexeyknyshev/quadkey"
+	"math"
+	"sort"
+)
+
+// Clusters are stored in tarantool 'clusters' space as
+// [quadkey, { longitude, latitude }, members, size]
+// where coordinate is a centroid of members.
+
+// Coordinates are stored as float, so compare centroids roughly
+const COORD_EPSILON = 1e-5
+
+type Point struct {
+	Id        uint32
+	Longitude float64
+	Latitude  float64
+}
+
+type Cluster struct {
+	QuadKey   string
+	Longitude float64
+	Latitude  float64
+	Members   []uint32
+}
+
+func (c *Cluster) Size() int {
+	return len(c.Members)
+}
+
+// Returns true if clusters have same members (in any order) and close centroids
+func (c *Cluster) Equal(o *Cluster) bool {
+	if c.QuadKey != o.QuadKey || len(c.Members) != len(o.Members) {
+		return false
+	}
+	if math.Abs(c.Longitude-o.Longitude) > COORD_EPSILON || math.Abs(c.Latitude-o.Latitude) > COORD_EPSILON {
+		return false
+	}
+
+	members := make(map[uint32]bool, len(c.Members))
+	for _, id := range c.Members {
+		members[id] = true
+	}
+	for _, id := range o.Members {
+		if !members[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns quadkeys of all clusters containing point
+func Branch(p Point) ([]string, error) {
+	quadKey, err := quadkey.Encode(p.Longitude, p.Latitude, quadkey.CLUSTER_ZOOM_MAX)
+	if err != nil {
+		return nil, err
+	}
+	return quadkey.Prefixes(quadKey, quadkey.CLUSTER_ZOOM_MIN, quadkey.CLUSTER_ZOOM_MAX), nil
+}
+
+// Builds cluster with passed quadkey from points lying inside of it.
+// Returns nil if there is no such points.
+func Build(quadKey string, points []Point) *Cluster {
+	zoom := uint32(len(quadKey))
+	c := &Cluster{QuadKey: quadKey, Members: make([]uint32, 0)}
+	for _, p := range points {
+		pointQuadKey, err := quadkey.Encode(p.Longitude, p.Latitude, zoom)
+		if err != nil || pointQuadKey != quadKey {
+			continue
+		}
+		c.Longitude += p.Longitude
+		c.Latitude += p.Latitude
+		c.Members = append(c.Members, p.Id)
+	}
+
+	if len(c.Members) == 0 {
+		return nil
+	}
+
+	c.Longitude /= float64(len(c.Members))
+	c.Latitude /= float64(len(c.Members))
+	sort.Sort(idList(c.Members))
+	return c
+}
+
+// Builds all clusters (CLUSTER_ZOOM_MIN..CLUSTER_ZOOM_MAX) of passed points.
+// Points with invalid coordinates are skipped.
+func BuildAll(points []Point) map[string]*Cluster {
+	result := make(map[string]*Cluster)
+	for _, p := range points {
+		branch, err := Branch(p)
+		if err != nil {
+			continue
+		}
+		for _, quadKey := range branch {
+			c, ok := result[quadKey]
+			if !ok {
+				c = &Cluster{QuadKey: quadKey, Members: make([]uint32, 0, 1)}
+				result[quadKey] = c
+			}
+			c.Longitude += p.Longitude
+			c.Latitude += p.Latitude
+			c.Members = append(c.Members, p.Id)
+		}
+	}
+
+	for _, c := range result {
+		c.Longitude /= float64(len(c.Members))
+		c.Latitude /= float64(len(c.Members))
+		sort.Sort(idList(c.Members))
+	}
+	return result
+}
+
+type idList []uint32
+
+func (l idList) Len() int {
+	return len(l)
+}
+
+func (l idList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l idList) Less(i, j int) bool {
+	return l[i] < l[j]
+}
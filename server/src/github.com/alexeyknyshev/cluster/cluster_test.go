@@ -0,0 +1,120 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBranch(t *testing.T) {
+	branch, err := Branch(Point{Id: 1, Longitude: 37.61775970459, Latitude: 55.755771636963})
+	if err != nil {
+		t.Fatalf("Branch failed: %v", err)
+	}
+	expected := []string{"3201323213", "32013232130", "320132321300", "3201323213002", "32013232130022", "320132321300220", "3201323213002200"}
+	if !reflect.DeepEqual(branch, expected) {
+		t.Errorf("Expected branch %v but got %v", expected, branch)
+	}
+
+	if _, err = Branch(Point{Id: 2, Longitude: 200.0, Latitude: 0.0}); err == nil {
+		t.Errorf("Expected error for invalid coordinate")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	points := []Point{
+		{Id: 7, Longitude: 37.64, Latitude: 55.75},
+		{Id: 3, Longitude: 37.62, Latitude: 55.76},
+		{Id: 5, Longitude: 30.31, Latitude: 59.93}, // out of cluster
+	}
+
+	c := Build("3201323213", points)
+	if c == nil {
+		t.Fatalf("Expected cluster but got nil")
+	}
+	if !reflect.DeepEqual(c.Members, []uint32{3, 7}) {
+		t.Errorf("Expected members [3 7] but got %v", c.Members)
+	}
+	expected := &Cluster{QuadKey: "3201323213", Longitude: 37.63, Latitude: 55.755, Members: []uint32{7, 3}}
+	if !c.Equal(expected) {
+		t.Errorf("Expected cluster %+v but got %+v", expected, c)
+	}
+
+	if c = Build("0000000000", points); c != nil {
+		t.Errorf("Expected no cluster but got %+v", c)
+	}
+}
+
+func TestClusterEqual(t *testing.T) {
+	a := &Cluster{QuadKey: "3201323213", Longitude: 37.61, Latitude: 55.755, Members: []uint32{3, 7}}
+	b := &Cluster{QuadKey: "3201323213", Longitude: 37.610001, Latitude: 55.755, Members: []uint32{7, 3}}
+	if !a.Equal(b) {
+		t.Errorf("Expected clusters to be equal: %+v %+v", a, b)
+	}
+
+	b.Members = []uint32{7, 4}
+	if a.Equal(b) {
+		t.Errorf("Expected clusters with different members to differ")
+	}
+
+	b.Members = []uint32{7, 3}
+	b.Latitude = 55.76
+	if a.Equal(b) {
+		t.Errorf("Expected clusters with different centroids to differ")
+	}
+}
+
+func TestReportTouchedByZoom(t *testing.T) {
+	r := &Report{
+		Created:   []string{"3201323213"},
+		Updated:   []string{"32013232130", "32013232131"},
+		Deleted:   []string{"3201323213002200"},
+		Unchanged: []string{"320132321300"},
+	}
+	if r.Touched() != 4 {
+		t.Errorf("Expected 4 touched clusters but got %d", r.Touched())
+	}
+	expected := map[int]int{10: 1, 11: 2, 16: 1}
+	if got := r.TouchedByZoom(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v but got %v", expected, got)
+	}
+}
+
+func TestBuildAll(t *testing.T) {
+	points := []Point{
+		{Id: 7, Longitude: 37.64, Latitude: 55.75},
+		{Id: 3, Longitude: 37.62, Latitude: 55.76},
+		{Id: 5, Longitude: 30.31, Latitude: 59.93},
+		{Id: 9, Longitude: 200.0, Latitude: 0.0}, // invalid
+	}
+
+	clusters := BuildAll(points)
+	for _, p := range points[:3] {
+		branch, _ := Branch(p)
+		for _, quadKey := range branch {
+			expected := Build(quadKey, points)
+			c, ok := clusters[quadKey]
+			if !ok {
+				t.Errorf("Missing cluster %s", quadKey)
+				continue
+			}
+			if !c.Equal(expected) {
+				t.Errorf("Expected cluster %+v but got %+v", expected, c)
+			}
+		}
+	}
+
+	// 2 branches diverge after zoom 10 in Moscow + 1 branch in Saint Petersburg
+	moscow, _ := Branch(points[0])
+	other, _ := Branch(points[1])
+	expectedCount := 7
+	for i := range moscow {
+		if moscow[i] != other[i] {
+			expectedCount += 2
+		} else {
+			expectedCount++
+		}
+	}
+	if len(clusters) != expectedCount {
+		t.Errorf("Expected %d clusters but got %d", expectedCount, len(clusters))
+	}
+}
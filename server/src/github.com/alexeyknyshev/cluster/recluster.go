@@ -0,0 +1,138 @@
+package cluster
+
+import (
+	"github.com/alexeyknyshev/quadkey"
+	"sort"
+)
+
+type Report struct {
+	Cashpoints int
+	Created    []string
+	Updated    []string
+	Deleted    []string
+	Unchanged  []string
+}
+
+// Count of created, updated and deleted clusters
+func (r *Report) Touched() int {
+	return len(r.Created) + len(r.Updated) + len(r.Deleted)
+}
+
+// Returns count of touched clusters per zoom level
+func (r *Report) TouchedByZoom() map[int]int {
+	result := make(map[int]int)
+	for _, list := range [][]string{r.Created, r.Updated, r.Deleted} {
+		for _, quadKey := range list {
+			result[len(quadKey)]++
+		}
+	}
+	return result
+}
+
+// Returns clusters of quad tree branches affected by passed cashpoints.
+// Cashpoint affects branch of its current position and branch of position
+// clusters were built from (old position of moved or deleted cashpoint).
+func affectedClusters(s *Store, ids []uint32) (map[string]bool, error) {
+	affected := make(map[string]bool)
+	for _, id := range ids {
+		current, err := s.Cashpoint(id)
+		if err != nil {
+			return nil, err
+		}
+		clustered, err := s.ClusteredPosition(id)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range []*Point{current, clustered} {
+			if p == nil {
+				continue
+			}
+			branch, err := Branch(*p)
+			if err != nil {
+				return nil, err
+			}
+			for _, quadKey := range branch {
+				affected[quadKey] = true
+			}
+		}
+	}
+	return affected, nil
+}
+
+// Recomputes members and centroids of clusters affected by passed
+// cashpoints, affected clusters are selected by quadkey. Tarantool is not
+// modified in dry run mode.
+func Recluster(s *Store, ids []uint32, dryRun bool) (*Report, error) {
+	report := &Report{
+		Cashpoints: len(ids),
+		Created:    make([]string, 0),
+		Updated:    make([]string, 0),
+		Deleted:    make([]string, 0),
+		Unchanged:  make([]string, 0),
+	}
+
+	affected, err := affectedClusters(s, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// all affected clusters of one branch are built from its root cashpoints
+	roots := make(map[string][]string)
+	for quadKey := range affected {
+		root := quadKey[:quadkey.CLUSTER_ZOOM_MIN]
+		roots[root] = append(roots[root], quadKey)
+	}
+
+	for root, quadKeys := range roots {
+		points, err := s.CashpointsInQuadKey(root)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, quadKey := range quadKeys {
+			c := Build(quadKey, points)
+
+			existing, err := s.Cluster(quadKey)
+			if err != nil {
+				return nil, err
+			}
+
+			switch {
+			case c == nil && existing == nil:
+				continue
+			case c == nil:
+				if !dryRun {
+					err = s.DeleteCluster(quadKey)
+				}
+				report.Deleted = append(report.Deleted, quadKey)
+			case existing == nil:
+				if !dryRun {
+					err = s.ReplaceCluster(c)
+				}
+				report.Created = append(report.Created, quadKey)
+			case !c.Equal(existing):
+				if !dryRun {
+					err = s.ReplaceCluster(c)
+				}
+				report.Updated = append(report.Updated, quadKey)
+			default:
+				report.Unchanged = append(report.Unchanged, quadKey)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !dryRun {
+		if err = s.SetClustered(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, list := range [][]string{report.Created, report.Updated, report.Deleted, report.Unchanged} {
+		sort.Strings(list)
+	}
+	return report, nil
+}
@@ -0,0 +1,402 @@
+package cluster
+
+import (
+	"errors"
+	"github.com/alexeyknyshev/quadkey"
+	"github.com/tarantool/go-tarantool"
+)
+
+const SELECT_BATCH_SIZE = 1024
+
+// Cashpoints space columns (zero based)
+const COL_CP_COORD = 1
+const COL_CP_TIMESTAMP = 19
+
+// Clusters space indexes
+const CLUSTERS_INDEX_PRIMARY = 0
+
+// Cashpoints space indexes
+const CASHPOINTS_INDEX_PRIMARY = 0
+const CASHPOINTS_INDEX_SPATIAL = 1
+
+// Clustered cashpoints space columns (zero based)
+// [cp_id] [coord]
+const COL_CLUSTERED_COORD = 1
+
+// Clustered cashpoints space indexes
+const CLUSTERED_INDEX_PRIMARY = 0
+
+// Tarantool backed access to cashpoints, clusters and clustered cashpoints
+// spaces. Clustered cashpoints keep positions clusters were built from, so
+// old position of moved or deleted cashpoint is known on recluster.
+type Store struct {
+	tnt               *tarantool.Connection
+	cashpointsSpaceId uint32
+	clustersSpaceId   uint32
+	clusteredSpaceId  uint32
+}
+
+func getSpaceId(tnt *tarantool.Connection, name string) (uint32, error) {
+	resp, err := tnt.Call("getSpaceId", []interface{}{name})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Data) == 0 {
+		return 0, errors.New("empty getSpaceId reply")
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) == 0 {
+		return 0, errors.New("unexpected getSpaceId reply")
+	}
+	id, ok := toUint64(tuple[0])
+	if !ok || id == 0 {
+		return 0, errors.New("no such tarantool space: " + name)
+	}
+	return uint32(id), nil
+}
+
+func NewStore(tnt *tarantool.Connection) (*Store, error) {
+	cashpointsSpaceId, err := getSpaceId(tnt, "cashpoints")
+	if err != nil {
+		return nil, err
+	}
+	clustersSpaceId, err := getSpaceId(tnt, "clusters")
+	if err != nil {
+		return nil, err
+	}
+	clusteredSpaceId, err := getSpaceId(tnt, "clustered_cashpoints")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		tnt:               tnt,
+		cashpointsSpaceId: cashpointsSpaceId,
+		clustersSpaceId:   clustersSpaceId,
+		clusteredSpaceId:  clusteredSpaceId,
+	}, nil
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch val := v.(type) {
+	case uint64:
+		return val, true
+	case int64:
+		return uint64(val), val >= 0
+	case uint32:
+		return uint64(val), true
+	case int32:
+		return uint64(val), val >= 0
+	case uint:
+		return uint64(val), true
+	case int:
+		return uint64(val), val >= 0
+	case uint16:
+		return uint64(val), true
+	case int16:
+		return uint64(val), val >= 0
+	case uint8:
+		return uint64(val), true
+	case int8:
+		return uint64(val), val >= 0
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	}
+	if u, ok := toUint64(v); ok {
+		return float64(u), true
+	}
+	if i, ok := v.(int64); ok {
+		return float64(i), true
+	}
+	return 0.0, false
+}
+
+func tupleCoord(v interface{}) (float64, float64, error) {
+	coord, ok := v.([]interface{})
+	if !ok || len(coord) < 2 {
+		return 0.0, 0.0, errors.New("invalid coordinate")
+	}
+	lon, okLon := toFloat64(coord[0])
+	lat, okLat := toFloat64(coord[1])
+	if !okLon || !okLat {
+		return 0.0, 0.0, errors.New("invalid coordinate")
+	}
+	return lon, lat, nil
+}
+
+func tupleToPoint(tuple []interface{}) (Point, error) {
+	if len(tuple) <= COL_CP_COORD {
+		return Point{}, errors.New("invalid cashpoint tuple")
+	}
+	id, ok := toUint64(tuple[0])
+	if !ok {
+		return Point{}, errors.New("invalid cashpoint id")
+	}
+	lon, lat, err := tupleCoord(tuple[COL_CP_COORD])
+	if err != nil {
+		return Point{}, err
+	}
+	return Point{Id: uint32(id), Longitude: lon, Latitude: lat}, nil
+}
+
+func tupleToCluster(tuple []interface{}) (*Cluster, error) {
+	if len(tuple) < 3 {
+		return nil, errors.New("invalid cluster tuple")
+	}
+	quadKey, ok := tuple[0].(string)
+	if !ok {
+		return nil, errors.New("invalid cluster quadkey")
+	}
+	lon, lat, err := tupleCoord(tuple[1])
+	if err != nil {
+		return nil, err
+	}
+	members, ok := tuple[2].([]interface{})
+	if !ok {
+		return nil, errors.New("invalid cluster members")
+	}
+
+	c := &Cluster{QuadKey: quadKey, Longitude: lon, Latitude: lat, Members: make([]uint32, 0, len(members))}
+	for _, m := range members {
+		id, ok := toUint64(m)
+		if !ok {
+			return nil, errors.New("invalid cluster member: " + quadKey)
+		}
+		c.Members = append(c.Members, uint32(id))
+	}
+	return c, nil
+}
+
+// Returns nil if there is no cashpoint with such id
+func (s *Store) Cashpoint(id uint32) (*Point, error) {
+	resp, err := s.tnt.Select(s.cashpointsSpaceId, CASHPOINTS_INDEX_PRIMARY, 0, 1, tarantool.IterEq, []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	tuples := resp.Tuples()
+	if len(tuples) == 0 {
+		return nil, nil
+	}
+	p, err := tupleToPoint(tuples[0])
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Iterates over all tuples of space with numeric primary key in key order
+func (s *Store) forEachTuple(spaceId uint32, callback func(tuple []interface{}) error) error {
+	var lastId uint64 = 0
+	iterator := tarantool.IterAll
+	key := []interface{}{}
+	for {
+		resp, err := s.tnt.Select(spaceId, 0, 0, SELECT_BATCH_SIZE, iterator, key)
+		if err != nil {
+			return err
+		}
+		tuples := resp.Tuples()
+		for _, tuple := range tuples {
+			lastId, _ = toUint64(tuple[0])
+			err = callback(tuple)
+			if err != nil {
+				return err
+			}
+		}
+		if len(tuples) < SELECT_BATCH_SIZE {
+			return nil
+		}
+		iterator = tarantool.IterGt
+		key = []interface{}{lastId}
+	}
+}
+
+// Iterates over all cashpoints in id order
+func (s *Store) ForEachCashpoint(callback func(tuple []interface{}) error) error {
+	return s.forEachTuple(s.cashpointsSpaceId, callback)
+}
+
+// Returns ids of cashpoints with timestamp (microseconds) not less than since
+// and ids of deleted cashpoints clusters are still built from.
+// Cashpoints without timestamp were not changed after import.
+func (s *Store) CashpointsChangedSince(since uint64) ([]uint32, error) {
+	result := make([]uint32, 0)
+	existing := make(map[uint32]bool)
+	err := s.ForEachCashpoint(func(tuple []interface{}) error {
+		id, _ := toUint64(tuple[0])
+		existing[uint32(id)] = true
+		if len(tuple) <= COL_CP_TIMESTAMP {
+			return nil
+		}
+		timestamp, ok := toUint64(tuple[COL_CP_TIMESTAMP])
+		if ok && timestamp >= since {
+			result = append(result, uint32(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// deleted cashpoints leave no timestamp
+	err = s.forEachTuple(s.clusteredSpaceId, func(tuple []interface{}) error {
+		id, _ := toUint64(tuple[0])
+		if !existing[uint32(id)] {
+			result = append(result, uint32(id))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Returns position clusters were built from for cashpoint, nil if
+// cashpoint was not clustered yet
+func (s *Store) ClusteredPosition(id uint32) (*Point, error) {
+	resp, err := s.tnt.Select(s.clusteredSpaceId, CLUSTERED_INDEX_PRIMARY, 0, 1, tarantool.IterEq, []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	tuples := resp.Tuples()
+	if len(tuples) == 0 {
+		return nil, nil
+	}
+	if len(tuples[0]) <= COL_CLUSTERED_COORD {
+		return nil, errors.New("invalid clustered cashpoint tuple")
+	}
+	lon, lat, err := tupleCoord(tuples[0][COL_CLUSTERED_COORD])
+	if err != nil {
+		return nil, err
+	}
+	return &Point{Id: id, Longitude: lon, Latitude: lat}, nil
+}
+
+func (s *Store) setClustered(p *Point) error {
+	_, err := s.tnt.Replace(s.clusteredSpaceId, []interface{}{p.Id, []float64{p.Longitude, p.Latitude}})
+	return err
+}
+
+// Remembers current positions of passed cashpoints as clustered ones,
+// deleted cashpoints are forgotten
+func (s *Store) SetClustered(ids []uint32) error {
+	for _, id := range ids {
+		p, err := s.Cashpoint(id)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			_, err = s.tnt.Delete(s.clusteredSpaceId, CLUSTERED_INDEX_PRIMARY, []interface{}{id})
+		} else {
+			err = s.setClustered(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remembers positions of all cashpoints as clustered ones after clusters
+// are built from scratch
+func (s *Store) ResetClustered() error {
+	_, err := s.tnt.Call("spaceTruncate", []interface{}{"clustered_cashpoints"})
+	if err != nil {
+		return err
+	}
+	return s.ForEachCashpoint(func(tuple []interface{}) error {
+		p, err := tupleToPoint(tuple)
+		if err != nil {
+			return err
+		}
+		return s.setClustered(&p)
+	})
+}
+
+// Returns cashpoints inside of quadkey rect (including its borders)
+func (s *Store) CashpointsInQuadKey(quadKey string) ([]Point, error) {
+	bbox, err := quadkey.Decode(quadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rect := []interface{}{bbox.MinLon, bbox.MinLat, bbox.MaxLon, bbox.MaxLat}
+	result := make([]Point, 0)
+	for offset := uint32(0); ; offset += SELECT_BATCH_SIZE {
+		resp, err := s.tnt.Select(s.cashpointsSpaceId, CASHPOINTS_INDEX_SPATIAL, offset, SELECT_BATCH_SIZE, tarantool.IterLe, rect)
+		if err != nil {
+			return nil, err
+		}
+		tuples := resp.Tuples()
+		for _, tuple := range tuples {
+			p, err := tupleToPoint(tuple)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, p)
+		}
+		if len(tuples) < SELECT_BATCH_SIZE {
+			return result, nil
+		}
+	}
+}
+
+// Returns nil if there is no cluster with such quadkey
+func (s *Store) Cluster(quadKey string) (*Cluster, error) {
+	resp, err := s.tnt.Select(s.clustersSpaceId, CLUSTERS_INDEX_PRIMARY, 0, 1, tarantool.IterEq, []interface{}{quadKey})
+	if err != nil {
+		return nil, err
+	}
+	tuples := resp.Tuples()
+	if len(tuples) == 0 {
+		return nil, nil
+	}
+	return tupleToCluster(tuples[0])
+}
+
+// Iterates over all clusters in primary (hash) index order
+func (s *Store) ForEachCluster(callback func(c *Cluster) error) error {
+	iterator := tarantool.IterAll
+	key := []interface{}{}
+	for {
+		resp, err := s.tnt.Select(s.clustersSpaceId, CLUSTERS_INDEX_PRIMARY, 0, SELECT_BATCH_SIZE, iterator, key)
+		if err != nil {
+			return err
+		}
+		tuples := resp.Tuples()
+		var lastQuadKey string
+		for _, tuple := range tuples {
+			c, err := tupleToCluster(tuple)
+			if err != nil {
+				return err
+			}
+			lastQuadKey = c.QuadKey
+			err = callback(c)
+			if err != nil {
+				return err
+			}
+		}
+		if len(tuples) < SELECT_BATCH_SIZE {
+			return nil
+		}
+		// hash index supports GT to continue full scan
+		iterator = tarantool.IterGt
+		key = []interface{}{lastQuadKey}
+	}
+}
+
+func (s *Store) ReplaceCluster(c *Cluster) error {
+	_, err := s.tnt.Replace(s.clustersSpaceId, []interface{}{
+		c.QuadKey, []float64{c.Longitude, c.Latitude}, c.Members, len(c.Members),
+	})
+	return err
+}
+
+func (s *Store) DeleteCluster(quadKey string) error {
+	_, err := s.tnt.Delete(s.clustersSpaceId, CLUSTERS_INDEX_PRIMARY, []interface{}{quadKey})
+	return err
+}
@@ -0,0 +1,301 @@
+package cpclient
+
+import (
+	"encoding/json"
+	"github.com/alexeyknyshev/models"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Batch size limits of cpsrv, bigger batches are split
+const MAX_CASHPOINTS_BATCH = 1024
+const MAX_TOWNS_BATCH = 1024
+const MAX_BANKS_BATCH = 256
+const MAX_METRO_BATCH = 1024
+
+func idPath(prefix string, id uint64, suffix string) string {
+	return prefix + strconv.FormatUint(id, 10) + suffix
+}
+
+// Requests batch endpoint for every chunk of ids, like {"towns": [1, 2]}.
+// Missing objects are skipped.
+func (c *Client) batch(path, key string, ids []uint32, batchSize int, appendResult func(data json.RawMessage) error) error {
+	for from := 0; from < len(ids); from += batchSize {
+		to := from + batchSize
+		if to > len(ids) {
+			to = len(ids)
+		}
+		var result json.RawMessage
+		err := c.query(path, map[string][]uint32{key: ids[from:to]}, &result)
+		if err != nil {
+			return err
+		}
+		err = appendResult(result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listQuery(opts ListOptions) string {
+	query := url.Values{}
+	if opts.Limit != 0 {
+		query.Set("limit", strconv.FormatUint(uint64(opts.Limit), 10))
+	}
+	if opts.After != "" {
+		query.Set("after", opts.After)
+	}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if len(opts.Fields) > 0 {
+		query.Set("fields", strings.Join(opts.Fields, ","))
+	}
+	if len(query) == 0 {
+		// list without params is plain list of ids
+		query.Set("sort", "id")
+	}
+	return "?" + query.Encode()
+}
+
+func (c *Client) Ping() error {
+	return c.get("/ping", nil)
+}
+
+// ======================================================================
+// Cashpoints
+
+func (c *Client) Cashpoint(id uint32) (*models.Cashpoint, error) {
+	var cp *models.Cashpoint
+	err := c.get(idPath("/cashpoint/", uint64(id), ""), &cp)
+	return cp, err
+}
+
+func (c *Client) Cashpoints(ids []uint32) ([]*models.Cashpoint, error) {
+	result := make([]*models.Cashpoint, 0, len(ids))
+	err := c.batch("/cashpoints", "cashpoints", ids, MAX_CASHPOINTS_BATCH, func(data json.RawMessage) error {
+		var cps []*models.Cashpoint
+		err := json.Unmarshal(data, &cps)
+		result = append(result, cps...)
+		return err
+	})
+	return result, err
+}
+
+// Returns ids of cashpoints in region
+func (c *Client) NearbyCashpoints(region Region, filter *Filter) ([]uint32, error) {
+	ids := make([]uint32, 0)
+	err := c.query("/nearby/cashpoints", &nearbyRequest{Region: region, Filter: filter}, &ids)
+	return ids, err
+}
+
+func (c *Client) NearbyClusters(region Region, zoom uint32, filter *Filter) ([]*Cluster, error) {
+	clusters := make([]*Cluster, 0)
+	err := c.query("/nearby/clusters", &nearbyRequest{Region: region, Filter: filter, Zoom: &zoom}, &clusters)
+	return clusters, err
+}
+
+// Returns non empty cells of cols x rows grid over region
+func (c *Client) Heatmap(region Region, cols, rows uint32, filter *Filter) (*Heatmap, error) {
+	heatmap := &Heatmap{}
+	err := c.query("/heatmap", &nearbyRequest{Region: region, Filter: filter, Cols: &cols, Rows: &rows}, heatmap)
+	return heatmap, err
+}
+
+// Proposes new cashpoint, returns its id
+func (c *Client) CreateCashpoint(userId uint64, data *models.CashpointData) (uint32, error) {
+	var id uint32
+	err := c.call(&request{Method: "POST", Path: "/cashpoint", Body: &patchRequest{UserId: userId, Data: data}}, &id)
+	return id, err
+}
+
+// Proposes patch of existing cashpoint, fields contain changed values only
+func (c *Client) PatchCashpoint(userId uint64, id uint32, fields map[string]interface{}) error {
+	data := make(map[string]interface{}, len(fields)+1)
+	for key, value := range fields {
+		data[key] = value
+	}
+	data["id"] = id
+	return c.call(&request{Method: "POST", Path: "/cashpoint", Body: &patchRequest{UserId: userId, Data: data}}, nil)
+}
+
+// Returns changed fields of pending patches by patch id
+func (c *Client) CashpointPatches(id uint32) (map[uint64]json.RawMessage, error) {
+	var patches map[string]json.RawMessage
+	err := c.get(idPath("/cashpoint/", uint64(id), "/patches"), &patches)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[uint64]json.RawMessage, len(patches))
+	for key, data := range patches {
+		patchId, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return nil, ErrUnexpected
+		}
+		result[patchId] = data
+	}
+	return result, nil
+}
+
+// Requires api key with permission to delete cashpoints
+func (c *Client) DeleteCashpoint(id uint32) error {
+	return c.call(&request{Method: "DELETE", Path: idPath("/cashpoint/", uint64(id), "")}, nil)
+}
+
+// Requires api key with debug permission
+func (c *Client) QuadKey(coord Coord, zoom uint32) (string, error) {
+	var reply struct {
+		QuadKey string `json:"quadkey"`
+	}
+	req := map[string]interface{}{"longitude": coord.Longitude, "latitude": coord.Latitude}
+	if zoom != 0 {
+		req["zoom"] = zoom
+	}
+	err := c.query("/quadkey", req, &reply)
+	return reply.QuadKey, err
+}
+
+// ======================================================================
+// Towns
+
+func (c *Client) Town(id uint32) (*models.Town, error) {
+	var town *models.Town
+	err := c.get(idPath("/town/", uint64(id), ""), &town)
+	return town, err
+}
+
+func (c *Client) TownIds() ([]uint32, error) {
+	ids := make([]uint32, 0)
+	err := c.get("/towns", &ids)
+	return ids, err
+}
+
+func (c *Client) Towns(ids []uint32) ([]*models.Town, error) {
+	result := make([]*models.Town, 0, len(ids))
+	err := c.batch("/towns", "towns", ids, MAX_TOWNS_BATCH, func(data json.RawMessage) error {
+		var towns []*models.Town
+		err := json.Unmarshal(data, &towns)
+		result = append(result, towns...)
+		return err
+	})
+	return result, err
+}
+
+func (c *Client) TownsPage(opts ListOptions) (*TownsPage, error) {
+	page := &TownsPage{}
+	err := c.get("/towns"+listQuery(opts), page)
+	return page, err
+}
+
+// Calls fn for every town requesting pages of opts.Limit size
+func (c *Client) EachTown(opts ListOptions, fn func(town *models.Town) error) error {
+	for {
+		page, err := c.TownsPage(opts)
+		if err != nil {
+			return err
+		}
+		for _, town := range page.Items {
+			if err = fn(town); err != nil {
+				return err
+			}
+		}
+		if !page.More || page.Next == "" {
+			return nil
+		}
+		opts.After = page.Next
+	}
+}
+
+// ======================================================================
+// Metro
+
+func (c *Client) Metro(id uint32) (*models.Metro, error) {
+	var metro *models.Metro
+	err := c.get(idPath("/metro/", uint64(id), ""), &metro)
+	return metro, err
+}
+
+func (c *Client) MetroBatch(ids []uint32) ([]*models.Metro, error) {
+	result := make([]*models.Metro, 0, len(ids))
+	err := c.batch("/metro", "metro", ids, MAX_METRO_BATCH, func(data json.RawMessage) error {
+		var metro []*models.Metro
+		err := json.Unmarshal(data, &metro)
+		result = append(result, metro...)
+		return err
+	})
+	return result, err
+}
+
+func (c *Client) TownMetroIds(townId uint32) ([]uint32, error) {
+	ids := make([]uint32, 0)
+	err := c.get(idPath("/town/", uint64(townId), "/metro"), &ids)
+	return ids, err
+}
+
+func (c *Client) TownMetro(townId uint32) ([]*models.Metro, error) {
+	ids, err := c.TownMetroIds(townId)
+	if err != nil {
+		return nil, err
+	}
+	return c.MetroBatch(ids)
+}
+
+// ======================================================================
+// Banks
+
+func (c *Client) Bank(id uint32) (*models.Bank, error) {
+	var bank *models.Bank
+	err := c.get(idPath("/bank/", uint64(id), ""), &bank)
+	return bank, err
+}
+
+func (c *Client) Banks(ids []uint32) ([]*models.Bank, error) {
+	result := make([]*models.Bank, 0, len(ids))
+	err := c.batch("/banks", "banks", ids, MAX_BANKS_BATCH, func(data json.RawMessage) error {
+		var banks []*models.Bank
+		err := json.Unmarshal(data, &banks)
+		result = append(result, banks...)
+		return err
+	})
+	return result, err
+}
+
+func (c *Client) BanksPage(opts ListOptions) (*BanksPage, error) {
+	page := &BanksPage{}
+	err := c.get("/banks"+listQuery(opts), page)
+	return page, err
+}
+
+// Calls fn for every bank requesting pages of opts.Limit size
+func (c *Client) EachBank(opts ListOptions, fn func(bank *models.Bank) error) error {
+	for {
+		page, err := c.BanksPage(opts)
+		if err != nil {
+			return err
+		}
+		for _, bank := range page.Items {
+			if err = fn(bank); err != nil {
+				return err
+			}
+		}
+		if !page.More || page.Next == "" {
+			return nil
+		}
+		opts.After = page.Next
+	}
+}
+
+// Returns banks of partner network of bank, bank itself excluded
+func (c *Client) BankPartners(id uint32) ([]*models.Bank, error) {
+	banks := make([]*models.Bank, 0)
+	err := c.get(idPath("/bank/", uint64(id), "/partners"), &banks)
+	return banks, err
+}
+
+func (c *Client) BankIco(id uint32) (*BankIco, error) {
+	var ico *BankIco
+	err := c.get(idPath("/bank/", uint64(id), "/ico"), &ico)
+	return ico, err
+}
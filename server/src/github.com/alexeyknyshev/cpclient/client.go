@@ -0,0 +1,237 @@
+// Package cpclient is typed Go client of cpsrv api. It sets request id
+// header every request needs, encodes request structs, decodes replies to
+// objects of models package and converts error replies to Go errors.
+//
+//	c := cpclient.NewClient("http://localhost:8080")
+//	town, err := c.Town(4)
+//	if cpclient.IsNotFound(err) {
+//		...
+//	}
+package cpclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+const DEFAULT_RETRIES = 2
+const DEFAULT_RETRY_DELAY = 200 * time.Millisecond
+
+// Kinds of error replies, compare with IsKind or Error.Kind
+var ErrBadRequest = errors.New("bad request")
+var ErrUnauthorized = errors.New("authorization required")
+var ErrForbidden = errors.New("access denied")
+var ErrNotFound = errors.New("not found")
+var ErrConflict = errors.New("conflict")
+var ErrTooLarge = errors.New("request is too large")
+var ErrServer = errors.New("server error")
+var ErrUnexpected = errors.New("unexpected reply")
+
+var STATUS_ERRORS = map[int]error{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+}
+
+// Error reply of api. Text is localized message of server if any,
+// e.g. "Invalid request parameter: zoom: missing required field".
+type Error struct {
+	Method string
+	Path   string
+	Code   int
+	Text   string
+}
+
+func (e *Error) Error() string {
+	msg := e.Method + " " + e.Path + ": " + strconv.Itoa(e.Code) + " " + http.StatusText(e.Code)
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	return msg
+}
+
+// Returns one of Err* values by status code
+func (e *Error) Kind() error {
+	if kind, ok := STATUS_ERRORS[e.Code]; ok {
+		return kind
+	}
+	if e.Code >= http.StatusInternalServerError {
+		return ErrServer
+	}
+	return ErrUnexpected
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind()
+}
+
+// Checks whether err is api error of kind
+func IsKind(err error, kind error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Kind() == kind
+	}
+	return err == kind
+}
+
+func IsNotFound(err error) bool {
+	return IsKind(err, ErrNotFound)
+}
+
+type Client struct {
+	Url        string
+	HttpClient *http.Client
+	// Accept-Language of requests ("ru" or "en"), server default if empty
+	Lang string
+	// Key of admin api, sent as bearer token
+	ApiKey string
+	// Idempotent requests failed by network or server error are repeated
+	// Retries times waiting RetryDelay, doubled every attempt
+	Retries    int
+	RetryDelay time.Duration
+
+	requestId int64
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		Url:        strings.TrimRight(url, "/"),
+		HttpClient: &http.Client{Timeout: DEFAULT_TIMEOUT},
+		Retries:    DEFAULT_RETRIES,
+		RetryDelay: DEFAULT_RETRY_DELAY,
+	}
+}
+
+// Request of api. Body is encoded to json unless nil.
+type request struct {
+	Method     string
+	Path       string
+	Body       interface{}
+	Idempotent bool
+}
+
+type response struct {
+	Header http.Header
+	Data   []byte
+}
+
+func (c *Client) nextRequestId() string {
+	return strconv.FormatInt(atomic.AddInt64(&c.requestId, 1), 10)
+}
+
+func (c *Client) send(req *request, body []byte) (*response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequest(req.Method, c.Url+req.Path, reader)
+	if err != nil {
+		return nil, err
+	}
+	// server rejects requests without nonzero id
+	httpReq.Header.Set("Id", c.nextRequestId())
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.Lang != "" {
+		httpReq.Header.Set("Accept-Language", c.Lang)
+	}
+	if c.ApiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.ApiKey)
+	}
+
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	data, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		apiErr := &Error{Method: req.Method, Path: req.Path, Code: httpResp.StatusCode}
+		var msg struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(data, &msg) == nil {
+			apiErr.Text = msg.Text
+		}
+		return nil, apiErr
+	}
+	return &response{Header: httpResp.Header, Data: data}, nil
+}
+
+func isRetryable(err error) bool {
+	if e, ok := err.(*Error); ok {
+		return e.Code >= http.StatusInternalServerError
+	}
+	return true // network error
+}
+
+// Sends request repeating idempotent ones on network and server errors
+func (c *Client) do(req *request) (*response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = json.Marshal(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retries := 0
+	if req.Idempotent {
+		retries = c.Retries
+	}
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(req, body)
+		if err == nil || attempt >= retries || !isRetryable(err) {
+			return resp, err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Sends request and decodes json reply to result
+func (c *Client) call(req *request, result interface{}) error {
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(resp.Data, result)
+	if err != nil {
+		return errors.New(req.Method + " " + req.Path + ": cannot decode reply: " + err.Error())
+	}
+	return nil
+}
+
+func (c *Client) get(path string, result interface{}) error {
+	return c.call(&request{Method: "GET", Path: path, Idempotent: true}, result)
+}
+
+// Post of read only request, e.g. batch or nearby search
+func (c *Client) query(path string, body interface{}, result interface{}) error {
+	return c.call(&request{Method: "POST", Path: path, Body: body, Idempotent: true}, result)
+}
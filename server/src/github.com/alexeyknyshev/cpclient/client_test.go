@@ -0,0 +1,266 @@
+package cpclient
+
+import (
+	"encoding/json"
+	"github.com/alexeyknyshev/models"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Test server counting requests of every path
+type testServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests map[string]int
+	ids      map[string]bool
+}
+
+func newTestServer(t *testing.T, handler http.HandlerFunc) *testServer {
+	s := &testServer{requests: make(map[string]int), ids: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		id := r.Header.Get("Id")
+		if id == "" || id == "0" || s.ids[id] {
+			t.Errorf("Unexpected request id '%s' of %s", id, r.URL.Path)
+		}
+		s.ids[id] = true
+		s.requests[r.Method+" "+r.URL.Path]++
+		s.mutex.Unlock()
+		handler(w, r)
+	}))
+	return s
+}
+
+func (s *testServer) count(request string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests[request]
+}
+
+func newTestClient(s *testServer) *Client {
+	c := NewClient(s.URL + "/")
+	c.RetryDelay = 0
+	return c
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestErrors(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Language") != "en" {
+			writeJson(w, http.StatusBadRequest, map[string]string{"text": "Неверный запрос"})
+			return
+		}
+		switch r.URL.Path {
+		case "/town/1":
+			writeJson(w, http.StatusNotFound, map[string]string{"text": "Town does not exist with id: 1"})
+		case "/bank/1":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.Write([]byte("{not json"))
+		}
+	})
+	defer s.Close()
+	c := newTestClient(s)
+	c.Lang = "en"
+
+	_, err := c.Town(1)
+	if !IsNotFound(err) {
+		t.Fatalf("Expected not found error but got %v", err)
+	}
+	apiErr := err.(*Error)
+	if apiErr.Code != http.StatusNotFound || apiErr.Text != "Town does not exist with id: 1" {
+		t.Errorf("Unexpected error %+v", apiErr)
+	}
+	if apiErr.Error() != "GET /town/1: 404 Not Found: Town does not exist with id: 1" {
+		t.Errorf("Unexpected error message: %s", apiErr.Error())
+	}
+
+	_, err = c.Bank(1)
+	if !IsKind(err, ErrForbidden) || IsNotFound(err) {
+		t.Errorf("Expected access denied error but got %v", err)
+	}
+
+	_, err = c.Metro(1)
+	if err == nil || IsKind(err, ErrServer) {
+		t.Errorf("Expected decoding error but got %v", err)
+	}
+
+	c.Lang = ""
+	err = c.Ping()
+	if !IsKind(err, ErrBadRequest) {
+		t.Errorf("Expected bad request error but got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	failures := 2
+	var mutex sync.Mutex
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path == "/town/4" && failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/town/4":
+			writeJson(w, http.StatusOK, &models.Town{Id: 4, Name: "Москва"})
+		case "/town/5":
+			writeJson(w, http.StatusNotFound, map[string]string{"text": "no such town"})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	defer s.Close()
+	c := newTestClient(s)
+
+	town, err := c.Town(4)
+	if err != nil || town.Id != 4 || town.Name != "Москва" {
+		t.Fatalf("Expected town after retries but got %+v, %v", town, err)
+	}
+	if n := s.count("GET /town/4"); n != 3 {
+		t.Errorf("Expected 3 attempts but got %d", n)
+	}
+
+	// client errors are not retried
+	c.Town(5)
+	if n := s.count("GET /town/5"); n != 1 {
+		t.Errorf("Expected single request of missing town but got %d", n)
+	}
+
+	// neither are not idempotent requests
+	_, err = c.CreateCashpoint(1, &models.CashpointData{})
+	if !IsKind(err, ErrServer) {
+		t.Errorf("Expected server error but got %v", err)
+	}
+	if n := s.count("POST /cashpoint"); n != 1 {
+		t.Errorf("Expected single cashpoint create request but got %d", n)
+	}
+
+	_, err = c.NearbyCashpoints(Region{}, nil)
+	if !IsKind(err, ErrServer) {
+		t.Errorf("Expected server error but got %v", err)
+	}
+	if n := s.count("POST /nearby/cashpoints"); n != 1+DEFAULT_RETRIES {
+		t.Errorf("Expected %d nearby requests but got %d", 1+DEFAULT_RETRIES, n)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var req map[string][]uint32
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req["banks"]) > MAX_BANKS_BATCH {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		banks := make([]*models.Bank, 0)
+		for _, id := range req["banks"] {
+			if id%2 == 0 { // odd banks are missing
+				banks = append(banks, &models.Bank{Id: id})
+			}
+		}
+		writeJson(w, http.StatusOK, banks)
+	})
+	defer s.Close()
+	c := newTestClient(s)
+
+	ids := make([]uint32, 300)
+	for i := range ids {
+		ids[i] = uint32(i + 1)
+	}
+	banks, err := c.Banks(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(banks) != 150 || banks[0].Id != 2 || banks[149].Id != 300 {
+		t.Errorf("Unexpected banks batch of %d banks", len(banks))
+	}
+	if n := s.count("POST /banks"); n != 2 {
+		t.Errorf("Expected 2 batch requests but got %d", n)
+	}
+
+	banks, err = c.Banks(nil)
+	if err != nil || len(banks) != 0 || s.count("POST /banks") != 2 {
+		t.Errorf("Expected no requests of empty batch")
+	}
+}
+
+func TestPaging(t *testing.T) {
+	s := newTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("sort") != "-population" || query.Get("limit") != "2" || query.Get("fields") != "id,name" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		from := 0
+		if after := query.Get("after"); after != "" {
+			from, _ = strconv.Atoi(after)
+		}
+		page := &TownsPage{Items: make([]*models.Town, 0)}
+		for id := from + 1; id <= from+2 && id <= 5; id++ {
+			page.Items = append(page.Items, &models.Town{Id: uint32(id)})
+		}
+		if from+2 < 5 {
+			page.More = true
+			page.Next = strconv.Itoa(from + 2)
+		}
+		writeJson(w, http.StatusOK, page)
+	})
+	defer s.Close()
+	c := newTestClient(s)
+
+	ids := make([]uint32, 0)
+	err := c.EachTown(ListOptions{Limit: 2, Sort: "-population", Fields: []string{"id", "name"}}, func(town *models.Town) error {
+		ids = append(ids, town.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Errorf("Unexpected towns %v", ids)
+	}
+	if n := s.count("GET /towns"); n != 3 {
+		t.Errorf("Expected 3 pages but got %d", n)
+	}
+
+	stop := ErrConflict
+	err = c.EachTown(ListOptions{Limit: 2, Sort: "-population", Fields: []string{"id", "name"}}, func(town *models.Town) error {
+		return stop
+	})
+	if err != stop || s.count("GET /towns") != 4 {
+		t.Errorf("Expected iteration to stop on first error but got %v", err)
+	}
+}
+
+func TestClusterDecode(t *testing.T) {
+	data := `[
+		{"id": "1203", "longitude": 37.6, "latitude": 55.7, "size": 20},
+		{"id": 4, "longitude": 37.61, "latitude": 55.75, "size": 1000},
+		{"id": 58552, "longitude": 37.58, "latitude": 55.71, "type": "atm", "bank_id": 2764, "town_id": 4}
+	]`
+	var clusters []*Cluster
+	err := json.Unmarshal([]byte(data), &clusters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := clusters[0]; c.Id != "1203" || c.Size != 20 || c.TownId != 0 || c.Cashpoint != nil {
+		t.Errorf("Unexpected quadkey cluster %+v", c)
+	}
+	if c := clusters[1]; c.Id != "" || c.TownId != 4 || c.Size != 1000 || c.Cashpoint != nil {
+		t.Errorf("Unexpected town cluster %+v", c)
+	}
+	c := clusters[2]
+	if c.Cashpoint == nil || c.Cashpoint.Id != 58552 || c.Cashpoint.BankId != 2764 || c.Size != 1 || c.Longitude != 37.58 {
+		t.Errorf("Unexpected cashpoint cluster %+v", c)
+	}
+}
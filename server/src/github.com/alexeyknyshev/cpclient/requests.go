@@ -0,0 +1,171 @@
+package cpclient
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/alexeyknyshev/models"
+)
+
+// Request structs of api, unset optional fields are omitted
+
+type Coord struct {
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+// Rectangle of map, nearby cashpoints are searched in region not bigger
+// than NEARBY_MAX_COORD_DELTA in both directions
+type Region struct {
+	TopLeft     Coord `json:"topLeft"`
+	BottomRight Coord `json:"bottomRight"`
+}
+
+const NEARBY_MAX_COORD_DELTA = 0.02
+
+// Region of given size centered at coord
+func RegionAround(center Coord, width, height float64) Region {
+	return Region{
+		TopLeft:     Coord{Longitude: center.Longitude - width/2, Latitude: center.Latitude + height/2},
+		BottomRight: Coord{Longitude: center.Longitude + width/2, Latitude: center.Latitude - height/2},
+	}
+}
+
+// Cashpoints open at Time (unix seconds) and during following Delta seconds
+type ScheduleFilter struct {
+	Time  uint64 `json:"time"`
+	Delta uint32 `json:"delta"`
+}
+
+type Filter struct {
+	BankId         []uint32        `json:"bank_id,omitempty"`
+	Type           string          `json:"type,omitempty"` // atm, office, branch or cash
+	FreeAccess     *bool           `json:"free_access,omitempty"`
+	MainOffice     *bool           `json:"main_office,omitempty"`
+	WithoutWeekend *bool           `json:"without_weekend,omitempty"`
+	RoundTheClock  *bool           `json:"round_the_clock,omitempty"`
+	WorksAsShop    *bool           `json:"works_as_shop,omitempty"`
+	Currency       []uint32        `json:"currency,omitempty"` // models.CURRENCY_*
+	CashIn         *bool           `json:"cash_in,omitempty"`
+	Approved       *bool           `json:"approved,omitempty"`
+	Schedule       *ScheduleFilter `json:"schedule,omitempty"`
+	PartnerOf      uint32          `json:"partner_of,omitempty"` // bank itself and its partners
+}
+
+// Pointer to value of optional filter flag
+func Bool(value bool) *bool {
+	return &value
+}
+
+type nearbyRequest struct {
+	Region
+	Filter *Filter `json:"filter,omitempty"`
+	Zoom   *uint32 `json:"zoom,omitempty"`
+	Cols   *uint32 `json:"cols,omitempty"`
+	Rows   *uint32 `json:"rows,omitempty"`
+}
+
+type patchRequest struct {
+	UserId uint64      `json:"user_id"`
+	Data   interface{} `json:"data"`
+}
+
+// Options of list pages. Next page is requested with After set to Next
+// of previous one, sort (field name, "-" prefix for descending order) has
+// to stay the same.
+type ListOptions struct {
+	Limit  uint32
+	After  string
+	Sort   string
+	Fields []string // all fields if empty
+}
+
+// ======================================================================
+// Replies
+
+// Item of nearby clusters reply. On small zooms items are towns
+// (TownId is set), otherwise clusters of quadtree nodes (Id is quadkey)
+// or single cashpoints (Cashpoint is set).
+type Cluster struct {
+	models.Cluster
+	TownId    uint32
+	Cashpoint *models.Cashpoint
+}
+
+func (c *Cluster) UnmarshalJSON(data []byte) error {
+	var probe struct {
+		Id   json.RawMessage `json:"id"`
+		Size *uint32         `json:"size"`
+	}
+	err := json.Unmarshal(data, &probe)
+	if err != nil {
+		return err
+	}
+	if len(probe.Id) == 0 {
+		return errors.New("cluster without id")
+	}
+
+	if probe.Size == nil {
+		c.Cashpoint = &models.Cashpoint{}
+		err = json.Unmarshal(data, c.Cashpoint)
+		if err != nil {
+			return err
+		}
+		c.Cluster = models.Cluster{
+			Longitude: c.Cashpoint.Longitude,
+			Latitude:  c.Cashpoint.Latitude,
+			Members:   []uint32{c.Cashpoint.Id},
+			Size:      1,
+		}
+		return nil
+	}
+
+	if probe.Id[0] != '"' { // town cluster
+		var town struct {
+			Id        uint32  `json:"id"`
+			Longitude float64 `json:"longitude"`
+			Latitude  float64 `json:"latitude"`
+			Size      uint32  `json:"size"`
+		}
+		err = json.Unmarshal(data, &town)
+		if err != nil {
+			return err
+		}
+		c.TownId = town.Id
+		c.Cluster = models.Cluster{Longitude: town.Longitude, Latitude: town.Latitude, Size: town.Size}
+		return nil
+	}
+	return json.Unmarshal(data, &c.Cluster)
+}
+
+type HeatmapCell struct {
+	Col       uint32  `json:"col"`
+	Row       uint32  `json:"row"`
+	Count     uint32  `json:"count"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+// Zoom of clusters cells are counted of, nil if raw cashpoints are counted
+type Heatmap struct {
+	CellWidth  float64        `json:"cell_width"`
+	CellHeight float64        `json:"cell_height"`
+	Zoom       *uint32        `json:"zoom"`
+	Cells      []*HeatmapCell `json:"cells"`
+}
+
+type BankIco struct {
+	BankId  uint32 `json:"bank_id"`
+	IcoData string `json:"ico_data"` // svg
+}
+
+type TownsPage struct {
+	Items []*models.Town `json:"items"`
+	Next  string         `json:"next"`
+	More  bool           `json:"more"`
+}
+
+type BanksPage struct {
+	Items []*models.Bank `json:"items"`
+	Next  string         `json:"next"`
+	More  bool           `json:"more"`
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Access control: API keys listed in server config have roles, roles grant
+// permissions checked per route. Key is passed as
+// "Authorization: Bearer <key>" or "X-Api-Key: <key>" header.
+
+const (
+	ROLE_USER      = "user"
+	ROLE_MODERATOR = "moderator"
+	ROLE_ADMIN     = "admin"
+	ROLE_SERVICE   = "service" // monitoring and other internal services
+)
+
+const (
+	PERM_EDIT_REFERENCE   = "edit_reference"   // admin CRUD of banks, towns, regions, metro
+	PERM_DELETE_CASHPOINT = "delete_cashpoint" // DELETE /cashpoint/{id}
+	PERM_VIEW_METRICS     = "view_metrics"     // /metrics/*
+	PERM_DEBUG            = "debug"            // quadkey and quad tree internals
+	PERM_EXPORT           = "export"           // GET /admin/export
+)
+
+var ROLE_PERMISSIONS = map[string]map[string]bool{
+	ROLE_USER: {},
+	ROLE_MODERATOR: {
+		PERM_DELETE_CASHPOINT: true,
+	},
+	ROLE_ADMIN: {
+		PERM_EDIT_REFERENCE:   true,
+		PERM_DELETE_CASHPOINT: true,
+		PERM_VIEW_METRICS:     true,
+		PERM_DEBUG:            true,
+		PERM_EXPORT:           true,
+	},
+	ROLE_SERVICE: {
+		PERM_VIEW_METRICS: true,
+		PERM_DEBUG:        true,
+	},
+}
+
+// Operational permissions granted to anonymous requests in testing mode,
+// so testing scripts work without keys
+var TESTING_MODE_PERMISSIONS = map[string]bool{
+	PERM_DELETE_CASHPOINT: true,
+	PERM_VIEW_METRICS:     true,
+	PERM_DEBUG:            true,
+}
+
+type ApiKey struct {
+	Key  string `json:"Key"`
+	Name string `json:"Name"`
+	Role string `json:"Role"`
+}
+
+// Checks roles of config keys, key with unknown role would be denied
+// everything silently
+func validateApiKeys(keys []ApiKey) error {
+	for i, apiKey := range keys {
+		if _, ok := ROLE_PERMISSIONS[apiKey.Role]; !ok {
+			return fmt.Errorf("Unknown role '%s' of api key #%d (%s)", apiKey.Role, i, apiKey.Name)
+		}
+	}
+	return nil
+}
+
+// Owner of API key request is authenticated with
+type Identity struct {
+	Name string
+	Role string
+}
+
+func (id *Identity) can(permission string) bool {
+	return ROLE_PERMISSIONS[id.Role][permission]
+}
+
+func getRequestApiKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("X-Api-Key"))
+}
+
+// Returns identity of request key, nil if key is not set or unknown
+func getRequestIdentity(conf ServerConfig, r *http.Request) *Identity {
+	key := getRequestApiKey(r)
+	if key == "" {
+		return nil
+	}
+	for _, apiKey := range conf.ApiKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKey.Key), []byte(key)) == 1 {
+			return &Identity{Name: apiKey.Name, Role: apiKey.Role}
+		}
+	}
+	return nil
+}
+
+// Returns http status of access check: 200 if request is allowed,
+// 401 if it is not authenticated and 403 if role lacks permission
+func checkPermission(conf ServerConfig, r *http.Request, permission string) (int, *Identity) {
+	identity := getRequestIdentity(conf, r)
+	if identity == nil {
+		if conf.TestingMode && TESTING_MODE_PERMISSIONS[permission] {
+			return http.StatusOK, nil
+		}
+		return http.StatusUnauthorized, nil
+	}
+	if !identity.can(permission) {
+		return http.StatusForbidden, identity
+	}
+	return http.StatusOK, identity
+}
+
+// Wraps route handler with permission check:
+//
+//	router.HandleFunc(requirePermission(ctx, conf, PERM_DEBUG)(handlerX(ctx)))
+func requirePermission(handlerContext HandlerContext, conf ServerConfig, permission string) func(string, EndpointCallback) (string, EndpointCallback) {
+	return func(url string, handler EndpointCallback) (string, EndpointCallback) {
+		return url, func(w http.ResponseWriter, r *http.Request) {
+			code, identity := checkPermission(conf, r, permission)
+			if code == http.StatusOK {
+				handler(w, r)
+				return
+			}
+
+			logger := handlerContext.Logger()
+			ok, requestId := prepareResponse(w, r, logger)
+			if ok == false {
+				return
+			}
+			logger.logRequest(w, r, requestId, "")
+
+			name := ""
+			if identity != nil {
+				name = identity.Name
+			}
+			context := getRequestContexString(r) + " " + getHandlerContextString("requirePermission", map[string]string{
+				"requestId":  strconv.FormatInt(requestId, 10),
+				"permission": permission,
+				"identity":   name,
+			})
+			log.Printf("%s => access denied: %d\n", context, code)
+
+			if code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(handlerContext, w, r, requestId, code, MSG_UNAUTHORIZED)
+			} else {
+				writeError(handlerContext, w, r, requestId, code, MSG_FORBIDDEN)
+			}
+		}
+	}
+}
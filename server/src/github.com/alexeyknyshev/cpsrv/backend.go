@@ -0,0 +1,16 @@
+package main
+
+import (
+	"github.com/tarantool/go-tarantool"
+)
+
+// Backend calls stored procedures of cashpoints api (see tnt_workdir/api).
+// Procedures reply with tarantool responses: resp.Data[0] is a list of
+// returned values. Tarantool connection is used in production and
+// MemoryBackend (see memory_backend.go) in handler tests.
+type Backend interface {
+	Call(functionName string, args interface{}) (*tarantool.Response, error)
+	Close() error
+}
+
+var _ Backend = (*tarantool.Connection)(nil)
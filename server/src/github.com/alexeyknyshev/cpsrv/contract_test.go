@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexeyknyshev/models"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Contract tests are described by yaml files of server/test/unit
+// (set CPSRV_CONTRACT_DIR to run another set) in pyresttest format:
+//
+//	- config:
+//	    - testset: "Banks"
+//	    - fixtures: [ "fixtures/alfabank.json" ]
+//	    - variables: { bank_id: 325 }
+//
+//	- test:
+//	    - name: "Get bank by id"
+//	    - url: "/bank/{{bank_id}}"
+//	    - method: "GET"
+//	    - headers: { Id: 1 }
+//	    - expected_status: 200
+//	    - expected_json: { id: 325, name: "Альфа-Банк", ... }
+//	    - validators:
+//	        - compare: { jsonpath_mini: 'name_tr', expected: "Alfa-Bank" }
+//	    - extract: { partner_id: 'partners.0' }
+//
+// Method defaults to GET and expected status to 200. Expected json is
+// compared with whole response body, validators compare single values.
+// Variables are substituted into url, headers, body and expected values
+// (value of single variable is compared as json), extracted ones are
+// visible for the following tests of the same file.
+//
+// Fixtures are json files (relative to yaml file) with regions, towns, banks,
+// metro and cashpoints added to in-memory backend over default fixtures, on
+// tarantool they are expected to be in testing data already.
+// Shell hooks (*.pre.sh, *.post.sh) belong to legacy server and are not run,
+// set skip in config or test to leave cases out of cpsrv run.
+
+const CONTRACT_DIR_DEFAULT = "../../../../test/unit"
+
+type ContractConfig struct {
+	Testset   string            `yaml:"testset"`
+	Fixtures  []string          `yaml:"fixtures"`
+	Variables map[string]string `yaml:"variables"`
+	Skip      string            `yaml:"skip"`
+}
+
+type ContractCompare struct {
+	JsonPath string      `yaml:"jsonpath_mini"`
+	Expected interface{} `yaml:"expected"`
+}
+
+type ContractValidator struct {
+	Compare *ContractCompare `yaml:"compare"`
+}
+
+type ContractTest struct {
+	Name           string              `yaml:"name"`
+	Group          string              `yaml:"group"`
+	Url            string              `yaml:"url"`
+	Method         string              `yaml:"method"`
+	Headers        map[string]string   `yaml:"headers"`
+	Body           string              `yaml:"body"`
+	ExpectedStatus int                 `yaml:"expected_status"`
+	ExpectedJson   interface{}         `yaml:"expected_json"`
+	Validators     []ContractValidator `yaml:"validators"`
+	Extract        map[string]string   `yaml:"extract"`
+	Skip           string              `yaml:"skip"`
+}
+
+type ContractFixtures struct {
+	Regions    []models.Region    `json:"regions"`
+	Towns      []models.Town      `json:"towns"`
+	Banks      []models.Bank      `json:"banks"`
+	Metro      []models.Metro     `json:"metro"`
+	Cashpoints []models.Cashpoint `json:"cashpoints"`
+}
+
+type contractVars map[string]string
+
+func (vars contractVars) expand(s string) string {
+	for name, value := range vars {
+		s = strings.Replace(s, "{{"+name+"}}", value, -1)
+	}
+	return s
+}
+
+func getContractDir() string {
+	if dir := os.Getenv("CPSRV_CONTRACT_DIR"); dir != "" {
+		return dir
+	}
+	return CONTRACT_DIR_DEFAULT
+}
+
+// pyresttest describes objects as lists of single key maps
+func decodeContractFields(fields []map[string]interface{}, result interface{}) error {
+	merged := make(map[string]interface{})
+	for _, field := range fields {
+		for key, value := range field {
+			merged[key] = value
+		}
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(data, result)
+}
+
+func loadContractFile(path string) (*ContractConfig, []*ContractTest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var items []map[string][]map[string]interface{}
+	err = yaml.Unmarshal(data, &items)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &ContractConfig{}
+	tests := make([]*ContractTest, 0)
+	for _, item := range items {
+		for kind, fields := range item {
+			switch kind {
+			case "config":
+				err = decodeContractFields(fields, config)
+			case "test":
+				test := &ContractTest{}
+				err = decodeContractFields(fields, test)
+				tests = append(tests, test)
+			default:
+				err = errors.New("unsupported item '" + kind + "'")
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return config, tests, nil
+}
+
+func loadContractFixtures(b *MemoryBackend, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fixtures ContractFixtures
+	err = json.Unmarshal(data, &fixtures)
+	if err != nil {
+		return errors.New(path + ": " + err.Error())
+	}
+
+	for _, region := range fixtures.Regions {
+		b.addRegion(region)
+	}
+	for _, town := range fixtures.Towns {
+		b.addTown(town)
+	}
+	for _, bank := range fixtures.Banks {
+		b.addBank(bank)
+	}
+	for _, metro := range fixtures.Metro {
+		b.addMetro(metro)
+	}
+	for _, cp := range fixtures.Cashpoints {
+		b.addCashpoint(cp)
+	}
+	return nil
+}
+
+// Converts value decoded from yaml to one encoding/json can marshal
+// (yaml maps have interface{} keys) substituting variables into strings.
+// String consisting of single variable takes its json value, e.g. number.
+func contractJsonValue(v interface{}, vars contractVars) interface{} {
+	switch node := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(node))
+		for key, value := range node {
+			result[fmt.Sprint(key)] = contractJsonValue(value, vars)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(node))
+		for i, value := range node {
+			result[i] = contractJsonValue(value, vars)
+		}
+		return result
+	case string:
+		if strings.HasPrefix(node, "{{") && strings.HasSuffix(node, "}}") {
+			if value, ok := vars[node[2:len(node)-2]]; ok {
+				var result interface{}
+				if json.Unmarshal([]byte(value), &result) == nil {
+					return result
+				}
+			}
+		}
+		return vars.expand(node)
+	}
+	return v
+}
+
+// Expected json is either json string or yaml value
+func getContractExpectedJson(expected interface{}, vars contractVars) ([]byte, error) {
+	if str, ok := expected.(string); ok {
+		return []byte(vars.expand(str)), nil
+	}
+	return json.Marshal(contractJsonValue(expected, vars))
+}
+
+// Dot separated object keys and array indices, e.g. 'partners.0'
+func getJsonPathMini(data interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch node := data.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			data = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			data = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func getContractVarValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+func runContractTest(t *testing.T, router http.Handler, context string, test *ContractTest, vars contractVars) {
+	method := test.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var body io.Reader
+	if test.Body != "" {
+		body = bytes.NewBufferString(vars.expand(test.Body))
+	}
+	req, err := http.NewRequest(method, vars.expand(test.Url), body)
+	if err != nil {
+		t.Errorf("%s: cannot make request: %v", context, err)
+		return
+	}
+	req.Header.Set("Id", "1")
+	for name, value := range test.Headers {
+		req.Header.Set(name, vars.expand(value))
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	response, err := readResponse(w)
+	if err != nil {
+		t.Errorf("%s: %v", context, err)
+		return
+	}
+
+	expectedStatus := test.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	if response.Code != expectedStatus {
+		t.Errorf("%s: expected %d %s but got %d", context, expectedStatus, http.StatusText(expectedStatus), response.Code)
+		return
+	}
+
+	if test.ExpectedJson != nil {
+		expected, err := getContractExpectedJson(test.ExpectedJson, vars)
+		if err != nil {
+			t.Errorf("%s: invalid expected_json: %v", context, err)
+		} else if !checkJsonResponse(t, response.Data, expected) {
+			t.Errorf("%s: unexpected response %s", context, string(response.Data))
+		}
+	}
+
+	if len(test.Validators) == 0 && len(test.Extract) == 0 {
+		return
+	}
+
+	var data interface{}
+	err = json.Unmarshal(response.Data, &data)
+	if err != nil {
+		t.Errorf("%s: cannot decode response: %v", context, err)
+		return
+	}
+
+	for _, validator := range test.Validators {
+		compare := validator.Compare
+		if compare == nil {
+			t.Errorf("%s: unsupported validator", context)
+			continue
+		}
+		got, ok := getJsonPathMini(data, compare.JsonPath)
+		if !ok {
+			t.Errorf("%s: no value at '%s'", context, compare.JsonPath)
+			continue
+		}
+		// round trip makes numbers float64 as in decoded response
+		var expected interface{}
+		expectedJson, _ := json.Marshal(contractJsonValue(compare.Expected, vars))
+		json.Unmarshal(expectedJson, &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %v at '%s' but got %v", context, expected, compare.JsonPath, got)
+		}
+	}
+
+	for name, path := range test.Extract {
+		value, ok := getJsonPathMini(data, path)
+		if !ok {
+			t.Errorf("%s: cannot extract '%s' from '%s'", context, name, path)
+			continue
+		}
+		vars[name] = getContractVarValue(value)
+	}
+}
+
+// Every file runs on fresh in-memory backend
+func runContractFile(t *testing.T, path string, hCtx *HandlerContextStruct) {
+	name := filepath.Base(path)
+	config, tests, err := loadContractFile(path)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if config.Skip != "" {
+		t.Logf("%s: skipped: %s", name, config.Skip)
+		return
+	}
+
+	if hCtx == nil {
+		backend := newFixtureBackend()
+		for _, fixture := range config.Fixtures {
+			err = loadContractFixtures(backend, filepath.Join(filepath.Dir(path), fixture))
+			if err != nil {
+				t.Errorf("%s: cannot load fixtures: %v", name, err)
+				return
+			}
+		}
+		hCtx = newHandlerContext(backend)
+	}
+	router := newRouter(hCtx, ServerConfig{TestingMode: true})
+
+	vars := make(contractVars)
+	for key, value := range config.Variables {
+		vars[key] = value
+	}
+
+	for _, test := range tests {
+		context := name + ": " + test.Name
+		if test.Skip != "" {
+			t.Logf("%s: skipped: %s", context, test.Skip)
+			continue
+		}
+		runContractTest(t, router, context, test, vars)
+	}
+}
+
+func TestContract(t *testing.T) {
+	dir := getContractDir()
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Skipf("no contract files in %s", dir)
+	}
+
+	var hCtx *HandlerContextStruct
+	if useTarantool() {
+		hCtx = makeTestHandlerContext(t)
+	} else {
+		t.Parallel()
+	}
+
+	for _, path := range files {
+		runContractFile(t, path, hCtx)
+	}
+}
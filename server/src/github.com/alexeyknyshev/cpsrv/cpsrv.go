@@ -4,10 +4,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/gorilla/mux"
 	"github.com/tarantool/go-tarantool"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -17,23 +15,30 @@ import (
 
 const SERVER_DEFAULT_CONFIG = "config.json"
 
+// Storage backends of server
+const BACKEND_TARANTOOL = "tarantool"
+const BACKEND_SQLITE = "sqlite"
+
 type ServerConfig struct {
-	TownsDataBase      string `json:"TownsDataBase"`
-	CashPointsDataBase string `json:"CashPointsDataBase"`
-	CertificateDir     string `json:"CertificateDir"`
-	Port               uint64 `json:"Port"`
-	UserLoginMinLength uint64 `json:"UserLoginMinLength"`
-	UserPwdMinLength   uint64 `json:"UserPwdMinLength"`
-	UseTLS             bool   `json:"UseTLS"`
-	RedisHost          string `json:"RedisHost"`
-	RedisScriptsDir    string `json:"RedisScriptsDir"`
-	ReqResLogTTL       uint64 `json:"ReqResLogTTL"`
-	UUID_TTL           uint64 `json:"UUID_TTL"`
-	BanksIcoDir        string `json:"BanksIcoDir"`
-	TestingMode        bool   `json:"TestingMode"`
-	TntUser            string `json:"TntUser"`
-	TntPass            string `json:"TntPass"`
-	TntUrl             string `json:"TntUrl"`
+	Backend            string   `json:"Backend"` // tarantool if empty
+	TownsDataBase      string   `json:"TownsDataBase"`
+	CashPointsDataBase string   `json:"CashPointsDataBase"`
+	BanksDataBase      string   `json:"BanksDataBase"`
+	CertificateDir     string   `json:"CertificateDir"`
+	Port               uint64   `json:"Port"`
+	UserLoginMinLength uint64   `json:"UserLoginMinLength"`
+	UserPwdMinLength   uint64   `json:"UserPwdMinLength"`
+	UseTLS             bool     `json:"UseTLS"`
+	RedisHost          string   `json:"RedisHost"`
+	RedisScriptsDir    string   `json:"RedisScriptsDir"`
+	ReqResLogTTL       uint64   `json:"ReqResLogTTL"`
+	UUID_TTL           uint64   `json:"UUID_TTL"`
+	BanksIcoDir        string   `json:"BanksIcoDir"`
+	TestingMode        bool     `json:"TestingMode"`
+	TntUser            string   `json:"TntUser"`
+	TntPass            string   `json:"TntPass"`
+	TntUrl             string   `json:"TntUrl"`
+	ApiKeys            []ApiKey `json:"ApiKeys"`
 }
 
 type Message struct {
@@ -41,18 +46,18 @@ type Message struct {
 }
 
 type HandlerContextStruct struct {
-	TntConnection *tarantool.Connection
-	TestLogger    *TestLogger
+	Backend    Backend
+	TestLogger *TestLogger
 }
 
 type HandlerContext interface {
-	Tnt() *tarantool.Connection
+	Tnt() Backend
 	Logger() Logger
 	Close()
 }
 
-func (handler HandlerContextStruct) Tnt() *tarantool.Connection {
-	return handler.TntConnection
+func (handler HandlerContextStruct) Tnt() Backend {
+	return handler.Backend
 }
 
 func (handler HandlerContextStruct) Logger() Logger {
@@ -60,10 +65,31 @@ func (handler HandlerContextStruct) Logger() Logger {
 }
 
 func (handler HandlerContextStruct) Close() {
-	handler.TntConnection.Close()
+	handler.Backend.Close()
+}
+
+func newHandlerContext(backend Backend) *HandlerContextStruct {
+	return &HandlerContextStruct{
+		Backend: backend,
+		TestLogger: &TestLogger{
+			ch: make(chan string),
+		},
+	}
 }
 
 func makeHandlerContext(serverConfig *ServerConfig) (*HandlerContextStruct, error) {
+	switch serverConfig.Backend {
+	case "", BACKEND_TARANTOOL:
+	case BACKEND_SQLITE:
+		backend, err := newSqliteBackend(serverConfig.CashPointsDataBase, serverConfig.TownsDataBase, serverConfig.BanksDataBase)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot open sqlite databases: %v", err)
+		}
+		return newHandlerContext(backend), nil
+	default:
+		return nil, fmt.Errorf("Unknown backend: %s", serverConfig.Backend)
+	}
+
 	opts := tarantool.Opts{
 		Reconnect:     1 * time.Second,
 		MaxReconnects: 3,
@@ -84,14 +110,7 @@ func makeHandlerContext(serverConfig *ServerConfig) (*HandlerContextStruct, erro
 		return nil, fmt.Errorf("Cannot connect to tarantool: %v", err)
 	}
 
-	handlerContext := &HandlerContextStruct{
-		TntConnection: tnt,
-		TestLogger: &TestLogger{
-			ch: make(chan string),
-		},
-	}
-
-	return handlerContext, nil
+	return newHandlerContext(tnt), nil
 }
 
 func prepareResponse(w http.ResponseWriter, r *http.Request, logger Logger) (bool, int64) {
@@ -126,6 +145,16 @@ func writeHeader(w http.ResponseWriter, r *http.Request, requestId int64, code i
 	logger.logResponse(w, r, requestId, "code "+strconv.FormatInt(int64(code), 10))
 }
 
+// Long-running handlers (bundles, exports) outlive server WriteTimeout
+const LONG_WRITE_TIMEOUT = 5 * time.Minute
+
+func extendWriteDeadline(w http.ResponseWriter, d time.Duration, context string) {
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d))
+	if err != nil && err != http.ErrNotSupported {
+		log.Printf("%s => cannot extend write deadline: %v\n", context, err)
+	}
+}
+
 func checkConvertionUint(val uint32, err error, context string) uint32 {
 	if err != nil {
 		log.Printf("%s: uint conversion err => %v\n", context, err)
@@ -166,15 +195,6 @@ func getRequestUserId(r *http.Request) (int64, error) {
 	return requestId, nil
 }
 
-func getRequestJsonStr(r *http.Request, context string) (string, error) {
-	jsonStr, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("%s => malformed json\n", context)
-		return "", err
-	}
-	return string(jsonStr), nil
-}
-
 type EndpointCallback func(w http.ResponseWriter, r *http.Request)
 
 func handlerPing(handlerContext HandlerContext) (string, EndpointCallback) {
@@ -217,6 +237,10 @@ func main() {
 		log.Fatalf("Failed to decode config file: %s\nError: %v\n", configFilePath, err)
 		return
 	}
+	err = validateApiKeys(serverConfig.ApiKeys)
+	if err != nil {
+		log.Fatalf("Invalid config file: %s\nError: %v\n", configFilePath, err)
+	}
 
 	if serverConfig.TestingMode {
 		log.Printf("WARNING: Server started is TESTING mode! Make sure it is not prod server.")
@@ -228,32 +252,7 @@ func main() {
 	}
 	defer handlerContext.Close()
 
-	router := mux.NewRouter()
-	router.HandleFunc(handlerPing(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerCashpoint(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerCashpointCreate(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerCashpointsBatch(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerCashpointPatches(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerTown(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerTownsBatch(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerTownsList(handlerContext)).Methods("GET")
-
-	router.HandleFunc(handlerMetroList(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerMetro(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerMetroBatch(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerBank(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerBankIco(handlerContext, serverConfig)).Methods("GET")
-	router.HandleFunc(handlerBanksList(handlerContext)).Methods("GET")
-	router.HandleFunc(handlerBanksBatch(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerNearbyCashPoints(handlerContext)).Methods("POST")
-	router.HandleFunc(handlerNearbyClusters(handlerContext)).Methods("POST")
-
-	if serverConfig.TestingMode {
-		router.HandleFunc(handlerCoordToQuadKey(handlerContext)).Methods("POST")
-		router.HandleFunc(handlerQuadTreeBranch(handlerContext)).Methods("GET")
-		router.HandleFunc(handlerCashpointDelete(handlerContext)).Methods("DELETE")
-		router.HandleFunc(handlerSpaceMetrics(handlerContext)).Methods("GET")
-	}
+	router := newRouter(handlerContext, serverConfig)
 
 	port := strconv.FormatUint(serverConfig.Port, 10)
 	log.Println("Listening port: " + port)
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/alexeyknyshev/cpclient"
+	"github.com/alexeyknyshev/models"
+	"net/http/httptest"
+	"testing"
+)
+
+// Client package against route table of server
+
+func makeTestClient(t *testing.T) (*cpclient.Client, func()) {
+	hCtx := makeTestHandlerContext(t)
+	server := httptest.NewServer(newRouter(hCtx, ServerConfig{TestingMode: true}))
+	c := cpclient.NewClient(server.URL)
+	c.Retries = 0
+	return c, func() {
+		server.Close()
+		hCtx.Close()
+	}
+}
+
+func containsId(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestClientReferenceData(t *testing.T) {
+	c, done := makeTestClient(t)
+	defer done()
+
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+
+	town, err := c.Town(4)
+	if err != nil || town.Name != "Москва" || !town.HasMetro {
+		t.Errorf("Unexpected town %+v, %v", town, err)
+	}
+	_, err = c.Town(100500)
+	if !cpclient.IsNotFound(err) {
+		t.Errorf("Expected not found error but got %v", err)
+	}
+
+	c.Lang = "en"
+	_, err = c.Bank(100500)
+	if !cpclient.IsNotFound(err) || err.(*cpclient.Error).Text != "Bank does not exist with id: 100500" {
+		t.Errorf("Expected localized not found error but got %v", err)
+	}
+	bank, err := c.Bank(322)
+	if err != nil || bank.Name != "Sberbank Rossii" {
+		t.Errorf("Expected english name of bank but got %+v, %v", bank, err)
+	}
+	c.Lang = ""
+
+	towns, err := c.Towns([]uint32{290, 100500, 4})
+	if err != nil || len(towns) != 2 {
+		t.Errorf("Expected 2 existing towns but got %d, %v", len(towns), err)
+	}
+	ids, err := c.TownIds()
+	if err != nil || !containsId(ids, 4) || !containsId(ids, 290) {
+		t.Errorf("Unexpected town ids %v, %v", ids, err)
+	}
+
+	partners, err := c.BankPartners(322)
+	if err != nil || len(partners) != 1 || partners[0].Id != 325 {
+		t.Errorf("Unexpected partners %+v, %v", partners, err)
+	}
+	banks, err := c.Banks([]uint32{322, 325, 2764})
+	if err != nil || len(banks) != 3 {
+		t.Errorf("Unexpected banks batch of %d banks, %v", len(banks), err)
+	}
+
+	metro, err := c.TownMetro(4)
+	if err != nil || len(metro) != 1 || metro[0].Id != 779 {
+		t.Errorf("Unexpected metro of town %+v, %v", metro, err)
+	}
+
+	_, err = c.BankIco(322)
+	if !cpclient.IsNotFound(err) {
+		t.Errorf("Expected missing icon but got %v", err)
+	}
+}
+
+func TestClientCashpoints(t *testing.T) {
+	c, done := makeTestClient(t)
+	defer done()
+
+	cp, err := c.Cashpoint(58552)
+	if err != nil || cp.BankId != 2764 || !cp.RoundTheClock {
+		t.Errorf("Unexpected cashpoint %+v, %v", cp, err)
+	}
+
+	cps, err := c.Cashpoints([]uint32{58552, 7138832, 1})
+	if err != nil || len(cps) != 2 {
+		t.Errorf("Expected 2 existing cashpoints but got %d, %v", len(cps), err)
+	}
+
+	region := cpclient.RegionAround(cpclient.Coord{Longitude: 37.644, Latitude: 55.764}, 0.01, 0.002)
+	ids, err := c.NearbyCashpoints(region, &cpclient.Filter{Currency: []uint32{models.CURRENCY_USD}})
+	if err != nil || len(ids) != len(FIXTURE_USD) {
+		t.Errorf("Expected cashpoints accepting dollars but got %v, %v", ids, err)
+	}
+
+	_, err = c.NearbyCashpoints(cpclient.RegionAround(cpclient.Coord{Longitude: 37.6, Latitude: 55.7}, 1, 1), nil)
+	if !cpclient.IsKind(err, cpclient.ErrBadRequest) {
+		t.Errorf("Expected bad request of too big region but got %v", err)
+	}
+
+	clusters, err := c.NearbyClusters(cpclient.RegionAround(cpclient.Coord{Longitude: 37.62, Latitude: 55.75}, 0.2, 0.1), 14, nil)
+	if err != nil || len(clusters) == 0 {
+		t.Fatalf("Expected clusters but got %v", err)
+	}
+	var size uint32 = 0
+	for _, cluster := range clusters {
+		size += cluster.Size
+		if cluster.Size == 1 && cluster.Cashpoint == nil {
+			t.Errorf("Expected cashpoint of single member cluster %+v", cluster)
+		}
+	}
+	if size == 0 {
+		t.Errorf("Unexpected empty clusters")
+	}
+}
+
+func TestClientHeatmap(t *testing.T) {
+	c, done := makeTestClient(t)
+	defer done()
+
+	countCells := func(heatmap *cpclient.Heatmap) int {
+		count := 0
+		for _, cell := range heatmap.Cells {
+			count += int(cell.Count)
+		}
+		return count
+	}
+
+	// raw cashpoints of Kitay-gorod
+	region := cpclient.Region{
+		TopLeft:     cpclient.Coord{Longitude: 37.64, Latitude: 55.77},
+		BottomRight: cpclient.Coord{Longitude: 37.65, Latitude: 55.76},
+	}
+	heatmap, err := c.Heatmap(region, 2, 2, nil)
+	if err != nil || heatmap.Zoom != nil || countCells(heatmap) != len(FIXTURE_USD)+2 {
+		t.Errorf("Unexpected heatmap of raw cashpoints %+v, %v", heatmap, err)
+	} else if heatmap.CellWidth < 0.0049 || heatmap.CellWidth > 0.0051 || heatmap.CellHeight < 0.0049 || heatmap.CellHeight > 0.0051 {
+		t.Errorf("Unexpected cell size %vx%v", heatmap.CellWidth, heatmap.CellHeight)
+	}
+
+	// clusters of Moscow and Astrakhan
+	region = cpclient.Region{
+		TopLeft:     cpclient.Coord{Longitude: 30.0, Latitude: 60.0},
+		BottomRight: cpclient.Coord{Longitude: 50.0, Latitude: 45.0},
+	}
+	heatmap, err = c.Heatmap(region, 4, 4, &cpclient.Filter{Currency: []uint32{models.CURRENCY_USD}})
+	if err != nil || heatmap.Zoom == nil || *heatmap.Zoom != 10 || countCells(heatmap) != len(FIXTURE_USD) {
+		t.Errorf("Unexpected heatmap of clusters %+v, %v", heatmap, err)
+	}
+
+	_, err = c.Heatmap(region, 1000, 4, nil)
+	if !cpclient.IsKind(err, cpclient.ErrBadRequest) {
+		t.Errorf("Expected bad request of too big grid but got %v", err)
+	}
+}
+
+func TestClientPatches(t *testing.T) {
+	c, done := makeTestClient(t)
+	defer done()
+
+	data := &models.CashpointData{
+		Longitude: 37.6247,
+		Latitude:  55.7591,
+		Type:      "atm",
+		BankId:    322,
+		TownId:    4,
+		Address:   "г. Москва, ул. Никольская, д. 10",
+		Schedule:  models.Schedule{},
+		Currency:  []uint32{models.CURRENCY_RUB},
+	}
+	id, err := c.CreateCashpoint(1, data)
+	if err != nil || id == 0 {
+		t.Fatalf("Cannot create cashpoint: %v", err)
+	}
+	cp, err := c.Cashpoint(id)
+	if err != nil || cp.Address != data.Address {
+		t.Fatalf("Unexpected created cashpoint %+v, %v", cp, err)
+	}
+
+	err = c.PatchCashpoint(2, id, map[string]interface{}{"cash_in": true})
+	if err != nil {
+		t.Fatalf("Cannot patch cashpoint: %v", err)
+	}
+	patches, err := c.CashpointPatches(id)
+	if err != nil {
+		t.Fatalf("Cannot get patches: %v", err)
+	}
+	// creation of cashpoint is recorded as patch too
+	found := false
+	for _, patch := range patches {
+		var fields map[string]interface{}
+		json.Unmarshal(patch, &fields)
+		found = found || (len(fields) == 1 && fields["cash_in"] == true)
+	}
+	if !found {
+		t.Errorf("Expected cash_in patch but got %v", patches)
+	}
+
+	_, err = c.CreateCashpoint(1, &models.CashpointData{Type: "bus"})
+	if !cpclient.IsKind(err, cpclient.ErrBadRequest) {
+		t.Errorf("Expected invalid cashpoint error but got %v", err)
+	}
+
+	// testing mode server permits deleting without api key
+	err = c.DeleteCashpoint(id)
+	if err != nil {
+		t.Errorf("Cannot delete cashpoint: %v", err)
+	}
+	_, err = c.Cashpoint(id)
+	if !cpclient.IsNotFound(err) {
+		t.Errorf("Expected deleted cashpoint to be not found but got %v", err)
+	}
+}
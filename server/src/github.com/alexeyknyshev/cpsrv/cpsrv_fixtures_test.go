@@ -0,0 +1,206 @@
+package main
+
+import (
+	"github.com/alexeyknyshev/models"
+	"os"
+	"testing"
+)
+
+// Handler tests run against in-memory backend filled with fixtures below.
+// Set CPSRV_TEST_TARANTOOL=1 to run them against tarantool with testing
+// data instead (see run_tests.sh).
+
+func useTarantool() bool {
+	return os.Getenv("CPSRV_TEST_TARANTOOL") != ""
+}
+
+// Returns handler context of tarantool or of fresh in-memory backend.
+// Tests on in-memory backend do not share data and run in parallel.
+func makeTestHandlerContext(t *testing.T) *HandlerContextStruct {
+	if !useTarantool() {
+		t.Parallel()
+		return newHandlerContext(newFixtureBackend())
+	}
+
+	hCtx, err := makeHandlerContext(getServerConfig())
+	if err != nil {
+		t.Fatalf("Connection to tarantool failed: %v", err)
+	}
+	return hCtx
+}
+
+// Cashpoints open on saturday 10:00—21:00 in the center of Moscow (see TestTimeFilter)
+var FIXTURE_OPEN_ON_SATURDAY = []uint32{
+	384924, 316411, 316416, 324453, 3470560,
+	4437472, 4508915, 4406301, 5500542, 943485,
+	2376541, 2820889, 7125785, 7194801, 7194843,
+	7235343, 7913779, 8158920, 8158944, 605269,
+	6764619, 736685, 6484376, 7129653, 7688033,
+	8128184, 8232204, 1259403, 1272692,
+}
+
+// Cashpoints accepting US dollars near Kitay-gorod (see TestFilterCurrency)
+var FIXTURE_USD = []uint32{6575135, 6580021, 341381, 342266}
+
+func newFixtureBackend() *MemoryBackend {
+	b := newMemoryBackend()
+
+	b.addRegion(models.Region{Id: 3, Longitude: 37.61775970459, Latitude: 55.755771636963, Name: "Москва", NameTr: "Moskva", Zoom: 9})
+	b.addRegion(models.Region{Id: 30, Longitude: 47.2, Latitude: 46.9, Name: "Астраханская область", NameTr: "Astrakhanskaya oblast", Zoom: 7})
+
+	b.addTown(models.Town{
+		Id:             4,
+		Longitude:      37.61775970459,
+		Latitude:       55.755771636963,
+		Name:           "Москва",
+		NameTr:         "Moskva",
+		RegionId:       3,
+		RegionalCenter: true,
+		Zoom:           10,
+		Big:            true,
+		Population:     12000000,
+	})
+	b.addTown(models.Town{
+		Id:             290,
+		Longitude:      48.0336,
+		Latitude:       46.3497,
+		Name:           "Астрахань",
+		NameTr:         "Astrakhan",
+		RegionId:       30,
+		RegionalCenter: true,
+		Zoom:           12,
+		Big:            true,
+		Population:     530000,
+	})
+
+	b.addBank(models.Bank{Id: 322, Name: "Сбербанк России", NameTr: "Sberbank Rossii", Partners: []uint32{325}, Licence: 1481, Rating: 1})
+	b.addBank(models.Bank{Id: 325, Name: "Тестовый партнер", NameTr: "Testovyy partner", Partners: []uint32{322}, Licence: 2, Rating: 2})
+	b.addBank(models.Bank{Id: 2764, Name: "Тестовый банк", NameTr: "Testovyy bank", Licence: 3, Rating: 3})
+	b.addBank(models.Bank{Id: 194275, Name: "Тестовый региональный банк", NameTr: "Testovyy regionalnyy bank", Licence: 4, Rating: 4})
+
+	b.addMetro(models.Metro{
+		Id:              779,
+		Longitude:       37.526596999601,
+		Latitude:        55.643621500032,
+		TownId:          4,
+		BranchId:        3,
+		StationName:     "Беляево",
+		StationExitName: "вход-выход 2 в северный вестибюль",
+	})
+
+	b.addCashpoint(models.Cashpoint{
+		CashpointData: models.CashpointData{
+			Id:             7138832,
+			Longitude:      37.562019348145,
+			Latitude:       55.6633644104,
+			Type:           "atm",
+			BankId:         2764,
+			TownId:         4,
+			Address:        "г. Москва, ул. Новочеремушкинская, д. 69",
+			AddressComment: "ОАО «Вниизарубежгеология»",
+			FreeAccess:     true,
+			WorksAsShop:    true,
+			Currency:       []uint32{643},
+		},
+		Approved: true,
+	})
+	b.addCashpoint(models.Cashpoint{
+		CashpointData: models.CashpointData{
+			Id:            58552,
+			Longitude:     37.5801,
+			Latitude:      55.7125,
+			Type:          "atm",
+			BankId:        2764,
+			TownId:        4,
+			Address:       "г. Москва, Ленинский пр-т, д. 30",
+			FreeAccess:    true,
+			RoundTheClock: true,
+			Currency:      []uint32{643},
+		},
+		Approved: true,
+	})
+	b.addCashpoint(models.Cashpoint{
+		CashpointData: models.CashpointData{
+			Id:        7243171,
+			Longitude: 48.049293518066,
+			Latitude:  46.369739532471,
+			Type:      "office",
+			BankId:    194275,
+			TownId:    290,
+			Address:   "г. Астрахань, ул.Савушкина, д.23в",
+			Schedule: fixtureSchedule(map[string][2]int{
+				"mon": {540, 1260}, "tue": {540, 1260}, "wed": {540, 1260}, "thu": {540, 1260}, "fri": {540, 1260},
+				"sat": {600, 1020},
+			}),
+			FreeAccess: true,
+			Currency:   []uint32{643},
+		},
+		Approved: true,
+	})
+
+	// grid over center of Moscow: open on saturday till 21:00
+	// with a couple of ones closed by saturday evening
+	for i, id := range FIXTURE_OPEN_ON_SATURDAY {
+		cp := fixtureMoscowCashpoint(id, 37.6095+float64(i%7)*0.0007, 55.7587+float64(i/7)*0.0008)
+		cp.Schedule = fixtureSchedule(map[string][2]int{"fri": {540, 1260}, "sat": {600, 1260}})
+		b.addCashpoint(cp)
+	}
+	closed := fixtureMoscowCashpoint(316412, 37.6098, 55.7623)
+	closed.Schedule = fixtureSchedule(map[string][2]int{"fri": {540, 1260}, "sat": {600, 1020}})
+	b.addCashpoint(closed)
+	weekdays := fixtureMoscowCashpoint(316413, 37.6133, 55.7625)
+	weekdays.Schedule = fixtureSchedule(map[string][2]int{"mon": {540, 1260}, "fri": {540, 1260}})
+	b.addCashpoint(weekdays)
+
+	for i, id := range FIXTURE_USD {
+		cp := fixtureMoscowCashpoint(id, 37.642+float64(i)*0.002, 55.764)
+		cp.Currency = []uint32{643, 840}
+		b.addCashpoint(cp)
+	}
+	b.addCashpoint(fixtureMoscowCashpoint(341382, 37.646, 55.767))
+	euro := fixtureMoscowCashpoint(341383, 37.648, 55.767)
+	euro.Currency = []uint32{643, 978}
+	b.addCashpoint(euro)
+
+	return b
+}
+
+func fixtureMoscowCashpoint(id uint32, longitude, latitude float64) models.Cashpoint {
+	return models.Cashpoint{
+		CashpointData: models.CashpointData{
+			Id:        id,
+			Longitude: longitude,
+			Latitude:  latitude,
+			Type:      "atm",
+			BankId:    322,
+			TownId:    4,
+			Address:   "г. Москва",
+			Currency:  []uint32{643},
+		},
+		Approved: true,
+	}
+}
+
+func fixtureSchedule(days map[string][2]int) models.Schedule {
+	var schedule models.Schedule
+	for day, hours := range days {
+		scheduleDay := &models.ScheduleDay{From: hours[0], To: hours[1]}
+		switch day {
+		case "mon":
+			schedule.Mon = scheduleDay
+		case "tue":
+			schedule.Tue = scheduleDay
+		case "wed":
+			schedule.Wed = scheduleDay
+		case "thu":
+			schedule.Thu = scheduleDay
+		case "fri":
+			schedule.Fri = scheduleDay
+		case "sat":
+			schedule.Sat = scheduleDay
+		case "sun":
+			schedule.Sun = scheduleDay
+		}
+	}
+	return schedule
+}
@@ -3,43 +3,20 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/alexeyknyshev/models"
 	"net/http"
 	"strconv"
 	"testing"
 )
 
-type PatchRequest struct {
-	Id             uint32    `json:"id,omitempty"`
-	Longitude      float64   `json:"longitude,omitempty"`
-	Latitude       float64   `json:"latitude,omitempty"`
-	Type           string    `json:"type,omitempty"`
-	BankId         uint32    `json:"bank_id,omitempty"`
-	TownId         uint32    `json:"town_id,omitempty"`
-	Address        string    `json:"address,omitempty"`
-	AddressComment string    `json:"address_comment,omitempty"`
-	MetroName      string    `json:"metro_name,omitempty"`
-	FreeAccess     *bool     `json:"free_access,omitempty"`
-	MainOffice     *bool     `json:"main_office,omitempty"`
-	WithoutWeekend *bool     `json:"without_weekend,omitempty"`
-	RoundTheClock  *bool     `json:"round_the_clock,omitempty"`
-	WorksAsShop    *bool     `json:"works_as_shop,omitempty"`
-	Schedule       *Schedule `json:"schedule,omitempty"`
-	Tel            string    `json:"tel,omitempty"`
-	Additional     string    `json:"additional,omitempty"`
-	Currency       []uint32  `json:"currency,omitempty"`
-	CashIn         *bool     `json:"cash_in,omitempty"`
-}
-
+// Data is models.CashpointData of new cashpoint or changed fields of existing one
 type TestPatchReq struct {
-	Data   PatchRequest `json:"data"`
-	UserId uint         `json:"user_id"`
+	Data   interface{} `json:"data"`
+	UserId uint        `json:"user_id"`
 }
 
-func getPatchExampleNewCP() *PatchRequest {
-	False := false
-	True := true
-	sched := Schedule{}
-	patchReq := PatchRequest{
+func getPatchExampleNewCP() *models.CashpointData {
+	patchReq := models.CashpointData{
 		Longitude:      37.6878262,
 		Latitude:       55.6946643,
 		Type:           "atm",
@@ -48,28 +25,29 @@ func getPatchExampleNewCP() *PatchRequest {
 		Address:        "г. Москва, Район Моей Мечты",
 		AddressComment: "ОАО UnderButtom",
 		MetroName:      "",
-		FreeAccess:     &True,
-		MainOffice:     &False,
-		WithoutWeekend: &False,
-		RoundTheClock:  &False,
-		WorksAsShop:    &True,
+		FreeAccess:     true,
+		MainOffice:     false,
+		WithoutWeekend: false,
+		RoundTheClock:  false,
+		WorksAsShop:    true,
 		Tel:            "",
-		Schedule:       &sched,
+		Schedule:       models.Schedule{},
 		Additional:     "",
 		Currency:       []uint32{643},
-		CashIn:         &False,
+		CashIn:         false,
 	}
 	return &patchReq
 
 }
 
-func getPatchExampleExistCP() (*PatchRequest, string) {
-	patchReq := PatchRequest{
-		Id:     58552,
-		BankId: 322,
+func getPatchExampleExistCP() (map[string]interface{}, string) {
+	var bankId uint32 = 322
+	patchReq := map[string]interface{}{
+		"id":      58552,
+		"bank_id": bankId,
 	}
-	exampleJson := "{\"bank_id\":" + strconv.FormatUint(uint64(patchReq.BankId), 10) + "}"
-	return &patchReq, exampleJson
+	exampleJson := "{\"bank_id\":" + strconv.FormatUint(uint64(bankId), 10) + "}"
+	return patchReq, exampleJson
 
 }
 
@@ -152,19 +130,16 @@ func TestPatchCreateNewCP(t *testing.T) {
 
 	patchReq := getPatchExampleNewCP()
 	request := TestPatchReq{
-		Data:   *patchReq,
+		Data:   patchReq,
 		UserId: 1,
 	}
 	requestJson, err := json.Marshal(request)
 	if err != nil {
 		t.Fatalf("Json Marshal error %v", err)
 	}
-	fmt.Println("Request:\n", string(requestJson), "\n")
+	fmt.Print("Request:\n ", string(requestJson), "\n\n")
 
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 
 	defer hCtx.Close()
 
@@ -197,19 +172,16 @@ func TestPatchChangeExistCP(t *testing.T) {
 
 	patchReq, expPatchData := getPatchExampleExistCP()
 	request := TestPatchReq{
-		Data:   *patchReq,
+		Data:   patchReq,
 		UserId: 1,
 	}
 	requestJson, err := json.Marshal(request)
 	if err != nil {
 		t.Fatalf("Json Marshal error %v", err)
 	}
-	fmt.Println("Request:\n", string(requestJson), "\n")
+	fmt.Print("Request:\n ", string(requestJson), "\n\n")
 
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -236,13 +208,7 @@ func TestPatchChangeExistCP(t *testing.T) {
 	}
 }
 
-type VotePatch struct {
-	PatchId uint32 `json:"patch_id,omitempty"`
-	UserId  uint32 `json:"user_id"`
-	Score   uint32 `json:"score"`
-}
-
-func voteCompare(t *testing.T, res, expected *VotePatch) bool {
+func voteCompare(t *testing.T, res, expected *models.PatchVote) bool {
 	success := true
 	if res.UserId != expected.UserId {
 		t.Error("expected UserId = ", expected.UserId, "got UserId = ", res.UserId)
@@ -255,7 +221,7 @@ func voteCompare(t *testing.T, res, expected *VotePatch) bool {
 	return success
 }
 
-func invokeTaranVoteFuncs(t *testing.T, hCtx *HandlerContextStruct, voteJsonReq []byte, lastPatch uint32) (*([]VotePatch), bool) {
+func invokeTaranVoteFuncs(t *testing.T, hCtx *HandlerContextStruct, voteJsonReq []byte, lastPatch uint32) (*([]models.PatchVote), bool) {
 	voteResp, err := hCtx.Tnt().Call("cashpointVotePatch", []interface{}{voteJsonReq})
 	if err != nil {
 		t.Errorf("Tnt cashpointVotePatch call err:\n%v", err)
@@ -272,7 +238,7 @@ func invokeTaranVoteFuncs(t *testing.T, hCtx *HandlerContextStruct, voteJsonReq
 		t.Errorf("Tnt getCashpointPatchVotes call err: %v", err)
 	}
 	//fmt.Println("getCashpointPatchVotes return:", voteList.Data[0].([]interface{})[0].(string))
-	var decodeVoteList []VotePatch
+	var decodeVoteList []models.PatchVote
 	err = json.Unmarshal([]byte(voteList.Data[0].([]interface{})[0].(string)), &decodeVoteList)
 	if err != nil {
 		t.Errorf("Unmarshal err: %v", err)
@@ -286,19 +252,16 @@ func TestPatchOneUserVoting(t *testing.T) {
 
 	patchReq := getPatchExampleNewCP()
 	request := TestPatchReq{
-		Data:   *patchReq,
+		Data:   patchReq,
 		UserId: 1,
 	}
 	requestJson, err := json.Marshal(request)
 	if err != nil {
 		t.Fatalf("Json Marshal error %v", err)
 	}
-	fmt.Println("Request:\n", string(requestJson), "\n")
+	fmt.Print("Request:\n ", string(requestJson), "\n\n")
 
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 
 	defer hCtx.Close()
 
@@ -315,8 +278,8 @@ func TestPatchOneUserVoting(t *testing.T) {
 	resp, err := hCtx.Tnt().Call("getCashpointPatchByPatchId", []interface{}{lastPatch})
 	resPatch := resp.Data[0].([]interface{})
 	fmt.Println("response patch:\n", resPatch)
-	voteReq := VotePatch{
-		PatchId: lastPatch,
+	voteReq := models.PatchVote{
+		PatchId: uint64(lastPatch),
 		UserId:  2,
 		Score:   1,
 	}
@@ -352,19 +315,16 @@ func TestPatchOneUserVoting(t *testing.T) {
 func TestPatchVotingByDiffUsers(t *testing.T) {
 	patchReq := getPatchExampleNewCP()
 	request := TestPatchReq{
-		Data:   *patchReq,
+		Data:   patchReq,
 		UserId: 1,
 	}
 	requestJson, err := json.Marshal(request)
 	if err != nil {
 		t.Fatalf("Json Marshal error %v", err)
 	}
-	fmt.Println("Request:\n", string(requestJson), "\n")
+	fmt.Print("Request:\n ", string(requestJson), "\n\n")
 
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 
 	defer hCtx.Close()
 
@@ -382,12 +342,12 @@ func TestPatchVotingByDiffUsers(t *testing.T) {
 	resPatch := resp.Data[0].([]interface{})
 	fmt.Println("response patch:\n", resPatch)
 	const NumberOfUsers = 5 // equals PATCH_APPROVE_VOTES from cpapi.lua
-	var voteReqs [NumberOfUsers]VotePatch
+	var voteReqs [NumberOfUsers]models.PatchVote
 	var voteJsonReqs [NumberOfUsers][]byte
 	for i, _ := range voteReqs {
-		voteReqs[i].PatchId = lastPatch
+		voteReqs[i].PatchId = uint64(lastPatch)
 		voteReqs[i].Score = 1
-		voteReqs[i].UserId = uint32(i + 1)
+		voteReqs[i].UserId = uint64(i + 1)
 		voteJsonReqs[i], _ = json.Marshal(voteReqs[i])
 		fmt.Println("request vote №", i, ":", voteReqs[i])
 	}
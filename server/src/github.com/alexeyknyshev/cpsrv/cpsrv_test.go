@@ -5,14 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/alexeyknyshev/export"
 	"github.com/alexeyknyshev/gojsondiff"
 	"github.com/alexeyknyshev/gojsondiff/formatter"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,6 +30,7 @@ type TestRequest struct {
 	EndpointUrl string
 	HandlerUrl  string
 	Data        string
+	Headers     map[string]string
 }
 
 type TestResponse struct {
@@ -113,6 +120,9 @@ func testRequest(request TestRequest, handler EndpointCallback) *httptest.Respon
 	}
 
 	req.Header.Add("Id", "1")
+	for name, value := range request.Headers {
+		req.Header.Set(name, value)
+	}
 
 	w := httptest.NewRecorder()
 	m := mux.NewRouter()
@@ -148,15 +158,6 @@ func checkJsonResponse(t *testing.T, got, expected []byte) bool {
 
 // ======================================================================
 
-type SpaceMetrics struct {
-	Regions           uint32 `json:"regions"`
-	Towns             uint32 `json:"towns"`
-	Cashpoints        uint32 `json:"cashpoints"`
-	Banks             uint32 `json:"banks"`
-	Clusters          uint32 `json:"clusters"`
-	CashpointsPatches uint32 `json:"cashpoints_patches"`
-}
-
 func getSpaceMetrics(hCtx HandlerContext) ([]byte, error) {
 	url, handler := handlerSpaceMetrics(hCtx)
 	request := TestRequest{RequestType: "GET", EndpointUrl: url}
@@ -269,10 +270,7 @@ func checkQuadTreeBranch(t *testing.T, getBranch QuadTreeBranchGetter, expected
 // ======================================================================
 
 func TestPing(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -299,24 +297,8 @@ func TestPing(t *testing.T) {
 
 // ======================================================================
 
-type Town struct {
-	Id             uint32  `json:"id"`
-	Name           string  `json:"name"`
-	NameTr         string  `json:"name_tr"`
-	Longitude      float64 `json:"longitude"`
-	Latitude       float64 `json:"latitude"`
-	RegionId       uint32  `json:"region_id"`
-	RegionalCenter bool    `json:"regional_center"`
-	Big            bool    `json:"big"`
-	Zoom           uint32  `json:"zoom"`
-	HasMetro       bool    `json:"has_metro"`
-}
-
 func TestTown(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -334,7 +316,7 @@ func TestTown(t *testing.T) {
 	}
 	checkHttpCode(t, response.Code, http.StatusOK)
 
-	expected := Town{
+	expected := models.Town{
 		Id:             4,
 		Name:           "Москва",
 		NameTr:         "Moskva",
@@ -353,64 +335,8 @@ func TestTown(t *testing.T) {
 
 // =====================================================================
 
-type ScheduleBreak struct {
-	From int `json:"f"`
-	To   int `json:"t"`
-}
-
-type ScheduleDay struct {
-	Day    int              `json:"-"`
-	From   int              `json:"f"`
-	To     int              `json:"t"`
-	Breaks *[]ScheduleBreak `json:"b,omitempty"`
-}
-
-type Schedule struct {
-	Mon    *ScheduleDay     `json:"mon,omitempty"`
-	Tue    *ScheduleDay     `json:"tue,omitempty"`
-	Wed    *ScheduleDay     `json:"wed,omitempty"`
-	Thu    *ScheduleDay     `json:"thu,omitempty"`
-	Fri    *ScheduleDay     `json:"fri,omitempty"`
-	Sat    *ScheduleDay     `json:"sat,omitempty"`
-	Sun    *ScheduleDay     `json:"sun,omitempty"`
-	Breaks *[]ScheduleBreak `json:"b,omitempty"`
-}
-
-type CashpointShort struct {
-	Id             uint32   `json:"id,omitempty"`
-	Longitude      float64  `json:"longitude"`
-	Latitude       float64  `json:"latitude"`
-	Type           string   `json:"type"`
-	BankId         uint32   `json:"bank_id"`
-	TownId         uint32   `json:"town_id"`
-	Address        string   `json:"address"`
-	AddressComment string   `json:"address_comment"`
-	MetroName      string   `json:"metro_name"`
-	FreeAccess     bool     `json:"free_access"`
-	MainOffice     bool     `json:"main_office"`
-	WithoutWeekend bool     `json:"without_weekend"`
-	RoundTheClock  bool     `json:"round_the_clock"`
-	WorksAsShop    bool     `json:"works_as_shop"`
-	Schedule       Schedule `json:"schedule"`
-	Tel            string   `json:"tel"`
-	Additional     string   `json:"additional"`
-	Currency       []uint32 `json:"currency"`
-	CashIn         bool     `json:"cash_in"`
-}
-
-type CashpointFull struct {
-	CashpointShort
-	Version    uint32  `json:"version"`
-	//	Timestamp      uint64  `json:"timestamp"` // TODO: timestamp on server
-	Approved   bool    `json:"approved"`
-	PatchCount uint32  `json:"patch_count"`
-}
-
 func TestCashpointGet(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -434,7 +360,7 @@ func TestCashpointGet(t *testing.T) {
 
 	checkHttpCode(t, response.Code, http.StatusOK)
 
-	cpShort := CashpointShort{
+	cpShort := models.CashpointData{
 		Id:             id,
 		Longitude:      37.562019348145,
 		Latitude:       55.6633644104,
@@ -449,15 +375,15 @@ func TestCashpointGet(t *testing.T) {
 		WithoutWeekend: false,
 		RoundTheClock:  false,
 		WorksAsShop:    true,
-		Schedule:       Schedule{},
+		Schedule:       models.Schedule{},
 		Tel:            "",
 		Additional:     "",
 		Currency:       []uint32{643},
 		CashIn:         false,
 	}
 
-	cp := CashpointFull{
-		CashpointShort: cpShort,
+	cp := models.Cashpoint{
+		CashpointData: cpShort,
 		Version:        0,
 		//Timestamp: 0,
 		Approved:       true,
@@ -480,11 +406,7 @@ type QuadKeyResponse struct {
 }
 
 func TestQuadKeyFromCoord(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -577,15 +499,7 @@ func TestQuadKeyFromCoord(t *testing.T) {
 
 // ======================================================================
 
-type Cluster struct {
-	Id        string   `json:"id"`
-	Longitude float64  `json:"longitude"`
-	Latitude  float64  `json:"latitude"`
-	Members   []uint32 `json:"members"`
-	Size      uint32   `json:"size"`
-}
-
-type ClusterArray []Cluster
+type ClusterArray []models.Cluster
 
 func (c ClusterArray) Compare(other ClusterArray) (bool, string) {
 	if len(c) != len(other) {
@@ -612,10 +526,7 @@ func (c ClusterArray) Compare(other ClusterArray) (bool, string) {
 }
 
 func TestQuadTreeBranch(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -680,7 +591,7 @@ func TestQuadTreeBranch(t *testing.T) {
 
 type CashpointCreateRequest struct {
 	UserId uint32         `json:"user_id"`
-	Data   CashpointShort `json:"data"`
+	Data   models.CashpointData `json:"data"`
 }
 
 type Coordinate struct {
@@ -701,10 +612,7 @@ type CashpointNearbyRequest struct {
 
 func TestCashpointCreateSuccessful(t *testing.T) {
 	log.SetFlags(log.Flags() | log.Lmicroseconds)
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -768,7 +676,7 @@ func TestCashpointCreateSuccessful(t *testing.T) {
 	}
 
 	// creating real cashpoint
-	cp := CashpointShort{
+	cp := models.CashpointData{
 		Longitude:      longitude,
 		Latitude:       latitude,
 		Type:           "atm",
@@ -782,7 +690,7 @@ func TestCashpointCreateSuccessful(t *testing.T) {
 		WithoutWeekend: true,
 		RoundTheClock:  false,
 		WorksAsShop:    false,
-		Schedule:       Schedule{},
+		Schedule:       models.Schedule{},
 		Tel:            "",
 		Additional:     "",
 		Currency:       []uint32{643},
@@ -835,8 +743,8 @@ func TestCashpointCreateSuccessful(t *testing.T) {
 
 	// extend cashpoint short data with returned id
 	cp.Id = uint32(cashpointId)
-	cpFull := CashpointFull{
-		CashpointShort: cp,
+	cpFull := models.Cashpoint{
+		CashpointData: cp,
 		Version:        0,
 		Approved:       false,
 		PatchCount:     1, // created & not approved cp has atleast 1 patch
@@ -941,10 +849,7 @@ func TestCashpointCreateSuccessful(t *testing.T) {
 }
 
 func TestCashpointCreateWrongCoordinates(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -977,7 +882,7 @@ func TestCashpointCreateWrongCoordinates(t *testing.T) {
 	checkHttpCode(t, response.Code, http.StatusBadRequest)
 
 	// creating real cashpoint with wrong coordinates
-	cp := CashpointShort{
+	cp := models.CashpointData{
 		Longitude:      longitude,
 		Latitude:       latitude,
 		Type:           "atm",
@@ -991,7 +896,7 @@ func TestCashpointCreateWrongCoordinates(t *testing.T) {
 		WithoutWeekend: true,
 		RoundTheClock:  false,
 		WorksAsShop:    false,
-		Schedule:       Schedule{},
+		Schedule:       models.Schedule{},
 		Tel:            "",
 		Additional:     "",
 		Currency:       []uint32{643},
@@ -1016,7 +921,7 @@ func TestCashpointCreateWrongCoordinates(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
-	if !checkHttpCode(t, response.Code, http.StatusInternalServerError) {
+	if !checkHttpCode(t, response.Code, http.StatusBadRequest) {
 		// cashpoint created for some reason
 		if response.Code == http.StatusOK {
 			var cashpointId uint64 = 0
@@ -1034,10 +939,7 @@ func TestCashpointCreateWrongCoordinates(t *testing.T) {
 }
 
 func TestCashpointCreateMissingRequredFields(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -1058,7 +960,7 @@ func TestCashpointCreateMissingRequredFields(t *testing.T) {
 	defer checkQuadTreeBranch(t, func() ([]byte, error) { return getQuadTreeBranch(t, hCtx, longitude, latitude) }, quadTreeBranch)
 
 	// creating real cashpoint with missing required fields
-	cp := CashpointShort{
+	cp := models.CashpointData{
 		Longitude:      longitude,
 		Latitude:       latitude,
 		Type:           "atm",
@@ -1072,7 +974,7 @@ func TestCashpointCreateMissingRequredFields(t *testing.T) {
 		WithoutWeekend: true,
 		// 		RoundTheClock: false, // WARNING: here is missing field
 		WorksAsShop: false,
-		Schedule:    Schedule{},
+		Schedule:    models.Schedule{},
 		Tel:         "",
 		Additional:  "",
 		Currency:    []uint32{643},
@@ -1108,7 +1010,7 @@ func TestCashpointCreateMissingRequredFields(t *testing.T) {
 	if err != nil {
 		t.Errorf("%v", err)
 	}
-	if !checkHttpCode(t, response.Code, http.StatusInternalServerError) {
+	if !checkHttpCode(t, response.Code, http.StatusBadRequest) {
 		// cashpoint created for some reason
 		if response.Code == http.StatusOK {
 			var cashpointId uint64 = 0
@@ -1126,10 +1028,7 @@ func TestCashpointCreateMissingRequredFields(t *testing.T) {
 }
 
 func TestCashpointCreateApproveHack(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -1150,7 +1049,7 @@ func TestCashpointCreateApproveHack(t *testing.T) {
 	defer checkQuadTreeBranch(t, func() ([]byte, error) { return getQuadTreeBranch(t, hCtx, longitude, latitude) }, quadTreeBranch)
 
 	// creating real cashpoint with missing required fields
-	cp := CashpointShort{
+	cp := models.CashpointData{
 		Longitude:      longitude,
 		Latitude:       latitude,
 		Type:           "atm",
@@ -1164,7 +1063,7 @@ func TestCashpointCreateApproveHack(t *testing.T) {
 		WithoutWeekend: true,
 		//RoundTheClock: false, // WARNING: here is missing field
 		WorksAsShop: false,
-		Schedule:    Schedule{},
+		Schedule:    models.Schedule{},
 		Tel:         "",
 		Additional:  "",
 		Currency:    []uint32{643},
@@ -1201,7 +1100,7 @@ func TestCashpointCreateApproveHack(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 	// expecting validation failure
-	if !checkHttpCode(t, response.Code, http.StatusInternalServerError) {
+	if !checkHttpCode(t, response.Code, http.StatusBadRequest) {
 		// cashpoint created for some reason
 		if response.Code == http.StatusOK {
 			var cashpointId uint64 = 0
@@ -1221,10 +1120,7 @@ func TestCashpointCreateApproveHack(t *testing.T) {
 // =====================================================
 
 func TestCashpointEdit(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	// check metrics before and after test
@@ -1274,11 +1170,11 @@ func TestCashpointEdit(t *testing.T) {
 	}
 	checkHttpCode(t, response.Code, http.StatusOK)
 
-	sDay := &ScheduleDay{
+	sDay := &models.ScheduleDay{
 		From: 540,  // 09:00
 		To:   1260, // 21:00
 	}
-	cp := CashpointShort{
+	cp := models.CashpointData{
 		Id:             cpId,
 		Longitude:      48.049293518066,
 		Latitude:       46.369739532471,
@@ -1294,13 +1190,13 @@ func TestCashpointEdit(t *testing.T) {
 		RoundTheClock:  false,
 		WorksAsShop:    false,
 		// 		Schedule:       "пн.—пт.: 09:00—21:00,сб.: 10:00—17:00",
-		Schedule: Schedule{
+		Schedule: models.Schedule{
 			Mon: sDay,
 			Tue: sDay,
 			Wed: sDay,
 			Thu: sDay,
 			Fri: sDay,
-			Sat: &ScheduleDay{
+			Sat: &models.ScheduleDay{
 				From: 600,  // 10:00
 				To:   1020, // 17:00
 			},
@@ -1310,8 +1206,8 @@ func TestCashpointEdit(t *testing.T) {
 		Currency:   []uint32{643},
 		CashIn:     false,
 	}
-	cpFull := CashpointFull{
-		CashpointShort: cp,
+	cpFull := models.Cashpoint{
+		CashpointData: cp,
 		Version:        0,
 		Approved:       true,
 		PatchCount:     1,
@@ -1334,7 +1230,7 @@ func TestCashpointEdit(t *testing.T) {
 	}
 	checkHttpCode(t, response.Code, http.StatusOK)
 
-	var metrics_ SpaceMetrics
+	var metrics_ models.SpaceMetrics
 	err = json.Unmarshal(metrics, &metrics_)
 	if err != nil {
 		t.Errorf("%v", err)
@@ -1349,7 +1245,8 @@ func TestCashpointEdit(t *testing.T) {
 	response, err = readResponse(testRequest(requestEdit, handlerEdit))
 	checkHttpCode(t, response.Code, http.StatusInternalServerError)
 
-	_, err = hCtx.Tnt().Eval("box.space.cashpoints_patches:delete{" + cpPatchId + "}", []interface{}{})
+	patchId, _ := strconv.ParseUint(cpPatchId, 10, 64)
+	_, err = hCtx.Tnt().Call("_deleteCashpointPatchById", []interface{}{patchId})
 	if err != nil {
 		t.Errorf("Cannot delete patch with id '1': %v", err)
 	}
@@ -1373,10 +1270,7 @@ type NearByRequest struct {
 }
 
 func TestFilterBankIdCount(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -1414,7 +1308,7 @@ func TestFilterBankIdCount(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	if !checkHttpCode(t, response.Code, http.StatusInternalServerError) {
+	if !checkHttpCode(t, response.Code, http.StatusBadRequest) {
 		// cashpoint created for some reason
 		if response.Code == http.StatusOK {
 			var cashpointId uint64 = 0
@@ -1432,10 +1326,7 @@ func TestFilterBankIdCount(t *testing.T) {
 }
 
 func TestFilterCurrency(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -1489,10 +1380,7 @@ func TestFilterCurrency(t *testing.T) {
 }
 
 func TestTimeFilter(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -1566,18 +1454,8 @@ func TestTimeFilter(t *testing.T) {
 }
 
 //Test metro
-type Metro struct {
-	StationName     string  `json:"station_name"`
-	Longitude       float64 `json:"longitude"`
-	Latitude        float64 `json:"latitude"`
-	Id              uint32  `json:"id"`
-	StationExitName string  `json:"station_exit_name"`
-	TownId          uint32  `json:"town_id"`
-	BranchId        uint32  `json:"branch_id"`
-}
-
-func getMetroTuple() Metro {
-	expected := Metro{
+func getMetroTuple() models.Metro {
+	expected := models.Metro{
 		StationName:     "Беляево",
 		Longitude:       37.526596999601,
 		Latitude:        55.643621500032,
@@ -1590,10 +1468,7 @@ func getMetroTuple() Metro {
 }
 
 func TestMetro(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -1615,10 +1490,7 @@ func TestMetro(t *testing.T) {
 }
 
 func TestMetroBatch(t *testing.T) {
-	hCtx, err := makeHandlerContext(getServerConfig())
-	if err != nil {
-		t.Fatalf("Connection to tarantool failed: %v", err)
-	}
+	hCtx := makeTestHandlerContext(t)
 	defer hCtx.Close()
 
 	metrics, err := getSpaceMetrics(hCtx)
@@ -1648,3 +1520,772 @@ func TestMetroBatch(t *testing.T) {
 	expectedResponse := "[" + string(expectedTuple) + "]"
 	checkJsonResponse(t, response.Data, []byte(expectedResponse))
 }
+
+func TestTile(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	metrics, err := getSpaceMetrics(hCtx)
+	if err != nil {
+		t.Errorf("Failed to get space metric on start: %v", err)
+	}
+	defer checkSpaceMetrics(t, func() ([]byte, error) { return getSpaceMetrics(hCtx) }, metrics)
+
+	url, handler := handlerTile(hCtx)
+
+	// Moscow center
+	for _, endpoint := range []string{"/tiles/5/19/10.mvt", "/tiles/10/619/320.mvt", "/tiles/16/39616/20486.mvt?bank_id=322,325"} {
+		request := TestRequest{RequestType: "GET", EndpointUrl: endpoint, HandlerUrl: url}
+		w := testRequest(request, handler)
+		response, err := readResponse(w)
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		if checkHttpCode(t, response.Code, http.StatusOK) {
+			if contentType := w.Header().Get("Content-Type"); contentType != TILE_CONTENT_TYPE {
+				t.Errorf("%s: unexpected content type: %s", endpoint, contentType)
+			}
+		}
+	}
+
+	for _, endpoint := range []string{"/tiles/2/4/0.mvt", "/tiles/10/619/320.mvt?bank_id=abc", "/tiles/10/619/320.mvt?unknown=1"} {
+		request := TestRequest{RequestType: "GET", EndpointUrl: endpoint, HandlerUrl: url}
+		response, err := readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		checkHttpCode(t, response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTileFilter(t *testing.T) {
+	query, _ := url.ParseQuery("bank_id=322,325&bank_id=326&type=atm&round_the_clock=true&time=600")
+	filter, err := getTileFilter(query)
+	if err != nil {
+		t.Fatalf("Failed to parse tile filter: %v", err)
+	}
+	filterJson, _ := json.Marshal(filter)
+	checkJsonResponse(t, filterJson, []byte(`{"bank_id":[322,325,326],"type":"atm","round_the_clock":true,"schedule":{"time":600,"delta":0}}`))
+
+	for _, q := range []string{"bank_id=x", "free_access=maybe", "delta=10", "radius=5"} {
+		query, _ = url.ParseQuery(q)
+		if _, err = getTileFilter(query); err == nil {
+			t.Errorf("Expected error for tile filter query: %s", q)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerSync(hCtx)
+
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/sync?since=0&town_id=4&limit=10", HandlerUrl: url}
+	response, err := readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		var changes SyncChangesResponse
+		if err = json.Unmarshal(response.Data, &changes); err != nil {
+			t.Fatalf("Cannot decode sync response: %v", err)
+		}
+		if !changes.More {
+			t.Errorf("Expected more changes after first page of full sync")
+		}
+		if _, err = parseSyncCursor(changes.Next); err != nil {
+			t.Errorf("Unexpected next cursor: %v", err)
+		}
+	}
+
+	for _, endpoint := range []string{"/sync?since=abc", "/sync?since=1:unknown:1", "/sync?limit=0", "/sync?town_id=-1", "/sync?foo=bar"} {
+		request := TestRequest{RequestType: "GET", EndpointUrl: endpoint, HandlerUrl: url}
+		response, err := readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		checkHttpCode(t, response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestSyncCursor(t *testing.T) {
+	for _, s := range []string{"0", "1466000000000000", "1466000000000000:cashpoint:42", "1:metro:7"} {
+		cursor, err := parseSyncCursor(s)
+		if err != nil {
+			t.Errorf("Failed to parse sync cursor %s: %v", s, err)
+			continue
+		}
+		if cursor.String() != s {
+			t.Errorf("Expected cursor %s but got %s", s, cursor.String())
+		}
+	}
+
+	for _, s := range []string{"", "-1", "1:cashpoint", "1:user:2", "1:bank:x"} {
+		if _, err := parseSyncCursor(s); err == nil {
+			t.Errorf("Expected error for sync cursor: %s", s)
+		}
+	}
+
+	query, _ := url.ParseQuery("since=5:bank:3&town_id=4")
+	req, err := getSyncChangesRequest(query)
+	if err != nil {
+		t.Fatalf("Failed to parse sync request: %v", err)
+	}
+	reqJson, _ := json.Marshal(req)
+	checkJsonResponse(t, reqJson, []byte(`{"since":{"timestamp":5,"kind":"bank","id":3},"town_id":4,"limit":500}`))
+}
+
+func TestTownBundle(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerTownBundle(hCtx, *getServerConfig())
+
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/bundle/town/4", HandlerUrl: url}
+	w := testRequest(request, handler)
+	response, err := readResponse(w)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		if contentType := w.Header().Get("Content-Type"); contentType != BUNDLE_CONTENT_TYPE {
+			t.Errorf("Unexpected content type: %s", contentType)
+		}
+		if !strings.HasPrefix(string(response.Data), "SQLite format 3") {
+			t.Errorf("Expected sqlite database in response")
+		}
+
+		etag := w.Header().Get("ETag")
+		request.Headers = map[string]string{"If-None-Match": etag}
+		response, err = readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		checkHttpCode(t, response.Code, http.StatusNotModified)
+	}
+
+	request = TestRequest{RequestType: "GET", EndpointUrl: "/bundle/town/999999", HandlerUrl: url}
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusNotFound)
+}
+
+func TestExport(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerExport(hCtx)
+
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/admin/export?town_id=4&type=atm&format=geojson", HandlerUrl: url}
+	w := testRequest(request, handler)
+	response, err := readResponse(w)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/geo+json" {
+			t.Errorf("Unexpected content type: %s", contentType)
+		}
+		collection := struct {
+			Features []struct {
+				Properties map[string]interface{}
+			}
+		}{}
+		if err = json.Unmarshal(response.Data, &collection); err != nil {
+			t.Fatalf("Cannot decode export: %v", err)
+		}
+		if len(collection.Features) == 0 {
+			t.Errorf("Expected cashpoints of town 4 in export")
+		}
+		for _, f := range collection.Features {
+			if f.Properties["type"] != "atm" || f.Properties["town_id"] != float64(4) || f.Properties["town_name"] == "" {
+				t.Errorf("Unexpected cashpoint in export: %v", f.Properties)
+				break
+			}
+		}
+		trailer := w.Result().Trailer
+		if trailer.Get(export.STATUS_TRAILER) != export.STATUS_COMPLETE ||
+			trailer.Get(export.COUNT_TRAILER) != strconv.Itoa(len(collection.Features)) {
+			t.Errorf("Unexpected export trailer: %v", trailer)
+		}
+	}
+
+	request = TestRequest{RequestType: "GET", EndpointUrl: "/admin/export?format=xls", HandlerUrl: url}
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusBadRequest)
+
+	request = TestRequest{RequestType: "GET", EndpointUrl: "/admin/export?town_id=999999", HandlerUrl: url}
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusNotFound)
+}
+
+func TestTownLocalized(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerTown(hCtx)
+	request := TestRequest{
+		RequestType: "GET",
+		EndpointUrl: "/town/4",
+		HandlerUrl:  url,
+		Headers:     map[string]string{"Accept-Language": "en-US,en;q=0.8"},
+	}
+	w := testRequest(request, handler)
+	response, err := readResponse(w)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		if lang := w.Header().Get("Content-Language"); lang != "en" {
+			t.Errorf("Expected Content-Language en but got %s", lang)
+		}
+		town := models.Town{}
+		json.Unmarshal(response.Data, &town)
+		if town.Name != "Moskva" || town.NameTr != "Moskva" {
+			t.Errorf("Expected transliterated town name but got %s", town.Name)
+		}
+	}
+
+	request.EndpointUrl = "/town/999999"
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusNotFound) {
+		msg := Message{}
+		json.Unmarshal(response.Data, &msg)
+		if msg.Text != MSG_NO_SUCH_TOWN+": 999999" {
+			t.Errorf("Unexpected error message: %s", msg.Text)
+		}
+	}
+}
+
+func TestErrorLocalized(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerTown(hCtx)
+	request := TestRequest{
+		RequestType: "GET",
+		EndpointUrl: "/town/999999",
+		HandlerUrl:  url,
+		Headers:     map[string]string{"Accept-Language": "ru"},
+	}
+	w := testRequest(request, handler)
+	response, err := readResponse(w)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusNotFound) {
+		if lang := w.Header().Get("Content-Language"); lang != "ru" {
+			t.Errorf("Expected Content-Language ru but got %s", lang)
+		}
+		msg := Message{}
+		json.Unmarshal(response.Data, &msg)
+		if msg.Text != "Не найден город с идентификатором: 999999" {
+			t.Errorf("Unexpected error message: %s", msg.Text)
+		}
+	}
+}
+
+func TestMessagesTranslated(t *testing.T) {
+	keys := []string{
+		MSG_MALFORMED_REQUEST, MSG_INVALID_PARAM, MSG_NO_SUCH_CASHPOINT, MSG_NO_SUCH_TOWN,
+		MSG_NO_SUCH_BANK, MSG_NO_SUCH_METRO, MSG_NO_SUCH_REGION, MSG_NO_SUCH_BANK_ICO,
+		MSG_REQUEST_TOO_LARGE, MSG_UNAUTHORIZED, MSG_FORBIDDEN, MSG_CONFLICT,
+
+		MSG_MISSING_FIELD, MSG_UNKNOWN_FIELD, MSG_WRONG_TYPE, MSG_EXPECTED_IDS,
+		MSG_EXPECTED_OBJECT, MSG_EXPECTED_INTEGER, MSG_OUT_OF_RANGE, MSG_MUST_NOT_BE_EMPTY,
+		MSG_MALFORMED_JSON, MSG_EMPTY_REQUEST, MSG_TRAILING_DATA, MSG_UNSUPPORTED_CURRENCY,
+		MSG_UNKNOWN_CP_TYPE, MSG_TOO_MANY_BANKS, MSG_TOO_MANY_PARTNERS, MSG_TOO_BIG_REGION,
+		MSG_EMPTY_REGION, MSG_TOO_BIG_BATCH, MSG_MALFORMED_CURSOR, MSG_CURSOR_MISMATCH,
+		MSG_UNSUPPORTED_SORT, MSG_UNKNOWN_LIST_FIELD, MSG_UNSUPPORTED_PARAM,
+	}
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for _, key := range keys {
+		text := models.Message(key, DEFAULT_LANG)
+		if text == "" {
+			t.Errorf("No %s translation of message '%s'", DEFAULT_LANG, key)
+			continue
+		}
+		// details are formatted with args after translation
+		if !reflect.DeepEqual(verbs.FindAllString(text, -1), verbs.FindAllString(key, -1)) {
+			t.Errorf("Translation '%s' does not match format of message '%s'", text, key)
+		}
+	}
+}
+
+func TestRequestParamsErrorLocalized(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerNearbyClusters(hCtx)
+	body := `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"zoom":40}`
+	expected := map[string]string{
+		"ru": "Недопустимый параметр запроса: zoom: вне диапазона [0, 22]",
+		"en": "Invalid request parameter: zoom: out of range [0, 22]",
+	}
+	for lang, text := range expected {
+		request := TestRequest{
+			RequestType: "POST",
+			EndpointUrl: "/nearby/clusters",
+			HandlerUrl:  url,
+			Headers:     map[string]string{"Accept-Language": lang},
+			Data:        body,
+		}
+		response, err := readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		if checkHttpCode(t, response.Code, http.StatusBadRequest) {
+			msg := Message{}
+			json.Unmarshal(response.Data, &msg)
+			if msg.Text != text {
+				t.Errorf("Expected %s error message '%s' but got '%s'", lang, text, msg.Text)
+			}
+		}
+	}
+}
+
+func TestNegotiateLang(t *testing.T) {
+	cases := map[string]string{
+		"":                           "ru",
+		"en":                         "en",
+		"en-US,en;q=0.8,ru;q=0.6":    "en",
+		"de-DE, ru;q=0.5, en;q=0.7":  "en",
+		"ru-RU,ru;q=0.9,en-US;q=0.8": "ru",
+		"en;q=0, ru;q=0.1":           "ru",
+		"fr, de":                     "ru",
+		"EN_gb;q=0.9, *;q=0.1":       "en",
+	}
+	for header, expected := range cases {
+		if lang := negotiateLang(header); lang != expected {
+			t.Errorf("Expected %s for Accept-Language '%s' but got %s", expected, header, lang)
+		}
+	}
+}
+
+func TestLocalizeJson(t *testing.T) {
+	reply := `{"towns":[{"id":4,"name":"Москва","name_tr":"Moskva"}],` +
+		`"banks":[{"id":322,"name":"Сбербанк России","name_tr":"","rating":12345678901}],` +
+		`"metro":[{"id":1,"station_name":"Охотный Ряд","station_exit_name":""}]}`
+
+	result, err := localizeJson(reply, "ru")
+	if err != nil || result != reply {
+		t.Errorf("Expected reply as is for default language but got %s (%v)", result, err)
+	}
+
+	result, err = localizeJson(reply, "en")
+	if err != nil {
+		t.Fatalf("localizeJson failed: %v", err)
+	}
+	checkJsonResponse(t, []byte(result), []byte(`{"towns":[{"id":4,"name":"Moskva","name_tr":"Moskva"}],`+
+		`"banks":[{"id":322,"name":"Сбербанк России","name_tr":"","rating":12345678901}],`+
+		`"metro":[{"id":1,"station_name":"Okhotnyy Ryad","station_exit_name":""}]}`))
+	if !strings.Contains(result, "12345678901") {
+		t.Errorf("Expected numbers to be kept as is: %s", result)
+	}
+}
+
+func TestRequestParams(t *testing.T) {
+	cases := []struct {
+		params RequestParams
+		body   string
+		field  string // expected error field, "-" means no error
+	}{
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"filter":{"bank_id":[322],"approved":true,"schedule":{"time":1,"delta":60}}}`, "-"},
+		{&NearbyCashpointsParams{}, ``, ""},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7}`, ""},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7}}`, "bottomRight"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6},"bottomRight":{"longitude":37.61,"latitude":55.69}}`, "topLeft.latitude"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":95.7},"bottomRight":{"longitude":37.61,"latitude":55.69}}`, "topLeft.latitude"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":"37.6","latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69}}`, "topLeft.longitude"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.7,"latitude":55.69}}`, "bottomRight.longitude"},
+		// payload of client (cashpointinradius.cpp)
+		{&NearbyCashpointsParams{}, `{"longitude":37.605,"latitude":55.695,"radius":500.5,"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"filter":{"bank_id":[322]}}`, "-"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"radius":"5"}`, "radius"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"distance":5}`, "distance"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"filter":{"type":"bar"}}`, "filter.type"},
+		{&NearbyCashpointsParams{}, `{"topLeft":{"longitude":37.6,"latitude":55.7},"bottomRight":{"longitude":37.61,"latitude":55.69},"filter":{"currency":[100]}}`, "filter.currency"},
+		{&NearbyClustersParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"zoom":10}`, "-"},
+		// payload of client (nearbyclusters.cpp)
+		{&NearbyClustersParams{}, `{"longitude":37.5,"latitude":55.5,"radius":60000,"zoom":10,"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55}}`, "-"},
+		{&NearbyClustersParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"zoom":10,"filter":{"partner_of":322}}`, "-"},
+		{&NearbyClustersParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"zoom":10,"filter":{"partner_of":"322"}}`, "filter.partner_of"},
+		{&NearbyClustersParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55}}`, "zoom"},
+		{&NearbyClustersParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"zoom":40}`, "zoom"},
+		{&QuadKeyParams{}, `{"longitude":56.6,"latitude":34.84,"zoom":16}`, "-"},
+		{&QuadKeyParams{}, `{"longitude":56.6}`, "latitude"},
+		{&HeatmapParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"cols":64,"rows":64,"filter":{"type":"atm"}}`, "-"},
+		{&HeatmapParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"cols":64}`, "rows"},
+		{&HeatmapParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":38,"latitude":55},"cols":1000,"rows":64}`, "cols"},
+		{&HeatmapParams{}, `{"topLeft":{"longitude":37,"latitude":56},"bottomRight":{"longitude":37,"latitude":55},"cols":64,"rows":64}`, "bottomRight"},
+		{newBatchParams("towns", 2), `{"towns":[1,2]}`, "-"},
+		{newBatchParams("towns", 2), `{"towns":[1,2,3]}`, "towns"},
+		{newBatchParams("towns", 2), `{"towns":["1"]}`, "towns"},
+		{newBatchParams("towns", 2), `{"banks":[1]}`, "banks"},
+		{newBatchParams("towns", 2), `{}`, "towns"},
+		{&CashpointPatchParams{}, `{"user_id":0,"data":{"id":5,"address":"Тверская, 1"}}`, "-"},
+		{&CashpointPatchParams{}, `{"user_id":0,"data":{"id":5,"longitude":37.6}}`, "data.latitude"},
+		{&CashpointPatchParams{}, `{"user_id":0,"data":{"address":"Тверская, 1"}}`, "data.type"},
+		{&CashpointPatchParams{}, `{"data":{"id":5}}`, "user_id"},
+		{&CashpointPatchParams{}, `{"user_id":0,"data":{"id":5,"schedule":[]}}`, "data.schedule"},
+		{&CashpointPatchParams{}, `{"user_id":0,"data":{"id":5,"approved":true}}`, "approved"},
+		{&BankAdminParams{create: true}, `{"name":"Тестбанк","partners":[322]}`, "-"},
+		{&BankAdminParams{create: true}, `{"tel":"8 800"}`, "name"},
+		{&BankAdminParams{}, `{"tel":"8 800"}`, "-"},
+		{&BankAdminParams{}, `{"name":" "}`, "name"},
+		{&TownAdminParams{create: true}, `{"name":"Тестгород","longitude":37.6}`, "latitude"},
+		{&TownAdminParams{}, `{"zoom":40}`, "zoom"},
+		{&RegionAdminParams{create: true}, `{"name":"Тестобласть","longitude":37.6,"latitude":55.7}`, "-"},
+		{&MetroAdminParams{create: true}, `{"station_name":"Тестовая","longitude":37.6,"latitude":55.7}`, "town_id"},
+		{&MetroAdminParams{}, `{"town_id":4,"branch":1}`, "branch"},
+	}
+
+	for _, c := range cases {
+		err := decodeRequestParams([]byte(c.body), c.params)
+		if c.field == "-" {
+			if err != nil {
+				t.Errorf("Unexpected error %v for request %s", err, c.body)
+			}
+			continue
+		}
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Errorf("Expected validation error for request %s but got %v", c.body, err)
+		} else if validationErr.Field != c.field {
+			t.Errorf("Expected error of field '%s' but got '%v' for request %s", c.field, err, c.body)
+		}
+	}
+}
+
+func TestListRequest(t *testing.T) {
+	query, _ := url.ParseQuery("limit=2&sort=-population&fields=id,name")
+	req, err := getListRequest(query, TOWNS_LIST_SPEC, "en")
+	if err != nil {
+		t.Fatalf("Failed to parse list request: %v", err)
+	}
+	reqJson, _ := json.Marshal(req)
+	checkJsonResponse(t, reqJson, []byte(`{"limit":2,"sort":"population","desc":true,"fields":["id","name","name_tr"]}`))
+
+	cursor := &ListCursor{Sort: "-population", Value: 12000000.0, Id: 4}
+	query.Set("after", cursor.String())
+	req, err = getListRequest(query, TOWNS_LIST_SPEC, "ru")
+	if err != nil {
+		t.Fatalf("Failed to parse list request with cursor: %v", err)
+	}
+	reqJson, _ = json.Marshal(req.After)
+	checkJsonResponse(t, reqJson, []byte(`{"value":12000000,"id":4}`))
+
+	query.Set("sort", "name")
+	if _, err = getListRequest(query, TOWNS_LIST_SPEC, "ru"); err == nil {
+		t.Errorf("Expected error for cursor of other sort order")
+	}
+
+	for _, q := range []string{"limit=0", "limit=1001", "sort=rating", "fields=id,tel", "after=xyz", "page=2"} {
+		query, _ = url.ParseQuery(q)
+		if _, err = getListRequest(query, TOWNS_LIST_SPEC, "ru"); err == nil {
+			t.Errorf("Expected error for list query: %s", q)
+		}
+	}
+
+	query, _ = url.ParseQuery("sort=name")
+	req, err = getListRequest(query, BANKS_LIST_SPEC, "en")
+	if err != nil || req.Sort != "name_tr" {
+		t.Errorf("Expected sort by name_tr for english but got %v (%v)", req, err)
+	}
+}
+
+func TestBatchMissingHeader(t *testing.T) {
+	params := newBatchParams("towns", MAX_TOWNS_BATCH)
+	params.Ids = []uint32{4, 5, 999, 5, 1000}
+	w := httptest.NewRecorder()
+	setBatchMissingHeader(w, params, `[{"id":4,"name":"Москва"},{"id":5}]`)
+	if missing := w.Header().Get("X-Missing-Ids"); missing != "999,1000" {
+		t.Errorf("Expected missing ids 999,1000 but got %s", missing)
+	}
+}
+
+func TestTownsListPage(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerTownsList(hCtx)
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/towns?limit=1&fields=id,name", HandlerUrl: url}
+
+	seen := make(map[uint32]bool)
+	for page := 0; page < 3; page++ {
+		response, err := readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		if !checkHttpCode(t, response.Code, http.StatusOK) {
+			return
+		}
+
+		list := struct {
+			Items []models.Town `json:"items"`
+			Next  string `json:"next"`
+			More  bool   `json:"more"`
+		}{}
+		json.Unmarshal(response.Data, &list)
+		if len(list.Items) != 1 || list.More != (list.Next != "") {
+			t.Fatalf("Unexpected towns page: %s", string(response.Data))
+		}
+		for _, town := range list.Items {
+			if seen[town.Id] {
+				t.Errorf("Town %d is returned twice", town.Id)
+			}
+			if town.Name == "" || town.Zoom != 0 {
+				t.Errorf("Unexpected town projection: %+v", town)
+			}
+			seen[town.Id] = true
+		}
+		if !list.More {
+			break
+		}
+		request.EndpointUrl = "/towns?limit=1&fields=id,name&after=" + list.Next
+	}
+	if len(seen) < 2 {
+		t.Errorf("Expected several pages of towns but got %d towns", len(seen))
+	}
+}
+
+func TestBankPartners(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerBankPartners(hCtx)
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/bank/322/partners", HandlerUrl: url}
+
+	response, err := readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		var partners []map[string]interface{}
+		if err = json.Unmarshal(response.Data, &partners); err != nil {
+			t.Errorf("Cannot decode bank partners: %v => %s", err, string(response.Data))
+		}
+	}
+
+	request.EndpointUrl = "/bank/999999/partners"
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusNotFound)
+}
+
+func TestStats(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerTownStats(hCtx)
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/stats/town/4", HandlerUrl: url}
+
+	response, err := readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		stats := struct {
+			Scope           string `json:"scope"`
+			Id              uint32 `json:"id"`
+			CashpointsCount uint32 `json:"cashpoints_count"`
+			ByBank          []struct {
+				BankId uint32 `json:"bank_id"`
+				Count  uint32 `json:"count"`
+			} `json:"by_bank"`
+		}{}
+		if err = json.Unmarshal(response.Data, &stats); err != nil {
+			t.Errorf("Cannot decode town stats: %v => %s", err, string(response.Data))
+		}
+		if stats.Scope != "town" || stats.Id != 4 || stats.CashpointsCount == 0 {
+			t.Errorf("Unexpected Moscow stats: %s", string(response.Data))
+		}
+		var sum uint32 = 0
+		for _, bank := range stats.ByBank {
+			sum += bank.Count
+		}
+		if sum != stats.CashpointsCount {
+			t.Errorf("Sum of cashpoints by bank %d does not match cashpoints count %d", sum, stats.CashpointsCount)
+		}
+	}
+
+	url, handler = handlerRegionStats(hCtx)
+	request = TestRequest{RequestType: "GET", EndpointUrl: "/stats/region/999999", HandlerUrl: url}
+	response, err = readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusNotFound)
+}
+
+func TestHeatmap(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	url, handler := handlerHeatmap(hCtx)
+	// Moscow: coarse grid is built of clusters, fine one of cashpoints,
+	// 16 and 32 cols grids are on the boundary of the finest clusters
+	for _, cols := range []uint32{8, 16, 32, 256} {
+		reqJson := fmt.Sprintf(`{"topLeft":{"longitude":37.3,"latitude":55.95},"bottomRight":{"longitude":37.9,"latitude":55.55},"cols":%d,"rows":8}`, cols)
+		request := TestRequest{RequestType: "POST", EndpointUrl: url, Data: reqJson}
+
+		response, err := readResponse(testRequest(request, handler))
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		if !checkHttpCode(t, response.Code, http.StatusOK) {
+			continue
+		}
+
+		heatmap := struct {
+			Zoom  *uint32 `json:"zoom"`
+			Cells []struct {
+				Col   uint32 `json:"col"`
+				Row   uint32 `json:"row"`
+				Count uint32 `json:"count"`
+			} `json:"cells"`
+		}{}
+		if err = json.Unmarshal(response.Data, &heatmap); err != nil {
+			t.Errorf("Cannot decode heatmap: %v => %s", err, string(response.Data))
+		}
+		if len(heatmap.Cells) == 0 {
+			t.Errorf("Empty heatmap of Moscow for %d cols", cols)
+		}
+		if heatmap.Zoom != nil && *heatmap.Zoom >= quadkey.CLUSTER_ZOOM_MAX {
+			t.Errorf("Heatmap of %d cols uses clusters of zoom %d out of clusters space", cols, *heatmap.Zoom)
+		}
+		for _, cell := range heatmap.Cells {
+			if cell.Col >= cols || cell.Row >= 8 || cell.Count == 0 {
+				t.Errorf("Unexpected heatmap cell: %+v", cell)
+			}
+		}
+	}
+}
+
+func TestCheckPermission(t *testing.T) {
+	conf := ServerConfig{ApiKeys: []ApiKey{
+		{Key: "admin-key", Name: "admin", Role: ROLE_ADMIN},
+		{Key: "monitoring-key", Name: "monitoring", Role: ROLE_SERVICE},
+	}}
+
+	cases := []struct {
+		header     string
+		value      string
+		permission string
+		testing    bool
+		code       int
+	}{
+		{"", "", PERM_DEBUG, false, http.StatusUnauthorized},
+		{"", "", PERM_DEBUG, true, http.StatusOK},
+		{"", "", PERM_EDIT_REFERENCE, true, http.StatusUnauthorized},
+		{"Authorization", "Bearer wrong-key", PERM_VIEW_METRICS, false, http.StatusUnauthorized},
+		{"Authorization", "Basic admin-key", PERM_VIEW_METRICS, false, http.StatusUnauthorized},
+		{"Authorization", "Bearer admin-key", PERM_EDIT_REFERENCE, false, http.StatusOK},
+		{"X-Api-Key", "monitoring-key", PERM_VIEW_METRICS, false, http.StatusOK},
+		{"X-Api-Key", "monitoring-key", PERM_DELETE_CASHPOINT, false, http.StatusForbidden},
+		{"X-Api-Key", "monitoring-key", PERM_DELETE_CASHPOINT, true, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		r, _ := http.NewRequest("GET", "/metrics/space", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		conf.TestingMode = c.testing
+		code, _ := checkPermission(conf, r, c.permission)
+		if code != c.code {
+			t.Errorf("Expected %d but got %d for %s: %s (%s, testing mode %v)", c.code, code, c.header, c.value, c.permission, c.testing)
+		}
+	}
+}
+
+func TestValidateApiKeys(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "admin-key", Name: "admin", Role: ROLE_ADMIN},
+		{Key: "monitoring-key", Name: "monitoring", Role: ROLE_SERVICE},
+	}
+	if err := validateApiKeys(keys); err != nil {
+		t.Errorf("Expected keys to be valid but got: %v", err)
+	}
+
+	for _, role := range []string{"", "Admin", "superuser"} {
+		invalid := append([]ApiKey{}, keys...)
+		invalid = append(invalid, ApiKey{Key: "key", Name: "test", Role: role})
+		if err := validateApiKeys(invalid); err == nil {
+			t.Errorf("Expected key with role '%s' to be invalid", role)
+		}
+	}
+}
+
+func TestAdminBank(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+
+	conf := ServerConfig{ApiKeys: []ApiKey{{Key: "secret", Name: "test", Role: ROLE_ADMIN}}}
+	requireEditReference := requirePermission(hCtx, conf, PERM_EDIT_REFERENCE)
+	kind := ADMIN_KINDS[0]
+	headers := map[string]string{"Authorization": "Bearer secret"}
+
+	url, handlerCreate := requireEditReference(handlerAdminCreate(hCtx, kind))
+	request := TestRequest{RequestType: "POST", EndpointUrl: url, Data: `{"name":"Тестбанк","partners":[322]}`}
+	response, err := readResponse(testRequest(request, handlerCreate))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusUnauthorized)
+
+	request.Headers = headers
+	response, err = readResponse(testRequest(request, handlerCreate))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	if !checkHttpCode(t, response.Code, http.StatusCreated) {
+		return
+	}
+	var created AdminResponse
+	json.Unmarshal(response.Data, &created)
+	bankIdStr := strconv.FormatUint(uint64(created.Id), 10)
+
+	url, handlerUpdate := requireEditReference(handlerAdminUpdate(hCtx, kind))
+	request = TestRequest{RequestType: "PUT", EndpointUrl: "/admin/bank/" + bankIdStr, HandlerUrl: url, Data: `{"tel":"8 800 000-00-00"}`, Headers: headers}
+	response, err = readResponse(testRequest(request, handlerUpdate))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusOK)
+
+	url, handlerDelete := requireEditReference(handlerAdminDelete(hCtx, kind))
+	// Sberbank has cashpoints
+	request = TestRequest{RequestType: "DELETE", EndpointUrl: "/admin/bank/322", HandlerUrl: url, Headers: headers}
+	response, err = readResponse(testRequest(request, handlerDelete))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusConflict)
+
+	request.EndpointUrl = "/admin/bank/" + bankIdStr
+	response, err = readResponse(testRequest(request, handlerDelete))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusOK)
+
+	response, err = readResponse(testRequest(request, handlerDelete))
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	checkHttpCode(t, response.Code, http.StatusNotFound)
+}
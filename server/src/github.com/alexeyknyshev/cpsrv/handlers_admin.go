@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Admin endpoints edit reference data (banks, towns, regions, metro).
+// Routes require PERM_EDIT_REFERENCE (see access.go).
+
+// Reference data kind editable by admins
+type AdminKind struct {
+	Name        string
+	NotFoundMsg string
+	NewParams   func(create bool) RequestParams
+}
+
+var ADMIN_KINDS = []AdminKind{
+	{"bank", MSG_NO_SUCH_BANK, func(create bool) RequestParams { return &BankAdminParams{create: create} }},
+	{"town", MSG_NO_SUCH_TOWN, func(create bool) RequestParams { return &TownAdminParams{create: create} }},
+	{"region", MSG_NO_SUCH_REGION, func(create bool) RequestParams { return &RegionAdminParams{create: create} }},
+	{"metro", MSG_NO_SUCH_METRO, func(create bool) RequestParams { return &MetroAdminParams{create: create} }},
+}
+
+// Errors of tarantool admin api
+const (
+	ADMIN_ERR_INVALID   = "invalid"
+	ADMIN_ERR_NOT_FOUND = "not_found"
+	ADMIN_ERR_CONFLICT  = "conflict"
+)
+
+type AdminReply struct {
+	Id      uint32 `json:"id"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+type AdminResponse struct {
+	Id uint32 `json:"id"`
+}
+
+func writeAdminReply(handlerContext HandlerContext, w http.ResponseWriter, r *http.Request, requestId int64, kind AdminKind, idStr string, successCode int, reply *AdminReply) {
+	logger := handlerContext.Logger()
+	switch reply.Error {
+	case "":
+		jsonByteArr, _ := json.Marshal(&AdminResponse{Id: reply.Id})
+		w.WriteHeader(successCode)
+		writeResponse(w, r, requestId, string(jsonByteArr), logger)
+	case ADMIN_ERR_INVALID:
+		writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, reply.Message)
+	case ADMIN_ERR_NOT_FOUND:
+		writeError(handlerContext, w, r, requestId, http.StatusNotFound, kind.NotFoundMsg, idStr)
+	case ADMIN_ERR_CONFLICT:
+		writeError(handlerContext, w, r, requestId, http.StatusConflict, MSG_CONFLICT, reply.Message)
+	default:
+		log.Printf("%s => unexpected admin reply error: %s\n", getRequestContexString(r), reply.Error)
+		writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+	}
+}
+
+func handlerAdminCreate(handlerContext HandlerContext, kind AdminKind) (string, EndpointCallback) {
+	return "/admin/" + kind.Name, func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerAdminCreate", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"kind":      kind.Name,
+		})
+
+		jsonStr, err := getRequestParams(r, kind.NewParams(true))
+		logger.logRequest(w, r, requestId, jsonStr)
+		if err != nil {
+			log.Printf("%s => invalid request: %v\n", context, err)
+			writeRequestParamsError(handlerContext, w, r, requestId, err)
+			return
+		}
+
+		var reply AdminReply
+		err = callTntJsonProc(handlerContext, "adminCreate", []interface{}{kind.Name, jsonStr}, &reply)
+		if err != nil {
+			log.Printf("%s => cannot create %s: %v => %s\n", context, kind.Name, err, jsonStr)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		writeAdminReply(handlerContext, w, r, requestId, kind, "", http.StatusCreated, &reply)
+	}
+}
+
+func handlerAdminUpdate(handlerContext HandlerContext, kind AdminKind) (string, EndpointCallback) {
+	return "/admin/" + kind.Name + "/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+
+		idStr := mux.Vars(r)["id"]
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerAdminUpdate", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"kind":      kind.Name,
+			"id":        idStr,
+		})
+
+		jsonStr, err := getRequestParams(r, kind.NewParams(false))
+		logger.logRequest(w, r, requestId, jsonStr)
+		if err != nil {
+			log.Printf("%s => invalid request: %v\n", context, err)
+			writeRequestParamsError(handlerContext, w, r, requestId, err)
+			return
+		}
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "id")
+			return
+		}
+
+		var reply AdminReply
+		err = callTntJsonProc(handlerContext, "adminUpdate", []interface{}{kind.Name, id, jsonStr}, &reply)
+		if err != nil {
+			log.Printf("%s => cannot update %s: %v => %s\n", context, kind.Name, err, jsonStr)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		writeAdminReply(handlerContext, w, r, requestId, kind, idStr, http.StatusOK, &reply)
+	}
+}
+
+func handlerAdminDelete(handlerContext HandlerContext, kind AdminKind) (string, EndpointCallback) {
+	return "/admin/" + kind.Name + "/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, "")
+
+		idStr := mux.Vars(r)["id"]
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerAdminDelete", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"kind":      kind.Name,
+			"id":        idStr,
+		})
+
+		id, err := strconv.ParseUint(idStr, 10, 32)
+		if err != nil {
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "id")
+			return
+		}
+
+		var reply AdminReply
+		err = callTntJsonProc(handlerContext, "adminDelete", []interface{}{kind.Name, id}, &reply)
+		if err != nil {
+			log.Printf("%s => cannot delete %s: %v\n", context, kind.Name, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		writeAdminReply(handlerContext, w, r, requestId, kind, idStr, http.StatusOK, &reply)
+	}
+}
@@ -12,53 +12,21 @@ import (
 )
 
 func handlerBank(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/bank/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-		logger.logRequest(w, r, requestId, "")
-
-		params := mux.Vars(r)
-		bankIdStr := params["id"]
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerBank", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-			"bankId":    bankIdStr,
-		})
-
-		bankId, err := strconv.ParseUint(bankIdStr, 10, 64)
-		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		resp, err := handlerContext.Tnt().Call("getBankById", []interface{}{bankId})
-		if err != nil {
-			log.Printf("%s => cannot get bank %d by id: %v\n", context, bankId, err)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		if len(resp.Data) == 0 {
-			log.Printf("%s => no such bank with id: %d\n", context, bankId)
-			writeHeader(w, r, requestId, http.StatusNotFound, logger)
-			return
-		}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerBank", Path: "/bank/{id:[0-9]+}", Proc: "getBankById",
+		Args:        []ProcArg{varArg("id", PROC_ARG_UINT64)},
+		Localized:   true,
+		NotFoundMsg: MSG_NO_SUCH_BANK,
+	})
+}
 
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			if jsonStr != "" {
-				writeResponse(w, r, requestId, jsonStr, logger)
-			} else {
-				writeHeader(w, r, requestId, http.StatusNotFound, logger)
-			}
-		} else {
-			log.Printf("%s => cannot convert bank reply for id: %d\n", context, bankId)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+func handlerBankPartners(handlerContext HandlerContext) (string, EndpointCallback) {
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerBankPartners", Path: "/bank/{id:[0-9]+}/partners", Proc: "getBankPartners",
+		Args:        []ProcArg{varArg("id", PROC_ARG_UINT32)},
+		Localized:   true,
+		NotFoundMsg: MSG_NO_SUCH_BANK,
+	})
 }
 
 type BankIco struct {
@@ -85,7 +53,7 @@ func handlerBankIco(handlerContext HandlerContext, conf ServerConfig) (string, E
 		icoFilePath := path.Join(conf.BanksIcoDir, bankIdStr+".svg")
 
 		if _, err := os.Stat(icoFilePath); os.IsNotExist(err) {
-			writeHeader(w, r, requestId, http.StatusNotFound, logger)
+			writeError(handlerContext, w, r, requestId, http.StatusNotFound, MSG_NO_SUCH_BANK_ICO, bankIdStr)
 			return
 		}
 
@@ -106,41 +74,12 @@ func handlerBankIco(handlerContext HandlerContext, conf ServerConfig) (string, E
 }
 
 func handlerBanksBatch(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/banks", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerBanksBatch", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-		})
-
-		jsonStr, err := getRequestJsonStr(r, context)
-		if err != nil {
-			logger.logRequest(w, r, requestId, "")
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, jsonStr)
-
-		resp, err := handlerContext.Tnt().Call("getBanksBatch", []interface{}{jsonStr})
-		if err != nil {
-			log.Printf("%s => cannot get banks batch: %v => %s\n", context, err, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert banks batch reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerBanksBatch", Path: "/banks", Proc: "getBanksBatch",
+		Args:      []ProcArg{bodyArg()},
+		Params:    func() RequestParams { return newBatchParams("banks", MAX_BANKS_BATCH) },
+		Localized: true,
+	})
 }
 
 func handlerBanksList(handlerContext HandlerContext) (string, EndpointCallback) {
@@ -157,6 +96,11 @@ func handlerBanksList(handlerContext HandlerContext) (string, EndpointCallback)
 
 		logger.logRequest(w, r, requestId, "")
 
+		if r.URL.RawQuery != "" {
+			writeListPage(handlerContext, w, r, requestId, context, "getBanksPage", BANKS_LIST_SPEC)
+			return
+		}
+
 		resp, err := handlerContext.Tnt().Call("getBanksList", []interface{}{})
 		if err != nil {
 			log.Printf("%s => cannot get banks list: %v\n", context, err)
@@ -168,7 +112,7 @@ func handlerBanksList(handlerContext HandlerContext) (string, EndpointCallback)
 		if jsonStr, ok := data.(string); ok {
 			writeResponse(w, r, requestId, jsonStr, logger)
 		} else {
-			log.Printf("%s => cannot convert banks list reply to json str\n", context, jsonStr)
+			log.Printf("%s => cannot convert banks list reply to json str\n", context)
 			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
 		}
 	}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/alexeyknyshev/bundle"
+	"github.com/alexeyknyshev/models"
+	"github.com/gorilla/mux"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+const BUNDLE_CONTENT_TYPE = "application/x-sqlite3"
+
+func handlerTownBundle(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+	return "/bundle/town/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, "")
+
+		params := mux.Vars(r)
+		townIdStr := params["id"]
+
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerTownBundle", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"townId":    townIdStr,
+		})
+
+		townId, err := strconv.ParseUint(townIdStr, 10, 32)
+		if err != nil {
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "id")
+			return
+		}
+
+		extendWriteDeadline(w, LONG_WRITE_TIMEOUT, context)
+
+		dir, err := ioutil.TempDir("", "cpsrv_bundle")
+		if err != nil {
+			log.Printf("%s => cannot create temp dir: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		filePath := path.Join(dir, townIdStr+".sqlite")
+		src := models.NewRepository(handlerContext.Tnt())
+		info, err := bundle.Build(src, uint32(townId), filePath, bundle.Options{IcoDir: conf.BanksIcoDir})
+		if err == bundle.ErrNoSuchTown {
+			writeError(handlerContext, w, r, requestId, http.StatusNotFound, MSG_NO_SUCH_TOWN, townIdStr)
+			return
+		} else if err != nil {
+			log.Printf("%s => cannot build bundle: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		etag := `"` + info.Hash + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("X-Bundle-Version", strconv.Itoa(info.FormatVersion))
+		if r.Header.Get("If-None-Match") == etag {
+			writeHeader(w, r, requestId, http.StatusNotModified, logger)
+			return
+		}
+
+		file, err := os.Open(filePath)
+		if err != nil {
+			log.Printf("%s => cannot open bundle: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		defer file.Close()
+
+		w.Header().Set("Content-Type", BUNDLE_CONTENT_TYPE)
+		w.Header().Set("Content-Disposition", `attachment; filename="town_`+townIdStr+`.sqlite"`)
+		size, err := io.Copy(w, file)
+		if err != nil {
+			log.Printf("%s => cannot write bundle: %v\n", context, err)
+		}
+		logger.logResponse(w, r, requestId, strconv.FormatInt(size, 10)+" bytes, hash "+info.Hash)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/alexeyknyshev/quadkey"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
@@ -10,206 +11,39 @@ import (
 
 var MAX_CLUSTER_COUNT uint64 = 32
 
-var MIN_QUADKEY_LENGTH int = 10
-var MAX_QUADKEY_LENGTH int = 16
+var MIN_QUADKEY_LENGTH int = quadkey.CLUSTER_ZOOM_MIN
+var MAX_QUADKEY_LENGTH int = quadkey.CLUSTER_ZOOM_MAX
 
 func handlerCashpoint(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/cashpoint/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-		logger.logRequest(w, r, requestId, "")
-
-		params := mux.Vars(r)
-		cashPointIdStr := params["id"]
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerCashpoint", map[string]string{
-			"requestId":   strconv.FormatInt(requestId, 10),
-			"cashPointId": cashPointIdStr,
-		})
-
-		cashPointId, err := strconv.ParseUint(cashPointIdStr, 10, 64)
-		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-		resp, err := handlerContext.Tnt().Call("getCashpointById", []interface{}{cashPointId})
-		if err != nil {
-			log.Printf("%s => cannot get cashpoint %d by id: %v\n", context, cashPointId, err)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		if len(resp.Data) == 0 {
-			log.Printf("%s => no such cashpoint with id: %d\n", context, cashPointId)
-			writeHeader(w, r, requestId, http.StatusNotFound, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			if jsonStr != "" {
-				writeResponse(w, r, requestId, jsonStr, logger)
-			} else {
-				writeHeader(w, r, requestId, http.StatusNotFound, logger)
-			}
-		} else {
-			log.Printf("%s => cannot convert cashpoint reply for id: %d\n", context, cashPointId)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
-}
-
-func handlerCashpointsStateBatch(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/cashpoint/state", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerCashpointsStateBatch", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-		})
-
-		jsonStr, err := getRequestJsonStr(r, context)
-		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, jsonStr)
-
-		resp, err := handlerContext.Tnt().Call("getCashpointsStateBatch", []interface{}{ jsonStr })
-		if err != nil {
-			log.Printf("%s => cannot get cashpoints state batch: %v => %s\n", context, err, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert cashpoints state batch reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerCashpoint", Path: "/cashpoint/{id:[0-9]+}", Proc: "getCashpointById",
+		Args:        []ProcArg{varArg("id", PROC_ARG_UINT64)},
+		NotFoundMsg: MSG_NO_SUCH_CASHPOINT,
+	})
 }
 
 func handlerCashpointsBatch(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/cashpoints", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerCashpointsBatch", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-		})
-
-		jsonStr, err := getRequestJsonStr(r, context)
-		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, jsonStr)
-
-		resp, err := handlerContext.Tnt().Call("getCashpointsBatch", []interface{}{jsonStr})
-		if err != nil {
-			log.Printf("%s => cannot get cashpoints batch: %v => %s\n", context, err, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert cashpoints batch reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerCashpointsBatch", Path: "/cashpoints", Proc: "getCashpointsBatch",
+		Args:   []ProcArg{bodyArg()},
+		Params: func() RequestParams { return newBatchParams("cashpoints", MAX_CASHPOINTS_BATCH) },
+	})
 }
 
 func handlerNearbyCashPoints(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/nearby/cashpoints", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerNearbyCashPoints", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-		})
-
-		jsonStr, err := getRequestJsonStr(r, context)
-		if err != nil {
-			logger.logRequest(w, r, requestId, "")
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, jsonStr)
-
-		resp, err := handlerContext.Tnt().Call("getNearbyCashpoints", []interface{}{jsonStr})
-		if err != nil {
-			log.Printf("%s => cannot get neraby cashpoints: %v => %s\n", context, err, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert nearby cashpoints batch reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerNearbyCashPoints", Path: "/nearby/cashpoints", Proc: "getNearbyCashpoints",
+		Args:   []ProcArg{bodyArg()},
+		Params: func() RequestParams { return &NearbyCashpointsParams{} },
+	})
 }
 
 func handlerNearbyClusters(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/nearby/clusters", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerNearbyClusters", map[string]string{
-			"requestId": strconv.FormatInt(requestId, 10),
-		})
-
-		jsonStr, err := getRequestJsonStr(r, context)
-		if err != nil {
-			logger.logRequest(w, r, requestId, "")
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, jsonStr)
-
-		resp, err := handlerContext.Tnt().Call("getNearbyClusters", []interface{}{jsonStr, MAX_CLUSTER_COUNT})
-		if err != nil {
-			log.Printf("%s => cannot get nearby clusters: %v => %s\n", context, err, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert nearby clusters batch reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerNearbyClusters", Path: "/nearby/clusters", Proc: "getNearbyClusters",
+		Args:   []ProcArg{bodyArg(), constArg(MAX_CLUSTER_COUNT)},
+		Params: func() RequestParams { return &NearbyClustersParams{} },
+	})
 }
 
 func handlerQuadTreeBranch(handlerContext HandlerContext) (string, EndpointCallback) {
@@ -231,7 +65,7 @@ func handlerQuadTreeBranch(handlerContext HandlerContext) (string, EndpointCallb
 
 		quadKeyStrLen := len(quadKeyStr)
 		if quadKeyStrLen > MAX_QUADKEY_LENGTH || quadKeyStrLen < MIN_QUADKEY_LENGTH {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "quadkey")
 			return
 		}
 
@@ -264,14 +98,14 @@ func handlerCashpointCreate(handlerContext HandlerContext) (string, EndpointCall
 			"requestId": strconv.FormatInt(requestId, 10),
 		})
 
-		jsonStr, err := getRequestJsonStr(r, context)
+		jsonStr, err := getRequestParams(r, &CashpointPatchParams{})
+		logger.logRequest(w, r, requestId, jsonStr)
 		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
+			log.Printf("%s => invalid request: %v\n", context, err)
+			writeRequestParamsError(handlerContext, w, r, requestId, err)
 			return
 		}
 
-		logger.logRequest(w, r, requestId, jsonStr)
-
 		resp, err := handlerContext.Tnt().Call("cashpointProposePatch", []interface{}{jsonStr})
 		if err != nil {
 			log.Printf("%s => cannot propose patch: %v => %s\n", context, err, jsonStr)
@@ -313,7 +147,7 @@ func handlerCashpointDelete(handlerContext HandlerContext) (string, EndpointCall
 		cashPointId, err := strconv.ParseUint(cashPointIdStr, 10, 64)
 		if err != nil {
 			logger.logRequest(w, r, requestId, "")
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "id")
 			return
 		}
 
@@ -331,7 +165,7 @@ func handlerCashpointDelete(handlerContext HandlerContext) (string, EndpointCall
 			if done {
 				writeHeader(w, r, requestId, http.StatusOK, logger)
 			} else {
-				writeHeader(w, r, requestId, http.StatusNotFound, logger)
+				writeError(handlerContext, w, r, requestId, http.StatusNotFound, MSG_NO_SUCH_CASHPOINT, cashPointIdStr)
 			}
 		} else {
 			log.Printf("%s => cannot convert response to bool for request cashpoint id: %s\n", context, cashPointIdStr)
@@ -341,45 +175,10 @@ func handlerCashpointDelete(handlerContext HandlerContext) (string, EndpointCall
 }
 
 func handlerCashpointPatches(handlerContext HandlerContext) (string, EndpointCallback) {
-	return "/cashpoint/{id:[0-9]+}/patches", func(w http.ResponseWriter, r *http.Request) {
-		logger := handlerContext.Logger()
-		ok, requestId := prepareResponse(w, r, logger)
-		if ok == false {
-			return
-		}
-
-		params := mux.Vars(r)
-		cashPointIdStr := params["id"]
-
-		context := getRequestContexString(r) + " " + getHandlerContextString("handlerCashpointPatches", map[string]string{
-			"requestId":   strconv.FormatInt(requestId, 10),
-			"cashPointId": cashPointIdStr,
-		})
-
-		cashPointId, err := strconv.ParseUint(cashPointIdStr, 10, 64)
-		if err != nil {
-			logger.logRequest(w, r, requestId, "")
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
-			return
-		}
-
-		logger.logRequest(w, r, requestId, "")
-
-		resp, err := handlerContext.Tnt().Call("getCashpointPatches", []interface{}{cashPointId})
-		if err != nil {
-			log.Printf("%s => cannot get cashpoint patches for id: %v => %s\n", context, err, cashPointIdStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-			return
-		}
-
-		data := resp.Data[0].([]interface{})[0]
-		if jsonStr, ok := data.(string); ok {
-			writeResponse(w, r, requestId, jsonStr, logger)
-		} else {
-			log.Printf("%s => cannot convert cashpoint patches reply to json str: %s\n", context, jsonStr)
-			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
-		}
-	}
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerCashpointPatches", Path: "/cashpoint/{id:[0-9]+}/patches", Proc: "getCashpointPatches",
+		Args: []ProcArg{varArg("id", PROC_ARG_UINT64)},
+	})
 }
 
 func handlerCoordToQuadKey(handlerContext HandlerContext) (string, EndpointCallback) {
@@ -394,14 +193,14 @@ func handlerCoordToQuadKey(handlerContext HandlerContext) (string, EndpointCallb
 			"requestId": strconv.FormatInt(requestId, 10),
 		})
 
-		jsonStr, err := getRequestJsonStr(r, context)
+		jsonStr, err := getRequestParams(r, &QuadKeyParams{})
+		logger.logRequest(w, r, requestId, jsonStr)
 		if err != nil {
-			writeHeader(w, r, requestId, http.StatusBadRequest, logger)
+			log.Printf("%s => invalid request: %v\n", context, err)
+			writeRequestParamsError(handlerContext, w, r, requestId, err)
 			return
 		}
 
-		logger.logRequest(w, r, requestId, jsonStr)
-
 		resp, err := handlerContext.Tnt().Call("getQuadKeyFromCoord", []interface{}{jsonStr})
 		if err != nil {
 			log.Printf("%s => cannot convert coord to quadkey: %v => %s\n", context, err, jsonStr)
@@ -414,7 +213,7 @@ func handlerCoordToQuadKey(handlerContext HandlerContext) (string, EndpointCallb
 			if jsonStrResp != "" {
 				writeResponse(w, r, requestId, jsonStrResp, logger)
 			} else {
-				writeHeader(w, r, requestId, http.StatusBadRequest, logger)
+				writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_MALFORMED_REQUEST)
 			}
 		} else {
 			log.Printf("%s => cannot convert response for quadkey from coord: %s\n", context, jsonStr)
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"github.com/alexeyknyshev/export"
+	"github.com/alexeyknyshev/models"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Export is written as it is read, so the whole country is not kept in memory.
+// Errors after first batch cannot change response code and are reported by
+// X-Export-Status trailer.
+
+// Returns format and filter of export, csv by default
+func getExportRequest(query url.Values) (string, export.Filter, error) {
+	format := export.FORMAT_CSV
+	filter := export.Filter{}
+
+	for name, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		var err error
+		var id uint64
+		switch name {
+		case "format":
+			format = values[0]
+			if _, ok := export.FORMATS[format]; !ok {
+				err = errors.New("unknown format")
+			}
+		case "town_id":
+			id, err = strconv.ParseUint(values[0], 10, 32)
+			filter.TownId = uint32(id)
+		case "region_id":
+			id, err = strconv.ParseUint(values[0], 10, 32)
+			filter.RegionId = uint32(id)
+		case "bank_id":
+			id, err = strconv.ParseUint(values[0], 10, 32)
+			filter.BankId = uint32(id)
+		case "type":
+			filter.Type = values[0]
+			if !CASHPOINT_TYPES[filter.Type] {
+				err = errors.New("unknown cashpoint type")
+			}
+		default:
+			err = errors.New("unsupported param")
+		}
+		if err != nil {
+			return "", filter, errors.New("invalid export param '" + name + "': " + err.Error())
+		}
+	}
+	return format, filter, nil
+}
+
+func handlerExport(handlerContext HandlerContext) (string, EndpointCallback) {
+	return "/admin/export", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, "")
+
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerExport", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"query":     r.URL.RawQuery,
+		})
+
+		format, filter, err := getExportRequest(r.URL.Query())
+		if err != nil {
+			log.Printf("%s => %v\n", context, err)
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_MALFORMED_REQUEST, err.Error())
+			return
+		}
+
+		extendWriteDeadline(w, LONG_WRITE_TIMEOUT, context)
+
+		exporter, err := export.New(models.NewRepository(handlerContext.Tnt()), format, filter)
+		if err == export.ErrNoSuchTown {
+			writeError(handlerContext, w, r, requestId, http.StatusNotFound, MSG_NO_SUCH_TOWN, strconv.FormatUint(uint64(filter.TownId), 10))
+			return
+		} else if err != nil {
+			log.Printf("%s => cannot start export: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		f := exporter.Format()
+		w.Header().Set("Content-Type", f.ContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="cashpoints.`+f.Extension+`"`)
+		w.Header().Set("Trailer", export.STATUS_TRAILER+", "+export.COUNT_TRAILER)
+		info, err := exporter.Write(w)
+		status := export.STATUS_COMPLETE
+		if err != nil {
+			log.Printf("%s => cannot write export: %v\n", context, err)
+			status = export.STATUS_FAILED
+		}
+		w.Header().Set(export.STATUS_TRAILER, status)
+		w.Header().Set(export.COUNT_TRAILER, strconv.Itoa(info.Cashpoints))
+		logger.logResponse(w, r, requestId, strconv.Itoa(info.Cashpoints)+" cashpoints in "+f.Name)
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+// Heatmap is a grid of cashpoints counts over requested region. Counts are
+// taken from quadkey clusters where cells are big enough and from
+// cashpoints themselves otherwise.
+func handlerHeatmap(handlerContext HandlerContext) (string, EndpointCallback) {
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerHeatmap", Path: "/heatmap", Proc: "getHeatmap",
+		Args:   []ProcArg{bodyArg()},
+		Params: func() RequestParams { return &HeatmapParams{} },
+	})
+}
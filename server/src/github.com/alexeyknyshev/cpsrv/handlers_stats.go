@@ -0,0 +1,30 @@
+package main
+
+// Cashpoints statistics: counts by bank, type, currency, round the clock
+// availability and density per 10k population of town, region or country
+
+func handlerStats(handlerContext HandlerContext) (string, EndpointCallback) {
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerStats", Path: "/stats", Proc: "getCashpointsStats",
+		Args:      []ProcArg{constArg("country"), constArg(uint64(0))},
+		Localized: true,
+	})
+}
+
+func handlerTownStats(handlerContext HandlerContext) (string, EndpointCallback) {
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerTownStats", Path: "/stats/town/{id:[0-9]+}", Proc: "getCashpointsStats",
+		Args:        []ProcArg{constArg("town"), varArg("id", PROC_ARG_UINT32)},
+		Localized:   true,
+		NotFoundMsg: MSG_NO_SUCH_TOWN,
+	})
+}
+
+func handlerRegionStats(handlerContext HandlerContext) (string, EndpointCallback) {
+	return handlerProc(handlerContext, ProcEndpoint{
+		Name: "handlerRegionStats", Path: "/stats/region/{id:[0-9]+}", Proc: "getCashpointsStats",
+		Args:        []ProcArg{constArg("region"), varArg("id", PROC_ARG_UINT32)},
+		Localized:   true,
+		NotFoundMsg: MSG_NO_SUCH_REGION,
+	})
+}
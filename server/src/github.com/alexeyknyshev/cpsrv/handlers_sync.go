@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var SYNC_DEFAULT_LIMIT uint64 = 500
+var SYNC_MAX_LIMIT uint64 = 1000
+
+var SYNC_KINDS = map[string]bool{
+	"cashpoint": true,
+	"bank":      true,
+	"town":      true,
+	"metro":     true,
+}
+
+// Position in sync log. Cursor is serialized as "timestamp" or
+// "timestamp:kind:id", timestamp is in microseconds like cashpoint timestamp.
+type SyncCursor struct {
+	Timestamp uint64 `json:"timestamp"`
+	Kind      string `json:"kind,omitempty"`
+	Id        uint64 `json:"id,omitempty"`
+}
+
+func (c SyncCursor) String() string {
+	ts := strconv.FormatUint(c.Timestamp, 10)
+	if c.Kind == "" {
+		return ts
+	}
+	return ts + ":" + c.Kind + ":" + strconv.FormatUint(c.Id, 10)
+}
+
+func parseSyncCursor(s string) (SyncCursor, error) {
+	cursor := SyncCursor{}
+	parts := strings.Split(s, ":")
+	if len(parts) != 1 && len(parts) != 3 {
+		return cursor, errors.New("malformed sync cursor: " + s)
+	}
+
+	var err error
+	cursor.Timestamp, err = strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return cursor, errors.New("malformed sync cursor timestamp: " + s)
+	}
+	if len(parts) == 3 {
+		if !SYNC_KINDS[parts[1]] {
+			return cursor, errors.New("unknown sync cursor kind: " + s)
+		}
+		cursor.Kind = parts[1]
+		cursor.Id, err = strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return cursor, errors.New("malformed sync cursor id: " + s)
+		}
+	}
+	return cursor, nil
+}
+
+type SyncChangesRequest struct {
+	Since  SyncCursor `json:"since"`
+	TownId *uint64    `json:"town_id,omitempty"`
+	Limit  uint64     `json:"limit"`
+}
+
+func getSyncChangesRequest(query url.Values) (*SyncChangesRequest, error) {
+	req := &SyncChangesRequest{Limit: SYNC_DEFAULT_LIMIT}
+
+	for name, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		var err error
+		switch name {
+		case "since":
+			req.Since, err = parseSyncCursor(values[0])
+		case "town_id":
+			var townId uint64
+			townId, err = strconv.ParseUint(values[0], 10, 32)
+			req.TownId = &townId
+		case "limit":
+			req.Limit, err = strconv.ParseUint(values[0], 10, 32)
+			if err == nil && (req.Limit == 0 || req.Limit > SYNC_MAX_LIMIT) {
+				err = errors.New("limit is out of range")
+			}
+		default:
+			err = errors.New("unsupported param")
+		}
+		if err != nil {
+			return nil, errors.New("invalid sync param '" + name + "': " + err.Error())
+		}
+	}
+	return req, nil
+}
+
+type SyncDeleted struct {
+	Cashpoints []uint64 `json:"cashpoints"`
+	Banks      []uint64 `json:"banks"`
+	Towns      []uint64 `json:"towns"`
+	Metro      []uint64 `json:"metro"`
+}
+
+// Objects are passed as is from tarantool
+type SyncChangesReply struct {
+	Cashpoints json.RawMessage `json:"cashpoints"`
+	Banks      json.RawMessage `json:"banks"`
+	Towns      json.RawMessage `json:"towns"`
+	Metro      json.RawMessage `json:"metro"`
+	Deleted    SyncDeleted     `json:"deleted"`
+	Last       SyncCursor      `json:"last"`
+	More       bool            `json:"more"`
+	Reset      bool            `json:"reset"`
+}
+
+type SyncChangesResponse struct {
+	Cashpoints json.RawMessage `json:"cashpoints"`
+	Banks      json.RawMessage `json:"banks"`
+	Towns      json.RawMessage `json:"towns"`
+	Metro      json.RawMessage `json:"metro"`
+	Deleted    SyncDeleted     `json:"deleted"`
+	Next       string          `json:"next"`
+	More       bool            `json:"more"`
+	Reset      bool            `json:"reset"`
+}
+
+func handlerSync(handlerContext HandlerContext) (string, EndpointCallback) {
+	return "/sync", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, r.URL.RawQuery)
+
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerSync", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+		})
+
+		req, err := getSyncChangesRequest(r.URL.Query())
+		if err != nil {
+			log.Printf("%s => %v\n", context, err)
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_MALFORMED_REQUEST, err.Error())
+			return
+		}
+
+		reqJson, _ := json.Marshal(req)
+
+		var reply SyncChangesReply
+		err = callTntJsonProc(handlerContext, "getSyncChanges", []interface{}{string(reqJson)}, &reply)
+		if err != nil {
+			log.Printf("%s => cannot get sync changes: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		response := SyncChangesResponse{
+			Cashpoints: reply.Cashpoints,
+			Banks:      reply.Banks,
+			Towns:      reply.Towns,
+			Metro:      reply.Metro,
+			Deleted:    reply.Deleted,
+			Next:       reply.Last.String(),
+			More:       reply.More,
+			Reset:      reply.Reset,
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			log.Printf("%s => cannot encode sync changes: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+		writeLocalizedResponse(w, r, requestId, string(responseJson), logger)
+	}
+}
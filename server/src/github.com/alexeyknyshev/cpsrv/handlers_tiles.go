@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/mvt"
+	"github.com/alexeyknyshev/quadkey"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Tiles with lower zoom are filled with town clusters
+var TILE_QUAD_CLUSTERS_MIN_ZOOM uint32 = 8
+
+// Tiles with greater or equal zoom are filled with cashpoints instead of clusters.
+// Tile of this zoom fits into nearby cashpoints request region limit.
+var TILE_CASHPOINTS_MIN_ZOOM uint32 = 15
+
+const TILE_CONTENT_TYPE = "application/vnd.mapbox-vector-tile"
+
+const TILE_LAYER_CLUSTERS = "clusters"
+const TILE_LAYER_CASHPOINTS = "cashpoints"
+
+type TileGeoPoint struct {
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+type TileNearbyRequest struct {
+	TopLeft     TileGeoPoint           `json:"topLeft"`
+	BottomRight TileGeoPoint           `json:"bottomRight"`
+	Zoom        uint32                 `json:"zoom,omitempty"`
+	Filter      map[string]interface{} `json:"filter"`
+}
+
+func parseUintList(values []string) ([]uint32, error) {
+	result := make([]uint32, 0)
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part == "" {
+				continue
+			}
+			id, err := strconv.ParseUint(part, 10, 32)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, uint32(id))
+		}
+	}
+	return result, nil
+}
+
+// Converts tile query params into nearby request filter object
+func getTileFilter(query url.Values) (map[string]interface{}, error) {
+	filter := make(map[string]interface{})
+
+	boolFilters := map[string]bool{
+		"free_access":     true,
+		"round_the_clock": true,
+		"without_weekend": true,
+		"approved":        true,
+	}
+
+	var schedule map[string]interface{}
+
+	for name, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		switch {
+		case name == "bank_id" || name == "currency":
+			list, err := parseUintList(values)
+			if err != nil {
+				return nil, errors.New("invalid list value of filter '" + name + "'")
+			}
+			if len(list) > 0 {
+				filter[name] = list
+			}
+		case name == "type":
+			filter[name] = values[0]
+		case boolFilters[name]:
+			val, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return nil, errors.New("invalid bool value of filter '" + name + "'")
+			}
+			filter[name] = val
+		case name == "time" || name == "delta":
+			val, err := strconv.ParseUint(values[0], 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid value of schedule filter '" + name + "'")
+			}
+			if schedule == nil {
+				schedule = make(map[string]interface{})
+			}
+			schedule[name] = val
+		default:
+			return nil, errors.New("unsupported filter '" + name + "'")
+		}
+	}
+
+	if schedule != nil {
+		if _, ok := schedule["time"]; !ok {
+			return nil, errors.New("schedule filter requires 'time'")
+		}
+		if _, ok := schedule["delta"]; !ok {
+			schedule["delta"] = 0
+		}
+		filter["schedule"] = schedule
+	}
+
+	return filter, nil
+}
+
+// Maps XYZ tile zoom to getNearbyClusters request zoom (quadkey length - 1).
+// Zoom lower than MIN_QUADKEY_LENGTH makes tarantool return town clusters.
+func getTileClustersZoom(z uint32) uint32 {
+	if z < TILE_QUAD_CLUSTERS_MIN_ZOOM {
+		return uint32(MIN_QUADKEY_LENGTH - 1)
+	}
+	zoom := z + 2
+	if zoom < uint32(MIN_QUADKEY_LENGTH) {
+		zoom = uint32(MIN_QUADKEY_LENGTH)
+	}
+	if zoom > uint32(MAX_QUADKEY_LENGTH-1) {
+		zoom = uint32(MAX_QUADKEY_LENGTH - 1)
+	}
+	return zoom
+}
+
+func getTileNearbyRequest(z, x, y uint32, filter map[string]interface{}) TileNearbyRequest {
+	west, south, east, north := mvt.Bounds(z, x, y)
+	return TileNearbyRequest{
+		TopLeft:     TileGeoPoint{Longitude: west, Latitude: north},
+		BottomRight: TileGeoPoint{Longitude: east, Latitude: south},
+		Filter:      filter,
+	}
+}
+
+func callTntJsonProc(handlerContext HandlerContext, proc string, args []interface{}, result interface{}) error {
+	resp, err := handlerContext.Tnt().Call(proc, args)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Data) == 0 {
+		return errors.New("empty " + proc + " reply")
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) == 0 {
+		return errors.New("unexpected " + proc + " reply")
+	}
+	jsonStr, ok := tuple[0].(string)
+	if !ok {
+		return errors.New("cannot convert " + proc + " reply to json str")
+	}
+	return json.Unmarshal([]byte(jsonStr), result)
+}
+
+func jsonNumberToUint(v interface{}) uint64 {
+	if num, ok := v.(float64); ok && num > 0 {
+		return uint64(num)
+	}
+	return 0
+}
+
+func getCashpointTileProps(cp *models.Cashpoint) map[string]interface{} {
+	return map[string]interface{}{
+		"bank_id":         uint64(cp.BankId),
+		"town_id":         uint64(cp.TownId),
+		"type":            cp.Type,
+		"round_the_clock": cp.RoundTheClock,
+		"free_access":     cp.FreeAccess,
+		"without_weekend": cp.WithoutWeekend,
+		"cash_in":         cp.CashIn,
+		"approved":        cp.Approved,
+	}
+}
+
+func addTilePoint(layer *mvt.Layer, z, x, y uint32, id uint64, lon, lat float64, props map[string]interface{}) error {
+	px, py := mvt.Project(z, x, y, layer.Extent(), lon, lat)
+	return layer.AddPoint(id, px, py, props)
+}
+
+func fillTileClusters(handlerContext HandlerContext, tile *mvt.Tile, z, x, y uint32, filter map[string]interface{}) error {
+	req := getTileNearbyRequest(z, x, y, filter)
+	req.Zoom = getTileClustersZoom(z)
+	reqJson, _ := json.Marshal(req)
+
+	var clusters []json.RawMessage
+	err := callTntJsonProc(handlerContext, "getNearbyClusters", []interface{}{string(reqJson), MAX_CLUSTER_COUNT}, &clusters)
+	if err != nil {
+		return err
+	}
+
+	layer := tile.Layer(TILE_LAYER_CLUSTERS)
+	for _, data := range clusters {
+		var c map[string]interface{}
+		err = json.Unmarshal(data, &c)
+		if err != nil {
+			return err
+		}
+
+		var id uint64
+		var props map[string]interface{}
+
+		if _, ok := c["bank_id"]; ok { // single cashpoint cluster
+			var cp models.Cashpoint
+			err = json.Unmarshal(data, &cp)
+			if err != nil {
+				return err
+			}
+			id = uint64(cp.Id)
+			props = getCashpointTileProps(&cp)
+			props["kind"] = "cashpoint"
+			props["size"] = uint64(1)
+		} else if quadKey, ok := c["id"].(string); ok {
+			id, _ = quadkey.ToUint64(quadKey)
+			props = map[string]interface{}{
+				"kind":    "cluster",
+				"quadkey": quadKey,
+				"size":    jsonNumberToUint(c["size"]),
+			}
+		} else {
+			id = jsonNumberToUint(c["id"])
+			props = map[string]interface{}{
+				"kind":    "town",
+				"town_id": id,
+				"size":    jsonNumberToUint(c["size"]),
+			}
+		}
+
+		lon, okLon := c["longitude"].(float64)
+		lat, okLat := c["latitude"].(float64)
+		if !okLon || !okLat {
+			return errors.New("cluster without coordinates")
+		}
+		err = addTilePoint(layer, z, x, y, id, lon, lat, props)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fillTileCashpoints(handlerContext HandlerContext, tile *mvt.Tile, z, x, y uint32, filter map[string]interface{}) error {
+	reqJson, _ := json.Marshal(getTileNearbyRequest(z, x, y, filter))
+
+	var ids []uint32
+	err := callTntJsonProc(handlerContext, "getNearbyCashpoints", []interface{}{string(reqJson)}, &ids)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	cashpoints, err := models.NewRepository(handlerContext.Tnt()).Cashpoints(ids)
+	if err != nil {
+		return err
+	}
+
+	layer := tile.Layer(TILE_LAYER_CASHPOINTS)
+	for _, cp := range cashpoints {
+		err = addTilePoint(layer, z, x, y, uint64(cp.Id), cp.Longitude, cp.Latitude, getCashpointTileProps(cp))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func handlerTile(handlerContext HandlerContext) (string, EndpointCallback) {
+	return "/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, r.URL.RawQuery)
+
+		params := mux.Vars(r)
+
+		context := getRequestContexString(r) + " " + getHandlerContextString("handlerTile", map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+			"z":         params["z"],
+			"x":         params["x"],
+			"y":         params["y"],
+		})
+
+		z, errZ := strconv.ParseUint(params["z"], 10, 32)
+		x, errX := strconv.ParseUint(params["x"], 10, 32)
+		y, errY := strconv.ParseUint(params["y"], 10, 32)
+		if errZ != nil || errX != nil || errY != nil || !mvt.IsValidTile(uint32(z), uint32(x), uint32(y)) {
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, "z/x/y")
+			return
+		}
+
+		filter, err := getTileFilter(r.URL.Query())
+		if err != nil {
+			log.Printf("%s => %v\n", context, err)
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, err.Error())
+			return
+		}
+
+		tile := mvt.NewTile()
+		if uint32(z) >= TILE_CASHPOINTS_MIN_ZOOM {
+			err = fillTileCashpoints(handlerContext, tile, uint32(z), uint32(x), uint32(y), filter)
+		} else {
+			err = fillTileClusters(handlerContext, tile, uint32(z), uint32(x), uint32(y), filter)
+		}
+		if err != nil {
+			log.Printf("%s => cannot fill tile: %v\n", context, err)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		data := tile.Marshal()
+		w.Header().Set("Content-Type", TILE_CONTENT_TYPE)
+		w.Write(data)
+		logger.logResponse(w, r, requestId, strconv.Itoa(len(data))+" bytes")
+	}
+}
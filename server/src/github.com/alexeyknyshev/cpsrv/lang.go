@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reference data is stored in russian, so russian is default language.
+// Towns and banks have transliterated names in 'name_tr', metro station
+// names are transliterated on the fly.
+const DEFAULT_LANG = "ru"
+
+var SUPPORTED_LANGS = map[string]bool{
+	"ru": true,
+	"en": true,
+}
+
+// Message keys are english messages, messages space contains their
+// translations seeded with models.MESSAGES (see migrateMessages in
+// server_sqlite_to_tarantool), every key has to be translated there
+const (
+	MSG_MALFORMED_REQUEST = "Malformed request"
+	MSG_INVALID_PARAM     = "Invalid request parameter"
+	MSG_NO_SUCH_CASHPOINT = "Cashpoint does not exist with id"
+	MSG_NO_SUCH_TOWN      = "Town does not exist with id"
+	MSG_NO_SUCH_BANK      = "Bank does not exist with id"
+	MSG_NO_SUCH_METRO     = "Metro station does not exist with id"
+	MSG_NO_SUCH_REGION    = "Region does not exist with id"
+	MSG_NO_SUCH_BANK_ICO  = "Bank icon does not exist with id"
+	MSG_REQUEST_TOO_LARGE = "Request body is too large"
+	MSG_UNAUTHORIZED      = "Authorization required"
+	MSG_FORBIDDEN         = "Access denied"
+	MSG_CONFLICT          = "Conflict with existing data"
+)
+
+// Details of invalid request parameter, formatted with limits or values
+// of parameter after translation
+const (
+	MSG_MISSING_FIELD        = "missing required field"
+	MSG_UNKNOWN_FIELD        = "unknown field"
+	MSG_WRONG_TYPE           = "wrong type, expected %s but got %s"
+	MSG_EXPECTED_IDS         = "wrong type, expected array of ids but got %s"
+	MSG_EXPECTED_OBJECT      = "wrong type, expected object"
+	MSG_EXPECTED_INTEGER     = "wrong type, expected integer"
+	MSG_OUT_OF_RANGE         = "out of range [%d, %d]"
+	MSG_MUST_NOT_BE_EMPTY    = "must not be empty"
+	MSG_MALFORMED_JSON       = "malformed json: %s"
+	MSG_EMPTY_REQUEST        = "empty request"
+	MSG_TRAILING_DATA        = "unexpected data after request json"
+	MSG_UNSUPPORTED_CURRENCY = "unsupported currency %d"
+	MSG_UNKNOWN_CP_TYPE      = "unknown cashpoint type '%s'"
+	MSG_TOO_MANY_BANKS       = "too many banks %d, max %d"
+	MSG_TOO_MANY_PARTNERS    = "too many partners, max %d"
+	MSG_TOO_BIG_REGION       = "too big region, max delta %v"
+	MSG_EMPTY_REGION         = "empty region"
+	MSG_TOO_BIG_BATCH        = "too big batch %d, max %d"
+	MSG_MALFORMED_CURSOR     = "malformed cursor"
+	MSG_CURSOR_MISMATCH      = "cursor does not match sort order"
+	MSG_UNSUPPORTED_SORT     = "unsupported sort field '%s'"
+	MSG_UNKNOWN_LIST_FIELD   = "unknown field '%s'"
+	MSG_UNSUPPORTED_PARAM    = "unsupported param"
+)
+
+type acceptLang struct {
+	lang    string
+	quality float64
+}
+
+type acceptLangList []acceptLang
+
+func (l acceptLangList) Len() int           { return len(l) }
+func (l acceptLangList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l acceptLangList) Less(i, j int) bool { return l[i].quality > l[j].quality }
+
+// Picks the most preferred supported language of Accept-Language header
+// value like "en-US,en;q=0.8,ru;q=0.6". Region subtags are ignored.
+func negotiateLang(header string) string {
+	langs := make(acceptLangList, 0)
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(params[0]))
+		if lang == "" {
+			continue
+		}
+		if pos := strings.IndexAny(lang, "-_"); pos >= 0 {
+			lang = lang[:pos]
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		if quality > 0 {
+			langs = append(langs, acceptLang{lang: lang, quality: quality})
+		}
+	}
+	sort.Stable(langs)
+
+	for _, l := range langs {
+		if SUPPORTED_LANGS[l.lang] {
+			return l.lang
+		}
+	}
+	return DEFAULT_LANG
+}
+
+func getRequestLang(r *http.Request) string {
+	return negotiateLang(r.Header.Get("Accept-Language"))
+}
+
+// Translations are cached per language, messages space is only filled
+// on migration so cached messages do not go stale while server runs
+var trCache = make(map[string]map[string]string)
+var trCacheMutex sync.RWMutex
+
+func getMessage(handlerContext HandlerContext, lang, msg string) (string, error) {
+	resp, err := handlerContext.Tnt().Call("getMessage", []interface{}{msg, lang})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Data) == 0 {
+		return "", nil
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) == 0 {
+		return "", errors.New("unexpected getMessage reply")
+	}
+	text, _ := tuple[0].(string)
+	return text, nil
+}
+
+// Returns translation of message or message itself if there is no translation
+func trMessage(handlerContext HandlerContext, lang, msg string) string {
+	trCacheMutex.RLock()
+	text, ok := trCache[lang][msg]
+	trCacheMutex.RUnlock()
+	if ok {
+		return text
+	}
+
+	text, err := getMessage(handlerContext, lang, msg)
+	if err != nil {
+		log.Printf("trMessage => cannot get message '%s' (%s): %v\n", msg, lang, err)
+		return msg
+	}
+	if text == "" {
+		text = msg
+	}
+
+	trCacheMutex.Lock()
+	if trCache[lang] == nil {
+		trCache[lang] = make(map[string]string)
+	}
+	trCache[lang][msg] = text
+	trCacheMutex.Unlock()
+	return text
+}
+
+// Writes error code with translated message body, args are appended to message
+func writeError(handlerContext HandlerContext, w http.ResponseWriter, r *http.Request, requestId int64, code int, msg string, args ...string) {
+	lang := getRequestLang(r)
+	text := trMessage(handlerContext, lang, msg)
+	if len(args) > 0 {
+		text = text + ": " + strings.Join(args, ", ")
+	}
+
+	logger := handlerContext.Logger()
+	jsonByteArr, _ := json.Marshal(&Message{Text: text})
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(code)
+	writeResponse(w, r, requestId, string(jsonByteArr), logger)
+}
+
+var TRANSLIT_TABLE = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch",
+	'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+func transliterate(s string) string {
+	var buf bytes.Buffer
+	for _, c := range s {
+		lower := []rune(strings.ToLower(string(c)))[0]
+		tr, ok := TRANSLIT_TABLE[lower]
+		if !ok {
+			buf.WriteRune(c)
+			continue
+		}
+		if lower != c && tr != "" {
+			tr = strings.ToUpper(tr[:1]) + tr[1:]
+		}
+		buf.WriteString(tr)
+	}
+	return buf.String()
+}
+
+func localizeObject(obj map[string]interface{}) {
+	if nameTr, ok := obj["name_tr"].(string); ok && nameTr != "" {
+		if _, ok = obj["name"].(string); ok {
+			obj["name"] = nameTr
+		}
+	}
+	for _, field := range []string{"station_name", "station_exit_name"} {
+		if name, ok := obj[field].(string); ok {
+			obj[field] = transliterate(name)
+		}
+	}
+}
+
+func localizeValue(v interface{}) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		localizeObject(val)
+		for _, item := range val {
+			localizeValue(item)
+		}
+	case []interface{}:
+		for _, item := range val {
+			localizeValue(item)
+		}
+	}
+}
+
+// Replaces names of towns, banks and metro in json reply by names
+// in lang. Reply is returned as is for default language.
+func localizeJson(jsonStr, lang string) (string, error) {
+	if lang == DEFAULT_LANG || jsonStr == "" {
+		return jsonStr, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(jsonStr))
+	decoder.UseNumber()
+	var data interface{}
+	err := decoder.Decode(&data)
+	if err != nil {
+		return "", err
+	}
+
+	localizeValue(data)
+	result, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+// Writes reference data reply localized for request language
+func writeLocalizedResponse(w http.ResponseWriter, r *http.Request, requestId int64, jsonStr string, logger Logger) {
+	lang := getRequestLang(r)
+	localized, err := localizeJson(jsonStr, lang)
+	if err != nil {
+		log.Printf("%s => cannot localize reply: %v\n", getRequestContexString(r), err)
+		localized = jsonStr
+		lang = DEFAULT_LANG
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+	writeResponse(w, r, requestId, localized, logger)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// List endpoints support cursor based pagination: reply contains opaque
+// cursor 'next' which has to be passed as 'after' to get the next page.
+// Cursor is bound to sort order it was created with.
+
+var LIST_MAX_LIMIT uint64 = 1000
+
+type ListCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	Id    uint64      `json:"id"`
+}
+
+func (c *ListCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func parseListCursor(s string) (*ListCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fieldError("after", MSG_MALFORMED_CURSOR)
+	}
+	cursor := &ListCursor{}
+	err = json.Unmarshal(data, cursor)
+	if err != nil || cursor.Value == nil {
+		return nil, fieldError("after", MSG_MALFORMED_CURSOR)
+	}
+	switch cursor.Value.(type) {
+	case string, float64:
+	default:
+		return nil, fieldError("after", MSG_MALFORMED_CURSOR)
+	}
+	return cursor, nil
+}
+
+// Fields of list objects and fields the list can be sorted by
+type ListSpec struct {
+	Fields map[string]bool
+	Sort   map[string]bool
+}
+
+var TOWNS_LIST_SPEC = ListSpec{
+	Fields: map[string]bool{
+		"id": true, "longitude": true, "latitude": true, "name": true, "name_tr": true,
+		"region_id": true, "regional_center": true, "zoom": true, "big": true,
+		"has_metro": true, "population": true, "cashpoints_count": true,
+	},
+	Sort: map[string]bool{"id": true, "name": true, "population": true, "cashpoints_count": true},
+}
+
+var BANKS_LIST_SPEC = ListSpec{
+	Fields: map[string]bool{
+		"id": true, "name": true, "name_tr": true, "name_tr_alt": true, "partners": true,
+		"licence": true, "rating": true, "tel": true, "cashpoints_count": true,
+	},
+	Sort: map[string]bool{"id": true, "name": true, "rating": true, "cashpoints_count": true},
+}
+
+type ListRequest struct {
+	Limit  uint64                 `json:"limit"`
+	After  map[string]interface{} `json:"after,omitempty"`
+	Sort   string                 `json:"sort"`
+	Desc   bool                   `json:"desc"`
+	Fields []string               `json:"fields,omitempty"`
+}
+
+// Parses query like "limit=50&after=<cursor>&sort=-population&fields=id,name".
+// Sort by name uses transliterated names for languages other than default
+// one, so order matches localized names.
+func getListRequest(query url.Values, spec ListSpec, lang string) (*ListRequest, error) {
+	req := &ListRequest{Limit: 100, Sort: "id"}
+	var cursor *ListCursor
+
+	for name, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		switch name {
+		case "limit":
+			limit, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || limit == 0 || limit > LIST_MAX_LIMIT {
+				return nil, fieldError("limit", MSG_OUT_OF_RANGE, 1, LIST_MAX_LIMIT)
+			}
+			req.Limit = limit
+		case "after":
+			var err error
+			cursor, err = parseListCursor(value)
+			if err != nil {
+				return nil, err
+			}
+		case "sort":
+			req.Desc = strings.HasPrefix(value, "-")
+			req.Sort = strings.TrimPrefix(value, "-")
+			if !spec.Sort[req.Sort] {
+				return nil, fieldError("sort", MSG_UNSUPPORTED_SORT, req.Sort)
+			}
+		case "fields":
+			for _, field := range strings.Split(value, ",") {
+				field = strings.TrimSpace(field)
+				if !spec.Fields[field] {
+					return nil, fieldError("fields", MSG_UNKNOWN_LIST_FIELD, field)
+				}
+				req.Fields = append(req.Fields, field)
+			}
+		default:
+			return nil, fieldError(name, MSG_UNSUPPORTED_PARAM)
+		}
+	}
+
+	if lang != DEFAULT_LANG {
+		if req.Sort == "name" {
+			req.Sort = "name_tr"
+		}
+		// localized name is taken from name_tr
+		if len(req.Fields) > 0 && containsString(req.Fields, "name") && !containsString(req.Fields, "name_tr") {
+			req.Fields = append(req.Fields, "name_tr")
+		}
+	}
+	if cursor != nil {
+		if cursor.Sort != req.sortKey() {
+			return nil, fieldError("after", MSG_CURSOR_MISMATCH)
+		}
+		req.After = map[string]interface{}{"value": cursor.Value, "id": cursor.Id}
+	}
+	return req, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (req *ListRequest) sortKey() string {
+	if req.Desc {
+		return "-" + req.Sort
+	}
+	return req.Sort
+}
+
+type ListReply struct {
+	Items json.RawMessage `json:"items"`
+	Last  *struct {
+		Value interface{} `json:"value"`
+		Id    uint64      `json:"id"`
+	} `json:"last"`
+	More bool `json:"more"`
+}
+
+type ListResponse struct {
+	Items json.RawMessage `json:"items"`
+	Next  string          `json:"next,omitempty"`
+	More  bool            `json:"more"`
+}
+
+// Writes page of list returned by tarantool proc
+func writeListPage(handlerContext HandlerContext, w http.ResponseWriter, r *http.Request, requestId int64, context, proc string, spec ListSpec) {
+	logger := handlerContext.Logger()
+	req, err := getListRequest(r.URL.Query(), spec, getRequestLang(r))
+	if err != nil {
+		log.Printf("%s => %v\n", context, err)
+		writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, err.Error())
+		return
+	}
+
+	reqJson, _ := json.Marshal(req)
+
+	var reply ListReply
+	err = callTntJsonProc(handlerContext, proc, []interface{}{string(reqJson)}, &reply)
+	if err != nil {
+		log.Printf("%s => cannot get list page: %v => %s\n", context, err, reqJson)
+		writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+		return
+	}
+
+	response := ListResponse{Items: reply.Items, More: reply.More}
+	if reply.More && reply.Last != nil {
+		cursor := &ListCursor{Sort: req.sortKey(), Value: reply.Last.Value, Id: reply.Last.Id}
+		response.Next = cursor.String()
+	}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("%s => cannot encode list page: %v\n", context, err)
+		writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+		return
+	}
+	writeLocalizedResponse(w, r, requestId, string(responseJson), logger)
+}
+
+// Batch replies contain found objects only, ids which were not found or
+// were cut off by batch size limit of tarantool are listed in header
+func setBatchMissingHeader(w http.ResponseWriter, params *BatchParams, replyJson string) {
+	var objects []struct {
+		Id uint32 `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(replyJson), &objects); err != nil {
+		return
+	}
+
+	found := make(map[uint32]bool, len(objects))
+	for _, obj := range objects {
+		found[obj.Id] = true
+	}
+	missing := make([]string, 0)
+	for _, id := range params.Ids {
+		if !found[id] {
+			missing = append(missing, strconv.FormatUint(uint64(id), 10))
+			found[id] = true // report duplicates once
+		}
+	}
+	w.Header().Set("X-Missing-Ids", strings.Join(missing, ","))
+}
@@ -0,0 +1,2335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
+	"github.com/tarantool/go-tarantool"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory backend implements procedures of tarantool api called by
+// handlers (getters, nearby search, clusters, patches and votes, list pages,
+// heatmap, stats, sync and admin editing), so handler tests do not need
+// running tarantool. Procedures follow lua implementation
+// in tnt_workdir/api. Quadkey clusters are built of cashpoints on demand
+// instead of being maintained on every change.
+
+// Limits of tarantool api
+const MEMORY_PATCH_APPROVE_VOTES = 5
+const MEMORY_MAX_CASHPOINTS_BATCH = 1024
+const MEMORY_MAX_TOWNS_BATCH = 1024
+const MEMORY_MAX_BANKS_BATCH = 256
+const MEMORY_MAX_METRO_BATCH = 1024
+const MEMORY_MAX_COORD_DELTA = 0.02
+const MEMORY_MAX_BANK_ID_FILTER = 16
+const MEMORY_DEFAULT_LIST_PAGE = 100
+const MEMORY_MAX_LIST_PAGE = 1000
+const MEMORY_MAX_HEATMAP_GRID = 256
+const MEMORY_MAX_SYNC_BATCH = 1000
+
+// Schedule filter time is local time of Moscow (UTC+3)
+var MEMORY_SCHEDULE_TIME_ZONE = time.FixedZone("UTC+3", 3*60*60)
+
+type memoryPatch struct {
+	Id          uint64
+	CashpointId uint64
+	UserId      uint64
+	Data        string
+	Timestamp   uint64
+}
+
+type memoryVote struct {
+	Id      uint64
+	PatchId uint64
+	UserId  uint64
+	Score   int64
+}
+
+type MemoryBackend struct {
+	mutex      sync.Mutex
+	regions    map[uint32]*models.Region
+	towns      map[uint32]*models.Town
+	banks      map[uint32]*models.Bank
+	metro      map[uint32]*models.Metro
+	cashpoints map[uint32]*models.Cashpoint
+	patches    map[uint64]*memoryPatch
+	votes      map[uint64]*memoryVote
+	syncLog    map[memorySyncKey]*memorySyncEntry
+	// Built on demand, reset on every cashpoint change
+	clusters map[string]*cluster.Cluster
+}
+
+func newMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		regions:    make(map[uint32]*models.Region),
+		towns:      make(map[uint32]*models.Town),
+		banks:      make(map[uint32]*models.Bank),
+		metro:      make(map[uint32]*models.Metro),
+		cashpoints: make(map[uint32]*models.Cashpoint),
+		patches:    make(map[uint64]*memoryPatch),
+		votes:      make(map[uint64]*memoryVote),
+		syncLog:    make(map[memorySyncKey]*memorySyncEntry),
+	}
+}
+
+func (b *MemoryBackend) addRegion(region models.Region) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.regions[region.Id] = &region
+}
+
+func (b *MemoryBackend) addTown(town models.Town) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.towns[town.Id] = &town
+	b.syncLogTouch(SYNC_KIND_TOWN, town.Id, 0, 0, false)
+}
+
+func (b *MemoryBackend) addBank(bank models.Bank) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if bank.Partners == nil {
+		bank.Partners = []uint32{}
+	}
+	b.banks[bank.Id] = &bank
+	b.syncLogTouch(SYNC_KIND_BANK, bank.Id, 0, 0, false)
+}
+
+func (b *MemoryBackend) addMetro(metro models.Metro) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.metro[metro.Id] = &metro
+	b.syncLogTouch(SYNC_KIND_METRO, metro.Id, metro.TownId, 0, false)
+}
+
+// Approved cashpoints are counted in their towns
+func (b *MemoryBackend) addCashpoint(cp models.Cashpoint) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.cashpoints[cp.Id] = &cp
+	if town, ok := b.towns[cp.TownId]; ok && cp.Approved {
+		town.CashpointsCount++
+	}
+	b.clusters = nil
+	b.syncLogTouch(SYNC_KIND_CASHPOINT, cp.Id, cp.TownId, cp.Timestamp, false)
+}
+
+type memoryProc func(b *MemoryBackend, args []interface{}) (interface{}, error)
+
+// Procedure returning tuple instead of single value
+type memoryTuple []interface{}
+
+var MEMORY_PROCS = map[string]memoryProc{
+	"getCashpointById":           (*MemoryBackend).getCashpointById,
+	"getCashpointsBatch":         (*MemoryBackend).getCashpointsBatch,
+	"getCashpointsStateBatch":    (*MemoryBackend).getCashpointsStateBatch,
+	"getNearbyCashpoints":        (*MemoryBackend).getNearbyCashpoints,
+	"getNearbyClusters":          (*MemoryBackend).getNearbyClusters,
+	"getQuadKeyFromCoord":        (*MemoryBackend).getQuadKeyFromCoord,
+	"getQuadTreeBranch":          (*MemoryBackend).getQuadTreeBranch,
+	"deleteCashpointById":        (*MemoryBackend).deleteCashpointById,
+	"cashpointProposePatch":      (*MemoryBackend).cashpointProposePatch,
+	"getCashpointPatches":        (*MemoryBackend).getCashpointPatches,
+	"getCashpointPatchByPatchId": (*MemoryBackend).getCashpointPatchByPatchId,
+	"_deleteCashpointPatchById":  (*MemoryBackend).deleteCashpointPatchById,
+	"cashpointVotePatch":         (*MemoryBackend).cashpointVotePatch,
+	"getCashpointPatchVotes":     (*MemoryBackend).getCashpointPatchVotes,
+	"getTownById":                (*MemoryBackend).getTownById,
+	"getTownsBatch":              (*MemoryBackend).getTownsBatch,
+	"getTownsList":               (*MemoryBackend).getTownsList,
+	"getTownCashpoints":          (*MemoryBackend).getTownCashpoints,
+	"getTownsPage":               (*MemoryBackend).getTownsPage,
+	"getRegionById":              (*MemoryBackend).getRegionById,
+	"getBankById":                (*MemoryBackend).getBankById,
+	"getBanksBatch":              (*MemoryBackend).getBanksBatch,
+	"getBanksList":               (*MemoryBackend).getBanksList,
+	"getBankPartners":            (*MemoryBackend).getBankPartners,
+	"getBanksPage":               (*MemoryBackend).getBanksPage,
+	"getMetroById":               (*MemoryBackend).getMetroById,
+	"getMetroList":               (*MemoryBackend).getMetroList,
+	"getMetroBatch":              (*MemoryBackend).getMetroBatch,
+	"getHeatmap":                 (*MemoryBackend).getHeatmap,
+	"getCashpointsStats":         (*MemoryBackend).getCashpointsStats,
+	"getSyncChanges":             (*MemoryBackend).getSyncChanges,
+	"adminCreate":                (*MemoryBackend).adminCreate,
+	"adminUpdate":                (*MemoryBackend).adminUpdate,
+	"adminDelete":                (*MemoryBackend).adminDelete,
+	"getSpaceMetrics":            (*MemoryBackend).getSpaceMetrics,
+	"getMessage":                 (*MemoryBackend).getMessage,
+}
+
+func (b *MemoryBackend) Call(functionName string, args interface{}) (*tarantool.Response, error) {
+	proc, ok := MEMORY_PROCS[functionName]
+	if !ok {
+		return nil, tarantool.Error{Code: tarantool.ErrNoSuchProc, Msg: "Procedure '" + functionName + "' is not defined"}
+	}
+	argList, _ := args.([]interface{})
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result, err := proc(b, argList)
+	if err != nil {
+		return nil, err
+	}
+	if tuple, ok := result.(memoryTuple); ok {
+		return &tarantool.Response{Data: []interface{}{[]interface{}(tuple)}}, nil
+	}
+	return &tarantool.Response{Data: []interface{}{[]interface{}{result}}}, nil
+}
+
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+// Same as box.error(malformedRequest(...)) of lua api
+func memoryMalformedRequest(func_ string, format string, args ...interface{}) error {
+	return tarantool.Error{Code: 400, Msg: func_ + ": " + fmt.Sprintf(format, args...)}
+}
+
+func memoryArgUint(args []interface{}, i int) uint64 {
+	if i >= len(args) {
+		return 0
+	}
+	switch v := args[i].(type) {
+	case uint64:
+		return v
+	case uint32:
+		return uint64(v)
+	case uint:
+		return uint64(v)
+	case int:
+		if v > 0 {
+			return uint64(v)
+		}
+	case int64:
+		if v > 0 {
+			return uint64(v)
+		}
+	case float64:
+		if v > 0 {
+			return uint64(v)
+		}
+	}
+	return 0
+}
+
+func memoryArgString(args []interface{}, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	switch v := args[i].(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func memoryArgJson(func_ string, args []interface{}, i int, result interface{}) error {
+	reqJson, ok := memoryArgString(args, i)
+	if !ok {
+		return memoryMalformedRequest(func_, "malformed request json")
+	}
+	if err := json.Unmarshal([]byte(reqJson), result); err != nil {
+		return memoryMalformedRequest(func_, "malformed request json: %v", err)
+	}
+	return nil
+}
+
+func memoryJson(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func memoryTimestamp() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+type memoryIdList []uint32
+
+func (l memoryIdList) Len() int           { return len(l) }
+func (l memoryIdList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l memoryIdList) Less(i, j int) bool { return l[i] < l[j] }
+
+func sortedIds(ids []uint32) []uint32 {
+	sort.Sort(memoryIdList(ids))
+	return ids
+}
+
+// ======================================================================
+// Cashpoints
+
+// Copy of cashpoint with count of its patches
+func (b *MemoryBackend) cashpointReply(cp *models.Cashpoint) *models.Cashpoint {
+	var patchCount uint32 = 0
+	for _, patch := range b.patches {
+		if patch.CashpointId == uint64(cp.Id) {
+			patchCount++
+		}
+	}
+	reply := *cp
+	reply.PatchCount = patchCount
+	return &reply
+}
+
+func (b *MemoryBackend) getCashpointById(args []interface{}) (interface{}, error) {
+	cp, ok := b.cashpoints[uint32(memoryArgUint(args, 0))]
+	if !ok {
+		return "", nil
+	}
+	return memoryJson(b.cashpointReply(cp))
+}
+
+func (b *MemoryBackend) getCashpointsBatch(args []interface{}) (interface{}, error) {
+	req := struct {
+		Cashpoints []uint32 `json:"cashpoints"`
+	}{}
+	if err := memoryArgJson("getCashpointsBatch", args, 0, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Cashpoint, 0, len(req.Cashpoints))
+	for _, id := range req.Cashpoints {
+		if cp, ok := b.cashpoints[id]; ok {
+			result = append(result, b.cashpointReply(cp))
+		}
+		if len(result) == MEMORY_MAX_CASHPOINTS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *MemoryBackend) getCashpointsStateBatch(args []interface{}) (interface{}, error) {
+	return getCashpointsState(args)
+}
+
+// Schedule based state is not implemented by lua api either, reply lists ids only
+func getCashpointsState(args []interface{}) (interface{}, error) {
+	req := struct {
+		Cashpoints []uint32 `json:"cashpoints"`
+	}{}
+	if err := memoryArgJson("getCashpointsStateBatch", args, 0, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]uint32, 0, len(req.Cashpoints))
+	for _, id := range req.Cashpoints {
+		result = append(result, map[string]uint32{"id": id})
+	}
+	return memoryJson(result)
+}
+
+func (b *MemoryBackend) deleteCashpointById(args []interface{}) (interface{}, error) {
+	id := uint32(memoryArgUint(args, 0))
+	cp, ok := b.cashpoints[id]
+	if !ok {
+		return false, nil
+	}
+	delete(b.cashpoints, id)
+	b.clusters = nil
+	if town, ok := b.towns[cp.TownId]; ok && cp.Approved {
+		town.CashpointsCount--
+	}
+	for patchId, patch := range b.patches {
+		if patch.CashpointId == uint64(id) {
+			b.deletePatch(patchId)
+		}
+	}
+	b.syncLogTouch(SYNC_KIND_CASHPOINT, id, cp.TownId, 0, true)
+	return true, nil
+}
+
+// ======================================================================
+// Nearby search
+
+type memoryCoord struct {
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+}
+
+type memoryScheduleFilter struct {
+	Time  int64   `json:"time"`
+	Delta float64 `json:"delta"`
+}
+
+// Filters of _getFiltersList (common.lua)
+type memoryFilter struct {
+	BankId         []uint32              `json:"bank_id"`
+	PartnerOf      *uint32               `json:"partner_of"`
+	Type           *string               `json:"type"`
+	Currency       []uint32              `json:"currency"`
+	RoundTheClock  *bool                 `json:"round_the_clock"`
+	WithoutWeekend *bool                 `json:"without_weekend"`
+	FreeAccess     *bool                 `json:"free_access"`
+	Approved       *bool                 `json:"approved"`
+	Schedule       *memoryScheduleFilter `json:"schedule"`
+}
+
+func (f *memoryFilter) isEmpty() bool {
+	return f.BankId == nil && f.Type == nil && f.Currency == nil && f.RoundTheClock == nil &&
+		f.WithoutWeekend == nil && f.FreeAccess == nil && f.Approved == nil && f.Schedule == nil
+}
+
+type memoryNearbyRequest struct {
+	TopLeft     *memoryCoord  `json:"topLeft"`
+	BottomRight *memoryCoord  `json:"bottomRight"`
+	Zoom        *float64      `json:"zoom"`
+	Filter      *memoryFilter `json:"filter"`
+}
+
+func (req *memoryNearbyRequest) bbox() (minLon, minLat, maxLon, maxLat float64) {
+	minLon = math.Min(*req.TopLeft.Longitude, *req.BottomRight.Longitude)
+	maxLon = math.Max(*req.TopLeft.Longitude, *req.BottomRight.Longitude)
+	minLat = math.Min(*req.TopLeft.Latitude, *req.BottomRight.Latitude)
+	maxLat = math.Max(*req.TopLeft.Latitude, *req.BottomRight.Latitude)
+	return
+}
+
+func (req *memoryNearbyRequest) contains(lon, lat float64) bool {
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	return lon >= minLon && lon <= maxLon && lat >= minLat && lat <= maxLat
+}
+
+func (b *MemoryBackend) getNearbyRequest(func_ string, args []interface{}) (*memoryNearbyRequest, error) {
+	var req memoryNearbyRequest
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	err := validateNearbyRequest(func_, &req, func(bankId uint32) ([]uint32, error) {
+		return b.getBankPartnerNetwork(bankId), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Validates request like validateRequest and replaces partner_of filter
+// like applyPartnerFilter. Network of bank is nil if there is no such bank.
+func validateNearbyRequest(func_ string, req *memoryNearbyRequest, partnerNetwork func(bankId uint32) ([]uint32, error)) error {
+	for _, field := range []struct {
+		name  string
+		coord *memoryCoord
+	}{{"topLeft", req.TopLeft}, {"bottomRight", req.BottomRight}} {
+		if field.coord == nil || field.coord.Longitude == nil || field.coord.Latitude == nil {
+			return memoryMalformedRequest(func_, "missing required request field: %s", field.name)
+		}
+	}
+	if req.Filter == nil {
+		req.Filter = &memoryFilter{}
+	}
+	if len(req.Filter.BankId) > MEMORY_MAX_BANK_ID_FILTER {
+		return memoryMalformedRequest(func_, "Receive %d bank_id filter. But max filter amount %d", len(req.Filter.BankId), MEMORY_MAX_BANK_ID_FILTER)
+	}
+
+	if req.Filter.PartnerOf != nil {
+		network, err := partnerNetwork(*req.Filter.PartnerOf)
+		if err != nil {
+			return err
+		}
+		if network == nil {
+			return memoryMalformedRequest(func_, "no such bank for filter.partner_of: %d", *req.Filter.PartnerOf)
+		}
+		if req.Filter.BankId != nil {
+			inNetwork := make(map[uint32]bool)
+			for _, id := range network {
+				inNetwork[id] = true
+			}
+			bankIds := make([]uint32, 0)
+			for _, id := range req.Filter.BankId {
+				if inNetwork[id] {
+					bankIds = append(bankIds, id)
+				}
+			}
+			network = bankIds
+		}
+		req.Filter.BankId = network
+		req.Filter.PartnerOf = nil
+	}
+	return nil
+}
+
+func (b *MemoryBackend) getNearbyCashpoints(args []interface{}) (interface{}, error) {
+	func_ := "getNearbyCashpoints"
+	req, err := b.getNearbyRequest(func_, args)
+	if err != nil {
+		return nil, err
+	}
+
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	if maxLon-minLon > MEMORY_MAX_COORD_DELTA {
+		return nil, memoryMalformedRequest(func_, "too big region size in request: longitude")
+	}
+	if maxLat-minLat > MEMORY_MAX_COORD_DELTA {
+		return nil, memoryMalformedRequest(func_, "too big region size in request: latitude")
+	}
+
+	result := make([]uint32, 0)
+	for _, cp := range b.cashpoints {
+		if req.contains(cp.Longitude, cp.Latitude) && memoryMatching(cp, req.Filter, true) {
+			result = append(result, cp.Id)
+		}
+	}
+	return memoryJson(sortedIds(result))
+}
+
+func memoryMatching(cp *models.Cashpoint, filter *memoryFilter, withBankFilter bool) bool {
+	if withBankFilter && filter.BankId != nil {
+		found := false
+		for _, id := range filter.BankId {
+			if cp.BankId == id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Type != nil && cp.Type != *filter.Type {
+		return false
+	}
+	for _, code := range filter.Currency {
+		found := false
+		for _, cpCode := range cp.Currency {
+			if cpCode == code {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.RoundTheClock != nil && cp.RoundTheClock != *filter.RoundTheClock {
+		return false
+	}
+	if filter.WithoutWeekend != nil && cp.WithoutWeekend != *filter.WithoutWeekend {
+		return false
+	}
+	if filter.FreeAccess != nil && cp.FreeAccess != *filter.FreeAccess {
+		return false
+	}
+	if filter.Approved != nil && cp.Approved != *filter.Approved {
+		return false
+	}
+	return memoryMatchingTime(cp, filter.Schedule)
+}
+
+func memoryDeltaInside(from, to, delta, curTime float64) bool {
+	if from > to {
+		to += 60 * 24
+	}
+	return from-curTime <= 0 && to-delta-curTime >= 0
+}
+
+// Cashpoint is open at filter time and stays open for filter delta
+// (matchingTimeFilter of common.lua). Cashpoints without schedule match.
+func memoryMatchingTime(cp *models.Cashpoint, filter *memoryScheduleFilter) bool {
+	if filter == nil {
+		return true
+	}
+	if cp.Schedule.IsEmpty() {
+		return true
+	}
+
+	t := time.Unix(filter.Time, 0).In(MEMORY_SCHEDULE_TIME_ZONE)
+	curTime := float64(t.Hour()*60 + t.Minute())
+	delta := filter.Delta / 60
+
+	curDay := cp.Schedule.Day(t.Weekday())
+	if curDay == nil {
+		return false
+	}
+	if curTime < float64(curDay.From) {
+		prevDay := cp.Schedule.Day(t.AddDate(0, 0, -1).Weekday())
+		if prevDay != nil && prevDay.From > prevDay.To {
+			return memoryDeltaInside(0, float64(prevDay.To), delta, curTime)
+		}
+		return false
+	}
+	return memoryDeltaInside(float64(curDay.From), float64(curDay.To), delta, curTime)
+}
+
+// ======================================================================
+// Clusters
+
+func (b *MemoryBackend) getClusters() map[string]*cluster.Cluster {
+	if b.clusters == nil {
+		points := make([]cluster.Point, 0, len(b.cashpoints))
+		for _, cp := range b.cashpoints {
+			points = append(points, cluster.Point{Id: cp.Id, Longitude: cp.Longitude, Latitude: cp.Latitude})
+		}
+		b.clusters = cluster.BuildAll(points)
+	}
+	return b.clusters
+}
+
+type memoryTownClusterReply struct {
+	Id        uint32  `json:"id"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+	Size      uint32  `json:"size"`
+}
+
+// Biggest towns first
+type memoryTownClusterList []*memoryTownClusterReply
+
+func (l memoryTownClusterList) Len() int      { return len(l) }
+func (l memoryTownClusterList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l memoryTownClusterList) Less(i, j int) bool {
+	if l[i].Size != l[j].Size {
+		return l[i].Size > l[j].Size
+	}
+	return l[i].Id < l[j].Id
+}
+
+func (b *MemoryBackend) getNearbyClusters(args []interface{}) (interface{}, error) {
+	func_ := "getNearbyClusters"
+	req, err := b.getNearbyRequest(func_, args)
+	if err != nil {
+		return nil, err
+	}
+	if req.Zoom == nil {
+		return nil, memoryMalformedRequest(func_, "missing required argument => req.zoom")
+	}
+
+	if *req.Zoom < quadkey.CLUSTER_ZOOM_MIN {
+		countLimit := memoryArgUint(args, 1)
+		if countLimit == 0 {
+			countLimit = 32
+		}
+		return b.getNearbyTownClusters(req, int(countLimit))
+	}
+	return b.getNearbyQuadClusters(req)
+}
+
+// Clusters of quadkey one level deeper than requested zoom
+func (b *MemoryBackend) getNearbyQuadClusters(req *memoryNearbyRequest) (interface{}, error) {
+	keyLen := int(*req.Zoom) + 1
+
+	quadKeys := make([]string, 0)
+	for quadKey, c := range b.getClusters() {
+		if len(quadKey) == keyLen && req.contains(c.Longitude, c.Latitude) {
+			quadKeys = append(quadKeys, quadKey)
+		}
+	}
+	sort.Strings(quadKeys)
+
+	result := make([]interface{}, 0, len(quadKeys))
+	for _, quadKey := range quadKeys {
+		c := b.clusters[quadKey]
+		reply := &models.Cluster{Id: quadKey, Longitude: c.Longitude, Latitude: c.Latitude}
+
+		members := c.Members
+		if !req.Filter.isEmpty() {
+			members = make([]uint32, 0)
+			reply.Longitude, reply.Latitude = 0.0, 0.0
+			for _, id := range c.Members {
+				cp, ok := b.cashpoints[id]
+				if ok && memoryMatching(cp, req.Filter, true) {
+					members = append(members, id)
+					reply.Longitude += cp.Longitude
+					reply.Latitude += cp.Latitude
+				}
+			}
+			if len(members) > 0 {
+				reply.Longitude /= float64(len(members))
+				reply.Latitude /= float64(len(members))
+			}
+		}
+
+		reply.Size = uint32(len(members))
+		if reply.Size == 1 {
+			result = append(result, b.cashpointReply(b.cashpoints[members[0]]))
+		} else if reply.Size > 1 {
+			result = append(result, reply)
+		}
+	}
+	return memoryJson(result)
+}
+
+// Towns in region merged with close bigger ones (_getNearbyTownClusters of clusterapi.lua)
+func (b *MemoryBackend) getNearbyTownClusters(req *memoryNearbyRequest, countLimit int) (interface{}, error) {
+	result := make([]*memoryTownClusterReply, 0)
+	for _, town := range b.towns {
+		if req.contains(town.Longitude, town.Latitude) {
+			result = append(result, &memoryTownClusterReply{
+				Id:        town.Id,
+				Longitude: town.Longitude,
+				Latitude:  town.Latitude,
+				Size:      town.CashpointsCount,
+			})
+		}
+	}
+	merged := mergeTownClusters(result, req, countLimit)
+
+	if !req.Filter.isEmpty() {
+		filtered := make([]*memoryTownClusterReply, 0, len(merged))
+		for _, c := range merged {
+			c.Size = 0
+			for _, cp := range b.cashpoints {
+				if cp.TownId == c.Id && memoryMatching(cp, req.Filter, true) {
+					c.Size++
+				}
+			}
+			if c.Size > 0 {
+				filtered = append(filtered, c)
+			}
+		}
+		merged = filtered
+	}
+	return memoryJson(merged)
+}
+
+// Merges towns with close bigger ones and leaves countLimit biggest
+func mergeTownClusters(result []*memoryTownClusterReply, req *memoryNearbyRequest, countLimit int) []*memoryTownClusterReply {
+	sort.Sort(memoryTownClusterList(result))
+
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	minDist := math.Min(maxLon-minLon, maxLat-minLat) * 0.2
+	for i := range result {
+		if result[i].Size == 0 {
+			continue
+		}
+		for j := len(result) - 1; j > i; j-- {
+			if result[j].Size == 0 {
+				continue
+			}
+			deltaLon := result[i].Longitude - result[j].Longitude
+			deltaLat := result[i].Latitude - result[j].Latitude
+			if deltaLon*deltaLon+deltaLat*deltaLat < minDist {
+				result[i].Size += result[j].Size
+				result[j].Size = 0
+			}
+		}
+	}
+
+	merged := make([]*memoryTownClusterReply, 0, len(result))
+	for _, c := range result {
+		if c.Size != 0 && len(merged) < countLimit {
+			merged = append(merged, c)
+		}
+	}
+	return merged
+}
+
+func (b *MemoryBackend) getQuadKeyFromCoord(args []interface{}) (interface{}, error) {
+	return getQuadKeyReply(args)
+}
+
+func getQuadKeyReply(args []interface{}) (interface{}, error) {
+	req := struct {
+		Longitude *float64 `json:"longitude"`
+		Latitude  *float64 `json:"latitude"`
+		Zoom      *float64 `json:"zoom"`
+	}{}
+	if err := memoryArgJson("getQuadKeyFromCoord", args, 0, &req); err != nil || req.Longitude == nil || req.Latitude == nil {
+		return "", nil
+	}
+
+	zoom := float64(quadkey.CLUSTER_ZOOM_MAX)
+	if req.Zoom != nil {
+		zoom = math.Floor(*req.Zoom)
+	}
+	if zoom < quadkey.CLUSTER_ZOOM_MIN || zoom > quadkey.CLUSTER_ZOOM_MAX {
+		return "", nil
+	}
+	quadKey, err := quadkey.Encode(*req.Longitude, *req.Latitude, uint32(zoom))
+	if err != nil {
+		return "", nil
+	}
+	return memoryJson(map[string]string{"quadkey": quadKey})
+}
+
+func (b *MemoryBackend) getQuadTreeBranch(args []interface{}) (interface{}, error) {
+	quadKey, _ := memoryArgString(args, 0)
+
+	clusters := b.getClusters()
+	result := make([]*models.Cluster, 0)
+	for zoom := quadkey.CLUSTER_ZOOM_MIN; zoom <= len(quadKey); zoom++ {
+		if c, ok := clusters[quadKey[:zoom]]; ok {
+			result = append(result, &models.Cluster{
+				Id:        c.QuadKey,
+				Longitude: c.Longitude,
+				Latitude:  c.Latitude,
+				Members:   c.Members,
+				Size:      uint32(c.Size()),
+			})
+		}
+	}
+	return memoryJson(result)
+}
+
+// ======================================================================
+// Patches and votes
+
+// Checks patch fields referring other objects (validateCashpoint of common.lua)
+func (b *MemoryBackend) validateCashpointData(data map[string]interface{}) bool {
+	if bankId, ok := data["bank_id"].(float64); ok {
+		if _, ok := b.banks[uint32(bankId)]; !ok {
+			return false
+		}
+	}
+	if townId, ok := data["town_id"].(float64); ok {
+		if _, ok := b.towns[uint32(townId)]; !ok {
+			return false
+		}
+	}
+	if cpType, ok := data["type"].(string); ok && !CASHPOINT_TYPES[cpType] {
+		return false
+	}
+	lon, okLon := data["longitude"].(float64)
+	lat, okLat := data["latitude"].(float64)
+	if okLon != okLat || (okLon && !quadkey.IsValidCoordinate(lon, lat)) {
+		return false
+	}
+	return true
+}
+
+// Applies fields of patch existing in cashpoint, returns false if nothing changed
+func applyCashpointPatch(cp *models.Cashpoint, data map[string]interface{}) (*models.Cashpoint, bool) {
+	oldJson, _ := json.Marshal(cp)
+	var fields map[string]interface{}
+	json.Unmarshal(oldJson, &fields)
+
+	changed := false
+	for k, v := range data {
+		if old, ok := fields[k]; ok && !reflect.DeepEqual(old, v) {
+			fields[k] = v
+			changed = true
+		}
+	}
+	if !changed {
+		return cp, false
+	}
+
+	newJson, _ := json.Marshal(fields)
+	var result models.Cashpoint
+	if err := json.Unmarshal(newJson, &result); err != nil {
+		return cp, false
+	}
+	return &result, true
+}
+
+func (b *MemoryBackend) nextPatchId() uint64 {
+	var id uint64 = 0
+	for patchId := range b.patches {
+		if patchId > id {
+			id = patchId
+		}
+	}
+	return id + 1
+}
+
+// Commits patch data to cashpoints, returns id of created / updated
+// cashpoint or 0 (cashpointCommit of cpapi.lua)
+func (b *MemoryBackend) cashpointCommit(data map[string]interface{}, userId uint64) uint32 {
+	timestamp := memoryTimestamp()
+
+	if idValue, ok := data["id"]; ok {
+		idNum, _ := idValue.(float64)
+		old, ok := b.cashpoints[uint32(idNum)]
+		if !ok || !b.validateCashpointData(data) {
+			return 0
+		}
+
+		if len(data) == 1 { // not a patch but a mark of new cashpoint
+			old.Approved = true
+			old.Timestamp = timestamp
+			if town, ok := b.towns[old.TownId]; ok {
+				town.CashpointsCount++
+			}
+			b.syncLogTouch(SYNC_KIND_CASHPOINT, old.Id, old.TownId, timestamp, false)
+			return old.Id
+		}
+
+		cp, changed := applyCashpointPatch(old, data)
+		if !changed {
+			return 0
+		}
+		if cp.TownId != old.TownId {
+			if town, ok := b.towns[old.TownId]; ok {
+				town.CashpointsCount--
+			}
+			if town, ok := b.towns[cp.TownId]; ok {
+				town.CashpointsCount++
+			}
+		}
+		cp.Version++
+		cp.Timestamp = timestamp
+		cp.Approved = true
+		b.cashpoints[cp.Id] = cp
+		b.clusters = nil
+		b.syncLogTouch(SYNC_KIND_CASHPOINT, cp.Id, cp.TownId, timestamp, false)
+		return cp.Id
+	}
+
+	if !b.validateCashpointData(data) {
+		return 0
+	}
+	dataJson, _ := json.Marshal(data)
+	cp := new(models.Cashpoint)
+	if err := json.Unmarshal(dataJson, cp); err != nil {
+		return 0
+	}
+	if _, err := quadkey.Encode(cp.Longitude, cp.Latitude, quadkey.CLUSTER_ZOOM_MAX); err != nil {
+		return 0
+	}
+
+	var id uint32 = 0
+	for cpId := range b.cashpoints {
+		if cpId > id {
+			id = cpId
+		}
+	}
+	cp.Id = id + 1
+	cp.Version = 0
+	cp.Timestamp = timestamp
+	cp.Approved = false
+	cp.UserId = uint32(userId)
+	b.cashpoints[cp.Id] = cp
+	b.clusters = nil
+	b.syncLogTouch(SYNC_KIND_CASHPOINT, cp.Id, cp.TownId, timestamp, false)
+
+	patchData, _ := json.Marshal(map[string]uint32{"id": cp.Id})
+	patchId := b.nextPatchId()
+	b.patches[patchId] = &memoryPatch{Id: patchId, CashpointId: uint64(cp.Id), UserId: userId, Data: string(patchData), Timestamp: timestamp}
+	return cp.Id
+}
+
+// Returns id of created or patched cashpoint, 0 if patch is invalid or
+// same patch is already proposed
+func (b *MemoryBackend) cashpointProposePatch(args []interface{}) (interface{}, error) {
+	func_ := "cashpointProposePatch"
+	req := struct {
+		UserId *uint64                `json:"user_id"`
+		Data   map[string]interface{} `json:"data"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if req.UserId == nil {
+		return nil, memoryMalformedRequest(func_, "missing required field user_id in request")
+	}
+	if req.Data == nil {
+		return nil, memoryMalformedRequest(func_, "missing required field data in request")
+	}
+
+	idValue, ok := req.Data["id"]
+	if !ok { // creating new cashpoint
+		return uint64(b.cashpointCommit(req.Data, *req.UserId)), nil
+	}
+
+	idNum, _ := idValue.(float64)
+	cpId := uint64(idNum)
+	delete(req.Data, "id") // don't save cashpoint id in patch
+
+	old, ok := b.cashpoints[uint32(cpId)]
+	if !ok || !b.validateCashpointData(req.Data) {
+		return uint64(0), nil
+	}
+	if _, changed := applyCashpointPatch(old, req.Data); !changed {
+		return uint64(0), nil
+	}
+
+	patchJson, _ := json.Marshal(req.Data)
+	for _, patch := range b.patches {
+		if patch.CashpointId == cpId && patch.Data == string(patchJson) { // same patch already exists
+			return uint64(0), nil
+		}
+	}
+
+	patchId := b.nextPatchId()
+	b.patches[patchId] = &memoryPatch{Id: patchId, CashpointId: cpId, UserId: *req.UserId, Data: string(patchJson), Timestamp: memoryTimestamp()}
+	return cpId, nil
+}
+
+func (b *MemoryBackend) getCashpointPatches(args []interface{}) (interface{}, error) {
+	cpId := memoryArgUint(args, 0)
+	result := make(map[string]json.RawMessage)
+	for _, patch := range b.patches {
+		if patch.CashpointId == cpId {
+			result[strconv.FormatUint(patch.Id, 10)] = json.RawMessage(patch.Data)
+		}
+	}
+	return memoryJson(result)
+}
+
+// Returns patch tuple: [id, cashpoint id, user id, data, timestamp]
+func (b *MemoryBackend) getCashpointPatchByPatchId(args []interface{}) (interface{}, error) {
+	patch, ok := b.patches[memoryArgUint(args, 0)]
+	if !ok {
+		return nil, nil
+	}
+	return memoryTuple{patch.Id, patch.CashpointId, patch.UserId, patch.Data, patch.Timestamp}, nil
+}
+
+func (b *MemoryBackend) deletePatch(patchId uint64) {
+	for voteId, vote := range b.votes {
+		if vote.PatchId == patchId {
+			delete(b.votes, voteId)
+		}
+	}
+	delete(b.patches, patchId)
+}
+
+func (b *MemoryBackend) deleteCashpointPatchById(args []interface{}) (interface{}, error) {
+	b.deletePatch(memoryArgUint(args, 0))
+	return nil, nil
+}
+
+func (b *MemoryBackend) getPatchVotes(patchId uint64) []*memoryVote {
+	result := make([]*memoryVote, 0)
+	for _, vote := range b.votes {
+		if vote.PatchId == patchId {
+			result = append(result, vote)
+		}
+	}
+	sort.Sort(memoryVoteList(result))
+	return result
+}
+
+type memoryVoteList []*memoryVote
+
+func (l memoryVoteList) Len() int           { return len(l) }
+func (l memoryVoteList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l memoryVoteList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+func (b *MemoryBackend) getCashpointPatchVotes(args []interface{}) (interface{}, error) {
+	result := make([]models.PatchVote, 0)
+	for _, vote := range b.getPatchVotes(memoryArgUint(args, 0)) {
+		result = append(result, models.PatchVote{UserId: vote.UserId, Score: int32(vote.Score)})
+	}
+	return memoryJson(result)
+}
+
+// Votes for patch, patch is committed once votes score reaches
+// MEMORY_PATCH_APPROVE_VOTES. Returns false if user has already voted.
+func (b *MemoryBackend) cashpointVotePatch(args []interface{}) (interface{}, error) {
+	func_ := "cashpointVotePatch"
+	vote := struct {
+		PatchId *uint64 `json:"patch_id"`
+		UserId  *uint64 `json:"user_id"`
+		Score   *int64  `json:"score"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &vote); err != nil {
+		return nil, err
+	}
+	if vote.PatchId == nil {
+		return nil, memoryMalformedRequest(func_, "missing patch id for vote")
+	}
+	patch, ok := b.patches[*vote.PatchId]
+	if !ok {
+		return nil, memoryMalformedRequest(func_, "no such patch id for vote")
+	}
+	if vote.UserId == nil {
+		return nil, memoryMalformedRequest(func_, "missing user_id for vote")
+	}
+	if vote.Score == nil || (*vote.Score != 1 && *vote.Score != -1) {
+		return nil, memoryMalformedRequest(func_, "wrong vote score")
+	}
+
+	score := *vote.Score
+	for _, v := range b.getPatchVotes(patch.Id) {
+		if v.UserId == *vote.UserId { // one vote per user
+			return false, nil
+		}
+		score += v.Score
+	}
+
+	var voteId uint64 = 0
+	for id := range b.votes {
+		if id > voteId {
+			voteId = id
+		}
+	}
+	voteId++
+	b.votes[voteId] = &memoryVote{Id: voteId, PatchId: patch.Id, UserId: *vote.UserId, Score: *vote.Score}
+
+	if score >= MEMORY_PATCH_APPROVE_VOTES {
+		var data map[string]interface{}
+		json.Unmarshal([]byte(patch.Data), &data)
+		if _, ok := data["id"]; !ok {
+			data["id"] = float64(patch.CashpointId)
+		}
+		if b.cashpointCommit(data, *vote.UserId) == 0 {
+			delete(b.votes, voteId)
+			return nil, tarantool.Error{Code: 400, Msg: "cannot commit approved cashpoint patch"}
+		}
+	}
+	return true, nil
+}
+
+// ======================================================================
+// Towns, banks and metro
+
+// Copy of town with has_metro flag
+func (b *MemoryBackend) townReply(town *models.Town) *models.Town {
+	hasMetro := false
+	for _, metro := range b.metro {
+		if metro.TownId == town.Id {
+			hasMetro = true
+			break
+		}
+	}
+	reply := *town
+	reply.HasMetro = hasMetro
+	return &reply
+}
+
+func (b *MemoryBackend) getTownById(args []interface{}) (interface{}, error) {
+	town, ok := b.towns[uint32(memoryArgUint(args, 0))]
+	if !ok {
+		return "", nil
+	}
+	return memoryJson(b.townReply(town))
+}
+
+func (b *MemoryBackend) getTownsBatch(args []interface{}) (interface{}, error) {
+	req := struct {
+		Towns []uint32 `json:"towns"`
+	}{}
+	if err := memoryArgJson("getTownsBatch", args, 0, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Town, 0, len(req.Towns))
+	for _, id := range req.Towns {
+		if town, ok := b.towns[id]; ok {
+			result = append(result, b.townReply(town))
+		}
+		if len(result) == MEMORY_MAX_TOWNS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *MemoryBackend) getTownsList(args []interface{}) (interface{}, error) {
+	result := make([]uint32, 0, len(b.towns))
+	for id := range b.towns {
+		result = append(result, id)
+	}
+	return memoryJson(sortedIds(result))
+}
+
+func (b *MemoryBackend) getTownCashpoints(args []interface{}) (interface{}, error) {
+	townId := uint32(memoryArgUint(args, 0))
+	result := make([]uint32, 0)
+	for _, cp := range b.cashpoints {
+		if cp.TownId == townId {
+			result = append(result, cp.Id)
+		}
+	}
+	return memoryJson(sortedIds(result))
+}
+
+func (b *MemoryBackend) getRegionById(args []interface{}) (interface{}, error) {
+	region, ok := b.regions[uint32(memoryArgUint(args, 0))]
+	if !ok {
+		return "", nil
+	}
+	return memoryJson(region)
+}
+
+func (b *MemoryBackend) getBankById(args []interface{}) (interface{}, error) {
+	bank, ok := b.banks[uint32(memoryArgUint(args, 0))]
+	if !ok {
+		return "", nil
+	}
+	return memoryJson(bank)
+}
+
+func (b *MemoryBackend) getBanksBatch(args []interface{}) (interface{}, error) {
+	req := struct {
+		Banks []uint32 `json:"banks"`
+	}{}
+	if err := memoryArgJson("getBanksBatch", args, 0, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Bank, 0, len(req.Banks))
+	for _, id := range req.Banks {
+		if bank, ok := b.banks[id]; ok {
+			result = append(result, bank)
+		}
+		if len(result) == MEMORY_MAX_BANKS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *MemoryBackend) getBanksList(args []interface{}) (interface{}, error) {
+	result := make([]uint32, 0, len(b.banks))
+	for id := range b.banks {
+		result = append(result, id)
+	}
+	return memoryJson(sortedIds(result))
+}
+
+// Returns ids of bank and its partners, nil if there is no such bank
+func (b *MemoryBackend) getBankPartnerNetwork(bankId uint32) []uint32 {
+	bank, ok := b.banks[bankId]
+	if !ok {
+		return nil
+	}
+	result := []uint32{bankId}
+	for _, id := range bank.Partners {
+		if id != bankId {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func (b *MemoryBackend) getBankPartners(args []interface{}) (interface{}, error) {
+	network := b.getBankPartnerNetwork(uint32(memoryArgUint(args, 0)))
+	if network == nil {
+		return "", nil
+	}
+
+	result := make([]*models.Bank, 0, len(network)-1)
+	for _, id := range network[1:] {
+		if bank, ok := b.banks[id]; ok {
+			result = append(result, bank)
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *MemoryBackend) getMetroById(args []interface{}) (interface{}, error) {
+	metro, ok := b.metro[uint32(memoryArgUint(args, 0))]
+	if !ok {
+		return "", nil
+	}
+	return memoryJson(metro)
+}
+
+func (b *MemoryBackend) getMetroList(args []interface{}) (interface{}, error) {
+	townId := uint32(memoryArgUint(args, 0))
+	result := make([]uint32, 0)
+	for _, metro := range b.metro {
+		if metro.TownId == townId {
+			result = append(result, metro.Id)
+		}
+	}
+	return memoryJson(sortedIds(result))
+}
+
+func (b *MemoryBackend) getMetroBatch(args []interface{}) (interface{}, error) {
+	req := struct {
+		Metro []uint32 `json:"metro"`
+	}{}
+	if err := memoryArgJson("getMetroBatch", args, 0, &req); err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Metro, 0, len(req.Metro))
+	for _, id := range req.Metro {
+		if metro, ok := b.metro[id]; ok {
+			result = append(result, metro)
+		}
+		if len(result) == MEMORY_MAX_METRO_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+// ======================================================================
+// List pages
+
+// Compares values of list field (numbers or strings)
+func compareListValues(a, b interface{}) int {
+	switch va := a.(type) {
+	case float64:
+		if vb, ok := b.(float64); ok {
+			if va < vb {
+				return -1
+			} else if va > vb {
+				return 1
+			}
+		}
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb)
+		}
+	}
+	return 0
+}
+
+type listItems struct {
+	items []map[string]interface{}
+	less  func(a, b map[string]interface{}) bool
+}
+
+func (l listItems) Len() int           { return len(l.items) }
+func (l listItems) Swap(i, j int)      { l.items[i], l.items[j] = l.items[j], l.items[i] }
+func (l listItems) Less(i, j int) bool { return l.less(l.items[i], l.items[j]) }
+
+// Page of items sorted by field and id (getListPage of common.lua).
+// req: { limit, after: { value, id }, sort, desc, fields }
+func getListPage(func_ string, items []map[string]interface{}, args []interface{}) (interface{}, error) {
+	req := struct {
+		Limit  *float64               `json:"limit"`
+		After  map[string]interface{} `json:"after"`
+		Sort   string                 `json:"sort"`
+		Desc   bool                   `json:"desc"`
+		Fields []string               `json:"fields"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	sortField := req.Sort
+	if sortField == "" {
+		sortField = "id"
+	}
+
+	limit := MEMORY_DEFAULT_LIST_PAGE
+	if req.Limit != nil {
+		if *req.Limit <= 0 || *req.Limit > MEMORY_MAX_LIST_PAGE {
+			return nil, memoryMalformedRequest(func_, "limit is out of range")
+		}
+		limit = int(*req.Limit)
+	}
+
+	var emptyValue interface{} = 0.0
+	for _, item := range items {
+		if _, ok := item[sortField].(string); ok {
+			emptyValue = ""
+			break
+		}
+	}
+	key := func(item map[string]interface{}) interface{} {
+		if value, ok := item[sortField]; ok && value != nil {
+			return value
+		}
+		return emptyValue
+	}
+	less := func(a, b map[string]interface{}) bool {
+		if c := compareListValues(key(a), key(b)); c != 0 {
+			return (c < 0) != req.Desc
+		}
+		return compareListValues(a["id"], b["id"]) < 0
+	}
+	sort.Sort(listItems{items, less})
+
+	first := 0
+	if req.After != nil {
+		id, ok := req.After["id"].(float64)
+		value := req.After["value"]
+		if !ok || (len(items) > 0 && reflect.TypeOf(value) != reflect.TypeOf(emptyValue)) {
+			return nil, memoryMalformedRequest(func_, "malformed cursor")
+		}
+		cursor := map[string]interface{}{"id": id, sortField: value}
+		for first < len(items) && !less(cursor, items[first]) {
+			first++
+		}
+	}
+
+	last := first + limit
+	if last > len(items) {
+		last = len(items)
+	}
+	result := make([]map[string]interface{}, 0, last-first)
+	reply := map[string]interface{}{"more": first+limit < len(items)}
+	for _, item := range items[first:last] {
+		reply["last"] = map[string]interface{}{"value": key(item), "id": item["id"]}
+		if req.Fields != nil {
+			projected := map[string]interface{}{"id": item["id"]}
+			for _, field := range req.Fields {
+				projected[field] = item[field]
+			}
+			item = projected
+		}
+		result = append(result, item)
+	}
+	reply["items"] = result
+	return memoryJson(reply)
+}
+
+// Fields of object as they are encoded in json
+func memoryListItem(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	item := make(map[string]interface{})
+	json.Unmarshal(data, &item)
+	return item
+}
+
+func (b *MemoryBackend) getTownsPage(args []interface{}) (interface{}, error) {
+	items := make([]map[string]interface{}, 0, len(b.towns))
+	for _, town := range b.towns {
+		item := memoryListItem(b.townReply(town))
+		item["population"] = float64(town.Population)
+		item["cashpoints_count"] = float64(town.CashpointsCount)
+		items = append(items, item)
+	}
+	return getListPage("getTownsPage", items, args)
+}
+
+// Cashpoints count is computed only if it is requested as sort or
+// projection field like in getBanksPage of bankapi.lua
+func (b *MemoryBackend) getBanksPage(args []interface{}) (interface{}, error) {
+	func_ := "getBanksPage"
+	req := struct {
+		Sort   string   `json:"sort"`
+		Fields []string `json:"fields"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	needCount := req.Sort == "cashpoints_count"
+	for _, field := range req.Fields {
+		if field == "cashpoints_count" {
+			needCount = true
+		}
+	}
+	counts := make(map[uint32]uint32)
+	if needCount {
+		for _, cp := range b.cashpoints {
+			counts[cp.BankId]++
+		}
+	}
+
+	items := make([]map[string]interface{}, 0, len(b.banks))
+	for _, bank := range b.banks {
+		item := memoryListItem(bank)
+		if needCount {
+			item["cashpoints_count"] = float64(counts[bank.Id])
+		}
+		items = append(items, item)
+	}
+	return getListPage(func_, items, args)
+}
+
+// ======================================================================
+// Heatmap
+
+// Picks zoom of quadkey clusters fine enough for cell of cellWidth degrees
+// (_getHeatmapZoom of heatmapapi.lua), returns false if raw cashpoints
+// have to be used. Clusters of zoom have keys of zoom + 1 length, so the
+// finest zoom is CLUSTER_ZOOM_MAX - 1.
+func getHeatmapZoom(cellWidth float64) (int, bool) {
+	for zoom := quadkey.CLUSTER_ZOOM_MIN; zoom < quadkey.CLUSTER_ZOOM_MAX; zoom++ {
+		tileWidth := 360.0 / math.Pow(2, float64(zoom))
+		if tileWidth*2 <= cellWidth {
+			return zoom, true
+		}
+	}
+	return 0, false
+}
+
+type heatmapCell struct {
+	Col       int     `json:"col"`
+	Row       int     `json:"row"`
+	Count     int     `json:"count"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+type heatmapCellList []*heatmapCell
+
+func (l heatmapCellList) Len() int      { return len(l) }
+func (l heatmapCellList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l heatmapCellList) Less(i, j int) bool {
+	if l[i].Row != l[j].Row {
+		return l[i].Row < l[j].Row
+	}
+	return l[i].Col < l[j].Col
+}
+
+// req: { topLeft, bottomRight, cols, rows, filter }
+// Returns non-empty cells of cols x rows grid over bbox with cashpoints count
+func (b *MemoryBackend) getHeatmap(args []interface{}) (interface{}, error) {
+	func_ := "getHeatmap"
+	req, err := b.getNearbyRequest(func_, args)
+	if err != nil {
+		return nil, err
+	}
+	grid := struct {
+		Cols *float64 `json:"cols"`
+		Rows *float64 `json:"rows"`
+	}{}
+	if err = memoryArgJson(func_, args, 0, &grid); err != nil {
+		return nil, err
+	}
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{{"cols", grid.Cols}, {"rows", grid.Rows}} {
+		if field.value == nil || *field.value < 1 || *field.value > MEMORY_MAX_HEATMAP_GRID {
+			return nil, memoryMalformedRequest(func_, "%s is out of range [1, %d]", field.name, MEMORY_MAX_HEATMAP_GRID)
+		}
+	}
+	cols, rows := *grid.Cols, *grid.Rows
+
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	cellWidth := (maxLon - minLon) / cols
+	cellHeight := (maxLat - minLat) / rows
+	if cellWidth <= 0 || cellHeight <= 0 {
+		return nil, memoryMalformedRequest(func_, "empty bbox")
+	}
+
+	cells := make(map[int]*heatmapCell)
+	addToCell := func(longitude, latitude float64, count int) {
+		if count == 0 || !req.contains(longitude, latitude) {
+			return
+		}
+		col := int(math.Min(math.Floor((longitude-minLon)/cellWidth), cols-1))
+		// rows go from top to bottom
+		row := int(math.Min(math.Floor((maxLat-latitude)/cellHeight), rows-1))
+		key := row*int(cols) + col
+		cell, ok := cells[key]
+		if !ok {
+			cell = &heatmapCell{Col: col, Row: row}
+			cells[key] = cell
+		}
+		cell.Count += count
+	}
+
+	reply := struct {
+		CellWidth  float64         `json:"cell_width"`
+		CellHeight float64         `json:"cell_height"`
+		Zoom       *int            `json:"zoom,omitempty"`
+		Cells      heatmapCellList `json:"cells"`
+	}{CellWidth: cellWidth, CellHeight: cellHeight, Cells: make(heatmapCellList, 0)}
+
+	if zoom, ok := getHeatmapZoom(cellWidth); ok {
+		reply.Zoom = &zoom
+		for quadKey, c := range b.getClusters() {
+			if len(quadKey) != zoom+1 {
+				continue
+			}
+			count := len(c.Members)
+			if !req.Filter.isEmpty() {
+				count = 0
+				for _, id := range c.Members {
+					if cp, ok := b.cashpoints[id]; ok && memoryMatching(cp, req.Filter, true) {
+						count++
+					}
+				}
+			}
+			addToCell(c.Longitude, c.Latitude, count)
+		}
+	} else {
+		for _, cp := range b.cashpoints {
+			if memoryMatching(cp, req.Filter, true) {
+				addToCell(cp.Longitude, cp.Latitude, 1)
+			}
+		}
+	}
+
+	for _, cell := range cells {
+		cell.Longitude = minLon + (float64(cell.Col)+0.5)*cellWidth
+		cell.Latitude = maxLat - (float64(cell.Row)+0.5)*cellHeight
+		reply.Cells = append(reply.Cells, cell)
+	}
+	sort.Sort(reply.Cells)
+	return memoryJson(reply)
+}
+
+// ======================================================================
+// Stats
+
+type statsCount struct {
+	key   uint32
+	count uint32
+}
+
+// Most frequent first
+type statsCountList []statsCount
+
+func (l statsCountList) Len() int      { return len(l) }
+func (l statsCountList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l statsCountList) Less(i, j int) bool {
+	if l[i].count != l[j].count {
+		return l[i].count > l[j].count
+	}
+	return l[i].key < l[j].key
+}
+
+func statsCountToList(counts map[uint32]uint32, keyName string) []map[string]uint32 {
+	list := make(statsCountList, 0, len(counts))
+	for key, count := range counts {
+		list = append(list, statsCount{key, count})
+	}
+	sort.Sort(list)
+
+	result := make([]map[string]uint32, 0, len(list))
+	for _, c := range list {
+		result = append(result, map[string]uint32{keyName: c.key, "count": c.count})
+	}
+	return result
+}
+
+// Aggregates approved cashpoints of towns, nil means all towns
+// (_collectStats of statsapi.lua). Density is calculated over towns with
+// known population only.
+func (b *MemoryBackend) collectStats(towns []*models.Town) map[string]interface{} {
+	inTowns := make(map[uint32]bool)
+	populated := make(map[uint32]bool)
+	var population uint64 = 0
+	if towns == nil {
+		for _, town := range b.towns {
+			towns = append(towns, town)
+		}
+	}
+	for _, town := range towns {
+		inTowns[town.Id] = true
+		if town.Population > 0 {
+			populated[town.Id] = true
+			population += uint64(town.Population)
+		}
+	}
+
+	var cashpointsCount, roundTheClock, populatedCount uint32
+	byBank := make(map[uint32]uint32)
+	byCurrency := make(map[uint32]uint32)
+	byType := make(map[string]uint32)
+	for _, cp := range b.cashpoints {
+		if !cp.Approved || !inTowns[cp.TownId] {
+			continue
+		}
+		cashpointsCount++
+		byBank[cp.BankId]++
+		byType[cp.Type]++
+		for _, currency := range cp.Currency {
+			byCurrency[currency]++
+		}
+		if cp.RoundTheClock {
+			roundTheClock++
+		}
+		if populated[cp.TownId] {
+			populatedCount++
+		}
+	}
+
+	stats := map[string]interface{}{
+		"cashpoints_count": cashpointsCount,
+		"round_the_clock":  roundTheClock,
+		"population":       population,
+		"by_bank":          statsCountToList(byBank, "bank_id"),
+		"by_currency":      statsCountToList(byCurrency, "currency"),
+		"by_type":          byType,
+	}
+	if population > 0 {
+		stats["density_per_10k"] = float64(populatedCount) * 10000 / float64(population)
+	}
+	return stats
+}
+
+// Returns cashpoints statistics json of town, region or whole country
+// (scope 'country', id is ignored) or "" if town or region does not exist
+func (b *MemoryBackend) getCashpointsStats(args []interface{}) (interface{}, error) {
+	scope, _ := memoryArgString(args, 0)
+	id := uint32(memoryArgUint(args, 1))
+
+	var stats map[string]interface{}
+	switch scope {
+	case "town":
+		town, ok := b.towns[id]
+		if !ok {
+			return "", nil
+		}
+		stats = b.collectStats([]*models.Town{town})
+		stats["id"] = town.Id
+		stats["name"] = town.Name
+		stats["name_tr"] = town.NameTr
+		stats["region_id"] = town.RegionId
+	case "region":
+		region, ok := b.regions[id]
+		if !ok {
+			return "", nil
+		}
+		towns := make([]*models.Town, 0)
+		for _, town := range b.towns {
+			if town.RegionId == id {
+				towns = append(towns, town)
+			}
+		}
+		stats = b.collectStats(towns)
+		stats["id"] = region.Id
+		stats["name"] = region.Name
+		stats["name_tr"] = region.NameTr
+		stats["towns_count"] = len(towns)
+	case "country":
+		stats = b.collectStats(nil)
+	default:
+		return nil, memoryMalformedRequest("getCashpointsStats", "unknown stats scope")
+	}
+
+	stats["scope"] = scope
+	return memoryJson(stats)
+}
+
+// ======================================================================
+// Sync log
+
+const (
+	SYNC_KIND_CASHPOINT = "cashpoint"
+	SYNC_KIND_BANK      = "bank"
+	SYNC_KIND_TOWN      = "town"
+	SYNC_KIND_METRO     = "metro"
+)
+
+// Response list names of sync kinds
+var SYNC_LISTS = map[string]string{
+	SYNC_KIND_CASHPOINT: "cashpoints",
+	SYNC_KIND_BANK:      "banks",
+	SYNC_KIND_TOWN:      "towns",
+	SYNC_KIND_METRO:     "metro",
+}
+
+type memorySyncKey struct {
+	kind string
+	id   uint32
+}
+
+type memorySyncEntry struct {
+	kind      string
+	id        uint32
+	townId    uint32
+	oldTownId uint32
+	timestamp uint64
+	deleted   bool
+}
+
+// Oldest first, entries with the same timestamp are ordered by kind and id
+type memorySyncEntryList []*memorySyncEntry
+
+func (l memorySyncEntryList) Len() int      { return len(l) }
+func (l memorySyncEntryList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l memorySyncEntryList) Less(i, j int) bool {
+	if l[i].timestamp != l[j].timestamp {
+		return l[i].timestamp < l[j].timestamp
+	}
+	if l[i].kind != l[j].kind {
+		return l[i].kind < l[j].kind
+	}
+	return l[i].id < l[j].id
+}
+
+// Records change of object for delta sync (syncLogTouch of syncapi.lua),
+// current time is used if timestamp is 0. Town of moved object is
+// remembered, so clients syncing old town get it as deleted.
+func (b *MemoryBackend) syncLogTouch(kind string, id, townId uint32, timestamp uint64, deleted bool) {
+	if timestamp == 0 {
+		timestamp = memoryTimestamp()
+	}
+
+	key := memorySyncKey{kind, id}
+	var oldTownId uint32 = 0
+	if prev, ok := b.syncLog[key]; ok {
+		if prev.townId != townId {
+			oldTownId = prev.townId
+		} else {
+			oldTownId = prev.oldTownId
+		}
+	}
+	b.syncLog[key] = &memorySyncEntry{kind, id, townId, oldTownId, timestamp, deleted}
+}
+
+// Returns object of sync kind, nil if it does not exist
+func (b *MemoryBackend) getSyncObject(kind string, id uint32) interface{} {
+	switch kind {
+	case SYNC_KIND_CASHPOINT:
+		if cp, ok := b.cashpoints[id]; ok {
+			return b.cashpointReply(cp)
+		}
+	case SYNC_KIND_BANK:
+		if bank, ok := b.banks[id]; ok {
+			return bank
+		}
+	case SYNC_KIND_TOWN:
+		if town, ok := b.towns[id]; ok {
+			return b.townReply(town)
+		}
+	case SYNC_KIND_METRO:
+		if metro, ok := b.metro[id]; ok {
+			return metro
+		}
+	}
+	return nil
+}
+
+// req: { since: { timestamp, kind, id }, town_id, limit }, kind and id of
+// since and town_id are optional (getSyncChanges of syncapi.lua). Sync log
+// in memory is never rebuilt, so clients are never reset.
+func (b *MemoryBackend) getSyncChanges(args []interface{}) (interface{}, error) {
+	func_ := "getSyncChanges"
+	req := struct {
+		Since *struct {
+			Timestamp *uint64 `json:"timestamp"`
+			Kind      string  `json:"kind"`
+			Id        uint32  `json:"id"`
+		} `json:"since"`
+		TownId *uint32 `json:"town_id"`
+		Limit  int     `json:"limit"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if req.Since == nil || req.Since.Timestamp == nil {
+		return nil, memoryMalformedRequest(func_, "missing since timestamp")
+	}
+	since := memorySyncEntry{kind: req.Since.Kind, id: req.Since.Id, timestamp: *req.Since.Timestamp}
+
+	limit := MEMORY_MAX_SYNC_BATCH
+	if req.Limit > 0 && req.Limit < MEMORY_MAX_SYNC_BATCH {
+		limit = req.Limit
+	}
+
+	entries := make(memorySyncEntryList, 0)
+	for _, e := range b.syncLog {
+		if since.kind != "" && since.id != 0 {
+			if memorySyncEntryList([]*memorySyncEntry{&since, e}).Less(0, 1) {
+				entries = append(entries, e)
+			}
+		} else if e.timestamp > since.timestamp {
+			entries = append(entries, e)
+		}
+	}
+	sort.Sort(entries)
+	more := len(entries) > limit
+	if more {
+		entries = entries[:limit]
+	}
+
+	result := make(map[string]interface{})
+	deleted := make(map[string][]uint32)
+	for _, list := range SYNC_LISTS {
+		result[list] = make([]interface{}, 0)
+		deleted[list] = make([]uint32, 0)
+	}
+	for _, e := range entries {
+		list := SYNC_LISTS[e.kind]
+		isDeleted := e.deleted
+		if req.TownId != nil && (e.kind == SYNC_KIND_CASHPOINT || e.kind == SYNC_KIND_METRO) && e.townId != *req.TownId {
+			if e.oldTownId != *req.TownId {
+				continue
+			}
+			isDeleted = true // moved out of requested town
+		}
+
+		if !isDeleted {
+			if obj := b.getSyncObject(e.kind, e.id); obj != nil {
+				result[list] = append(result[list].([]interface{}), obj)
+				continue
+			}
+		}
+		deleted[list] = append(deleted[list], e.id)
+	}
+
+	last := SyncCursor{Timestamp: since.timestamp, Kind: since.kind, Id: uint64(since.id)}
+	if len(entries) > 0 {
+		e := entries[len(entries)-1]
+		last = SyncCursor{Timestamp: e.timestamp, Kind: e.kind, Id: uint64(e.id)}
+	}
+
+	result["deleted"] = deleted
+	result["last"] = last
+	result["more"] = more
+	result["reset"] = false
+	return memoryJson(result)
+}
+
+// ======================================================================
+// Admin
+
+// Field of reference object editable by admins. Fields without default
+// value are required for creation.
+type adminField struct {
+	Type     string // lua type of json value
+	Default  interface{}
+	ReadOnly bool
+}
+
+// Fields of reference objects editable by admins (ADMIN_KINDS of adminapi.lua)
+var ADMIN_FIELDS = map[string]map[string]adminField{
+	"bank": {
+		"name":        {Type: "string"},
+		"name_tr":     {Type: "string", Default: ""},
+		"name_tr_alt": {Type: "string", Default: ""},
+		"partners":    {Type: "table", Default: []interface{}{}},
+		"town":        {Type: "string", Default: ""},
+		"licence":     {Type: "number", Default: 0.0},
+		"rating":      {Type: "number", Default: 0.0},
+		"tel":         {Type: "string", Default: ""},
+	},
+	"town": {
+		"longitude":        {Type: "number"},
+		"latitude":         {Type: "number"},
+		"name":             {Type: "string"},
+		"name_tr":          {Type: "string", Default: ""},
+		"region_id":        {Type: "number", Default: 0.0},
+		"regional_center":  {Type: "boolean", Default: false},
+		"zoom":             {Type: "number", Default: 10.0},
+		"big":              {Type: "boolean", Default: false},
+		"cashpoints_count": {ReadOnly: true},
+		"population":       {Type: "number", Default: 0.0},
+	},
+	"region": {
+		"longitude": {Type: "number"},
+		"latitude":  {Type: "number"},
+		"name":      {Type: "string"},
+		"name_tr":   {Type: "string", Default: ""},
+		"zoom":      {Type: "number", Default: 7.0},
+	},
+	"metro": {
+		"longitude":         {Type: "number"},
+		"latitude":          {Type: "number"},
+		"town_id":           {Type: "number"},
+		"branch_id":         {Type: "number", Default: 0.0},
+		"station_name":      {Type: "string"},
+		"station_exit_name": {Type: "string", Default: ""},
+	},
+}
+
+func luaType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}, map[string]interface{}:
+		return "table"
+	}
+	return "nil"
+}
+
+func formatLuaNumber(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func memoryAdminError(err, message string) (interface{}, error) {
+	return memoryJson(&AdminReply{Error: err, Message: message})
+}
+
+func memoryAdminId(id uint32) (interface{}, error) {
+	return memoryJson(&AdminResponse{Id: id})
+}
+
+func getAdminFields(kind string) (map[string]adminField, error) {
+	fields, ok := ADMIN_FIELDS[kind]
+	if !ok {
+		return nil, memoryMalformedRequest("admin", "unknown kind: %s", kind)
+	}
+	return fields, nil
+}
+
+// Decodes json object of admin request, returns nil if it is not an object
+func getAdminData(args []interface{}, i int) map[string]interface{} {
+	reqJson, _ := memoryArgString(args, i)
+	var data map[string]interface{}
+	if json.Unmarshal([]byte(reqJson), &data) != nil {
+		return nil
+	}
+	return data
+}
+
+func sortedFieldNames(fields map[string]adminField) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Applies fields of data to obj, missing fields are taken from defaults
+// if obj is created. Returns error message.
+func applyAdminFields(fields map[string]adminField, obj, data map[string]interface{}, create bool) string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := fields[name]
+		if !ok || field.ReadOnly {
+			return "unknown field: " + name
+		}
+		if luaType(data[name]) != field.Type {
+			return "invalid type of field " + name + ", expected " + field.Type
+		}
+	}
+
+	for _, name := range sortedFieldNames(fields) {
+		field := fields[name]
+		if field.ReadOnly {
+			continue
+		}
+		value, ok := data[name]
+		if !ok && create {
+			if field.Default == nil {
+				return "missing required field: " + name
+			}
+			value, ok = field.Default, true
+		}
+		if ok {
+			obj[name] = value
+		}
+	}
+	return ""
+}
+
+// Reads editable fields of object, returns nil if there is no such object
+func (b *MemoryBackend) getAdminObject(kind string, id uint32) map[string]interface{} {
+	var obj map[string]interface{}
+	switch kind {
+	case "bank":
+		if bank, ok := b.banks[id]; ok {
+			obj = memoryListItem(bank)
+			obj["town"] = bank.Town
+		}
+	case "town":
+		if town, ok := b.towns[id]; ok {
+			obj = memoryListItem(town)
+			obj["population"] = float64(town.Population)
+			delete(obj, "has_metro")
+		}
+	case "region":
+		if region, ok := b.regions[id]; ok {
+			obj = memoryListItem(region)
+		}
+	case "metro":
+		if metro, ok := b.metro[id]; ok {
+			obj = memoryListItem(metro)
+		}
+	}
+	if obj != nil {
+		delete(obj, "id")
+	}
+	return obj
+}
+
+// Returns id for object created without one (auto_increment of space)
+func (b *MemoryBackend) nextAdminId(kind string) uint32 {
+	ids := make([]uint32, 0)
+	switch kind {
+	case "bank":
+		for id := range b.banks {
+			ids = append(ids, id)
+		}
+	case "town":
+		for id := range b.towns {
+			ids = append(ids, id)
+		}
+	case "region":
+		for id := range b.regions {
+			ids = append(ids, id)
+		}
+	case "metro":
+		for id := range b.metro {
+			ids = append(ids, id)
+		}
+	}
+	var maxId uint32 = 0
+	for _, id := range ids {
+		if id > maxId {
+			maxId = id
+		}
+	}
+	return maxId + 1
+}
+
+// Stores object, fields hidden in json of objects are set explicitly
+func (b *MemoryBackend) writeAdminObject(kind string, id uint32, obj map[string]interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "bank":
+		bank := &models.Bank{}
+		if err = json.Unmarshal(data, bank); err != nil {
+			return err
+		}
+		bank.Id = id
+		bank.Town, _ = obj["town"].(string)
+		if bank.Partners == nil {
+			bank.Partners = []uint32{}
+		}
+		b.banks[id] = bank
+		b.syncLogTouch(SYNC_KIND_BANK, id, 0, 0, false)
+	case "town":
+		town := &models.Town{}
+		if err = json.Unmarshal(data, town); err != nil {
+			return err
+		}
+		town.Id = id
+		population, _ := obj["population"].(float64)
+		town.Population = uint32(population)
+		if old, ok := b.towns[id]; ok {
+			town.CashpointsCount = old.CashpointsCount
+		}
+		b.towns[id] = town
+		b.syncLogTouch(SYNC_KIND_TOWN, id, 0, 0, false)
+	case "region":
+		region := &models.Region{}
+		if err = json.Unmarshal(data, region); err != nil {
+			return err
+		}
+		region.Id = id
+		b.regions[id] = region
+	case "metro":
+		metro := &models.Metro{}
+		if err = json.Unmarshal(data, metro); err != nil {
+			return err
+		}
+		metro.Id = id
+		b.metro[id] = metro
+		b.syncLogTouch(SYNC_KIND_METRO, id, metro.TownId, 0, false)
+	}
+	return nil
+}
+
+// Checks references of object to other objects, returns error message
+func (b *MemoryBackend) checkAdminReferences(kind string, id uint32, obj map[string]interface{}) string {
+	switch kind {
+	case "bank":
+		partners, _ := obj["partners"].([]interface{})
+		for _, partner := range partners {
+			partnerId, ok := partner.(float64)
+			if !ok {
+				return "partners must contain bank ids"
+			}
+			if _, found := b.banks[uint32(partnerId)]; uint32(partnerId) == id || !found {
+				return "no such partner bank: " + formatLuaNumber(partnerId)
+			}
+		}
+	case "town":
+		regionId, _ := obj["region_id"].(float64)
+		if _, found := b.regions[uint32(regionId)]; regionId != 0 && !found {
+			return "no such region: " + formatLuaNumber(regionId)
+		}
+	case "metro":
+		townId, _ := obj["town_id"].(float64)
+		if _, found := b.towns[uint32(townId)]; !found {
+			return "no such town: " + formatLuaNumber(townId)
+		}
+	}
+	return ""
+}
+
+// Checks whether pending cashpoint patches set field to id
+func (b *MemoryBackend) patchesRefer(field string, id uint32) bool {
+	for _, patch := range b.patches {
+		var data map[string]interface{}
+		if json.Unmarshal([]byte(patch.Data), &data) == nil && data[field] == float64(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns description of objects referencing object or empty string
+func (b *MemoryBackend) findAdminReferrers(kind string, id uint32) string {
+	switch kind {
+	case "bank":
+		for _, cp := range b.cashpoints {
+			if cp.BankId == id {
+				return "bank has cashpoints"
+			}
+		}
+		bankIds := make([]uint32, 0, len(b.banks))
+		for bankId := range b.banks {
+			bankIds = append(bankIds, bankId)
+		}
+		for _, bankId := range sortedIds(bankIds) {
+			for _, partnerId := range b.banks[bankId].Partners {
+				if partnerId == id {
+					return "bank is partner of bank " + strconv.FormatUint(uint64(bankId), 10)
+				}
+			}
+		}
+		if b.patchesRefer("bank_id", id) {
+			return "bank has pending cashpoint patches"
+		}
+	case "town":
+		for _, cp := range b.cashpoints {
+			if cp.TownId == id {
+				return "town has cashpoints"
+			}
+		}
+		for _, metro := range b.metro {
+			if metro.TownId == id {
+				return "town has metro stations"
+			}
+		}
+		if b.patchesRefer("town_id", id) {
+			return "town has pending cashpoint patches"
+		}
+	case "region":
+		for _, town := range b.towns {
+			if town.RegionId == id {
+				return "region has towns"
+			}
+		}
+	}
+	return ""
+}
+
+// Creates object of kind (bank, town, region, metro). Id is assigned
+// automatically unless passed in data. Returns json {id} or {error, message}.
+func (b *MemoryBackend) adminCreate(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	fields, err := getAdminFields(kind)
+	if err != nil {
+		return nil, err
+	}
+	data := getAdminData(args, 1)
+	if data == nil {
+		return memoryAdminError(ADMIN_ERR_INVALID, "malformed request json")
+	}
+
+	var id uint32 = 0
+	if idValue, ok := data["id"]; ok {
+		idNum, ok := idValue.(float64)
+		if !ok {
+			return memoryAdminError(ADMIN_ERR_INVALID, "invalid type of field id, expected number")
+		}
+		id = uint32(idNum)
+		delete(data, "id")
+	}
+
+	obj := make(map[string]interface{})
+	msg := applyAdminFields(fields, obj, data, true)
+	if msg == "" {
+		msg = b.checkAdminReferences(kind, id, obj)
+	}
+	if msg != "" {
+		return memoryAdminError(ADMIN_ERR_INVALID, msg)
+	}
+
+	if id == 0 {
+		id = b.nextAdminId(kind)
+	} else if b.getAdminObject(kind, id) != nil {
+		return memoryAdminError(ADMIN_ERR_CONFLICT, kind+" already exists with id "+strconv.FormatUint(uint64(id), 10))
+	}
+	if err = b.writeAdminObject(kind, id, obj); err != nil {
+		return nil, err
+	}
+	return memoryAdminId(id)
+}
+
+// Updates fields passed in data of existing object
+func (b *MemoryBackend) adminUpdate(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	fields, err := getAdminFields(kind)
+	if err != nil {
+		return nil, err
+	}
+	id := uint32(memoryArgUint(args, 1))
+	data := getAdminData(args, 2)
+	if data == nil {
+		return memoryAdminError(ADMIN_ERR_INVALID, "malformed request json")
+	}
+	if idValue, ok := data["id"]; ok && idValue != float64(id) {
+		return memoryAdminError(ADMIN_ERR_INVALID, "id cannot be changed")
+	}
+	delete(data, "id")
+
+	obj := b.getAdminObject(kind, id)
+	if obj == nil {
+		return memoryAdminError(ADMIN_ERR_NOT_FOUND, kind+" does not exist with id "+strconv.FormatUint(uint64(id), 10))
+	}
+
+	msg := applyAdminFields(fields, obj, data, false)
+	if msg == "" {
+		msg = b.checkAdminReferences(kind, id, obj)
+	}
+	if msg != "" {
+		return memoryAdminError(ADMIN_ERR_INVALID, msg)
+	}
+
+	if err = b.writeAdminObject(kind, id, obj); err != nil {
+		return nil, err
+	}
+	return memoryAdminId(id)
+}
+
+// Deletes object unless other objects refer to it
+func (b *MemoryBackend) adminDelete(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	if _, err := getAdminFields(kind); err != nil {
+		return nil, err
+	}
+	id := uint32(memoryArgUint(args, 1))
+
+	if b.getAdminObject(kind, id) == nil {
+		return memoryAdminError(ADMIN_ERR_NOT_FOUND, kind+" does not exist with id "+strconv.FormatUint(uint64(id), 10))
+	}
+	if referrer := b.findAdminReferrers(kind, id); referrer != "" {
+		return memoryAdminError(ADMIN_ERR_CONFLICT, referrer)
+	}
+
+	switch kind {
+	case "bank":
+		delete(b.banks, id)
+		b.syncLogTouch(SYNC_KIND_BANK, id, 0, 0, true)
+	case "town":
+		delete(b.towns, id)
+		b.syncLogTouch(SYNC_KIND_TOWN, id, 0, 0, true)
+	case "region":
+		delete(b.regions, id)
+	case "metro":
+		b.syncLogTouch(SYNC_KIND_METRO, id, b.metro[id].TownId, 0, true)
+		delete(b.metro, id)
+	}
+	return memoryAdminId(id)
+}
+
+// ======================================================================
+
+func (b *MemoryBackend) getSpaceMetrics(args []interface{}) (interface{}, error) {
+	return memoryJson(map[string]int{
+		"banks":                    len(b.banks),
+		"towns":                    len(b.towns),
+		"regions":                  len(b.regions),
+		"metro":                    len(b.metro),
+		"cashpoints":               len(b.cashpoints),
+		"cashpoints_patches":       len(b.patches),
+		"cashpoints_patches_votes": len(b.votes),
+		"clusters":                 len(b.getClusters()),
+		"clusters_cache":           0,
+	})
+}
+
+// Returns default translation of message (see models.MESSAGES) or message
+// key itself if there is no translation
+func defaultMessage(key, lang string) string {
+	if text := models.Message(key, lang); text != "" {
+		return text
+	}
+	return key
+}
+
+// There is no messages space in memory, api messages have default translations
+func (b *MemoryBackend) getMessage(args []interface{}) (interface{}, error) {
+	key, _ := memoryArgString(args, 0)
+	lang, _ := memoryArgString(args, 1)
+	return defaultMessage(key, lang), nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// OpenAPI 3 document of route table served at /openapi.json. Schemas of
+// request and response bodies are made by reflection of go types: json
+// field names, pointers are optional values, named structs go to components.
+
+const OPENAPI_VERSION = "3.0.3"
+const API_TITLE = "Cashpoints API"
+const API_VERSION = "1.0"
+
+// Subset of JSON schema used by openapi
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+}
+
+func objectSchema(properties map[string]*Schema) *Schema {
+	return &Schema{Type: "object", Properties: properties}
+}
+
+func arraySchema(items *Schema) *Schema {
+	return &Schema{Type: "array", Items: items}
+}
+
+// Batch request like {"towns": [1, 2, 3]}, see BatchParams
+func batchSchema(key string, maxSize int) *Schema {
+	ids := arraySchema(&Schema{Type: "integer"})
+	ids.MaxItems = &maxSize
+	s := objectSchema(map[string]*Schema{key: ids})
+	s.Required = []string{key}
+	return s
+}
+
+type OpenApiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenApiParam struct {
+	Ref         string  `json:"$ref,omitempty"`
+	Name        string  `json:"name,omitempty"`
+	In          string  `json:"in,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type OpenApiMedia struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Request body or response
+type OpenApiBody struct {
+	Description string                   `json:"description,omitempty"`
+	Required    bool                     `json:"required,omitempty"`
+	Content     map[string]*OpenApiMedia `json:"content,omitempty"`
+}
+
+type OpenApiOperation struct {
+	OperationId string                  `json:"operationId"`
+	Summary     string                  `json:"summary,omitempty"`
+	Tags        []string                `json:"tags,omitempty"`
+	Parameters  []*OpenApiParam         `json:"parameters"`
+	RequestBody *OpenApiBody            `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenApiBody `json:"responses"`
+	Security    []map[string][]string   `json:"security,omitempty"`
+	Permission  string                  `json:"x-permission,omitempty"`
+	TestingOnly bool                    `json:"x-testing-only,omitempty"`
+}
+
+type OpenApiComponents struct {
+	Schemas         map[string]*Schema           `json:"schemas"`
+	Parameters      map[string]*OpenApiParam     `json:"parameters"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+type OpenApiDoc struct {
+	OpenApi    string                                  `json:"openapi"`
+	Info       OpenApiInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenApiOperation `json:"paths"`
+	Components OpenApiComponents                       `json:"components"`
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// Builds schemas of go types collecting named structs to components
+type schemaBuilder struct {
+	schemas map[string]*Schema
+	types   map[string]reflect.Type
+}
+
+func (b *schemaBuilder) schemaOf(v interface{}) *Schema {
+	if s, ok := v.(*Schema); ok {
+		return s
+	}
+	return b.typeSchema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) typeSchema(t reflect.Type) *Schema {
+	if t == rawMessageType {
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return b.typeSchema(t.Elem())
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		min := 0.0
+		return &Schema{Type: "integer", Minimum: &min}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return arraySchema(b.typeSchema(t.Elem()))
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: b.typeSchema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		return b.componentRef(t)
+	}
+	return &Schema{} // any value
+}
+
+func (b *schemaBuilder) componentRef(t reflect.Type) *Schema {
+	name := t.Name()
+	if other, ok := b.types[name]; ok && other != t {
+		// same name in different packages
+		name = strings.Title(path.Base(t.PkgPath())) + name
+	}
+	if _, ok := b.types[name]; !ok {
+		b.types[name] = t // set before fields for recursive types
+		b.schemas[name] = b.structSchema(t)
+	}
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) *Schema {
+	s := objectSchema(make(map[string]*Schema))
+	b.addFields(s, t)
+	return s
+}
+
+func (b *schemaBuilder) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			b.addFields(s, fieldType)
+			continue
+		}
+		if field.PkgPath != "" { // unexported
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = b.typeSchema(field.Type)
+	}
+}
+
+// Converts mux pattern to openapi path and its params:
+// "/town/{id:[0-9]+}" => "/town/{id}"
+func getOpenApiPath(pattern string) (string, []*OpenApiParam) {
+	params := make([]*OpenApiParam, 0)
+	var result []string
+	for _, part := range strings.Split(pattern, "{") {
+		end := strings.Index(part, "}")
+		if end < 0 {
+			result = append(result, part)
+			continue
+		}
+		nameRegexp := strings.SplitN(part[:end], ":", 2)
+		param := &OpenApiParam{Name: nameRegexp[0], In: "path", Required: true, Schema: &Schema{Type: "string"}}
+		if len(nameRegexp) == 2 && nameRegexp[1] == "[0-9]+" {
+			param.Schema.Type = "integer"
+		}
+		params = append(params, param)
+		result = append(result, "{"+param.Name+"}"+part[end+1:])
+	}
+	return strings.Join(result, ""), params
+}
+
+func jsonContent(s *Schema) map[string]*OpenApiMedia {
+	return map[string]*OpenApiMedia{"application/json": {Schema: s}}
+}
+
+func newOpenApiOperation(b *schemaBuilder, route Route, pathParams []*OpenApiParam) *OpenApiOperation {
+	op := &OpenApiOperation{
+		OperationId: route.Name,
+		Summary:     route.Summary,
+		Tags:        []string{route.Tag},
+		Parameters: []*OpenApiParam{
+			{Ref: "#/components/parameters/Id"},
+			{Ref: "#/components/parameters/AcceptLanguage"},
+		},
+		Responses:   make(map[string]*OpenApiBody),
+		Permission:  route.Permission,
+		TestingOnly: route.TestingOnly,
+	}
+	op.Parameters = append(op.Parameters, pathParams...)
+	for _, param := range route.Params {
+		op.Parameters = append(op.Parameters, &OpenApiParam{
+			Name:        param.Name,
+			In:          "query",
+			Description: param.Description,
+			Schema:      &Schema{Type: param.Type},
+		})
+	}
+
+	errorResponse := func(description string) *OpenApiBody {
+		return &OpenApiBody{Description: description, Content: jsonContent(&Schema{Ref: "#/components/schemas/Message"})}
+	}
+	if route.Request != nil {
+		op.RequestBody = &OpenApiBody{Required: true, Content: jsonContent(b.schemaOf(route.Request))}
+		op.Responses["413"] = errorResponse(MSG_REQUEST_TOO_LARGE)
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := &OpenApiBody{Description: http.StatusText(status)}
+	if route.ResponseType != "" {
+		success.Content = map[string]*OpenApiMedia{route.ResponseType: {Schema: &Schema{Type: "string"}}}
+	} else if route.Response != nil {
+		success.Content = jsonContent(b.schemaOf(route.Response))
+	}
+	op.Responses[strconv.Itoa(status)] = success
+
+	// request without Id header is rejected before anything else
+	op.Responses["400"] = errorResponse(MSG_MALFORMED_REQUEST + " or " + MSG_INVALID_PARAM)
+	if len(pathParams) > 0 {
+		op.Responses["404"] = errorResponse("Object does not exist")
+	}
+	if route.Permission != "" {
+		op.Security = []map[string][]string{{"apiKey": {}}}
+		op.Responses["401"] = errorResponse(MSG_UNAUTHORIZED)
+		op.Responses["403"] = errorResponse(MSG_FORBIDDEN)
+	}
+	op.Responses["500"] = &OpenApiBody{Description: http.StatusText(http.StatusInternalServerError)}
+	return op
+}
+
+// Documents routes of table, testing only ones are left out unless
+// server is in testing mode
+func newOpenApiDoc(routes []Route, testingMode bool) *OpenApiDoc {
+	b := &schemaBuilder{schemas: make(map[string]*Schema), types: make(map[string]reflect.Type)}
+	b.componentRef(reflect.TypeOf(Message{}))
+
+	doc := &OpenApiDoc{
+		OpenApi: OPENAPI_VERSION,
+		Info:    OpenApiInfo{Title: API_TITLE, Version: API_VERSION},
+		Paths:   make(map[string]map[string]*OpenApiOperation),
+		Components: OpenApiComponents{
+			Schemas: b.schemas,
+			Parameters: map[string]*OpenApiParam{
+				"Id": {
+					Name: "Id", In: "header", Required: true,
+					Description: "nonzero request id, returned in response header",
+					Schema:      &Schema{Type: "integer"},
+				},
+				"AcceptLanguage": {
+					Name: "Accept-Language", In: "header",
+					Description: "language of names and messages, " + DEFAULT_LANG + " by default",
+					Schema:      &Schema{Type: "string"},
+				},
+			},
+			SecuritySchemes: map[string]map[string]string{
+				"apiKey": {"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		if route.TestingOnly && !testingMode {
+			continue
+		}
+		openApiPath, pathParams := getOpenApiPath(route.Path)
+		methods, ok := doc.Paths[openApiPath]
+		if !ok {
+			methods = make(map[string]*OpenApiOperation)
+			doc.Paths[openApiPath] = methods
+		}
+		methods[strings.ToLower(route.Method)] = newOpenApiOperation(b, route, pathParams)
+	}
+	return doc
+}
+
+func handlerOpenApi(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+	docJson, err := json.Marshal(newOpenApiDoc(getRoutes(), conf.TestingMode))
+	if err != nil {
+		log.Fatalf("Cannot encode openapi document: %v", err)
+	}
+	return "/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+		logger.logRequest(w, r, requestId, "")
+		w.Write(docJson)
+		logger.logResponse(w, r, requestId, "openapi document")
+	}
+}
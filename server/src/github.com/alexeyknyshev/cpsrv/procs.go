@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Endpoints of read only tarantool procedures returning json string are
+// declared by ProcEndpoint instead of handler code: path vars and request
+// body are converted to procedure arguments, empty reply is 404. New lua
+// api is exposed by route of procRoute in route table (see routes.go).
+
+type ProcArgType int
+
+const (
+	PROC_ARG_UINT32 ProcArgType = iota // path var as uint32
+	PROC_ARG_UINT64                    // path var as uint64
+	PROC_ARG_STRING                    // path var as is
+	PROC_ARG_BODY                      // json of validated request body
+	PROC_ARG_CONST                     // value of arg
+)
+
+type ProcArg struct {
+	Type  ProcArgType
+	Var   string // name of path var
+	Value interface{}
+}
+
+func varArg(name string, argType ProcArgType) ProcArg {
+	return ProcArg{Type: argType, Var: name}
+}
+
+func bodyArg() ProcArg {
+	return ProcArg{Type: PROC_ARG_BODY}
+}
+
+func constArg(value interface{}) ProcArg {
+	return ProcArg{Type: PROC_ARG_CONST, Value: value}
+}
+
+type ProcEndpoint struct {
+	Name string // handler name of log context
+	Path string // mux pattern
+	Proc string
+	Args []ProcArg
+	// Params of request body passed by PROC_ARG_BODY, nil if endpoint has
+	// no body. Ids missing in reply of *BatchParams are listed in
+	// X-Missing-Ids header
+	Params func() RequestParams
+	// Reply has names translated by Accept-Language, see lang.go
+	Localized bool
+	// Message of 404 on empty reply with value of first path var, empty
+	// reply is written as is if not set
+	NotFoundMsg string
+}
+
+func procRoute(endpoint ProcEndpoint) RouteHandler {
+	return func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+		return handlerProc(handlerContext, endpoint)
+	}
+}
+
+// Converts path vars and body to arguments of procedure, returns name of
+// invalid path var on error
+func getProcArgs(args []ProcArg, vars map[string]string, jsonStr string) ([]interface{}, string) {
+	result := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		switch arg.Type {
+		case PROC_ARG_UINT32, PROC_ARG_UINT64:
+			bitSize := 64
+			if arg.Type == PROC_ARG_UINT32 {
+				bitSize = 32
+			}
+			value, err := strconv.ParseUint(vars[arg.Var], 10, bitSize)
+			if err != nil {
+				return nil, arg.Var
+			}
+			result = append(result, value)
+		case PROC_ARG_STRING:
+			result = append(result, vars[arg.Var])
+		case PROC_ARG_BODY:
+			result = append(result, jsonStr)
+		case PROC_ARG_CONST:
+			result = append(result, arg.Value)
+		}
+	}
+	return result, ""
+}
+
+// Value of first path var of args written in not found message
+func getProcNotFoundArgs(args []ProcArg, vars map[string]string) []string {
+	for _, arg := range args {
+		if arg.Var != "" {
+			return []string{vars[arg.Var]}
+		}
+	}
+	return nil
+}
+
+func handlerProc(handlerContext HandlerContext, endpoint ProcEndpoint) (string, EndpointCallback) {
+	return endpoint.Path, func(w http.ResponseWriter, r *http.Request) {
+		logger := handlerContext.Logger()
+		ok, requestId := prepareResponse(w, r, logger)
+		if ok == false {
+			return
+		}
+
+		vars := mux.Vars(r)
+		contextParams := map[string]string{
+			"requestId": strconv.FormatInt(requestId, 10),
+		}
+		for name, value := range vars {
+			contextParams[name] = value
+		}
+		context := getRequestContexString(r) + " " + getHandlerContextString(endpoint.Name, contextParams)
+
+		var params RequestParams
+		jsonStr := ""
+		if endpoint.Params != nil {
+			var err error
+			params = endpoint.Params()
+			jsonStr, err = getRequestParams(r, params)
+			logger.logRequest(w, r, requestId, jsonStr)
+			if err != nil {
+				log.Printf("%s => invalid request: %v\n", context, err)
+				writeRequestParamsError(handlerContext, w, r, requestId, err)
+				return
+			}
+		} else {
+			logger.logRequest(w, r, requestId, "")
+		}
+
+		args, invalidVar := getProcArgs(endpoint.Args, vars, jsonStr)
+		if invalidVar != "" {
+			writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, invalidVar)
+			return
+		}
+
+		resp, err := handlerContext.Tnt().Call(endpoint.Proc, args)
+		if err != nil {
+			log.Printf("%s => cannot call %s: %v => %s\n", context, endpoint.Proc, err, jsonStr)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		var data interface{} = ""
+		if len(resp.Data) > 0 {
+			if tuple, ok := resp.Data[0].([]interface{}); ok && len(tuple) > 0 {
+				data = tuple[0]
+			}
+		}
+		replyStr, ok := data.(string)
+		if !ok {
+			log.Printf("%s => cannot convert %s reply to json str\n", context, endpoint.Proc)
+			writeHeader(w, r, requestId, http.StatusInternalServerError, logger)
+			return
+		}
+
+		if replyStr == "" && endpoint.NotFoundMsg != "" {
+			notFoundArgs := getProcNotFoundArgs(endpoint.Args, vars)
+			writeError(handlerContext, w, r, requestId, http.StatusNotFound, endpoint.NotFoundMsg, notFoundArgs...)
+			return
+		}
+		if batch, ok := params.(*BatchParams); ok {
+			setBatchMissingHeader(w, batch, replyStr)
+		}
+		if endpoint.Localized {
+			writeLocalizedResponse(w, r, requestId, replyStr, logger)
+		} else {
+			writeResponse(w, r, requestId, replyStr, logger)
+		}
+	}
+}
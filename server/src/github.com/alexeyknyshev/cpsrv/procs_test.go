@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/alexeyknyshev/models"
+	"net/http"
+	"testing"
+)
+
+func TestProcArgs(t *testing.T) {
+	t.Parallel()
+	vars := map[string]string{"id": "42", "big": "4294967296", "quadKey": "0123"}
+
+	args, invalidVar := getProcArgs([]ProcArg{
+		constArg("town"),
+		varArg("id", PROC_ARG_UINT32),
+		bodyArg(),
+		varArg("quadKey", PROC_ARG_STRING),
+		varArg("big", PROC_ARG_UINT64),
+	}, vars, `{"towns":[4]}`)
+	if invalidVar != "" {
+		t.Fatalf("Unexpected invalid var %s", invalidVar)
+	}
+	expected := []interface{}{"town", uint64(42), `{"towns":[4]}`, "0123", uint64(4294967296)}
+	if len(args) != len(expected) {
+		t.Fatalf("Expected %d args but got %v", len(expected), args)
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Errorf("Expected arg %d to be %#v but got %#v", i, expected[i], args[i])
+		}
+	}
+
+	_, invalidVar = getProcArgs([]ProcArg{varArg("id", PROC_ARG_UINT64), varArg("big", PROC_ARG_UINT32)}, vars, "")
+	if invalidVar != "big" {
+		t.Errorf("Expected out of range uint32 var to be invalid but got '%s'", invalidVar)
+	}
+	_, invalidVar = getProcArgs([]ProcArg{varArg("missing", PROC_ARG_UINT64)}, vars, "")
+	if invalidVar != "missing" {
+		t.Errorf("Expected missing var to be invalid but got '%s'", invalidVar)
+	}
+}
+
+func TestProcEndpoint(t *testing.T) {
+	t.Parallel()
+	hCtx := newHandlerContext(newFixtureBackend())
+	defer hCtx.Close()
+
+	url, handler := handlerProc(hCtx, ProcEndpoint{
+		Name: "handlerTestTown", Path: "/test/{town:[0-9]+}", Proc: "getTownById",
+		Args:        []ProcArg{varArg("town", PROC_ARG_UINT32)},
+		NotFoundMsg: MSG_NO_SUCH_TOWN,
+	})
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/test/4", HandlerUrl: url}
+	response, err := readResponse(testRequest(request, handler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		town := struct {
+			Id   uint32 `json:"id"`
+			Name string `json:"name"`
+		}{}
+		json.Unmarshal(response.Data, &town)
+		if town.Id != 4 || town.Name != "Москва" {
+			t.Errorf("Unexpected town reply: %s", string(response.Data))
+		}
+	}
+
+	// empty reply
+	request.EndpointUrl = "/test/100500"
+	response, _ = readResponse(testRequest(request, handler))
+	if checkHttpCode(t, response.Code, http.StatusNotFound) {
+		msg := &Message{}
+		json.Unmarshal(response.Data, msg)
+		if msg.Text != models.Message(MSG_NO_SUCH_TOWN, DEFAULT_LANG)+": 100500" {
+			t.Errorf("Unexpected not found message: %s", string(response.Data))
+		}
+	}
+
+	// conversion of path var
+	request.EndpointUrl = "/test/4294967296"
+	response, _ = readResponse(testRequest(request, handler))
+	checkHttpCode(t, response.Code, http.StatusBadRequest)
+
+	// procedure error
+	url, handler = handlerProc(hCtx, ProcEndpoint{Name: "handlerTestMissing", Path: "/test", Proc: "noSuchProc"})
+	request = TestRequest{RequestType: "GET", EndpointUrl: "/test", HandlerUrl: url}
+	response, _ = readResponse(testRequest(request, handler))
+	checkHttpCode(t, response.Code, http.StatusInternalServerError)
+}
+
+func TestProcRoutes(t *testing.T) {
+	t.Parallel()
+	hCtx := newHandlerContext(newFixtureBackend())
+	defer hCtx.Close()
+	router := newRouter(hCtx, ServerConfig{})
+
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/town/4/cashpoints"}
+	response, err := readResponse(testRequest(request, router.ServeHTTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		var ids []uint32
+		json.Unmarshal(response.Data, &ids)
+		if !containsId(ids, 58552) || !containsId(ids, 7138832) {
+			t.Errorf("Unexpected cashpoints of town: %s", string(response.Data))
+		}
+	}
+
+	request = TestRequest{RequestType: "POST", EndpointUrl: "/cashpoint/state", Data: `{"cashpoints":[58552]}`}
+	response, _ = readResponse(testRequest(request, router.ServeHTTP))
+	if checkHttpCode(t, response.Code, http.StatusOK) {
+		checkJsonResponse(t, response.Data, []byte(`[{"id":58552}]`))
+	}
+
+	request.Data = `{"cashpoints":"58552"}`
+	response, _ = readResponse(testRequest(request, router.ServeHTTP))
+	checkHttpCode(t, response.Code, http.StatusBadRequest)
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alexeyknyshev/mvt"
+	"github.com/alexeyknyshev/quadkey"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Request bodies are decoded and validated before passing to tarantool,
+// so malformed requests never reach database. Body is passed to tarantool
+// as is after validation.
+
+const MAX_REQUEST_BODY_SIZE = 1 << 20
+
+// Limits have to be in sync with tarantool api
+const NEARBY_MAX_COORD_DELTA = 0.02
+const MAX_BANK_ID_FILTER = 16
+const MAX_CASHPOINTS_BATCH = 1024
+const MAX_TOWNS_BATCH = 1024
+const MAX_BANKS_BATCH = 256
+const MAX_METRO_BATCH = 1024
+const HEATMAP_MAX_GRID_SIZE = 256
+
+var CASHPOINT_TYPES = map[string]bool{
+	"atm":    true,
+	"office": true,
+	"branch": true,
+	"cash":   true,
+}
+
+var SUPPORTED_CURRENCIES = map[uint32]bool{
+	643: true, // RUB
+	840: true, // USD
+	978: true, // EUR
+}
+
+var ErrRequestTooLarge = errors.New("request body is too large")
+
+// Error of particular request field. Message is MSG_* format key
+// translated on reply, args are limits or values of field.
+type ValidationError struct {
+	Field   string
+	Message string
+	Args    []interface{}
+}
+
+func (e *ValidationError) Error() string {
+	return e.text(e.Message)
+}
+
+// Formats error with message translated to another language
+func (e *ValidationError) text(msg string) string {
+	if len(e.Args) > 0 {
+		msg = fmt.Sprintf(msg, e.Args...)
+	}
+	if e.Field == "" {
+		return msg
+	}
+	return e.Field + ": " + msg
+}
+
+func fieldError(field, msg string, args ...interface{}) *ValidationError {
+	return &ValidationError{Field: field, Message: msg, Args: args}
+}
+
+type RequestParams interface {
+	validate() error
+}
+
+// Decodes json strictly: unknown fields, type mismatch and trailing data are errors
+func decodeRequestParams(data []byte, params RequestParams) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(params)
+	if err == nil && decoder.More() {
+		err = fieldError("", MSG_TRAILING_DATA)
+	}
+	if err != nil {
+		return convertDecodeError(err)
+	}
+	return params.validate()
+}
+
+func convertDecodeError(err error) error {
+	switch e := err.(type) {
+	case *ValidationError:
+		return e
+	case *json.UnmarshalTypeError:
+		return fieldError(e.Field, MSG_WRONG_TYPE, e.Type.String(), e.Value)
+	case *json.SyntaxError:
+		return fieldError("", MSG_MALFORMED_JSON, e.Error())
+	}
+	if err == io.EOF {
+		return fieldError("", MSG_EMPTY_REQUEST)
+	}
+	const unknownFieldPrefix = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknownFieldPrefix) {
+		return fieldError(strings.Trim(msg[len(unknownFieldPrefix):], `"`), MSG_UNKNOWN_FIELD)
+	}
+	return fieldError("", MSG_MALFORMED_JSON, err.Error())
+}
+
+// Reads limited request body and validates it as params
+func getRequestParams(r *http.Request, params RequestParams) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_REQUEST_BODY_SIZE+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > MAX_REQUEST_BODY_SIZE {
+		return "", ErrRequestTooLarge
+	}
+	return string(data), decodeRequestParams(data, params)
+}
+
+func writeRequestParamsError(handlerContext HandlerContext, w http.ResponseWriter, r *http.Request, requestId int64, err error) {
+	if err == ErrRequestTooLarge {
+		writeError(handlerContext, w, r, requestId, http.StatusRequestEntityTooLarge, MSG_REQUEST_TOO_LARGE)
+		return
+	}
+	if validationErr, ok := err.(*ValidationError); ok {
+		msg := trMessage(handlerContext, getRequestLang(r), validationErr.Message)
+		writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_INVALID_PARAM, validationErr.text(msg))
+		return
+	}
+	writeError(handlerContext, w, r, requestId, http.StatusBadRequest, MSG_MALFORMED_REQUEST)
+}
+
+// ======================================================================
+
+type CoordParams struct {
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+}
+
+func validateCoord(field string, longitude, latitude *float64) error {
+	if longitude == nil {
+		return fieldError(field+"longitude", MSG_MISSING_FIELD)
+	}
+	if latitude == nil {
+		return fieldError(field+"latitude", MSG_MISSING_FIELD)
+	}
+	if math.Abs(*longitude) > 180.0 {
+		return fieldError(field+"longitude", MSG_OUT_OF_RANGE, -180, 180)
+	}
+	if math.Abs(*latitude) > 90.0 {
+		return fieldError(field+"latitude", MSG_OUT_OF_RANGE, -90, 90)
+	}
+	return nil
+}
+
+func validateCoordParams(field string, coord *CoordParams) error {
+	if coord == nil {
+		return fieldError(field, MSG_MISSING_FIELD)
+	}
+	return validateCoord(field+".", coord.Longitude, coord.Latitude)
+}
+
+func validateCurrency(field string, currency []uint32) error {
+	for _, code := range currency {
+		if !SUPPORTED_CURRENCIES[code] {
+			return fieldError(field, MSG_UNSUPPORTED_CURRENCY, code)
+		}
+	}
+	return nil
+}
+
+type ScheduleFilterParams struct {
+	Time  uint64 `json:"time"`
+	Delta uint32 `json:"delta"`
+}
+
+type CashpointsFilterParams struct {
+	BankId         []uint32              `json:"bank_id"`
+	Type           *string               `json:"type"`
+	FreeAccess     *bool                 `json:"free_access"`
+	MainOffice     *bool                 `json:"main_office"`
+	WithoutWeekend *bool                 `json:"without_weekend"`
+	RoundTheClock  *bool                 `json:"round_the_clock"`
+	WorksAsShop    *bool                 `json:"works_as_shop"`
+	Currency       []uint32              `json:"currency"`
+	CashIn         *bool                 `json:"cash_in"`
+	Approved       *bool                 `json:"approved"`
+	Schedule       *ScheduleFilterParams `json:"schedule"`
+	PartnerOf      *uint32               `json:"partner_of"` // bank itself and its partners
+}
+
+func (f *CashpointsFilterParams) validate() error {
+	if len(f.BankId) > MAX_BANK_ID_FILTER {
+		return fieldError("filter.bank_id", MSG_TOO_MANY_BANKS, len(f.BankId), MAX_BANK_ID_FILTER)
+	}
+	if f.Type != nil && !CASHPOINT_TYPES[*f.Type] {
+		return fieldError("filter.type", MSG_UNKNOWN_CP_TYPE, *f.Type)
+	}
+	return validateCurrency("filter.currency", f.Currency)
+}
+
+type NearbyCashpointsParams struct {
+	TopLeft     *CoordParams            `json:"topLeft"`
+	BottomRight *CoordParams            `json:"bottomRight"`
+	Filter      *CashpointsFilterParams `json:"filter"`
+	// Center and radius of legacy requests are still sent by client, ignored
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+	Radius    *float64 `json:"radius"`
+}
+
+func (p *NearbyCashpointsParams) validateRegion() error {
+	if err := validateCoordParams("topLeft", p.TopLeft); err != nil {
+		return err
+	}
+	if err := validateCoordParams("bottomRight", p.BottomRight); err != nil {
+		return err
+	}
+	if p.Filter != nil {
+		return p.Filter.validate()
+	}
+	return nil
+}
+
+func (p *NearbyCashpointsParams) validate() error {
+	if err := p.validateRegion(); err != nil {
+		return err
+	}
+	if math.Abs(*p.TopLeft.Longitude-*p.BottomRight.Longitude) > NEARBY_MAX_COORD_DELTA {
+		return fieldError("bottomRight.longitude", MSG_TOO_BIG_REGION, NEARBY_MAX_COORD_DELTA)
+	}
+	if math.Abs(*p.TopLeft.Latitude-*p.BottomRight.Latitude) > NEARBY_MAX_COORD_DELTA {
+		return fieldError("bottomRight.latitude", MSG_TOO_BIG_REGION, NEARBY_MAX_COORD_DELTA)
+	}
+	return nil
+}
+
+type NearbyClustersParams struct {
+	NearbyCashpointsParams
+	Zoom *uint32 `json:"zoom"`
+}
+
+func (p *NearbyClustersParams) validate() error {
+	if err := p.validateRegion(); err != nil {
+		return err
+	}
+	if p.Zoom == nil {
+		return fieldError("zoom", MSG_MISSING_FIELD)
+	}
+	if *p.Zoom > mvt.MAX_ZOOM {
+		return fieldError("zoom", MSG_OUT_OF_RANGE, 0, mvt.MAX_ZOOM)
+	}
+	return nil
+}
+
+type QuadKeyParams struct {
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+	Zoom      *uint32  `json:"zoom"`
+}
+
+func (p *QuadKeyParams) validate() error {
+	if err := validateCoord("", p.Longitude, p.Latitude); err != nil {
+		return err
+	}
+	if p.Zoom != nil && (*p.Zoom == 0 || *p.Zoom > quadkey.MAX_ZOOM) {
+		return fieldError("zoom", MSG_OUT_OF_RANGE, 1, quadkey.MAX_ZOOM)
+	}
+	return nil
+}
+
+type HeatmapParams struct {
+	NearbyCashpointsParams
+	Cols *uint32 `json:"cols"`
+	Rows *uint32 `json:"rows"`
+}
+
+func (p *HeatmapParams) validate() error {
+	if err := p.validateRegion(); err != nil {
+		return err
+	}
+	if *p.TopLeft.Longitude == *p.BottomRight.Longitude || *p.TopLeft.Latitude == *p.BottomRight.Latitude {
+		return fieldError("bottomRight", MSG_EMPTY_REGION)
+	}
+	if p.Cols == nil || *p.Cols == 0 || *p.Cols > HEATMAP_MAX_GRID_SIZE {
+		return fieldError("cols", MSG_OUT_OF_RANGE, 1, HEATMAP_MAX_GRID_SIZE)
+	}
+	if p.Rows == nil || *p.Rows == 0 || *p.Rows > HEATMAP_MAX_GRID_SIZE {
+		return fieldError("rows", MSG_OUT_OF_RANGE, 1, HEATMAP_MAX_GRID_SIZE)
+	}
+	return nil
+}
+
+// ======================================================================
+
+// Batch request of objects by id like {"towns": [1, 2, 3]}
+type BatchParams struct {
+	Key     string
+	MaxSize int
+	Ids     []uint32
+}
+
+func (p *BatchParams) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if name != p.Key {
+			return fieldError(name, MSG_UNKNOWN_FIELD)
+		}
+		err = json.Unmarshal(value, &p.Ids)
+		if err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				return fieldError(p.Key, MSG_EXPECTED_IDS, typeErr.Value)
+			}
+			return err
+		}
+	}
+	if _, ok := fields[p.Key]; !ok {
+		return fieldError(p.Key, MSG_MISSING_FIELD)
+	}
+	return nil
+}
+
+func (p *BatchParams) validate() error {
+	if len(p.Ids) > p.MaxSize {
+		return fieldError(p.Key, MSG_TOO_BIG_BATCH, len(p.Ids), p.MaxSize)
+	}
+	return nil
+}
+
+func newBatchParams(key string, maxSize int) *BatchParams {
+	return &BatchParams{Key: key, MaxSize: maxSize}
+}
+
+// ======================================================================
+
+type CashpointParams struct {
+	Id             *uint32          `json:"id"`
+	Type           *string          `json:"type"`
+	BankId         *uint32          `json:"bank_id"`
+	TownId         *uint32          `json:"town_id"`
+	Longitude      *float64         `json:"longitude"`
+	Latitude       *float64         `json:"latitude"`
+	Address        *string          `json:"address"`
+	AddressComment *string          `json:"address_comment"`
+	MetroName      *string          `json:"metro_name"`
+	FreeAccess     *bool            `json:"free_access"`
+	MainOffice     *bool            `json:"main_office"`
+	WithoutWeekend *bool            `json:"without_weekend"`
+	RoundTheClock  *bool            `json:"round_the_clock"`
+	WorksAsShop    *bool            `json:"works_as_shop"`
+	Schedule       *json.RawMessage `json:"schedule"`
+	Tel            *string          `json:"tel"`
+	Additional     *string          `json:"additional"`
+	Currency       *[]uint32        `json:"currency"`
+	CashIn         *bool            `json:"cash_in"`
+	Version        *uint32          `json:"version"`
+	Timestamp      *uint64          `json:"timestamp"`
+}
+
+// New cashpoint must have all of required fields, patch of existing
+// cashpoint (with id) contains changed fields only
+func (cp *CashpointParams) validate() error {
+	if cp.Id == nil {
+		required := []struct {
+			name string
+			set  bool
+		}{
+			{"type", cp.Type != nil},
+			{"bank_id", cp.BankId != nil},
+			{"town_id", cp.TownId != nil},
+			{"longitude", cp.Longitude != nil},
+			{"latitude", cp.Latitude != nil},
+			{"free_access", cp.FreeAccess != nil},
+			{"main_office", cp.MainOffice != nil},
+			{"without_weekend", cp.WithoutWeekend != nil},
+			{"round_the_clock", cp.RoundTheClock != nil},
+			{"works_as_shop", cp.WorksAsShop != nil},
+			{"schedule", cp.Schedule != nil},
+			{"currency", cp.Currency != nil},
+			{"cash_in", cp.CashIn != nil},
+		}
+		for _, field := range required {
+			if !field.set {
+				return fieldError("data."+field.name, MSG_MISSING_FIELD)
+			}
+		}
+	}
+
+	if cp.Type != nil && !CASHPOINT_TYPES[*cp.Type] {
+		return fieldError("data.type", MSG_UNKNOWN_CP_TYPE, *cp.Type)
+	}
+	if cp.Longitude != nil || cp.Latitude != nil {
+		if err := validateCoord("data.", cp.Longitude, cp.Latitude); err != nil {
+			return err
+		}
+	}
+	if cp.Schedule != nil {
+		schedule := bytes.TrimSpace(*cp.Schedule)
+		if len(schedule) == 0 || schedule[0] != '{' {
+			return fieldError("data.schedule", MSG_EXPECTED_OBJECT)
+		}
+	}
+	if cp.Currency != nil {
+		return validateCurrency("data.currency", *cp.Currency)
+	}
+	return nil
+}
+
+// Proposal of new cashpoint or patch of existing one
+type CashpointPatchParams struct {
+	UserId *json.Number     `json:"user_id"`
+	Data   *CashpointParams `json:"data"`
+}
+
+func (p *CashpointPatchParams) validate() error {
+	if p.UserId == nil {
+		return fieldError("user_id", MSG_MISSING_FIELD)
+	}
+	if _, err := p.UserId.Int64(); err != nil {
+		return fieldError("user_id", MSG_EXPECTED_INTEGER)
+	}
+	if p.Data == nil {
+		return fieldError("data", MSG_MISSING_FIELD)
+	}
+	return p.Data.validate()
+}
+
+// ======================================================================
+
+// Reference data edited by admins. New objects must have all of required
+// fields, updates contain changed fields only.
+
+type requiredField struct {
+	name string
+	set  bool
+}
+
+func checkRequiredFields(fields []requiredField) error {
+	for _, field := range fields {
+		if !field.set {
+			return fieldError(field.name, MSG_MISSING_FIELD)
+		}
+	}
+	return nil
+}
+
+func validateName(field string, name *string) error {
+	if name != nil && strings.TrimSpace(*name) == "" {
+		return fieldError(field, MSG_MUST_NOT_BE_EMPTY)
+	}
+	return nil
+}
+
+func validateAdminCoord(longitude, latitude *float64) error {
+	if longitude != nil || latitude != nil {
+		return validateCoord("", longitude, latitude)
+	}
+	return nil
+}
+
+type BankAdminParams struct {
+	create    bool
+	Id        *uint32   `json:"id"`
+	Name      *string   `json:"name"`
+	NameTr    *string   `json:"name_tr"`
+	NameTrAlt *string   `json:"name_tr_alt"`
+	Partners  *[]uint32 `json:"partners"`
+	Town      *string   `json:"town"`
+	Licence   *uint32   `json:"licence"`
+	Rating    *uint32   `json:"rating"`
+	Tel       *string   `json:"tel"`
+}
+
+func (p *BankAdminParams) validate() error {
+	if p.create {
+		if err := checkRequiredFields([]requiredField{{"name", p.Name != nil}}); err != nil {
+			return err
+		}
+	}
+	if p.Partners != nil && len(*p.Partners) > MAX_BANKS_BATCH {
+		return fieldError("partners", MSG_TOO_MANY_PARTNERS, MAX_BANKS_BATCH)
+	}
+	return validateName("name", p.Name)
+}
+
+type TownAdminParams struct {
+	create         bool
+	Id             *uint32  `json:"id"`
+	Longitude      *float64 `json:"longitude"`
+	Latitude       *float64 `json:"latitude"`
+	Name           *string  `json:"name"`
+	NameTr         *string  `json:"name_tr"`
+	RegionId       *uint32  `json:"region_id"`
+	RegionalCenter *bool    `json:"regional_center"`
+	Zoom           *uint32  `json:"zoom"`
+	Big            *bool    `json:"big"`
+	Population     *uint32  `json:"population"`
+}
+
+func (p *TownAdminParams) validate() error {
+	if p.create {
+		err := checkRequiredFields([]requiredField{
+			{"longitude", p.Longitude != nil},
+			{"latitude", p.Latitude != nil},
+			{"name", p.Name != nil},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := validateAdminCoord(p.Longitude, p.Latitude); err != nil {
+		return err
+	}
+	if p.Zoom != nil && *p.Zoom > mvt.MAX_ZOOM {
+		return fieldError("zoom", MSG_OUT_OF_RANGE, 0, mvt.MAX_ZOOM)
+	}
+	return validateName("name", p.Name)
+}
+
+type RegionAdminParams struct {
+	create    bool
+	Id        *uint32  `json:"id"`
+	Longitude *float64 `json:"longitude"`
+	Latitude  *float64 `json:"latitude"`
+	Name      *string  `json:"name"`
+	NameTr    *string  `json:"name_tr"`
+	Zoom      *uint32  `json:"zoom"`
+}
+
+func (p *RegionAdminParams) validate() error {
+	if p.create {
+		err := checkRequiredFields([]requiredField{
+			{"longitude", p.Longitude != nil},
+			{"latitude", p.Latitude != nil},
+			{"name", p.Name != nil},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := validateAdminCoord(p.Longitude, p.Latitude); err != nil {
+		return err
+	}
+	if p.Zoom != nil && *p.Zoom > mvt.MAX_ZOOM {
+		return fieldError("zoom", MSG_OUT_OF_RANGE, 0, mvt.MAX_ZOOM)
+	}
+	return validateName("name", p.Name)
+}
+
+type MetroAdminParams struct {
+	create          bool
+	Id              *uint32  `json:"id"`
+	Longitude       *float64 `json:"longitude"`
+	Latitude        *float64 `json:"latitude"`
+	TownId          *uint32  `json:"town_id"`
+	BranchId        *uint32  `json:"branch_id"`
+	StationName     *string  `json:"station_name"`
+	StationExitName *string  `json:"station_exit_name"`
+}
+
+func (p *MetroAdminParams) validate() error {
+	if p.create {
+		err := checkRequiredFields([]requiredField{
+			{"longitude", p.Longitude != nil},
+			{"latitude", p.Latitude != nil},
+			{"town_id", p.TownId != nil},
+			{"station_name", p.StationName != nil},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := validateAdminCoord(p.Longitude, p.Latitude); err != nil {
+		return err
+	}
+	return validateName("station_name", p.StationName)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"github.com/alexeyknyshev/export"
+	"github.com/alexeyknyshev/models"
+	"github.com/gorilla/mux"
+	"net/http"
+	"strings"
+)
+
+// Route table of api. Router of server and contract tests and openapi
+// document (see openapi.go) are built from it, so every route has to be
+// declared here. Path params are taken from mux pattern of path.
+
+type RouteHandler func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback)
+
+// Query param of route
+type RouteParam struct {
+	Name        string
+	Type        string // openapi type: integer, number, string, boolean
+	Description string
+}
+
+type Route struct {
+	Name    string // openapi operation id
+	Method  string
+	Path    string // mux pattern returned by handler
+	Handler RouteHandler
+	Tag     string
+	Summary string
+	// Permission of api key the route requires, see access.go
+	Permission string
+	// Debugging and testing scripts endpoint, not documented unless
+	// server runs in testing mode
+	TestingOnly bool
+	Params      []RouteParam
+	// Request and response bodies: value of go type described by
+	// reflection or *Schema, nil if route has no json body
+	Request  interface{}
+	Response interface{}
+	// Content type of non json response
+	ResponseType string
+	// Status of successful response, 200 if not set
+	Status int
+}
+
+func withoutConfig(handler func(HandlerContext) (string, EndpointCallback)) RouteHandler {
+	return func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+		return handler(handlerContext)
+	}
+}
+
+var LIST_PARAMS = []RouteParam{
+	{"limit", "integer", "page size, 1..1000, 100 by default"},
+	{"after", "string", "cursor of next page returned by previous one"},
+	{"sort", "string", "field to sort by, '-' prefix for descending order"},
+	{"fields", "string", "comma separated fields of objects, all by default"},
+}
+
+var TILE_PARAMS = []RouteParam{
+	{"bank_id", "string", "comma separated bank ids"},
+	{"currency", "string", "comma separated currency codes"},
+	{"type", "string", "cashpoint type"},
+	{"free_access", "boolean", ""},
+	{"round_the_clock", "boolean", ""},
+	{"without_weekend", "boolean", ""},
+	{"approved", "boolean", ""},
+	{"time", "integer", "unix time cashpoints are open at"},
+	{"delta", "integer", "seconds cashpoints stay open after time"},
+}
+
+var SYNC_PARAMS = []RouteParam{
+	{"since", "string", "cursor of previous sync, changes since epoch if not set"},
+	{"town_id", "integer", "changes of town only"},
+	{"limit", "integer", "max objects count, 1..1000, 500 by default"},
+}
+
+var EXPORT_PARAMS = []RouteParam{
+	{"format", "string", "csv, geojson or kml, csv by default"},
+	{"town_id", "integer", "cashpoints of town"},
+	{"region_id", "integer", "cashpoints of region"},
+	{"bank_id", "integer", "cashpoints of bank"},
+	{"type", "string", "cashpoint type"},
+}
+
+// Replies of tarantool api without go types
+var STATS_SCHEMA = &Schema{Type: "object", Description: "counts of cashpoints by bank, type and currency"}
+var QUADKEY_SCHEMA = objectSchema(map[string]*Schema{"quadkey": {Type: "string"}})
+
+var HEATMAP_SCHEMA = objectSchema(map[string]*Schema{
+	"cell_width":  {Type: "number"},
+	"cell_height": {Type: "number"},
+	"zoom":        {Type: "integer", Description: "zoom of clusters cells are counted of, missing for raw cashpoints"},
+	"cells": arraySchema(objectSchema(map[string]*Schema{
+		"col":       {Type: "integer"},
+		"row":       {Type: "integer"},
+		"count":     {Type: "integer"},
+		"longitude": {Type: "number"},
+		"latitude":  {Type: "number"},
+	})),
+})
+
+// Clusters of quadtree nodes, towns on small zooms or single cashpoints
+var CLUSTERS_SCHEMA = arraySchema(&Schema{Type: "object", Description: "cluster, town cluster or cashpoint"})
+
+var CASHPOINTS_STATE_SCHEMA = arraySchema(objectSchema(map[string]*Schema{"id": {Type: "integer"}}))
+
+var PATCHES_SCHEMA = &Schema{
+	Type:                 "object",
+	Description:          "changed fields of pending patches by patch id",
+	AdditionalProperties: &Schema{Type: "object"},
+}
+
+type TownsListResponse struct {
+	Items []models.Town `json:"items"`
+	Next  string        `json:"next,omitempty"`
+	More  bool          `json:"more"`
+}
+
+type BanksListResponse struct {
+	Items []models.Bank `json:"items"`
+	Next  string        `json:"next,omitempty"`
+	More  bool          `json:"more"`
+}
+
+func getRoutes() []Route {
+	routes := []Route{
+		{
+			Name: "ping", Method: "GET", Path: "/ping", Handler: withoutConfig(handlerPing),
+			Tag: "service", Summary: "Check server is alive",
+			Response: &Message{},
+		},
+		{
+			Name: "openApi", Method: "GET", Path: "/openapi.json", Handler: handlerOpenApi,
+			Tag: "service", Summary: "OpenAPI document of api",
+			Response: &Schema{Type: "object"},
+		},
+		{
+			Name: "getCashpoint", Method: "GET", Path: "/cashpoint/{id:[0-9]+}", Handler: withoutConfig(handlerCashpoint),
+			Tag: "cashpoints", Summary: "Get cashpoint by id",
+			Response: &models.Cashpoint{},
+		},
+		{
+			Name: "createCashpoint", Method: "POST", Path: "/cashpoint", Handler: withoutConfig(handlerCashpointCreate),
+			Tag: "cashpoints", Summary: "Propose new cashpoint or patch of existing one, returns cashpoint id",
+			Request: &CashpointPatchParams{}, Response: &Schema{Type: "integer"},
+		},
+		{
+			Name: "getCashpointsBatch", Method: "POST", Path: "/cashpoints", Handler: withoutConfig(handlerCashpointsBatch),
+			Tag: "cashpoints", Summary: "Get cashpoints by ids, missing ids are listed in X-Missing-Ids header",
+			Request: batchSchema("cashpoints", MAX_CASHPOINTS_BATCH), Response: []models.Cashpoint{},
+		},
+		{
+			Name: "getCashpointsState", Method: "POST", Path: "/cashpoint/state",
+			Handler: procRoute(ProcEndpoint{
+				Name: "handlerCashpointsState", Path: "/cashpoint/state", Proc: "getCashpointsStateBatch",
+				Args:   []ProcArg{bodyArg()},
+				Params: func() RequestParams { return newBatchParams("cashpoints", MAX_CASHPOINTS_BATCH) },
+			}),
+			Tag: "cashpoints", Summary: "Get current state of cashpoints by ids",
+			Request: batchSchema("cashpoints", MAX_CASHPOINTS_BATCH), Response: CASHPOINTS_STATE_SCHEMA,
+		},
+		{
+			Name: "getCashpointPatches", Method: "GET", Path: "/cashpoint/{id:[0-9]+}/patches", Handler: withoutConfig(handlerCashpointPatches),
+			Tag: "cashpoints", Summary: "Get pending patches of cashpoint",
+			Response: PATCHES_SCHEMA,
+		},
+		{
+			Name: "getTown", Method: "GET", Path: "/town/{id:[0-9]+}", Handler: withoutConfig(handlerTown),
+			Tag: "towns", Summary: "Get town by id",
+			Response: &models.Town{},
+		},
+		{
+			Name: "getTownsBatch", Method: "POST", Path: "/towns", Handler: withoutConfig(handlerTownsBatch),
+			Tag: "towns", Summary: "Get towns by ids, missing ids are listed in X-Missing-Ids header",
+			Request: batchSchema("towns", MAX_TOWNS_BATCH), Response: []models.Town{},
+		},
+		{
+			Name: "getTownsList", Method: "GET", Path: "/towns", Handler: withoutConfig(handlerTownsList),
+			Tag: "towns", Summary: "Get page of towns, list of all town ids without params",
+			Params: LIST_PARAMS, Response: &TownsListResponse{},
+		},
+		{
+			Name: "getTownMetro", Method: "GET", Path: "/town/{townid:[0-9]+}/metro", Handler: withoutConfig(handlerMetroList),
+			Tag: "metro", Summary: "Get ids of metro stations of town",
+			Response: []uint32{},
+		},
+		{
+			Name: "getTownCashpoints", Method: "GET", Path: "/town/{id:[0-9]+}/cashpoints",
+			Handler: procRoute(ProcEndpoint{
+				Name: "handlerTownCashpoints", Path: "/town/{id:[0-9]+}/cashpoints", Proc: "getTownCashpoints",
+				Args: []ProcArg{varArg("id", PROC_ARG_UINT32)},
+			}),
+			Tag: "towns", Summary: "Get ids of cashpoints of town",
+			Response: []uint32{},
+		},
+		{
+			Name: "getMetro", Method: "GET", Path: "/metro/{metroid:[0-9]+}", Handler: withoutConfig(handlerMetro),
+			Tag: "metro", Summary: "Get metro station by id",
+			Response: &models.Metro{},
+		},
+		{
+			Name: "getMetroBatch", Method: "POST", Path: "/metro", Handler: withoutConfig(handlerMetroBatch),
+			Tag: "metro", Summary: "Get metro stations by ids, missing ids are listed in X-Missing-Ids header",
+			Request: batchSchema("metro", MAX_METRO_BATCH), Response: []models.Metro{},
+		},
+		{
+			Name: "getBank", Method: "GET", Path: "/bank/{id:[0-9]+}", Handler: withoutConfig(handlerBank),
+			Tag: "banks", Summary: "Get bank by id",
+			Response: &models.Bank{},
+		},
+		{
+			Name: "getBankIco", Method: "GET", Path: "/bank/{id:[0-9]+}/ico", Handler: handlerBankIco,
+			Tag: "banks", Summary: "Get svg icon of bank",
+			Response: &BankIco{},
+		},
+		{
+			Name: "getBankPartners", Method: "GET", Path: "/bank/{id:[0-9]+}/partners", Handler: withoutConfig(handlerBankPartners),
+			Tag: "banks", Summary: "Get partner banks of bank",
+			Response: []models.Bank{},
+		},
+		{
+			Name: "getBanksList", Method: "GET", Path: "/banks", Handler: withoutConfig(handlerBanksList),
+			Tag: "banks", Summary: "Get page of banks, list of all bank ids without params",
+			Params: LIST_PARAMS, Response: &BanksListResponse{},
+		},
+		{
+			Name: "getBanksBatch", Method: "POST", Path: "/banks", Handler: withoutConfig(handlerBanksBatch),
+			Tag: "banks", Summary: "Get banks by ids, missing ids are listed in X-Missing-Ids header",
+			Request: batchSchema("banks", MAX_BANKS_BATCH), Response: []models.Bank{},
+		},
+		{
+			Name: "getNearbyCashpoints", Method: "POST", Path: "/nearby/cashpoints", Handler: withoutConfig(handlerNearbyCashPoints),
+			Tag: "cashpoints", Summary: "Get ids of cashpoints in region",
+			Request: &NearbyCashpointsParams{}, Response: []uint32{},
+		},
+		{
+			Name: "getNearbyClusters", Method: "POST", Path: "/nearby/clusters", Handler: withoutConfig(handlerNearbyClusters),
+			Tag: "cashpoints", Summary: "Get clusters of cashpoints in region",
+			Request: &NearbyClustersParams{}, Response: CLUSTERS_SCHEMA,
+		},
+		{
+			Name: "getHeatmap", Method: "POST", Path: "/heatmap", Handler: withoutConfig(handlerHeatmap),
+			Tag: "cashpoints", Summary: "Get grid of cashpoints counts over region",
+			Request: &HeatmapParams{}, Response: HEATMAP_SCHEMA,
+		},
+		{
+			Name: "getTile", Method: "GET", Path: "/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", Handler: withoutConfig(handlerTile),
+			Tag: "cashpoints", Summary: "Get vector tile of cashpoints and clusters",
+			Params: TILE_PARAMS, ResponseType: TILE_CONTENT_TYPE,
+		},
+		{
+			Name: "getSyncChanges", Method: "GET", Path: "/sync", Handler: withoutConfig(handlerSync),
+			Tag: "sync", Summary: "Get objects changed since cursor",
+			Params: SYNC_PARAMS, Response: &SyncChangesResponse{},
+		},
+		{
+			Name: "getTownBundle", Method: "GET", Path: "/bundle/town/{id:[0-9]+}", Handler: handlerTownBundle,
+			Tag: "sync", Summary: "Get sqlite database of town for offline use",
+			ResponseType: BUNDLE_CONTENT_TYPE,
+		},
+		{
+			Name: "getStats", Method: "GET", Path: "/stats", Handler: withoutConfig(handlerStats),
+			Tag: "stats", Summary: "Get cashpoints statistics of country",
+			Response: STATS_SCHEMA,
+		},
+		{
+			Name: "getTownStats", Method: "GET", Path: "/stats/town/{id:[0-9]+}", Handler: withoutConfig(handlerTownStats),
+			Tag: "stats", Summary: "Get cashpoints statistics of town",
+			Response: STATS_SCHEMA,
+		},
+		{
+			Name: "getRegionStats", Method: "GET", Path: "/stats/region/{id:[0-9]+}", Handler: withoutConfig(handlerRegionStats),
+			Tag: "stats", Summary: "Get cashpoints statistics of region",
+			Response: STATS_SCHEMA,
+		},
+	}
+
+	for _, kind := range ADMIN_KINDS {
+		kind := kind
+		name := strings.ToUpper(kind.Name[:1]) + kind.Name[1:]
+		routes = append(routes,
+			Route{
+				Name: "adminCreate" + name, Method: "POST", Path: "/admin/" + kind.Name,
+				Handler: func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+					return handlerAdminCreate(handlerContext, kind)
+				},
+				Tag: "admin", Summary: "Create " + kind.Name, Permission: PERM_EDIT_REFERENCE,
+				Request: kind.NewParams(true), Response: &AdminResponse{}, Status: http.StatusCreated,
+			},
+			Route{
+				Name: "adminUpdate" + name, Method: "PUT", Path: "/admin/" + kind.Name + "/{id:[0-9]+}",
+				Handler: func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+					return handlerAdminUpdate(handlerContext, kind)
+				},
+				Tag: "admin", Summary: "Update fields of " + kind.Name, Permission: PERM_EDIT_REFERENCE,
+				Request: kind.NewParams(false), Response: &AdminResponse{},
+			},
+			Route{
+				Name: "adminDelete" + name, Method: "DELETE", Path: "/admin/" + kind.Name + "/{id:[0-9]+}",
+				Handler: func(handlerContext HandlerContext, conf ServerConfig) (string, EndpointCallback) {
+					return handlerAdminDelete(handlerContext, kind)
+				},
+				Tag: "admin", Summary: "Delete " + kind.Name, Permission: PERM_EDIT_REFERENCE,
+				Response: &AdminResponse{},
+			},
+		)
+	}
+	routes = append(routes, Route{
+		Name: "adminExport", Method: "GET", Path: "/admin/export", Handler: withoutConfig(handlerExport),
+		Tag: "admin", Summary: "Export cashpoints with bank and town names to csv, geojson or kml", Permission: PERM_EXPORT,
+		Params: EXPORT_PARAMS, ResponseType: export.FORMATS[export.FORMAT_CSV].ContentType,
+	})
+
+	// operational endpoints are open for anonymous requests in testing mode only
+	routes = append(routes,
+		Route{
+			Name: "getQuadKey", Method: "POST", Path: "/quadkey", Handler: withoutConfig(handlerCoordToQuadKey),
+			Tag: "debug", Summary: "Get quadkey of coordinate", Permission: PERM_DEBUG, TestingOnly: true,
+			Request: &QuadKeyParams{}, Response: QUADKEY_SCHEMA,
+		},
+		Route{
+			Name: "getQuadTreeBranch", Method: "GET", Path: "/quadtree/branch/{quadKey:[0-3]+}", Handler: withoutConfig(handlerQuadTreeBranch),
+			Tag: "debug", Summary: "Get clusters of quadtree branch", Permission: PERM_DEBUG, TestingOnly: true,
+			Response: &Schema{Type: "object"},
+		},
+		Route{
+			Name: "deleteCashpoint", Method: "DELETE", Path: "/cashpoint/{id:[0-9]+}", Handler: withoutConfig(handlerCashpointDelete),
+			Tag: "cashpoints", Summary: "Delete cashpoint", Permission: PERM_DELETE_CASHPOINT,
+		},
+		Route{
+			Name: "getSpaceMetrics", Method: "GET", Path: "/metrics/space", Handler: withoutConfig(handlerSpaceMetrics),
+			Tag: "service", Summary: "Get tuple counts of tarantool spaces", Permission: PERM_VIEW_METRICS,
+			Response: &models.SpaceMetrics{},
+		},
+	)
+	return routes
+}
+
+// Router of route table, shared by server and contract tests
+func newRouter(handlerContext HandlerContext, serverConfig ServerConfig) *mux.Router {
+	router := mux.NewRouter()
+	for _, route := range getRoutes() {
+		url, handler := route.Handler(handlerContext, serverConfig)
+		if route.Permission != "" {
+			url, handler = requirePermission(handlerContext, serverConfig, route.Permission)(url, handler)
+		}
+		router.HandleFunc(url, handler).Methods(route.Method)
+	}
+	return router
+}
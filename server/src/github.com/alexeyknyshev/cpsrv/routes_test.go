@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var ROUTE_VAR_REGEXP = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestRouteTable(t *testing.T) {
+	t.Parallel()
+	hCtx := newHandlerContext(newFixtureBackend())
+	conf := ServerConfig{}
+
+	declared := make(map[string]Route)
+	names := make(map[string]bool)
+	for _, route := range getRoutes() {
+		key := route.Method + " " + route.Path
+		if _, ok := declared[key]; ok {
+			t.Errorf("Duplicate route %s", key)
+		}
+		declared[key] = route
+		if names[route.Name] {
+			t.Errorf("Duplicate route name %s", route.Name)
+		}
+		names[route.Name] = true
+
+		url, _ := route.Handler(hCtx, conf)
+		if url != route.Path {
+			t.Errorf("Route %s declares path %s but handler serves %s", route.Name, route.Path, url)
+		}
+		if route.Tag == "" || route.Summary == "" {
+			t.Errorf("Route %s is not documented", route.Name)
+		}
+	}
+
+	router := newRouter(hCtx, conf)
+	registered := make(map[string]bool)
+	router.Walk(func(r *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := r.GetPathTemplate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		methods, err := r.GetMethods()
+		if err != nil {
+			t.Fatalf("Route %s has no methods", path)
+		}
+		for _, method := range methods {
+			key := method + " " + path
+			registered[key] = true
+			if _, ok := declared[key]; !ok {
+				t.Errorf("Route %s is not declared in route table", key)
+			}
+		}
+		return nil
+	})
+
+	for key, route := range declared {
+		if !registered[key] {
+			t.Errorf("Route %s is not registered", key)
+			continue
+		}
+		// request reaches route of its own pattern
+		url := ROUTE_VAR_REGEXP.ReplaceAllString(route.Path, "1")
+		req, _ := http.NewRequest(route.Method, url, nil)
+		var match mux.RouteMatch
+		if !router.Match(req, &match) {
+			t.Errorf("Request %s %s does not match any route", route.Method, url)
+			continue
+		}
+		path, _ := match.Route.GetPathTemplate()
+		if path != route.Path {
+			t.Errorf("Request %s %s is served by %s instead of %s", route.Method, url, path, route.Path)
+		}
+	}
+}
+
+func getOpenApiDoc(t *testing.T, conf ServerConfig) (*OpenApiDoc, map[string]interface{}) {
+	hCtx := newHandlerContext(newFixtureBackend())
+	request := TestRequest{RequestType: "GET", EndpointUrl: "/openapi.json"}
+	response, err := readResponse(testRequest(request, newRouter(hCtx, conf).ServeHTTP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHttpCode(t, response.Code, http.StatusOK)
+
+	doc := &OpenApiDoc{}
+	err = json.Unmarshal(response.Data, doc)
+	if err != nil {
+		t.Fatalf("Cannot decode openapi document: %v", err)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(response.Data, &raw)
+	return doc, raw
+}
+
+// Collects values of all $ref keys
+func collectRefs(v interface{}, refs map[string]bool) {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for key, value := range node {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				refs[ref] = true
+			}
+			collectRefs(value, refs)
+		}
+	case []interface{}:
+		for _, value := range node {
+			collectRefs(value, refs)
+		}
+	}
+}
+
+func TestOpenApi(t *testing.T) {
+	t.Parallel()
+	doc, raw := getOpenApiDoc(t, ServerConfig{})
+	if doc.OpenApi != OPENAPI_VERSION {
+		t.Errorf("Unexpected openapi version %s", doc.OpenApi)
+	}
+
+	for _, route := range getRoutes() {
+		path, pathParams := getOpenApiPath(route.Path)
+		op := doc.Paths[path][strings.ToLower(route.Method)]
+		if route.TestingOnly {
+			if op != nil {
+				t.Errorf("Unexpected testing only route %s in document", route.Name)
+			}
+			continue
+		}
+		if op == nil {
+			t.Errorf("Route %s %s is missing in document", route.Method, path)
+			continue
+		}
+		if op.OperationId != route.Name {
+			t.Errorf("Expected operation %s but got %s", route.Name, op.OperationId)
+		}
+		if strings.Count(path, "{") != len(pathParams) {
+			t.Errorf("Unexpected path params of %s: %d", path, len(pathParams))
+		}
+		params := make(map[string]string)
+		for _, param := range op.Parameters {
+			params[param.Name] = param.In
+		}
+		for _, name := range ROUTE_VAR_REGEXP.FindAllString(route.Path, -1) {
+			name = strings.SplitN(strings.Trim(name, "{}"), ":", 2)[0]
+			if params[name] != "path" {
+				t.Errorf("Path param %s of %s is not documented", name, path)
+			}
+		}
+		if (route.Request != nil) != (op.RequestBody != nil) {
+			t.Errorf("Unexpected request body of %s", route.Name)
+		}
+		if (route.Permission != "") != (len(op.Security) > 0) {
+			t.Errorf("Unexpected security of %s", route.Name)
+		}
+	}
+
+	refs := make(map[string]bool)
+	collectRefs(raw, refs)
+	for ref := range refs {
+		parts := strings.Split(ref, "/")
+		if len(parts) != 4 || parts[0] != "#" || parts[1] != "components" {
+			t.Errorf("Unexpected ref %s", ref)
+			continue
+		}
+		var ok bool
+		switch parts[2] {
+		case "schemas":
+			_, ok = doc.Components.Schemas[parts[3]]
+		case "parameters":
+			_, ok = doc.Components.Parameters[parts[3]]
+		}
+		if !ok {
+			t.Errorf("Unresolved ref %s", ref)
+		}
+	}
+
+	// embedded request structs are flattened
+	clusters := doc.Paths["/nearby/clusters"]["post"].RequestBody.Content["application/json"].Schema
+	params := doc.Components.Schemas[strings.TrimPrefix(clusters.Ref, "#/components/schemas/")]
+	for _, name := range []string{"topLeft", "bottomRight", "filter", "zoom"} {
+		if params == nil || params.Properties[name] == nil {
+			t.Errorf("Expected %s field of nearby clusters request", name)
+		}
+	}
+	cp := doc.Components.Schemas["Cashpoint"]
+	if cp == nil || cp.Properties["bank_id"] == nil || cp.Properties["approved"] == nil {
+		t.Errorf("Expected fields of cashpoint data and cashpoint in cashpoint schema")
+	}
+	if town := doc.Components.Schemas["Town"]; town == nil || town.Properties["population"] != nil {
+		t.Errorf("Unexpected town schema %+v", town)
+	}
+}
+
+func TestOpenApiTestingMode(t *testing.T) {
+	t.Parallel()
+	doc, _ := getOpenApiDoc(t, ServerConfig{TestingMode: true})
+	op := doc.Paths["/quadtree/branch/{quadKey}"]["get"]
+	if op == nil || !op.TestingOnly || op.Parameters[2].Schema.Type != "string" {
+		t.Errorf("Expected testing only quadtree route in testing mode but got %+v", op)
+	}
+}
+
+// Checks json value against documented schema, null is allowed for any
+// schema as pointers are optional values
+func checkSchema(t *testing.T, doc *OpenApiDoc, schema *Schema, value interface{}, path string) {
+	if schema.Ref != "" {
+		name := strings.TrimPrefix(schema.Ref, "#/components/schemas/")
+		if schema = doc.Components.Schemas[name]; schema == nil {
+			t.Errorf("%s: unresolved schema %s", path, name)
+			return
+		}
+	}
+	if value == nil || schema.Type == "" {
+		return
+	}
+
+	ok := true
+	switch schema.Type {
+	case "object":
+		var obj map[string]interface{}
+		if obj, ok = value.(map[string]interface{}); ok {
+			for key, item := range obj {
+				property := schema.Properties[key]
+				if property == nil {
+					property = schema.AdditionalProperties
+				}
+				if property == nil {
+					if schema.Properties != nil {
+						t.Errorf("%s: field %s is not documented", path, key)
+					}
+					continue
+				}
+				checkSchema(t, doc, property, item, path+"."+key)
+			}
+		}
+	case "array":
+		var items []interface{}
+		if items, ok = value.([]interface{}); ok && schema.Items != nil {
+			for i, item := range items {
+				checkSchema(t, doc, schema.Items, item, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	case "integer":
+		var number float64
+		if number, ok = value.(float64); ok {
+			ok = number == math.Trunc(number)
+		}
+	case "number":
+		_, ok = value.(float64)
+	case "string":
+		_, ok = value.(string)
+	case "boolean":
+		_, ok = value.(bool)
+	}
+	if !ok {
+		t.Errorf("%s: expected %s but got %v", path, schema.Type, value)
+	}
+}
+
+// Documented response schemas match replies of handlers
+func TestOpenApiResponses(t *testing.T) {
+	hCtx := makeTestHandlerContext(t)
+	defer hCtx.Close()
+	router := newRouter(hCtx, ServerConfig{})
+	doc, _ := getOpenApiDoc(t, ServerConfig{})
+
+	for _, c := range []struct {
+		method string
+		path   string
+		url    string
+		body   string
+	}{
+		{"post", "/heatmap", "/heatmap", `{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0},"cols":4,"rows":4}`},
+		{"post", "/heatmap", "/heatmap", `{"topLeft":{"longitude":37.64,"latitude":55.77},"bottomRight":{"longitude":37.65,"latitude":55.76},"cols":2,"rows":2}`},
+		{"get", "/town/{id}", "/town/4", ""},
+		{"get", "/cashpoint/{id}", "/cashpoint/7243171", ""},
+	} {
+		op := doc.Paths[c.path][c.method]
+		if op == nil || op.Responses["200"] == nil || op.Responses["200"].Content["application/json"] == nil {
+			t.Errorf("No documented reply of %s %s", c.method, c.path)
+			continue
+		}
+		request := TestRequest{RequestType: strings.ToUpper(c.method), EndpointUrl: c.url, Data: c.body}
+		response, err := readResponse(testRequest(request, router.ServeHTTP))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !checkHttpCode(t, response.Code, http.StatusOK) {
+			continue
+		}
+		var reply interface{}
+		if err = json.Unmarshal(response.Data, &reply); err != nil {
+			t.Errorf("Cannot decode reply of %s: %v", c.url, err)
+			continue
+		}
+		checkSchema(t, doc, op.Responses["200"].Content["application/json"].Schema, reply, c.url)
+	}
+}
@@ -0,0 +1,2400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/tarantool/go-tarantool"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sqlite backend serves procedures of tarantool api straight from sqlite
+// databases read by migrators (cp.db, towns.db and banks.db, see
+// tools/cpgen), so small deployments and local development do not need
+// tarantool. Towns and banks databases are attached to cashpoints one.
+// Tables of tarantool spaces missing in migrator databases (r*tree of
+// cashpoint coordinates, patches, votes, quadkey clusters and sync log)
+// are created on open and filled from imported cashpoints. Procedures
+// follow lua implementation in tnt_workdir/api and share argument, filter
+// and patch helpers of MemoryBackend.
+
+const SQLITE_DRIVER = "sqlite3"
+
+// Limits of tarantool api not shared with MemoryBackend
+const SQLITE_MAX_SYNC_BATCH = 1000
+const SQLITE_MAX_HEATMAP_GRID = 256
+
+// Tables of migrator databases created if missing, so server can start
+// with empty databases
+const SQLITE_DATA_SCHEMA = `
+CREATE TABLE IF NOT EXISTS towns_db.regions (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT,
+                                             latitude REAL, longitude REAL, zoom INTEGER);
+CREATE TABLE IF NOT EXISTS towns_db.towns (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT, region_id INTEGER,
+                                           regional_center INTEGER, latitude REAL, longitude REAL, zoom INTEGER,
+                                           has_emblem INTEGER, population INTEGER);
+CREATE TABLE IF NOT EXISTS towns_db.metro (id INTEGER PRIMARY KEY AUTOINCREMENT, latitude REAL, longitude REAL,
+                                           town_id INTEGER, branch_id INTEGER, name TEXT, ext TEXT);
+CREATE TABLE IF NOT EXISTS towns_db.tr (msg TEXT, ru TEXT, en TEXT);
+CREATE TABLE IF NOT EXISTS main.cashpoints (id INTEGER PRIMARY KEY, type TEXT, bank_id INTEGER, town_id INTEGER,
+                                            longitude REAL, latitude REAL, address TEXT, address_comment TEXT,
+                                            metro_name TEXT, free_access INTEGER, main_office INTEGER,
+                                            without_weekend INTEGER, round_the_clock INTEGER, works_as_shop INTEGER,
+                                            schedule_general TEXT, tel TEXT, additional TEXT,
+                                            rub INTEGER, usd INTEGER, eur INTEGER, cash_in INTEGER, hidden INTEGER);
+CREATE TABLE IF NOT EXISTS banks_db.banks (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT, name_tr_alt TEXT,
+                                           town TEXT, licence INTEGER, rating INTEGER, tel TEXT);
+CREATE TABLE IF NOT EXISTS banks_db.partners (id INTEGER, partner_id INTEGER);`
+
+type sqliteColumn struct {
+	Name string
+	Decl string
+}
+
+// Columns of cashpoints tarantool space added to imported cashpoints
+var SQLITE_CASHPOINTS_COLUMNS = []sqliteColumn{
+	{"hidden", "INTEGER DEFAULT 0"},
+	{"schedule", "TEXT"}, // json, schedule_general is parsed if not set
+	{"version", "INTEGER DEFAULT 0"},
+	{"timestamp", "INTEGER DEFAULT 0"},
+	{"approved", "INTEGER DEFAULT 1"},
+	{"user_id", "INTEGER DEFAULT 0"},
+	{"quadkey", "TEXT"}, // of CLUSTER_ZOOM_MAX, not set for imported cashpoints
+}
+
+const SQLITE_SERVICE_SCHEMA = `
+CREATE INDEX IF NOT EXISTS main.cashpoints_town_id ON cashpoints (town_id);
+CREATE INDEX IF NOT EXISTS main.cashpoints_quadkey ON cashpoints (quadkey);
+CREATE VIRTUAL TABLE IF NOT EXISTS main.cashpoints_rtree USING rtree (id, min_lon, max_lon, min_lat, max_lat);
+CREATE TABLE IF NOT EXISTS main.cashpoints_patches (id INTEGER PRIMARY KEY AUTOINCREMENT, cashpoint_id INTEGER,
+                                                    user_id INTEGER, data TEXT, timestamp INTEGER);
+CREATE INDEX IF NOT EXISTS main.cashpoints_patches_cashpoint_id ON cashpoints_patches (cashpoint_id);
+CREATE TABLE IF NOT EXISTS main.cashpoints_patches_votes (id INTEGER PRIMARY KEY AUTOINCREMENT, patch_id INTEGER,
+                                                          user_id INTEGER, score INTEGER);
+CREATE INDEX IF NOT EXISTS main.cashpoints_patches_votes_patch_id ON cashpoints_patches_votes (patch_id);
+CREATE TABLE IF NOT EXISTS main.clusters (quadkey TEXT PRIMARY KEY, zoom INTEGER,
+                                          longitude REAL, latitude REAL, members TEXT);
+CREATE INDEX IF NOT EXISTS main.clusters_zoom ON clusters (zoom, longitude, latitude);
+CREATE TABLE IF NOT EXISTS main.sync_log (kind TEXT, id INTEGER, town_id INTEGER, old_town_id INTEGER,
+                                          timestamp INTEGER, deleted INTEGER, PRIMARY KEY (kind, id));
+CREATE INDEX IF NOT EXISTS main.sync_log_timestamp ON sync_log (timestamp, kind, id);`
+
+// Sync log entry keeping timestamp of last log rebuild
+const SYNC_KIND_EPOCH = "epoch"
+
+type SqliteBackend struct {
+	mutex sync.Mutex
+	db    *sql.DB
+	// Transaction of current call, every call is a transaction
+	tx *sql.Tx
+}
+
+// Opens databases creating missing tables, paths are file names or uris
+// of sqlite
+func newSqliteBackend(cashpointsDb, townsDb, banksDb string) (*SqliteBackend, error) {
+	db, err := sql.Open(SQLITE_DRIVER, cashpointsDb)
+	if err != nil {
+		return nil, err
+	}
+	// attached databases belong to connection
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	for _, attach := range []struct{ path, name string }{{townsDb, "towns_db"}, {banksDb, "banks_db"}} {
+		_, err = db.Exec("ATTACH DATABASE ? AS "+attach.name, attach.path)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("cannot attach %s: %v", attach.path, err)
+		}
+	}
+
+	b := &SqliteBackend{db: db}
+	err = b.inTx(b.prepare)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *SqliteBackend) inTx(f func() error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	b.tx = tx
+	defer func() { b.tx = nil }()
+
+	if err = f(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteProc func(b *SqliteBackend, args []interface{}) (interface{}, error)
+
+var SQLITE_PROCS = map[string]sqliteProc{
+	"getCashpointById":           (*SqliteBackend).getCashpointById,
+	"getCashpointsBatch":         (*SqliteBackend).getCashpointsBatch,
+	"getCashpointsStateBatch":    (*SqliteBackend).getCashpointsStateBatch,
+	"getNearbyCashpoints":        (*SqliteBackend).getNearbyCashpoints,
+	"getNearbyClusters":          (*SqliteBackend).getNearbyClusters,
+	"getQuadKeyFromCoord":        (*SqliteBackend).getQuadKeyFromCoord,
+	"getQuadTreeBranch":          (*SqliteBackend).getQuadTreeBranch,
+	"deleteCashpointById":        (*SqliteBackend).deleteCashpointById,
+	"cashpointProposePatch":      (*SqliteBackend).cashpointProposePatch,
+	"getCashpointPatches":        (*SqliteBackend).getCashpointPatches,
+	"getCashpointPatchByPatchId": (*SqliteBackend).getCashpointPatchByPatchId,
+	"_deleteCashpointPatchById":  (*SqliteBackend).deleteCashpointPatchById,
+	"cashpointVotePatch":         (*SqliteBackend).cashpointVotePatch,
+	"getCashpointPatchVotes":     (*SqliteBackend).getCashpointPatchVotes,
+	"getTownById":                (*SqliteBackend).getTownById,
+	"getRegionById":              (*SqliteBackend).getRegionById,
+	"getTownsBatch":              (*SqliteBackend).getTownsBatch,
+	"getTownsList":               (*SqliteBackend).getTownsList,
+	"getTownsPage":               (*SqliteBackend).getTownsPage,
+	"getTownCashpoints":          (*SqliteBackend).getTownCashpoints,
+	"getBankById":                (*SqliteBackend).getBankById,
+	"getBanksBatch":              (*SqliteBackend).getBanksBatch,
+	"getBanksList":               (*SqliteBackend).getBanksList,
+	"getBanksPage":               (*SqliteBackend).getBanksPage,
+	"getBankPartners":            (*SqliteBackend).getBankPartners,
+	"getMetroById":               (*SqliteBackend).getMetroById,
+	"getMetroList":               (*SqliteBackend).getMetroList,
+	"getMetroBatch":              (*SqliteBackend).getMetroBatch,
+	"getHeatmap":                 (*SqliteBackend).getHeatmap,
+	"getCashpointsStats":         (*SqliteBackend).getCashpointsStats,
+	"getSyncChanges":             (*SqliteBackend).getSyncChanges,
+	"adminCreate":                (*SqliteBackend).adminCreate,
+	"adminUpdate":                (*SqliteBackend).adminUpdate,
+	"adminDelete":                (*SqliteBackend).adminDelete,
+	"getSpaceMetrics":            (*SqliteBackend).getSpaceMetrics,
+	"getMessage":                 (*SqliteBackend).getMessage,
+}
+
+func (b *SqliteBackend) Call(functionName string, args interface{}) (*tarantool.Response, error) {
+	proc, ok := SQLITE_PROCS[functionName]
+	if !ok {
+		return nil, tarantool.Error{Code: tarantool.ErrNoSuchProc, Msg: "Procedure '" + functionName + "' is not defined"}
+	}
+	argList, _ := args.([]interface{})
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var result interface{}
+	err := b.inTx(func() error {
+		var err error
+		result, err = proc(b, argList)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tuple, ok := result.(memoryTuple); ok {
+		return &tarantool.Response{Data: []interface{}{[]interface{}(tuple)}}, nil
+	}
+	return &tarantool.Response{Data: []interface{}{[]interface{}{result}}}, nil
+}
+
+func (b *SqliteBackend) Close() error {
+	return b.db.Close()
+}
+
+// ======================================================================
+// Schema
+
+func (b *SqliteBackend) prepare() error {
+	_, err := b.tx.Exec(SQLITE_DATA_SCHEMA)
+	if err != nil {
+		return err
+	}
+
+	columns, err := b.tableColumns("main", "cashpoints")
+	if err != nil {
+		return err
+	}
+	for _, column := range SQLITE_CASHPOINTS_COLUMNS {
+		if !columns[column.Name] {
+			_, err = b.tx.Exec("ALTER TABLE cashpoints ADD COLUMN " + column.Name + " " + column.Decl)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = b.tx.Exec(SQLITE_SERVICE_SCHEMA)
+	if err != nil {
+		return err
+	}
+
+	imported, err := b.indexCashpoints()
+	if err != nil {
+		return err
+	}
+	if imported {
+		err = b.rebuildClusters()
+		if err != nil {
+			return err
+		}
+	}
+
+	epoch, err := b.getSyncEpoch()
+	if err != nil {
+		return err
+	}
+	if imported || epoch == 0 {
+		return b.syncLogRebuild()
+	}
+	return nil
+}
+
+func (b *SqliteBackend) tableColumns(schema, table string) (map[string]bool, error) {
+	rows, err := b.tx.Query("PRAGMA " + schema + ".table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue interface{}
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = true
+	}
+	return result, rows.Err()
+}
+
+func (b *SqliteBackend) queryPoints(query string, args ...interface{}) ([]cluster.Point, error) {
+	rows, err := b.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]cluster.Point, 0)
+	for rows.Next() {
+		var p cluster.Point
+		if err = rows.Scan(&p.Id, &p.Longitude, &p.Latitude); err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// Sets quadkeys of imported cashpoints and rebuilds r*tree if there are
+// any, returns true in this case
+func (b *SqliteBackend) indexCashpoints() (bool, error) {
+	points, err := b.queryPoints("SELECT id, longitude, latitude FROM cashpoints WHERE quadkey IS NULL")
+	if err != nil || len(points) == 0 {
+		return false, err
+	}
+
+	for _, p := range points {
+		quadKey, err := quadkey.Encode(p.Longitude, p.Latitude, quadkey.CLUSTER_ZOOM_MAX)
+		if err != nil {
+			quadKey = "" // not clustered
+		}
+		_, err = b.tx.Exec("UPDATE cashpoints SET quadkey = ? WHERE id = ?", quadKey, p.Id)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	_, err = b.tx.Exec(`DELETE FROM cashpoints_rtree;
+	                    INSERT INTO cashpoints_rtree SELECT id, longitude, longitude, latitude, latitude FROM cashpoints;`)
+	return true, err
+}
+
+// ======================================================================
+// Clusters
+
+// Hidden cashpoints are not clustered like in migrateClusters
+func (b *SqliteBackend) rebuildClusters() error {
+	_, err := b.tx.Exec("DELETE FROM clusters")
+	if err != nil {
+		return err
+	}
+	points, err := b.queryPoints("SELECT id, longitude, latitude FROM cashpoints WHERE hidden = 0")
+	if err != nil {
+		return err
+	}
+	for _, c := range cluster.BuildAll(points) {
+		if err = b.replaceCluster(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *SqliteBackend) replaceCluster(c *cluster.Cluster) error {
+	members, _ := json.Marshal(c.Members)
+	_, err := b.tx.Exec("INSERT OR REPLACE INTO clusters (quadkey, zoom, longitude, latitude, members) VALUES (?, ?, ?, ?, ?)",
+		c.QuadKey, len(c.QuadKey), c.Longitude, c.Latitude, string(members))
+	return err
+}
+
+// Rebuilds clusters of quad tree branches of passed positions (old and
+// new positions of changed cashpoints) like cluster.Recluster does
+func (b *SqliteBackend) recluster(positions ...cluster.Point) error {
+	roots := make(map[string]map[string]bool)
+	for _, p := range positions {
+		branch, err := cluster.Branch(p)
+		if err != nil {
+			continue
+		}
+		root := branch[0]
+		if roots[root] == nil {
+			roots[root] = make(map[string]bool)
+		}
+		for _, quadKey := range branch {
+			roots[root][quadKey] = true
+		}
+	}
+
+	for root, quadKeys := range roots {
+		// digits of quadkey are 0-3, so '4' ends range of prefix
+		points, err := b.queryPoints("SELECT id, longitude, latitude FROM cashpoints WHERE hidden = 0 AND quadkey >= ? AND quadkey < ?",
+			root, root+"4")
+		if err != nil {
+			return err
+		}
+		for quadKey := range quadKeys {
+			c := cluster.Build(quadKey, points)
+			if c == nil {
+				_, err = b.tx.Exec("DELETE FROM clusters WHERE quadkey = ?", quadKey)
+			} else {
+				err = b.replaceCluster(c)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func scanSqliteCluster(row sqliteScanner) (*models.Cluster, error) {
+	c := new(models.Cluster)
+	var members string
+	err := row.Scan(&c.Id, &c.Longitude, &c.Latitude, &members)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(members), &c.Members); err != nil {
+		return nil, err
+	}
+	c.Size = uint32(len(c.Members))
+	return c, nil
+}
+
+const SQLITE_CLUSTER_COLUMNS = "quadkey, longitude, latitude, members"
+
+// Clusters of zoom with centroid in bbox of request ordered by quadkey
+func (b *SqliteBackend) getClustersInBBox(zoom int, req *memoryNearbyRequest) ([]*models.Cluster, error) {
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	rows, err := b.tx.Query("SELECT "+SQLITE_CLUSTER_COLUMNS+" FROM clusters WHERE zoom = ? AND "+
+		"longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ? ORDER BY quadkey", zoom, minLon, maxLon, minLat, maxLat)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*models.Cluster, 0)
+	for rows.Next() {
+		c, err := scanSqliteCluster(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+func (b *SqliteBackend) getCluster(quadKey string) (*models.Cluster, error) {
+	c, err := scanSqliteCluster(b.tx.QueryRow("SELECT "+SQLITE_CLUSTER_COLUMNS+" FROM clusters WHERE quadkey = ?", quadKey))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// ======================================================================
+// Common
+
+// *sql.Row or *sql.Rows
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (b *SqliteBackend) count(query string, args ...interface{}) (uint32, error) {
+	var result uint32
+	err := b.tx.QueryRow(query, args...).Scan(&result)
+	return result, err
+}
+
+func (b *SqliteBackend) exists(table string, id interface{}) (bool, error) {
+	count, err := b.count("SELECT COUNT(*) FROM "+table+" WHERE id = ?", id)
+	return count > 0, err
+}
+
+func (b *SqliteBackend) queryIds(query string, args ...interface{}) ([]uint32, error) {
+	rows, err := b.tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]uint32, 0)
+	for rows.Next() {
+		var id uint32
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+	return result, rows.Err()
+}
+
+// Runs statements with same arguments, driver does not reuse arguments
+// of multiple statements query
+func (b *SqliteBackend) execEach(queries []string, args ...interface{}) error {
+	for _, query := range queries {
+		if _, err := b.tx.Exec(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decodes batch request like {"towns": [1, 2, 3]}
+func sqliteBatchIds(func_ string, args []interface{}, key string) ([]uint32, error) {
+	req := make(map[string][]uint32)
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	return req[key], nil
+}
+
+// ======================================================================
+// Cashpoints
+
+const SQLITE_CASHPOINT_COLUMNS = `id, IFNULL(type, ''), IFNULL(bank_id, 0), IFNULL(town_id, 0),
+	longitude, latitude, IFNULL(address, ''), IFNULL(address_comment, ''), IFNULL(metro_name, ''),
+	IFNULL(free_access, 0), IFNULL(main_office, 0), IFNULL(without_weekend, 0),
+	IFNULL(round_the_clock, 0), IFNULL(works_as_shop, 0), IFNULL(schedule_general, ''), schedule,
+	IFNULL(tel, ''), IFNULL(additional, ''), IFNULL(rub, 0), IFNULL(usd, 0), IFNULL(eur, 0),
+	IFNULL(cash_in, 0), IFNULL(version, 0), IFNULL(timestamp, 0), IFNULL(approved, 1), IFNULL(user_id, 0)`
+
+// Cashpoint fields written by writeCashpoint
+var SQLITE_CASHPOINT_FIELDS = []string{
+	"type", "bank_id", "town_id", "longitude", "latitude", "address", "address_comment", "metro_name",
+	"free_access", "main_office", "without_weekend", "round_the_clock", "works_as_shop", "schedule",
+	"tel", "additional", "rub", "usd", "eur", "cash_in", "version", "timestamp", "approved", "user_id", "quadkey",
+}
+
+// Schedule that cannot be parsed is left empty like in migrator
+func scanSqliteCashpoint(row sqliteScanner) (*models.Cashpoint, error) {
+	cp := new(models.Cashpoint)
+	var scheduleGeneral string
+	var schedule sql.NullString
+	var rub, usd, eur bool
+	err := row.Scan(&cp.Id, &cp.Type, &cp.BankId, &cp.TownId,
+		&cp.Longitude, &cp.Latitude, &cp.Address, &cp.AddressComment, &cp.MetroName,
+		&cp.FreeAccess, &cp.MainOffice, &cp.WithoutWeekend,
+		&cp.RoundTheClock, &cp.WorksAsShop, &scheduleGeneral, &schedule,
+		&cp.Tel, &cp.Additional, &rub, &usd, &eur,
+		&cp.CashIn, &cp.Version, &cp.Timestamp, &cp.Approved, &cp.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.Currency = models.CurrencyFromFlags(rub, usd, eur)
+	if schedule.Valid {
+		err = json.Unmarshal([]byte(schedule.String), &cp.Schedule)
+	} else {
+		cp.Schedule, err = models.ParseSchedule(scheduleGeneral)
+	}
+	if err != nil {
+		cp.Schedule = models.Schedule{}
+	}
+	return cp, nil
+}
+
+func (b *SqliteBackend) queryCashpoints(query string, args ...interface{}) ([]*models.Cashpoint, error) {
+	rows, err := b.tx.Query("SELECT "+SQLITE_CASHPOINT_COLUMNS+" FROM cashpoints "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*models.Cashpoint, 0)
+	for rows.Next() {
+		cp, err := scanSqliteCashpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cp)
+	}
+	return result, rows.Err()
+}
+
+// Returns nil if there is no such cashpoint
+func (b *SqliteBackend) getCashpoint(id uint32) (*models.Cashpoint, error) {
+	cp, err := scanSqliteCashpoint(b.tx.QueryRow("SELECT "+SQLITE_CASHPOINT_COLUMNS+" FROM cashpoints WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return cp, err
+}
+
+// Sets count of cashpoint patches
+func (b *SqliteBackend) cashpointReply(cp *models.Cashpoint) (*models.Cashpoint, error) {
+	var err error
+	cp.PatchCount, err = b.count("SELECT COUNT(*) FROM cashpoints_patches WHERE cashpoint_id = ?", cp.Id)
+	return cp, err
+}
+
+// Inserts or updates cashpoint and its r*tree entry. Currencies other
+// than rub, usd and eur have no columns and are not saved.
+func (b *SqliteBackend) writeCashpoint(cp *models.Cashpoint, create bool) error {
+	quadKey, _ := quadkey.Encode(cp.Longitude, cp.Latitude, quadkey.CLUSTER_ZOOM_MAX)
+	schedule, _ := json.Marshal(cp.Schedule)
+	values := []interface{}{
+		cp.Type, cp.BankId, cp.TownId, cp.Longitude, cp.Latitude, cp.Address, cp.AddressComment, cp.MetroName,
+		cp.FreeAccess, cp.MainOffice, cp.WithoutWeekend, cp.RoundTheClock, cp.WorksAsShop, string(schedule),
+		cp.Tel, cp.Additional, cp.HasCurrency(models.CURRENCY_RUB), cp.HasCurrency(models.CURRENCY_USD),
+		cp.HasCurrency(models.CURRENCY_EUR), cp.CashIn, cp.Version, cp.Timestamp, cp.Approved, cp.UserId, quadKey,
+	}
+
+	var err error
+	if create {
+		_, err = b.tx.Exec("INSERT INTO cashpoints (id, schedule_general, hidden, "+strings.Join(SQLITE_CASHPOINT_FIELDS, ", ")+
+			") VALUES (?, '', 0"+strings.Repeat(", ?", len(SQLITE_CASHPOINT_FIELDS))+")", append([]interface{}{cp.Id}, values...)...)
+	} else {
+		_, err = b.tx.Exec("UPDATE cashpoints SET "+strings.Join(SQLITE_CASHPOINT_FIELDS, " = ?, ")+" = ? WHERE id = ?",
+			append(values, cp.Id)...)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = b.tx.Exec("INSERT OR REPLACE INTO cashpoints_rtree VALUES (?, ?, ?, ?, ?)",
+		cp.Id, cp.Longitude, cp.Longitude, cp.Latitude, cp.Latitude)
+	return err
+}
+
+func cashpointPoint(cp *models.Cashpoint) cluster.Point {
+	return cluster.Point{Id: cp.Id, Longitude: cp.Longitude, Latitude: cp.Latitude}
+}
+
+func (b *SqliteBackend) getCashpointById(args []interface{}) (interface{}, error) {
+	cp, err := b.getCashpoint(uint32(memoryArgUint(args, 0)))
+	if err != nil || cp == nil {
+		return "", err
+	}
+	if _, err = b.cashpointReply(cp); err != nil {
+		return nil, err
+	}
+	return memoryJson(cp)
+}
+
+func (b *SqliteBackend) getCashpointsBatch(args []interface{}) (interface{}, error) {
+	ids, err := sqliteBatchIds("getCashpointsBatch", args, "cashpoints")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Cashpoint, 0, len(ids))
+	for _, id := range ids {
+		cp, err := b.getCashpoint(id)
+		if err != nil {
+			return nil, err
+		}
+		if cp != nil {
+			if _, err = b.cashpointReply(cp); err != nil {
+				return nil, err
+			}
+			result = append(result, cp)
+		}
+		if len(result) == MEMORY_MAX_CASHPOINTS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *SqliteBackend) getCashpointsStateBatch(args []interface{}) (interface{}, error) {
+	return getCashpointsState(args)
+}
+
+func (b *SqliteBackend) deleteCashpointById(args []interface{}) (interface{}, error) {
+	id := uint32(memoryArgUint(args, 0))
+	cp, err := b.getCashpoint(id)
+	if err != nil || cp == nil {
+		return false, err
+	}
+
+	err = b.execEach([]string{
+		"DELETE FROM cashpoints WHERE id = ?",
+		"DELETE FROM cashpoints_rtree WHERE id = ?",
+		"DELETE FROM cashpoints_patches_votes WHERE patch_id IN (SELECT id FROM cashpoints_patches WHERE cashpoint_id = ?)",
+		"DELETE FROM cashpoints_patches WHERE cashpoint_id = ?",
+	}, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.recluster(cashpointPoint(cp)); err != nil {
+		return nil, err
+	}
+	if err = b.syncLogTouch(SYNC_KIND_CASHPOINT, uint64(id), uint64(cp.TownId), 0, true); err != nil {
+		return nil, err
+	}
+	return true, nil
+}
+
+// ======================================================================
+// Nearby search
+
+func (b *SqliteBackend) partnerNetwork(bankId uint32) ([]uint32, error) {
+	return b.getBankPartnerNetwork(bankId)
+}
+
+func (b *SqliteBackend) getNearbyRequest(func_ string, args []interface{}) (*memoryNearbyRequest, error) {
+	var req memoryNearbyRequest
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if err := validateNearbyRequest(func_, &req, b.partnerNetwork); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// Cashpoints in bbox of request matching its filter ordered by id
+func (b *SqliteBackend) getCashpointsInBBox(req *memoryNearbyRequest) ([]*models.Cashpoint, error) {
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	// r*tree keeps coordinates as 32 bit floats, so bbox is checked once more
+	cashpoints, err := b.queryCashpoints(`WHERE id IN (SELECT id FROM cashpoints_rtree
+		WHERE max_lon >= ? AND min_lon <= ? AND max_lat >= ? AND min_lat <= ?) ORDER BY id`,
+		minLon, maxLon, minLat, maxLat)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Cashpoint, 0, len(cashpoints))
+	for _, cp := range cashpoints {
+		if req.contains(cp.Longitude, cp.Latitude) && memoryMatching(cp, req.Filter, true) {
+			result = append(result, cp)
+		}
+	}
+	return result, nil
+}
+
+func (b *SqliteBackend) getNearbyCashpoints(args []interface{}) (interface{}, error) {
+	func_ := "getNearbyCashpoints"
+	req, err := b.getNearbyRequest(func_, args)
+	if err != nil {
+		return nil, err
+	}
+
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	if maxLon-minLon > MEMORY_MAX_COORD_DELTA {
+		return nil, memoryMalformedRequest(func_, "too big region size in request: longitude")
+	}
+	if maxLat-minLat > MEMORY_MAX_COORD_DELTA {
+		return nil, memoryMalformedRequest(func_, "too big region size in request: latitude")
+	}
+
+	cashpoints, err := b.getCashpointsInBBox(req)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint32, 0, len(cashpoints))
+	for _, cp := range cashpoints {
+		result = append(result, cp.Id)
+	}
+	return memoryJson(result)
+}
+
+func (b *SqliteBackend) getNearbyClusters(args []interface{}) (interface{}, error) {
+	func_ := "getNearbyClusters"
+	req, err := b.getNearbyRequest(func_, args)
+	if err != nil {
+		return nil, err
+	}
+	if req.Zoom == nil {
+		return nil, memoryMalformedRequest(func_, "missing required argument => req.zoom")
+	}
+
+	if *req.Zoom < quadkey.CLUSTER_ZOOM_MIN {
+		countLimit := memoryArgUint(args, 1)
+		if countLimit == 0 {
+			countLimit = 32
+		}
+		return b.getNearbyTownClusters(req, int(countLimit))
+	}
+	return b.getNearbyQuadClusters(req)
+}
+
+// Returns members of cluster matching filter with their centroid
+func (b *SqliteBackend) filterClusterMembers(c *models.Cluster, filter *memoryFilter) ([]uint32, float64, float64, error) {
+	members := make([]uint32, 0)
+	longitude, latitude := 0.0, 0.0
+	for _, id := range c.Members {
+		cp, err := b.getCashpoint(id)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if cp != nil && memoryMatching(cp, filter, true) {
+			members = append(members, id)
+			longitude += cp.Longitude
+			latitude += cp.Latitude
+		}
+	}
+	if len(members) > 0 {
+		longitude /= float64(len(members))
+		latitude /= float64(len(members))
+	}
+	return members, longitude, latitude, nil
+}
+
+// Clusters of quadkey one level deeper than requested zoom
+func (b *SqliteBackend) getNearbyQuadClusters(req *memoryNearbyRequest) (interface{}, error) {
+	clusters, err := b.getClustersInBBox(int(*req.Zoom)+1, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]interface{}, 0, len(clusters))
+	for _, c := range clusters {
+		reply := &models.Cluster{Id: c.Id, Longitude: c.Longitude, Latitude: c.Latitude}
+		members := c.Members
+		if !req.Filter.isEmpty() {
+			members, reply.Longitude, reply.Latitude, err = b.filterClusterMembers(c, req.Filter)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		reply.Size = uint32(len(members))
+		if reply.Size == 1 {
+			cp, err := b.getCashpoint(members[0])
+			if err != nil {
+				return nil, err
+			}
+			if cp != nil {
+				if _, err = b.cashpointReply(cp); err != nil {
+					return nil, err
+				}
+				result = append(result, cp)
+			}
+		} else if reply.Size > 1 {
+			result = append(result, reply)
+		}
+	}
+	return memoryJson(result)
+}
+
+// Towns in region merged with close bigger ones (_getNearbyTownClusters of clusterapi.lua)
+func (b *SqliteBackend) getNearbyTownClusters(req *memoryNearbyRequest, countLimit int) (interface{}, error) {
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	rows, err := b.tx.Query(`SELECT id, longitude, latitude,
+		(SELECT COUNT(*) FROM cashpoints WHERE town_id = towns.id AND approved = 1)
+		FROM towns WHERE longitude BETWEEN ? AND ? AND latitude BETWEEN ? AND ?`, minLon, maxLon, minLat, maxLat)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*memoryTownClusterReply, 0)
+	for rows.Next() {
+		c := new(memoryTownClusterReply)
+		if err = rows.Scan(&c.Id, &c.Longitude, &c.Latitude, &c.Size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	merged := mergeTownClusters(result, req, countLimit)
+
+	if !req.Filter.isEmpty() {
+		filtered := make([]*memoryTownClusterReply, 0, len(merged))
+		for _, c := range merged {
+			cashpoints, err := b.queryCashpoints("WHERE town_id = ?", c.Id)
+			if err != nil {
+				return nil, err
+			}
+			c.Size = 0
+			for _, cp := range cashpoints {
+				if memoryMatching(cp, req.Filter, true) {
+					c.Size++
+				}
+			}
+			if c.Size > 0 {
+				filtered = append(filtered, c)
+			}
+		}
+		merged = filtered
+	}
+	return memoryJson(merged)
+}
+
+func (b *SqliteBackend) getQuadKeyFromCoord(args []interface{}) (interface{}, error) {
+	return getQuadKeyReply(args)
+}
+
+func (b *SqliteBackend) getQuadTreeBranch(args []interface{}) (interface{}, error) {
+	quadKey, _ := memoryArgString(args, 0)
+
+	result := make([]*models.Cluster, 0)
+	for zoom := quadkey.CLUSTER_ZOOM_MIN; zoom <= len(quadKey); zoom++ {
+		c, err := b.getCluster(quadKey[:zoom])
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			result = append(result, c)
+		}
+	}
+	return memoryJson(result)
+}
+
+// ======================================================================
+// Patches and votes
+
+// Checks patch fields referring other objects (validateCashpoint of common.lua)
+func (b *SqliteBackend) validateCashpointData(data map[string]interface{}) (bool, error) {
+	for _, ref := range []struct{ field, table string }{{"bank_id", "banks"}, {"town_id", "towns"}} {
+		if id, ok := data[ref.field].(float64); ok {
+			found, err := b.exists(ref.table, uint32(id))
+			if err != nil || !found {
+				return false, err
+			}
+		}
+	}
+	if cpType, ok := data["type"].(string); ok && !CASHPOINT_TYPES[cpType] {
+		return false, nil
+	}
+	lon, okLon := data["longitude"].(float64)
+	lat, okLat := data["latitude"].(float64)
+	if okLon != okLat || (okLon && !quadkey.IsValidCoordinate(lon, lat)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b *SqliteBackend) addPatch(cpId, userId uint64, data string, timestamp uint64) error {
+	_, err := b.tx.Exec("INSERT INTO cashpoints_patches (cashpoint_id, user_id, data, timestamp) VALUES (?, ?, ?, ?)",
+		cpId, userId, data, timestamp)
+	return err
+}
+
+// Commits patch data to cashpoints, returns id of created / updated
+// cashpoint or 0 (cashpointCommit of cpapi.lua)
+func (b *SqliteBackend) cashpointCommit(data map[string]interface{}, userId uint64) (uint32, error) {
+	timestamp := memoryTimestamp()
+
+	valid, err := b.validateCashpointData(data)
+	if err != nil || !valid {
+		return 0, err
+	}
+
+	if idValue, ok := data["id"]; ok {
+		idNum, _ := idValue.(float64)
+		old, err := b.getCashpoint(uint32(idNum))
+		if err != nil || old == nil {
+			return 0, err
+		}
+
+		cp := old
+		if len(data) == 1 { // not a patch but a mark of new cashpoint
+			cp.Approved = true
+			cp.Timestamp = timestamp
+			err = b.writeCashpoint(cp, false)
+		} else {
+			var changed bool
+			cp, changed = applyCashpointPatch(old, data)
+			if !changed {
+				return 0, nil
+			}
+			cp.Version++
+			cp.Timestamp = timestamp
+			cp.Approved = true
+			err = b.writeCashpoint(cp, false)
+			if err == nil && (cp.Longitude != old.Longitude || cp.Latitude != old.Latitude) {
+				err = b.recluster(cashpointPoint(old), cashpointPoint(cp))
+			}
+		}
+		if err == nil {
+			err = b.syncLogTouch(SYNC_KIND_CASHPOINT, uint64(cp.Id), uint64(cp.TownId), timestamp, false)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return cp.Id, nil
+	}
+
+	dataJson, _ := json.Marshal(data)
+	cp := new(models.Cashpoint)
+	if err := json.Unmarshal(dataJson, cp); err != nil {
+		return 0, nil
+	}
+	if _, err := quadkey.Encode(cp.Longitude, cp.Latitude, quadkey.CLUSTER_ZOOM_MAX); err != nil {
+		return 0, nil
+	}
+
+	err = b.tx.QueryRow("SELECT IFNULL(MAX(id), 0) + 1 FROM cashpoints").Scan(&cp.Id)
+	if err != nil {
+		return 0, err
+	}
+	cp.Version = 0
+	cp.Timestamp = timestamp
+	cp.Approved = false
+	cp.UserId = uint32(userId)
+	if err = b.writeCashpoint(cp, true); err != nil {
+		return 0, err
+	}
+	if err = b.recluster(cashpointPoint(cp)); err != nil {
+		return 0, err
+	}
+	if err = b.syncLogTouch(SYNC_KIND_CASHPOINT, uint64(cp.Id), uint64(cp.TownId), timestamp, false); err != nil {
+		return 0, err
+	}
+
+	patchData, _ := json.Marshal(map[string]uint32{"id": cp.Id})
+	if err = b.addPatch(uint64(cp.Id), userId, string(patchData), timestamp); err != nil {
+		return 0, err
+	}
+	return cp.Id, nil
+}
+
+// Returns id of created or patched cashpoint, 0 if patch is invalid or
+// same patch is already proposed
+func (b *SqliteBackend) cashpointProposePatch(args []interface{}) (interface{}, error) {
+	func_ := "cashpointProposePatch"
+	req := struct {
+		UserId *uint64                `json:"user_id"`
+		Data   map[string]interface{} `json:"data"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if req.UserId == nil {
+		return nil, memoryMalformedRequest(func_, "missing required field user_id in request")
+	}
+	if req.Data == nil {
+		return nil, memoryMalformedRequest(func_, "missing required field data in request")
+	}
+
+	idValue, ok := req.Data["id"]
+	if !ok { // creating new cashpoint
+		id, err := b.cashpointCommit(req.Data, *req.UserId)
+		return uint64(id), err
+	}
+
+	idNum, _ := idValue.(float64)
+	cpId := uint64(idNum)
+	delete(req.Data, "id") // don't save cashpoint id in patch
+
+	old, err := b.getCashpoint(uint32(cpId))
+	if err != nil || old == nil {
+		return uint64(0), err
+	}
+	valid, err := b.validateCashpointData(req.Data)
+	if err != nil || !valid {
+		return uint64(0), err
+	}
+	if _, changed := applyCashpointPatch(old, req.Data); !changed {
+		return uint64(0), nil
+	}
+
+	patchJson, _ := json.Marshal(req.Data)
+	same, err := b.count("SELECT COUNT(*) FROM cashpoints_patches WHERE cashpoint_id = ? AND data = ?", cpId, string(patchJson))
+	if err != nil || same > 0 {
+		return uint64(0), err
+	}
+	if err = b.addPatch(cpId, *req.UserId, string(patchJson), memoryTimestamp()); err != nil {
+		return nil, err
+	}
+	return cpId, nil
+}
+
+func (b *SqliteBackend) getCashpointPatches(args []interface{}) (interface{}, error) {
+	rows, err := b.tx.Query("SELECT id, data FROM cashpoints_patches WHERE cashpoint_id = ?", memoryArgUint(args, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var id uint64
+		var data string
+		if err = rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		result[strconv.FormatUint(id, 10)] = json.RawMessage(data)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return memoryJson(result)
+}
+
+// Returns patch tuple: [id, cashpoint id, user id, data, timestamp]
+func (b *SqliteBackend) getCashpointPatchByPatchId(args []interface{}) (interface{}, error) {
+	var patch memoryPatch
+	err := b.tx.QueryRow("SELECT id, cashpoint_id, user_id, data, timestamp FROM cashpoints_patches WHERE id = ?",
+		memoryArgUint(args, 0)).Scan(&patch.Id, &patch.CashpointId, &patch.UserId, &patch.Data, &patch.Timestamp)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return memoryTuple{patch.Id, patch.CashpointId, patch.UserId, patch.Data, patch.Timestamp}, nil
+}
+
+func (b *SqliteBackend) deleteCashpointPatchById(args []interface{}) (interface{}, error) {
+	return nil, b.execEach([]string{
+		"DELETE FROM cashpoints_patches_votes WHERE patch_id = ?",
+		"DELETE FROM cashpoints_patches WHERE id = ?",
+	}, memoryArgUint(args, 0))
+}
+
+func (b *SqliteBackend) getPatchVotes(patchId uint64) ([]*memoryVote, error) {
+	rows, err := b.tx.Query("SELECT id, patch_id, user_id, score FROM cashpoints_patches_votes WHERE patch_id = ? ORDER BY id", patchId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*memoryVote, 0)
+	for rows.Next() {
+		vote := new(memoryVote)
+		if err = rows.Scan(&vote.Id, &vote.PatchId, &vote.UserId, &vote.Score); err != nil {
+			return nil, err
+		}
+		result = append(result, vote)
+	}
+	return result, rows.Err()
+}
+
+func (b *SqliteBackend) getCashpointPatchVotes(args []interface{}) (interface{}, error) {
+	votes, err := b.getPatchVotes(memoryArgUint(args, 0))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]models.PatchVote, 0, len(votes))
+	for _, vote := range votes {
+		result = append(result, models.PatchVote{UserId: vote.UserId, Score: int32(vote.Score)})
+	}
+	return memoryJson(result)
+}
+
+// Votes for patch, patch is committed once votes score reaches
+// MEMORY_PATCH_APPROVE_VOTES. Returns false if user has already voted.
+func (b *SqliteBackend) cashpointVotePatch(args []interface{}) (interface{}, error) {
+	func_ := "cashpointVotePatch"
+	vote := struct {
+		PatchId *uint64 `json:"patch_id"`
+		UserId  *uint64 `json:"user_id"`
+		Score   *int64  `json:"score"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &vote); err != nil {
+		return nil, err
+	}
+	if vote.PatchId == nil {
+		return nil, memoryMalformedRequest(func_, "missing patch id for vote")
+	}
+	patch, err := b.getCashpointPatchByPatchId([]interface{}{*vote.PatchId})
+	if err != nil {
+		return nil, err
+	}
+	if patch == nil {
+		return nil, memoryMalformedRequest(func_, "no such patch id for vote")
+	}
+	if vote.UserId == nil {
+		return nil, memoryMalformedRequest(func_, "missing user_id for vote")
+	}
+	if vote.Score == nil || (*vote.Score != 1 && *vote.Score != -1) {
+		return nil, memoryMalformedRequest(func_, "wrong vote score")
+	}
+
+	votes, err := b.getPatchVotes(*vote.PatchId)
+	if err != nil {
+		return nil, err
+	}
+	score := *vote.Score
+	for _, v := range votes {
+		if v.UserId == *vote.UserId { // one vote per user
+			return false, nil
+		}
+		score += v.Score
+	}
+
+	_, err = b.tx.Exec("INSERT INTO cashpoints_patches_votes (patch_id, user_id, score) VALUES (?, ?, ?)",
+		*vote.PatchId, *vote.UserId, *vote.Score)
+	if err != nil {
+		return nil, err
+	}
+
+	if score >= MEMORY_PATCH_APPROVE_VOTES {
+		tuple := patch.(memoryTuple)
+		var data map[string]interface{}
+		json.Unmarshal([]byte(tuple[3].(string)), &data)
+		if _, ok := data["id"]; !ok {
+			data["id"] = float64(tuple[1].(uint64))
+		}
+		id, err := b.cashpointCommit(data, *vote.UserId)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 { // vote is rolled back with transaction
+			return nil, tarantool.Error{Code: 400, Msg: "cannot commit approved cashpoint patch"}
+		}
+	}
+	return true, nil
+}
+
+// ======================================================================
+// Towns, banks and metro
+
+const SQLITE_TOWN_COLUMNS = `id, longitude, latitude, IFNULL(name, ''), IFNULL(name_tr, ''), IFNULL(region_id, 0),
+	IFNULL(regional_center, 0), IFNULL(zoom, 0), IFNULL(has_emblem, 0),
+	EXISTS (SELECT 1 FROM metro WHERE metro.town_id = towns.id),
+	(SELECT COUNT(*) FROM cashpoints WHERE cashpoints.town_id = towns.id AND approved = 1),
+	IFNULL(population, 0)`
+
+func (b *SqliteBackend) queryTowns(query string, args ...interface{}) ([]*models.Town, error) {
+	rows, err := b.tx.Query("SELECT "+SQLITE_TOWN_COLUMNS+" FROM towns "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*models.Town, 0)
+	for rows.Next() {
+		town := new(models.Town)
+		err = rows.Scan(&town.Id, &town.Longitude, &town.Latitude, &town.Name, &town.NameTr, &town.RegionId,
+			&town.RegionalCenter, &town.Zoom, &town.Big, &town.HasMetro, &town.CashpointsCount, &town.Population)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, town)
+	}
+	return result, rows.Err()
+}
+
+// Returns nil if there is no such town
+func (b *SqliteBackend) getTown(id uint32) (*models.Town, error) {
+	towns, err := b.queryTowns("WHERE id = ?", id)
+	if err != nil || len(towns) == 0 {
+		return nil, err
+	}
+	return towns[0], nil
+}
+
+func (b *SqliteBackend) getTownById(args []interface{}) (interface{}, error) {
+	town, err := b.getTown(uint32(memoryArgUint(args, 0)))
+	if err != nil || town == nil {
+		return "", err
+	}
+	return memoryJson(town)
+}
+
+func (b *SqliteBackend) getRegionById(args []interface{}) (interface{}, error) {
+	region := models.Region{}
+	err := b.tx.QueryRow(`SELECT id, IFNULL(name, ''), IFNULL(name_tr, ''), IFNULL(longitude, 0), IFNULL(latitude, 0),
+	                             IFNULL(zoom, 0) FROM regions WHERE id = ?`, uint32(memoryArgUint(args, 0))).Scan(
+		&region.Id, &region.Name, &region.NameTr, &region.Longitude, &region.Latitude, &region.Zoom)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return nil, err
+	}
+	return memoryJson(&region)
+}
+
+func (b *SqliteBackend) getTownsBatch(args []interface{}) (interface{}, error) {
+	ids, err := sqliteBatchIds("getTownsBatch", args, "towns")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Town, 0, len(ids))
+	for _, id := range ids {
+		town, err := b.getTown(id)
+		if err != nil {
+			return nil, err
+		}
+		if town != nil {
+			result = append(result, town)
+		}
+		if len(result) == MEMORY_MAX_TOWNS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *SqliteBackend) getTownsList(args []interface{}) (interface{}, error) {
+	ids, err := b.queryIds("SELECT id FROM towns ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return memoryJson(ids)
+}
+
+// Converts object to map of its json fields
+func sqliteListItem(v interface{}) map[string]interface{} {
+	data, _ := json.Marshal(v)
+	var result map[string]interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func (b *SqliteBackend) getTownsPage(args []interface{}) (interface{}, error) {
+	towns, err := b.queryTowns("")
+	if err != nil {
+		return nil, err
+	}
+	items := make([]map[string]interface{}, 0, len(towns))
+	for _, town := range towns {
+		item := sqliteListItem(town)
+		item["population"] = float64(town.Population)
+		item["cashpoints_count"] = float64(town.CashpointsCount)
+		items = append(items, item)
+	}
+	return getListPage("getTownsPage", items, args)
+}
+
+func (b *SqliteBackend) getTownCashpoints(args []interface{}) (interface{}, error) {
+	ids, err := b.queryIds("SELECT id FROM cashpoints WHERE town_id = ? ORDER BY id", memoryArgUint(args, 0))
+	if err != nil {
+		return nil, err
+	}
+	return memoryJson(ids)
+}
+
+const SQLITE_BANK_COLUMNS = `id, IFNULL(name, ''), IFNULL(name_tr, ''), IFNULL(name_tr_alt, ''),
+	IFNULL(licence, 0), IFNULL(rating, 0), IFNULL(tel, '')`
+
+func (b *SqliteBackend) queryBanks(query string, args ...interface{}) ([]*models.Bank, error) {
+	rows, err := b.tx.Query("SELECT "+SQLITE_BANK_COLUMNS+" FROM banks "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*models.Bank, 0)
+	for rows.Next() {
+		bank := new(models.Bank)
+		err = rows.Scan(&bank.Id, &bank.Name, &bank.NameTr, &bank.NameTrAlt, &bank.Licence, &bank.Rating, &bank.Tel)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result = append(result, bank)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, bank := range result {
+		bank.Partners, err = b.queryIds("SELECT partner_id FROM partners WHERE id = ? ORDER BY rowid", bank.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Returns nil if there is no such bank
+func (b *SqliteBackend) getBank(id uint32) (*models.Bank, error) {
+	banks, err := b.queryBanks("WHERE id = ?", id)
+	if err != nil || len(banks) == 0 {
+		return nil, err
+	}
+	return banks[0], nil
+}
+
+func (b *SqliteBackend) getBankById(args []interface{}) (interface{}, error) {
+	bank, err := b.getBank(uint32(memoryArgUint(args, 0)))
+	if err != nil || bank == nil {
+		return "", err
+	}
+	return memoryJson(bank)
+}
+
+func (b *SqliteBackend) getBanksBatch(args []interface{}) (interface{}, error) {
+	ids, err := sqliteBatchIds("getBanksBatch", args, "banks")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Bank, 0, len(ids))
+	for _, id := range ids {
+		bank, err := b.getBank(id)
+		if err != nil {
+			return nil, err
+		}
+		if bank != nil {
+			result = append(result, bank)
+		}
+		if len(result) == MEMORY_MAX_BANKS_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+func (b *SqliteBackend) getBanksList(args []interface{}) (interface{}, error) {
+	ids, err := b.queryIds("SELECT id FROM banks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return memoryJson(ids)
+}
+
+// cashpoints_count is computed only if it is requested as sort or
+// projection field like in bankapi.lua
+func (b *SqliteBackend) getBanksPage(args []interface{}) (interface{}, error) {
+	func_ := "getBanksPage"
+	req := struct {
+		Sort   string   `json:"sort"`
+		Fields []string `json:"fields"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	needCount := req.Sort == "cashpoints_count" || containsString(req.Fields, "cashpoints_count")
+
+	counts := make(map[uint32]uint32)
+	if needCount {
+		rows, err := b.tx.Query("SELECT bank_id, COUNT(*) FROM cashpoints GROUP BY bank_id")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var bankId, count uint32
+			if err = rows.Scan(&bankId, &count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts[bankId] = count
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	banks, err := b.queryBanks("")
+	if err != nil {
+		return nil, err
+	}
+	items := make([]map[string]interface{}, 0, len(banks))
+	for _, bank := range banks {
+		item := sqliteListItem(bank)
+		if needCount {
+			item["cashpoints_count"] = float64(counts[bank.Id])
+		}
+		items = append(items, item)
+	}
+	return getListPage(func_, items, args)
+}
+
+// Returns ids of bank and its partners, nil if there is no such bank
+func (b *SqliteBackend) getBankPartnerNetwork(bankId uint32) ([]uint32, error) {
+	bank, err := b.getBank(bankId)
+	if err != nil || bank == nil {
+		return nil, err
+	}
+	result := []uint32{bankId}
+	for _, id := range bank.Partners {
+		if id != bankId {
+			result = append(result, id)
+		}
+	}
+	return result, nil
+}
+
+func (b *SqliteBackend) getBankPartners(args []interface{}) (interface{}, error) {
+	network, err := b.getBankPartnerNetwork(uint32(memoryArgUint(args, 0)))
+	if err != nil || network == nil {
+		return "", err
+	}
+
+	result := make([]*models.Bank, 0, len(network)-1)
+	for _, id := range network[1:] {
+		bank, err := b.getBank(id)
+		if err != nil {
+			return nil, err
+		}
+		if bank != nil {
+			result = append(result, bank)
+		}
+	}
+	return memoryJson(result)
+}
+
+const SQLITE_METRO_COLUMNS = `id, longitude, latitude, IFNULL(town_id, 0), IFNULL(branch_id, 0),
+	IFNULL(name, ''), IFNULL(ext, '')`
+
+// Returns nil if there is no such station
+func (b *SqliteBackend) getMetro(id uint32) (*models.Metro, error) {
+	metro := new(models.Metro)
+	err := b.tx.QueryRow("SELECT "+SQLITE_METRO_COLUMNS+" FROM metro WHERE id = ?", id).Scan(&metro.Id,
+		&metro.Longitude, &metro.Latitude, &metro.TownId, &metro.BranchId, &metro.StationName, &metro.StationExitName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return metro, err
+}
+
+func (b *SqliteBackend) getMetroById(args []interface{}) (interface{}, error) {
+	metro, err := b.getMetro(uint32(memoryArgUint(args, 0)))
+	if err != nil || metro == nil {
+		return "", err
+	}
+	return memoryJson(metro)
+}
+
+func (b *SqliteBackend) getMetroList(args []interface{}) (interface{}, error) {
+	ids, err := b.queryIds("SELECT id FROM metro WHERE town_id = ? ORDER BY id", memoryArgUint(args, 0))
+	if err != nil {
+		return nil, err
+	}
+	return memoryJson(ids)
+}
+
+func (b *SqliteBackend) getMetroBatch(args []interface{}) (interface{}, error) {
+	ids, err := sqliteBatchIds("getMetroBatch", args, "metro")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*models.Metro, 0, len(ids))
+	for _, id := range ids {
+		metro, err := b.getMetro(id)
+		if err != nil {
+			return nil, err
+		}
+		if metro != nil {
+			result = append(result, metro)
+		}
+		if len(result) == MEMORY_MAX_METRO_BATCH {
+			break
+		}
+	}
+	return memoryJson(result)
+}
+
+// ======================================================================
+// Heatmap
+
+// req: { topLeft, bottomRight, cols, rows, filter }
+// Returns non-empty cells of cols x rows grid over bbox with cashpoints count
+func (b *SqliteBackend) getHeatmap(args []interface{}) (interface{}, error) {
+	func_ := "getHeatmap"
+	req := struct {
+		memoryNearbyRequest
+		Cols *float64 `json:"cols"`
+		Rows *float64 `json:"rows"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if err := validateNearbyRequest(func_, &req.memoryNearbyRequest, b.partnerNetwork); err != nil {
+		return nil, err
+	}
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{{"cols", req.Cols}, {"rows", req.Rows}} {
+		if field.value == nil || *field.value < 1 || *field.value > SQLITE_MAX_HEATMAP_GRID {
+			return nil, memoryMalformedRequest(func_, "%s is out of range [1, %d]", field.name, SQLITE_MAX_HEATMAP_GRID)
+		}
+	}
+	cols, rows := *req.Cols, *req.Rows
+
+	minLon, minLat, maxLon, maxLat := req.bbox()
+	cellWidth := (maxLon - minLon) / cols
+	cellHeight := (maxLat - minLat) / rows
+	if cellWidth <= 0 || cellHeight <= 0 {
+		return nil, memoryMalformedRequest(func_, "empty bbox")
+	}
+
+	cells := make(map[int]*heatmapCell)
+	addToCell := func(longitude, latitude float64, count int) {
+		if count == 0 || !req.contains(longitude, latitude) {
+			return
+		}
+		col := int(math.Min(math.Floor((longitude-minLon)/cellWidth), cols-1))
+		// rows go from top to bottom
+		row := int(math.Min(math.Floor((maxLat-latitude)/cellHeight), rows-1))
+		key := row*int(cols) + col
+		cell, ok := cells[key]
+		if !ok {
+			cell = &heatmapCell{Col: col, Row: row}
+			cells[key] = cell
+		}
+		cell.Count += count
+	}
+
+	reply := struct {
+		CellWidth  float64         `json:"cell_width"`
+		CellHeight float64         `json:"cell_height"`
+		Zoom       *int            `json:"zoom,omitempty"`
+		Cells      heatmapCellList `json:"cells"`
+	}{CellWidth: cellWidth, CellHeight: cellHeight, Cells: make(heatmapCellList, 0)}
+
+	if zoom, ok := getHeatmapZoom(cellWidth); ok {
+		reply.Zoom = &zoom
+		clusters, err := b.getClustersInBBox(zoom+1, &req.memoryNearbyRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clusters {
+			count := len(c.Members)
+			if !req.Filter.isEmpty() {
+				members, _, _, err := b.filterClusterMembers(c, req.Filter)
+				if err != nil {
+					return nil, err
+				}
+				count = len(members)
+			}
+			addToCell(c.Longitude, c.Latitude, count)
+		}
+	} else {
+		cashpoints, err := b.getCashpointsInBBox(&req.memoryNearbyRequest)
+		if err != nil {
+			return nil, err
+		}
+		for _, cp := range cashpoints {
+			addToCell(cp.Longitude, cp.Latitude, 1)
+		}
+	}
+
+	for _, cell := range cells {
+		cell.Longitude = minLon + (float64(cell.Col)+0.5)*cellWidth
+		cell.Latitude = maxLat - (float64(cell.Row)+0.5)*cellHeight
+		reply.Cells = append(reply.Cells, cell)
+	}
+	sort.Sort(reply.Cells)
+	return memoryJson(reply)
+}
+
+// ======================================================================
+// Stats
+
+// Aggregates approved cashpoints of towns matching condition, all towns
+// if it is empty (_collectStats of statsapi.lua). Density is calculated
+// over towns with known population only.
+func (b *SqliteBackend) collectStats(townsCond string, args ...interface{}) (map[string]interface{}, error) {
+	townsQuery := "SELECT id, IFNULL(population, 0) FROM towns"
+	cashpointsQuery := "SELECT IFNULL(type, ''), IFNULL(bank_id, 0), IFNULL(town_id, 0), IFNULL(round_the_clock, 0), " +
+		"IFNULL(rub, 0), IFNULL(usd, 0), IFNULL(eur, 0) FROM cashpoints WHERE approved = 1"
+	if townsCond != "" {
+		townsQuery += " WHERE " + townsCond
+		cashpointsQuery += " AND town_id IN (SELECT id FROM towns WHERE " + townsCond + ")"
+	}
+
+	populated := make(map[uint32]bool)
+	var population uint64 = 0
+	rows, err := b.tx.Query(townsQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var townId uint32
+		var townPopulation int64
+		if err = rows.Scan(&townId, &townPopulation); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if townPopulation > 0 {
+			populated[townId] = true
+			population += uint64(townPopulation)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var cashpointsCount, roundTheClock, populatedCount uint32
+	byBank := make(map[uint32]uint32)
+	byCurrency := make(map[uint32]uint32)
+	byType := make(map[string]uint32)
+	rows, err = b.tx.Query(cashpointsQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cpType string
+		var bankId, townId uint32
+		var cpRoundTheClock, rub, usd, eur bool
+		if err = rows.Scan(&cpType, &bankId, &townId, &cpRoundTheClock, &rub, &usd, &eur); err != nil {
+			return nil, err
+		}
+		cashpointsCount++
+		byBank[bankId]++
+		byType[cpType]++
+		for _, currency := range models.CurrencyFromFlags(rub, usd, eur) {
+			byCurrency[currency]++
+		}
+		if cpRoundTheClock {
+			roundTheClock++
+		}
+		if populated[townId] {
+			populatedCount++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]interface{}{
+		"cashpoints_count": cashpointsCount,
+		"round_the_clock":  roundTheClock,
+		"population":       population,
+		"by_bank":          statsCountToList(byBank, "bank_id"),
+		"by_currency":      statsCountToList(byCurrency, "currency"),
+		"by_type":          byType,
+	}
+	if population > 0 {
+		stats["density_per_10k"] = float64(populatedCount) * 10000 / float64(population)
+	}
+	return stats, nil
+}
+
+// Returns cashpoints statistics json of town, region or whole country
+// (scope 'country', id is ignored) or "" if town or region does not exist
+func (b *SqliteBackend) getCashpointsStats(args []interface{}) (interface{}, error) {
+	scope, _ := memoryArgString(args, 0)
+	id := memoryArgUint(args, 1)
+
+	var stats map[string]interface{}
+	var err error
+	switch scope {
+	case "town":
+		town, err := b.getTown(uint32(id))
+		if err != nil || town == nil {
+			return "", err
+		}
+		if stats, err = b.collectStats("id = ?", id); err != nil {
+			return nil, err
+		}
+		stats["id"] = town.Id
+		stats["name"] = town.Name
+		stats["name_tr"] = town.NameTr
+		stats["region_id"] = town.RegionId
+	case "region":
+		var name, nameTr string
+		err = b.tx.QueryRow("SELECT IFNULL(name, ''), IFNULL(name_tr, '') FROM regions WHERE id = ?", id).Scan(&name, &nameTr)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stats, err = b.collectStats("region_id = ?", id); err != nil {
+			return nil, err
+		}
+		stats["id"] = id
+		stats["name"] = name
+		stats["name_tr"] = nameTr
+		if stats["towns_count"], err = b.count("SELECT COUNT(*) FROM towns WHERE region_id = ?", id); err != nil {
+			return nil, err
+		}
+	case "country":
+		if stats, err = b.collectStats(""); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, memoryMalformedRequest("getCashpointsStats", "unknown stats scope")
+	}
+
+	stats["scope"] = scope
+	return memoryJson(stats)
+}
+
+// ======================================================================
+// Sync log
+
+// Records change of object for delta sync (syncLogTouch of syncapi.lua),
+// current time is used if timestamp is 0. Town of moved object is
+// remembered, so clients syncing old town get it as deleted.
+func (b *SqliteBackend) syncLogTouch(kind string, id, townId, timestamp uint64, deleted bool) error {
+	if timestamp == 0 {
+		timestamp = memoryTimestamp()
+	}
+
+	var oldTownId, prevTownId, prevOldTownId uint64
+	err := b.tx.QueryRow("SELECT town_id, old_town_id FROM sync_log WHERE kind = ? AND id = ?", kind, id).Scan(&prevTownId, &prevOldTownId)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case prevTownId != townId:
+		oldTownId = prevTownId
+	default:
+		oldTownId = prevOldTownId
+	}
+
+	_, err = b.tx.Exec("INSERT OR REPLACE INTO sync_log VALUES (?, ?, ?, ?, ?, ?)", kind, id, townId, oldTownId, timestamp, deleted)
+	return err
+}
+
+func (b *SqliteBackend) getSyncEpoch() (uint64, error) {
+	var epoch uint64
+	err := b.tx.QueryRow("SELECT timestamp FROM sync_log WHERE kind = ? AND id = 0", SYNC_KIND_EPOCH).Scan(&epoch)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+// Fills sync log from scratch after import (syncLogRebuild of syncapi.lua)
+func (b *SqliteBackend) syncLogRebuild() error {
+	_, err := b.tx.Exec("DELETE FROM sync_log")
+	if err != nil {
+		return err
+	}
+	timestamp := memoryTimestamp()
+	for _, source := range []struct{ kind, query string }{
+		{SYNC_KIND_CASHPOINT, "SELECT ?, id, IFNULL(town_id, 0), 0, ?, 0 FROM cashpoints"},
+		{SYNC_KIND_BANK, "SELECT ?, id, 0, 0, ?, 0 FROM banks"},
+		{SYNC_KIND_TOWN, "SELECT ?, id, 0, 0, ?, 0 FROM towns"},
+		{SYNC_KIND_METRO, "SELECT ?, id, IFNULL(town_id, 0), 0, ?, 0 FROM metro"},
+		{SYNC_KIND_EPOCH, "VALUES (?, 0, 0, 0, ?, 0)"},
+	} {
+		_, err = b.tx.Exec("INSERT INTO sync_log "+source.query, source.kind, timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns object of sync kind, nil if it does not exist
+func (b *SqliteBackend) getSyncObject(kind string, id uint64) (interface{}, error) {
+	switch kind {
+	case SYNC_KIND_CASHPOINT:
+		cp, err := b.getCashpoint(uint32(id))
+		if err != nil || cp == nil {
+			return nil, err
+		}
+		return b.cashpointReply(cp)
+	case SYNC_KIND_BANK:
+		bank, err := b.getBank(uint32(id))
+		if err != nil || bank == nil {
+			return nil, err
+		}
+		return bank, nil
+	case SYNC_KIND_TOWN:
+		town, err := b.getTown(uint32(id))
+		if err != nil || town == nil {
+			return nil, err
+		}
+		return town, nil
+	case SYNC_KIND_METRO:
+		metro, err := b.getMetro(uint32(id))
+		if err != nil || metro == nil {
+			return nil, err
+		}
+		return metro, nil
+	}
+	return nil, nil
+}
+
+type sqliteSyncEntry struct {
+	kind      string
+	id        uint64
+	townId    uint64
+	oldTownId uint64
+	timestamp uint64
+	deleted   bool
+}
+
+// req: { since: { timestamp, kind, id }, town_id, limit }, kind and id of
+// since and town_id are optional (getSyncChanges of syncapi.lua)
+func (b *SqliteBackend) getSyncChanges(args []interface{}) (interface{}, error) {
+	func_ := "getSyncChanges"
+	req := struct {
+		Since *struct {
+			Timestamp *uint64 `json:"timestamp"`
+			Kind      string  `json:"kind"`
+			Id        uint64  `json:"id"`
+		} `json:"since"`
+		TownId *uint64 `json:"town_id"`
+		Limit  int     `json:"limit"`
+	}{}
+	if err := memoryArgJson(func_, args, 0, &req); err != nil {
+		return nil, err
+	}
+	if req.Since == nil || req.Since.Timestamp == nil {
+		return nil, memoryMalformedRequest(func_, "missing since timestamp")
+	}
+	since := SyncCursor{Timestamp: *req.Since.Timestamp, Kind: req.Since.Kind, Id: req.Since.Id}
+
+	limit := SQLITE_MAX_SYNC_BATCH
+	if req.Limit > 0 && req.Limit < SQLITE_MAX_SYNC_BATCH {
+		limit = req.Limit
+	}
+
+	epoch, err := b.getSyncEpoch()
+	if err != nil {
+		return nil, err
+	}
+	reset := since.Timestamp > 0 && since.Timestamp < epoch
+
+	query := "SELECT kind, id, town_id, old_town_id, timestamp, deleted FROM sync_log WHERE kind != ?"
+	queryArgs := []interface{}{SYNC_KIND_EPOCH}
+	if !reset {
+		if since.Kind != "" && since.Id != 0 {
+			query += " AND (timestamp > ? OR (timestamp = ? AND (kind > ? OR (kind = ? AND id > ?))))"
+			queryArgs = append(queryArgs, since.Timestamp, since.Timestamp, since.Kind, since.Kind, since.Id)
+		} else {
+			query += " AND timestamp > ?"
+			queryArgs = append(queryArgs, since.Timestamp)
+		}
+	}
+	query += " ORDER BY timestamp, kind, id LIMIT ?"
+	queryArgs = append(queryArgs, limit+1)
+
+	rows, err := b.tx.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]sqliteSyncEntry, 0)
+	for rows.Next() {
+		var e sqliteSyncEntry
+		if err = rows.Scan(&e.kind, &e.id, &e.townId, &e.oldTownId, &e.timestamp, &e.deleted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	more := len(entries) > limit
+	if more {
+		entries = entries[:limit]
+	}
+
+	result := make(map[string]interface{})
+	deleted := make(map[string][]uint64)
+	for _, list := range SYNC_LISTS {
+		result[list] = make([]interface{}, 0)
+		deleted[list] = make([]uint64, 0)
+	}
+	for _, e := range entries {
+		list := SYNC_LISTS[e.kind]
+		isDeleted := e.deleted
+		if req.TownId != nil && (e.kind == SYNC_KIND_CASHPOINT || e.kind == SYNC_KIND_METRO) && e.townId != *req.TownId {
+			if e.oldTownId != *req.TownId {
+				continue
+			}
+			isDeleted = true // moved out of requested town
+		}
+
+		if !isDeleted {
+			obj, err := b.getSyncObject(e.kind, e.id)
+			if err != nil {
+				return nil, err
+			}
+			if obj != nil {
+				result[list] = append(result[list].([]interface{}), obj)
+				continue
+			}
+		}
+		deleted[list] = append(deleted[list], e.id)
+	}
+
+	last := since
+	if len(entries) > 0 {
+		e := entries[len(entries)-1]
+		last = SyncCursor{Timestamp: e.timestamp, Kind: e.kind, Id: e.id}
+	} else if reset { // nothing changed, keep cursor
+		last = SyncCursor{Timestamp: epoch}
+	}
+
+	result["deleted"] = deleted
+	result["last"] = last
+	result["more"] = more
+	result["reset"] = reset
+	return memoryJson(result)
+}
+
+// ======================================================================
+// Admin
+
+// Table of reference objects editable by admins and columns of their
+// fields (see ADMIN_FIELDS). Fields without column are kept elsewhere.
+type sqliteAdminKind struct {
+	Table   string
+	Fields  map[string]adminField
+	Columns map[string]string
+}
+
+// Reference tables editable by admins, partners of bank are kept in
+// partners table
+var SQLITE_ADMIN_KINDS = map[string]sqliteAdminKind{
+	"bank": {Table: "banks", Columns: map[string]string{
+		"name":        "name",
+		"name_tr":     "name_tr",
+		"name_tr_alt": "name_tr_alt",
+		"town":        "town",
+		"licence":     "licence",
+		"rating":      "rating",
+		"tel":         "tel",
+	}},
+	"town": {Table: "towns", Columns: map[string]string{
+		"longitude":       "longitude",
+		"latitude":        "latitude",
+		"name":            "name",
+		"name_tr":         "name_tr",
+		"region_id":       "region_id",
+		"regional_center": "regional_center",
+		"zoom":            "zoom",
+		"big":             "has_emblem",
+		"population":      "population",
+	}},
+	"region": {Table: "regions", Columns: map[string]string{
+		"longitude": "longitude",
+		"latitude":  "latitude",
+		"name":      "name",
+		"name_tr":   "name_tr",
+		"zoom":      "zoom",
+	}},
+	"metro": {Table: "metro", Columns: map[string]string{
+		"longitude":         "longitude",
+		"latitude":          "latitude",
+		"town_id":           "town_id",
+		"branch_id":         "branch_id",
+		"station_name":      "name",
+		"station_exit_name": "ext",
+	}},
+}
+
+func sqliteAdminError(err, message string) (interface{}, error) {
+	return memoryJson(&AdminReply{Error: err, Message: message})
+}
+
+func sqliteAdminId(id uint64) (interface{}, error) {
+	return memoryJson(&AdminResponse{Id: uint32(id)})
+}
+
+func getSqliteAdminKind(kind string) (*sqliteAdminKind, error) {
+	fields, err := getAdminFields(kind)
+	if err != nil {
+		return nil, err
+	}
+	spec := SQLITE_ADMIN_KINDS[kind]
+	spec.Fields = fields
+	return &spec, nil
+}
+
+// Checks references of object to other tables, returns error message
+func (b *SqliteBackend) checkAdminReferences(kind string, id uint64, obj map[string]interface{}) (string, error) {
+	switch kind {
+	case "bank":
+		partners, _ := obj["partners"].([]interface{})
+		for _, partner := range partners {
+			partnerId, ok := partner.(float64)
+			if !ok {
+				return "partners must contain bank ids", nil
+			}
+			found, err := b.exists("banks", partnerId)
+			if err != nil {
+				return "", err
+			}
+			if uint64(partnerId) == id || !found {
+				return "no such partner bank: " + formatLuaNumber(partnerId), nil
+			}
+		}
+	case "town":
+		regionId := obj["region_id"]
+		if regionId != 0.0 {
+			found, err := b.exists("regions", regionId)
+			if err != nil || !found {
+				return "no such region: " + formatLuaNumber(regionId), err
+			}
+		}
+	case "metro":
+		found, err := b.exists("towns", obj["town_id"])
+		if err != nil || !found {
+			return "no such town: " + formatLuaNumber(obj["town_id"]), err
+		}
+	}
+	return "", nil
+}
+
+// Returns description of objects referencing object or empty string
+func (b *SqliteBackend) findAdminReferrers(kind string, id uint64) (string, error) {
+	var checks []struct{ query, message string }
+	switch kind {
+	case "bank":
+		count, err := b.count("SELECT COUNT(*) FROM cashpoints WHERE bank_id = ?", id)
+		if err != nil || count > 0 {
+			return "bank has cashpoints", err
+		}
+		var bankId uint64
+		err = b.tx.QueryRow("SELECT id FROM partners WHERE partner_id = ? ORDER BY id LIMIT 1", id).Scan(&bankId)
+		if err == sql.ErrNoRows {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return "bank is partner of bank " + strconv.FormatUint(bankId, 10), nil
+	case "town":
+		checks = []struct{ query, message string }{
+			{"SELECT COUNT(*) FROM cashpoints WHERE town_id = ?", "town has cashpoints"},
+			{"SELECT COUNT(*) FROM metro WHERE town_id = ?", "town has metro stations"},
+		}
+	case "region":
+		checks = []struct{ query, message string }{
+			{"SELECT COUNT(*) FROM towns WHERE region_id = ?", "region has towns"},
+		}
+	}
+	for _, check := range checks {
+		count, err := b.count(check.query, id)
+		if err != nil || count > 0 {
+			return check.message, err
+		}
+	}
+	return "", nil
+}
+
+// Reads fields of object, returns nil if there is no such object
+func (b *SqliteBackend) getAdminObject(kind string, spec *sqliteAdminKind, id uint64) (map[string]interface{}, error) {
+	names := make([]string, 0, len(spec.Fields))
+	columns := make([]string, 0, len(spec.Fields))
+	for _, name := range sortedFieldNames(spec.Fields) {
+		if column, ok := spec.Columns[name]; ok {
+			names = append(names, name)
+			columns = append(columns, column)
+		}
+	}
+
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err := b.tx.QueryRow("SELECT "+strings.Join(columns, ", ")+" FROM "+spec.Table+" WHERE id = ?", id).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	obj := make(map[string]interface{})
+	for i, name := range names {
+		field := spec.Fields[name]
+		switch v := values[i].(type) {
+		case int64:
+			if field.Type == "boolean" {
+				obj[name] = v != 0
+			} else {
+				obj[name] = float64(v)
+			}
+		case float64:
+			obj[name] = v
+		case []byte:
+			obj[name] = string(v)
+		case string:
+			obj[name] = v
+		default:
+			obj[name] = field.Default
+		}
+	}
+	if kind == "bank" {
+		partners, err := b.queryIds("SELECT partner_id FROM partners WHERE id = ? ORDER BY rowid", id)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]interface{}, 0, len(partners))
+		for _, partnerId := range partners {
+			list = append(list, float64(partnerId))
+		}
+		obj["partners"] = list
+	}
+	return obj, nil
+}
+
+// Inserts (id is 0 for automatic one) or updates object, returns its id
+func (b *SqliteBackend) writeAdminObject(kind string, spec *sqliteAdminKind, id uint64, obj map[string]interface{}, create bool) (uint64, error) {
+	columns := make([]string, 0, len(obj))
+	values := make([]interface{}, 0, len(obj))
+	for _, name := range sortedFieldNames(spec.Fields) {
+		column, ok := spec.Columns[name]
+		if value, found := obj[name]; ok && found {
+			columns = append(columns, column)
+			values = append(values, value)
+		}
+	}
+
+	if create {
+		if id != 0 {
+			columns = append(columns, "id")
+			values = append(values, id)
+		}
+		res, err := b.tx.Exec("INSERT INTO "+spec.Table+" ("+strings.Join(columns, ", ")+") VALUES (?"+
+			strings.Repeat(", ?", len(columns)-1)+")", values...)
+		if err != nil {
+			return 0, err
+		}
+		rowId, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = uint64(rowId)
+	} else {
+		_, err := b.tx.Exec("UPDATE "+spec.Table+" SET "+strings.Join(columns, " = ?, ")+" = ? WHERE id = ?", append(values, id)...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if partners, ok := obj["partners"].([]interface{}); ok && kind == "bank" {
+		if _, err := b.tx.Exec("DELETE FROM partners WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		for _, partnerId := range partners {
+			if _, err := b.tx.Exec("INSERT INTO partners (id, partner_id) VALUES (?, ?)", id, partnerId); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return id, nil
+}
+
+func (b *SqliteBackend) adminSyncTouch(kind string, id uint64, obj map[string]interface{}, deleted bool) error {
+	switch kind {
+	case "bank", "town":
+		return b.syncLogTouch(kind, id, 0, 0, deleted)
+	case "metro":
+		townId, _ := obj["town_id"].(float64)
+		return b.syncLogTouch(kind, id, uint64(townId), 0, deleted)
+	}
+	return nil
+}
+
+// Creates object of kind (bank, town, region, metro). Id is assigned
+// automatically unless passed in data. Returns json {id} or {error, message}.
+func (b *SqliteBackend) adminCreate(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	spec, err := getSqliteAdminKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	data := getAdminData(args, 1)
+	if data == nil {
+		return sqliteAdminError(ADMIN_ERR_INVALID, "malformed request json")
+	}
+
+	var id uint64 = 0
+	if idValue, ok := data["id"]; ok {
+		idNum, ok := idValue.(float64)
+		if !ok {
+			return sqliteAdminError(ADMIN_ERR_INVALID, "invalid type of field id, expected number")
+		}
+		id = uint64(idNum)
+		delete(data, "id")
+	}
+
+	obj := make(map[string]interface{})
+	if msg := applyAdminFields(spec.Fields, obj, data, true); msg != "" {
+		return sqliteAdminError(ADMIN_ERR_INVALID, msg)
+	}
+	msg, err := b.checkAdminReferences(kind, id, obj)
+	if err != nil {
+		return nil, err
+	}
+	if msg != "" {
+		return sqliteAdminError(ADMIN_ERR_INVALID, msg)
+	}
+
+	if id != 0 {
+		found, err := b.exists(spec.Table, id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return sqliteAdminError(ADMIN_ERR_CONFLICT, kind+" already exists with id "+strconv.FormatUint(id, 10))
+		}
+	}
+	if id, err = b.writeAdminObject(kind, spec, id, obj, true); err != nil {
+		return nil, err
+	}
+	if err = b.adminSyncTouch(kind, id, obj, false); err != nil {
+		return nil, err
+	}
+	return sqliteAdminId(id)
+}
+
+// Updates fields passed in data of existing object
+func (b *SqliteBackend) adminUpdate(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	spec, err := getSqliteAdminKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	id := memoryArgUint(args, 1)
+	data := getAdminData(args, 2)
+	if data == nil {
+		return sqliteAdminError(ADMIN_ERR_INVALID, "malformed request json")
+	}
+	if idValue, ok := data["id"]; ok && idValue != float64(id) {
+		return sqliteAdminError(ADMIN_ERR_INVALID, "id cannot be changed")
+	}
+	delete(data, "id")
+
+	obj, err := b.getAdminObject(kind, spec, id)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return sqliteAdminError(ADMIN_ERR_NOT_FOUND, kind+" does not exist with id "+strconv.FormatUint(id, 10))
+	}
+
+	if msg := applyAdminFields(spec.Fields, obj, data, false); msg != "" {
+		return sqliteAdminError(ADMIN_ERR_INVALID, msg)
+	}
+	msg, err := b.checkAdminReferences(kind, id, obj)
+	if err != nil {
+		return nil, err
+	}
+	if msg != "" {
+		return sqliteAdminError(ADMIN_ERR_INVALID, msg)
+	}
+
+	if _, err = b.writeAdminObject(kind, spec, id, obj, false); err != nil {
+		return nil, err
+	}
+	if err = b.adminSyncTouch(kind, id, obj, false); err != nil {
+		return nil, err
+	}
+	return sqliteAdminId(id)
+}
+
+// Deletes object unless other objects refer to it
+func (b *SqliteBackend) adminDelete(args []interface{}) (interface{}, error) {
+	kind, _ := memoryArgString(args, 0)
+	spec, err := getSqliteAdminKind(kind)
+	if err != nil {
+		return nil, err
+	}
+	id := memoryArgUint(args, 1)
+
+	obj, err := b.getAdminObject(kind, spec, id)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return sqliteAdminError(ADMIN_ERR_NOT_FOUND, kind+" does not exist with id "+strconv.FormatUint(id, 10))
+	}
+
+	referrer, err := b.findAdminReferrers(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	if referrer != "" {
+		return sqliteAdminError(ADMIN_ERR_CONFLICT, referrer)
+	}
+
+	if _, err = b.tx.Exec("DELETE FROM "+spec.Table+" WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	if kind == "bank" {
+		if _, err = b.tx.Exec("DELETE FROM partners WHERE id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+	if err = b.adminSyncTouch(kind, id, obj, true); err != nil {
+		return nil, err
+	}
+	return sqliteAdminId(id)
+}
+
+// ======================================================================
+
+func (b *SqliteBackend) getSpaceMetrics(args []interface{}) (interface{}, error) {
+	result := make(map[string]uint32)
+	for name, table := range map[string]string{
+		"banks":                    "banks",
+		"towns":                    "towns",
+		"regions":                  "regions",
+		"metro":                    "metro",
+		"cashpoints":               "cashpoints",
+		"cashpoints_patches":       "cashpoints_patches",
+		"cashpoints_patches_votes": "cashpoints_patches_votes",
+		"clusters":                 "clusters",
+	} {
+		count, err := b.count("SELECT COUNT(*) FROM " + table)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = count
+	}
+	result["clusters_cache"] = 0
+	return memoryJson(result)
+}
+
+// Returns translation of message from column of language in tr table,
+// its default translation or message key itself if there is no translation
+// (getMessage of messageapi.lua)
+func (b *SqliteBackend) getMessage(args []interface{}) (interface{}, error) {
+	key, ok := memoryArgString(args, 0)
+	if !ok {
+		return "", nil
+	}
+	lang, _ := memoryArgString(args, 1)
+	if lang == "" || lang == "msg" {
+		return key, nil
+	}
+
+	langs, err := b.tableColumns("towns_db", "tr")
+	if err != nil {
+		return nil, err
+	}
+	if !langs[lang] {
+		return defaultMessage(key, lang), nil
+	}
+
+	var text sql.NullString
+	err = b.tx.QueryRow(`SELECT "`+lang+`" FROM tr WHERE msg = ?`, key).Scan(&text)
+	if err == sql.ErrNoRows || (err == nil && (!text.Valid || text.String == "")) {
+		return defaultMessage(key, lang), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return text.String, nil
+}
@@ -0,0 +1,710 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Schedule of Astrakhan office imported as schedule_general text
+const FIXTURE_SCHEDULE_TEXT = "пн.-пт.: 09:00-21:00\nсб.: 10:00-17:00"
+
+type sqliteFixture struct {
+	dir        string
+	cashpoints string
+	towns      string
+	banks      string
+}
+
+func (f *sqliteFixture) open(t *testing.T) *SqliteBackend {
+	b, err := newSqliteBackend(f.cashpoints, f.towns, f.banks)
+	if err != nil {
+		t.Fatalf("Cannot open sqlite backend: %v", err)
+	}
+	return b
+}
+
+func (f *sqliteFixture) remove() {
+	os.RemoveAll(f.dir)
+}
+
+// Writes fixtures of in-memory backend to empty databases like migrators
+// do, so they are indexed by backend opened on them
+func newSqliteFixture(t *testing.T) *sqliteFixture {
+	dir, err := ioutil.TempDir("", "cpsrv_sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &sqliteFixture{
+		dir:        dir,
+		cashpoints: filepath.Join(dir, "cp.db"),
+		towns:      filepath.Join(dir, "towns.db"),
+		banks:      filepath.Join(dir, "banks.db"),
+	}
+	b := f.open(t)
+	defer b.Close()
+
+	exec := func(query string, args ...interface{}) {
+		if _, err := b.db.Exec(query, args...); err != nil {
+			f.remove()
+			t.Fatalf("Cannot write fixture: %v => %s", err, query)
+		}
+	}
+
+	m := newFixtureBackend()
+	for _, region := range m.regions {
+		exec("INSERT INTO regions VALUES (?, ?, ?, ?, ?, ?)",
+			region.Id, region.Name, region.NameTr, region.Latitude, region.Longitude, region.Zoom)
+	}
+	for _, town := range m.towns {
+		exec("INSERT INTO towns VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", town.Id, town.Name, town.NameTr, town.RegionId,
+			town.RegionalCenter, town.Latitude, town.Longitude, town.Zoom, town.Big, town.Population)
+	}
+	for _, metro := range m.metro {
+		exec("INSERT INTO metro VALUES (?, ?, ?, ?, ?, ?, ?)", metro.Id, metro.Latitude, metro.Longitude,
+			metro.TownId, metro.BranchId, metro.StationName, metro.StationExitName)
+	}
+	exec("INSERT INTO tr VALUES ('Moscow', 'Москва', 'Moscow')")
+	for _, bank := range m.banks {
+		exec("INSERT INTO banks VALUES (?, ?, ?, ?, '', ?, ?, ?)", bank.Id, bank.Name, bank.NameTr, bank.NameTrAlt,
+			bank.Licence, bank.Rating, bank.Tel)
+		for _, partnerId := range bank.Partners {
+			exec("INSERT INTO partners VALUES (?, ?)", bank.Id, partnerId)
+		}
+	}
+	for _, cp := range m.cashpoints {
+		var schedule interface{}
+		scheduleText := ""
+		if cp.Id == 7243171 {
+			scheduleText = FIXTURE_SCHEDULE_TEXT
+		} else {
+			scheduleJson, _ := json.Marshal(cp.Schedule)
+			schedule = string(scheduleJson)
+		}
+		exec(`INSERT INTO cashpoints (id, type, bank_id, town_id, longitude, latitude, address, address_comment,
+		                              metro_name, free_access, main_office, without_weekend, round_the_clock,
+		                              works_as_shop, schedule_general, tel, additional, rub, usd, eur, cash_in,
+		                              hidden, schedule)
+		      VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?)`,
+			cp.Id, cp.Type, cp.BankId, cp.TownId, cp.Longitude, cp.Latitude, cp.Address, cp.AddressComment,
+			cp.MetroName, cp.FreeAccess, cp.MainOffice, cp.WithoutWeekend, cp.RoundTheClock,
+			cp.WorksAsShop, scheduleText, cp.Tel, cp.Additional, cp.HasCurrency(models.CURRENCY_RUB),
+			cp.HasCurrency(models.CURRENCY_USD), cp.HasCurrency(models.CURRENCY_EUR), cp.CashIn, schedule)
+	}
+	return f
+}
+
+// Returns json reply of procedure
+func callSqliteProc(t *testing.T, b Backend, proc string, args ...interface{}) string {
+	resp, err := b.Call(proc, args)
+	if err != nil {
+		t.Fatalf("%s failed: %v", proc, err)
+	}
+	data := resp.Data[0].([]interface{})
+	if len(data) == 0 {
+		return ""
+	}
+	if s, ok := data[0].(string); ok {
+		return s
+	}
+	reply, _ := json.Marshal(data[0])
+	return string(reply)
+}
+
+// Compares decoded json values, centroids of clusters depend on order of
+// summation, so numbers are compared with tolerance
+func jsonValuesEqual(a, b interface{}) bool {
+	switch va := a.(type) {
+	case float64:
+		vb, ok := b.(float64)
+		return ok && math.Abs(va-vb) < 1e-9
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !jsonValuesEqual(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok || len(va) != len(vb) {
+			return false
+		}
+		for k := range va {
+			if !jsonValuesEqual(va[k], vb[k]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestSqliteBackendParity(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+	m := newFixtureBackend()
+
+	centerReq := `{"topLeft":{"longitude":37.6,"latitude":55.77},"bottomRight":{"longitude":37.615,"latitude":55.755}`
+	kitayGorodReq := `{"topLeft":{"longitude":37.64,"latitude":55.77},"bottomRight":{"longitude":37.65,"latitude":55.76}`
+	moscowReq := `{"topLeft":{"longitude":37.3,"latitude":56.0},"bottomRight":{"longitude":37.9,"latitude":55.5}`
+	russiaReq := `{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0}`
+
+	calls := []struct {
+		proc string
+		args []interface{}
+	}{
+		{"getCashpointById", []interface{}{uint64(7243171)}},
+		{"getCashpointById", []interface{}{uint64(100500)}},
+		{"getCashpointsBatch", []interface{}{`{"cashpoints":[7138832,58552,100500,341383]}`}},
+		{"getCashpointsStateBatch", []interface{}{`{"cashpoints":[7138832,58552]}`}},
+		{"getNearbyCashpoints", []interface{}{centerReq + `}`}},
+		{"getNearbyCashpoints", []interface{}{kitayGorodReq + `,"filter":{"currency":[840]}}`}},
+		{"getNearbyCashpoints", []interface{}{kitayGorodReq + `,"filter":{"bank_id":[325],"partner_of":325}}`}},
+		{"getNearbyCashpoints", []interface{}{centerReq + `,"filter":{"approved":true,"free_access":true,"round_the_clock":false}}`}},
+		{"getNearbyCashpoints", []interface{}{`{"topLeft":{"longitude":48.0,"latitude":46.4},"bottomRight":{"longitude":48.01,"latitude":46.39}}`}},
+		{"getNearbyClusters", []interface{}{moscowReq + `,"zoom":12}`}},
+		{"getNearbyClusters", []interface{}{moscowReq + `,"zoom":13,"filter":{"currency":[840]}}`}},
+		{"getNearbyClusters", []interface{}{russiaReq + `,"zoom":5}`, uint64(10)}},
+		{"getNearbyClusters", []interface{}{russiaReq + `,"zoom":5,"filter":{"bank_id":[2764]}}`, uint64(10)}},
+		{"getQuadKeyFromCoord", []interface{}{`{"longitude":37.62,"latitude":55.75,"zoom":12}`}},
+		{"getTownById", []interface{}{uint64(4)}},
+		{"getTownById", []interface{}{uint64(100500)}},
+		{"getRegionById", []interface{}{uint64(3)}},
+		{"getRegionById", []interface{}{uint64(100500)}},
+		{"getTownsBatch", []interface{}{`{"towns":[290,4,100500]}`}},
+		{"getTownsList", []interface{}{}},
+		{"getTownCashpoints", []interface{}{uint64(290)}},
+		{"getBankById", []interface{}{uint64(322)}},
+		{"getBanksBatch", []interface{}{`{"banks":[322,325,2764,194275]}`}},
+		{"getBanksList", []interface{}{}},
+		{"getBankPartners", []interface{}{uint64(322)}},
+		{"getBankPartners", []interface{}{uint64(100500)}},
+		{"getMetroById", []interface{}{uint64(779)}},
+		{"getMetroList", []interface{}{uint64(4)}},
+		{"getMetroBatch", []interface{}{`{"metro":[779,100500]}`}},
+		{"getTownsPage", []interface{}{`{"limit":1,"sort":"name"}`}},
+		{"getBanksPage", []interface{}{`{"limit":2}`}},
+		{"getHeatmap", []interface{}{russiaReq + `,"cols":4,"rows":4}`}},
+		{"getHeatmap", []interface{}{kitayGorodReq + `,"cols":2,"rows":2}`}},
+		{"getCashpointsStats", []interface{}{"country", uint64(0)}},
+		{"getCashpointsStats", []interface{}{"town", uint64(4)}},
+	}
+
+	for _, call := range calls {
+		expected := callSqliteProc(t, m, call.proc, call.args...)
+		got := callSqliteProc(t, b, call.proc, call.args...)
+		var expectedValue, gotValue interface{}
+		json.Unmarshal([]byte(expected), &expectedValue)
+		json.Unmarshal([]byte(got), &gotValue)
+		if !jsonValuesEqual(expectedValue, gotValue) {
+			t.Errorf("%s%v: expected %s but got %s", call.proc, call.args, expected, got)
+		}
+	}
+
+	// branch of quadkey of first cluster, single cashpoints have numeric ids
+	var clusters []map[string]interface{}
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getNearbyClusters", moscowReq+`,"zoom":12}`)), &clusters)
+	quadKey := ""
+	var size float64
+	for _, c := range clusters {
+		if id, ok := c["id"].(string); ok {
+			quadKey, size = id, c["size"].(float64)
+			break
+		}
+	}
+	if quadKey == "" {
+		t.Fatalf("Expected clusters in Moscow but got %v", clusters)
+	}
+	var branch []models.Cluster
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getQuadTreeBranch", quadKey)), &branch)
+	if len(branch) != len(quadKey)-9 {
+		t.Fatalf("Expected %d clusters in branch of %s but got %d", len(quadKey)-9, quadKey, len(branch))
+	}
+	if leaf := branch[len(branch)-1]; leaf.Id != quadKey || float64(leaf.Size) != size || len(leaf.Members) != int(size) {
+		t.Errorf("Unexpected leaf of branch %+v, expected cluster %s of size %v", leaf, quadKey, size)
+	}
+}
+
+func TestSqliteBackendMetrics(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+
+	metrics := make(map[string]uint32)
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getSpaceMetrics")), &metrics)
+	cashpoints := uint32(len(newFixtureBackend().cashpoints))
+	if metrics["cashpoints"] != cashpoints || metrics["towns"] != 2 || metrics["regions"] != 2 ||
+		metrics["banks"] != 4 || metrics["metro"] != 1 || metrics["clusters"] == 0 {
+		t.Errorf("Unexpected space metrics: %v", metrics)
+	}
+
+	for _, c := range []struct{ key, lang, expected string }{
+		{"Moscow", "ru", "Москва"},
+		{"Moscow", "", "Moscow"},
+		{"Moscow", "de", "Moscow"},
+		{"Kazan", "ru", "Kazan"},
+	} {
+		if msg := callSqliteProc(t, b, "getMessage", c.key, c.lang); msg != c.expected {
+			t.Errorf("Expected message '%s' of %s in '%s' but got '%s'", c.expected, c.key, c.lang, msg)
+		}
+	}
+}
+
+func TestSqliteBackendPages(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+
+	var page ListReply
+	var items []map[string]interface{}
+	getPage := func(proc, req string) {
+		items = nil
+		json.Unmarshal([]byte(callSqliteProc(t, b, proc, req)), &page)
+		json.Unmarshal(page.Items, &items)
+	}
+
+	getPage("getTownsPage", `{"sort":"population","desc":true,"limit":1}`)
+	if len(items) != 1 || !page.More || page.Last == nil {
+		t.Fatalf("Unexpected towns page: %+v", page)
+	}
+	if items[0]["id"] != 4.0 || items[0]["population"] != 12000000.0 {
+		t.Errorf("Expected Moscow first by population but got %v", items[0])
+	}
+
+	after, _ := json.Marshal(page.Last)
+	getPage("getTownsPage", `{"sort":"population","desc":true,"limit":1,"fields":["name"],"after":`+string(after)+`}`)
+	if len(items) != 1 || len(items[0]) != 2 || items[0]["id"] != 290.0 || items[0]["name"] != "Астрахань" || page.More {
+		t.Errorf("Unexpected second towns page: %v, more %v", items, page.More)
+	}
+
+	getPage("getBanksPage", `{"sort":"cashpoints_count","desc":true,"fields":["cashpoints_count"]}`)
+	if len(items) != 4 || items[0]["id"] != 322.0 || items[0]["cashpoints_count"] == nil {
+		t.Errorf("Expected Sberbank to have most cashpoints but got %v", items)
+	}
+	getPage("getBanksPage", `{"sort":"name"}`)
+	if len(items) != 4 || items[0]["cashpoints_count"] != nil || items[0]["name"] != "Сбербанк России" {
+		t.Errorf("Unexpected banks page sorted by name: %v", items)
+	}
+
+	for _, req := range []string{`{"limit":0}`, `{"limit":1001}`, `{"after":{"value":"Москва","id":4}}`, `{"after":{"value":1}}`} {
+		_, err := b.Call("getTownsPage", []interface{}{req})
+		if err == nil {
+			t.Errorf("Expected error of towns page request %s", req)
+		}
+	}
+}
+
+func TestSqliteBackendStats(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+	m := newFixtureBackend()
+
+	stats := struct {
+		Scope           string             `json:"scope"`
+		Id              uint32             `json:"id"`
+		Name            string             `json:"name"`
+		CashpointsCount uint32             `json:"cashpoints_count"`
+		RoundTheClock   uint32             `json:"round_the_clock"`
+		Population      uint64             `json:"population"`
+		Density         *float64           `json:"density_per_10k"`
+		TownsCount      uint32             `json:"towns_count"`
+		ByBank          []map[string]int   `json:"by_bank"`
+		ByCurrency      []map[string]int   `json:"by_currency"`
+		ByType          map[string]float64 `json:"by_type"`
+	}{}
+
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointsStats", "country", uint64(0))), &stats)
+	total := uint32(len(m.cashpoints))
+	if stats.Scope != "country" || stats.CashpointsCount != total || stats.RoundTheClock != 1 ||
+		stats.Population != 12530000 || stats.Density == nil {
+		t.Errorf("Unexpected country stats: %+v", stats)
+	}
+	if len(stats.ByBank) == 0 || stats.ByBank[0]["bank_id"] != 322 {
+		t.Errorf("Expected Sberbank to be most frequent bank: %v", stats.ByBank)
+	}
+	if len(stats.ByCurrency) != 3 || stats.ByCurrency[0]["currency"] != models.CURRENCY_RUB ||
+		stats.ByCurrency[1]["currency"] != models.CURRENCY_USD || stats.ByCurrency[1]["count"] != len(FIXTURE_USD) {
+		t.Errorf("Unexpected currencies stats: %v", stats.ByCurrency)
+	}
+
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointsStats", "region", uint64(30))), &stats)
+	if stats.Scope != "region" || stats.Id != 30 || stats.CashpointsCount != 1 || stats.TownsCount != 1 ||
+		stats.ByType["office"] != 1 {
+		t.Errorf("Unexpected region stats: %+v", stats)
+	}
+
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointsStats", "town", uint64(4))), &stats)
+	if stats.Scope != "town" || stats.Name != "Москва" || stats.CashpointsCount != total-1 {
+		t.Errorf("Unexpected town stats: %+v", stats)
+	}
+
+	if reply := callSqliteProc(t, b, "getCashpointsStats", "town", uint64(100500)); reply != "" {
+		t.Errorf("Expected empty stats of missing town but got %s", reply)
+	}
+	if _, err := b.Call("getCashpointsStats", []interface{}{"planet", uint64(0)}); err == nil {
+		t.Error("Expected error of unknown stats scope")
+	}
+}
+
+func TestSqliteBackendHeatmap(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+
+	heatmap := struct {
+		CellWidth float64        `json:"cell_width"`
+		Zoom      *int           `json:"zoom"`
+		Cells     []*heatmapCell `json:"cells"`
+	}{}
+	countCells := func() int {
+		count := 0
+		for _, cell := range heatmap.Cells {
+			count += cell.Count
+		}
+		return count
+	}
+
+	// raw cashpoints of Kitay-gorod
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getHeatmap",
+		`{"topLeft":{"longitude":37.64,"latitude":55.77},"bottomRight":{"longitude":37.65,"latitude":55.76},"cols":2,"rows":2}`)), &heatmap)
+	if heatmap.Zoom != nil || countCells() != len(FIXTURE_USD)+2 {
+		t.Errorf("Unexpected heatmap of raw cashpoints: %+v", heatmap)
+	}
+	for i := 1; i < len(heatmap.Cells); i++ {
+		prev, cell := heatmap.Cells[i-1], heatmap.Cells[i]
+		if prev.Row > cell.Row || (prev.Row == cell.Row && prev.Col >= cell.Col) {
+			t.Errorf("Cells are not sorted: %v before %v", prev, cell)
+		}
+	}
+
+	// clusters of Moscow and Astrakhan
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getHeatmap",
+		`{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0},"cols":4,"rows":4}`)), &heatmap)
+	total := len(newFixtureBackend().cashpoints)
+	if heatmap.Zoom == nil || *heatmap.Zoom != 10 || countCells() != total || len(heatmap.Cells) != 2 {
+		t.Errorf("Unexpected heatmap of clusters: %+v", heatmap)
+	}
+
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getHeatmap",
+		`{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0},"cols":4,"rows":4,
+		  "filter":{"currency":[840]}}`)), &heatmap)
+	if countCells() != len(FIXTURE_USD) {
+		t.Errorf("Unexpected heatmap of filtered clusters: %+v", heatmap)
+	}
+
+	// finest clusters are of CLUSTER_ZOOM_MAX - 1, finer cells of Moscow
+	// are built of raw cashpoints
+	for _, c := range []struct {
+		cols uint32
+		zoom int
+	}{{16, quadkey.CLUSTER_ZOOM_MAX - 1}, {32, 0}} {
+		heatmap.Zoom = nil
+		json.Unmarshal([]byte(callSqliteProc(t, b, "getHeatmap", fmt.Sprintf(
+			`{"topLeft":{"longitude":37.3,"latitude":55.95},"bottomRight":{"longitude":37.9,"latitude":55.55},"cols":%d,"rows":8}`,
+			c.cols))), &heatmap)
+		if (c.zoom == 0) != (heatmap.Zoom == nil) || (heatmap.Zoom != nil && *heatmap.Zoom != c.zoom) ||
+			countCells() != total-1 {
+			t.Errorf("Unexpected heatmap of %d cols: %+v", c.cols, heatmap)
+		}
+	}
+
+	for _, req := range []string{
+		`{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0},"cols":0,"rows":4}`,
+		`{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":50.0,"latitude":45.0},"cols":4,"rows":257}`,
+		`{"topLeft":{"longitude":30.0,"latitude":60.0},"bottomRight":{"longitude":30.0,"latitude":45.0},"cols":4,"rows":4}`,
+	} {
+		if _, err := b.Call("getHeatmap", []interface{}{req}); err == nil {
+			t.Errorf("Expected error of heatmap request %s", req)
+		}
+	}
+}
+
+// Patches, votes and deletion persist after reopening and are reported by sync
+func TestSqliteBackendPatches(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+
+	sync := struct {
+		Cashpoints []models.Cashpoint `json:"cashpoints"`
+		Deleted    struct {
+			Cashpoints []uint32 `json:"cashpoints"`
+		} `json:"deleted"`
+		Last  SyncCursor `json:"last"`
+		More  bool       `json:"more"`
+		Reset bool       `json:"reset"`
+	}{}
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getSyncChanges", `{"since":{"timestamp":0},"limit":1000}`)), &sync)
+	total := len(newFixtureBackend().cashpoints)
+	if len(sync.Cashpoints) != total || sync.More || sync.Reset {
+		t.Fatalf("Expected all %d cashpoints in initial sync but got %d", total, len(sync.Cashpoints))
+	}
+	since := sync.Last
+
+	// moved out of center of Moscow
+	patchId := callSqliteProc(t, b, "cashpointProposePatch", `{"user_id":1,"data":{"id":316412,"longitude":37.5801,"latitude":55.7126}}`)
+	if patchId != "316412" {
+		t.Fatalf("Expected patch of cashpoint 316412 but got %s", patchId)
+	}
+	patches := make(map[string]json.RawMessage)
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointPatches", uint64(316412))), &patches)
+	if len(patches) != 1 {
+		t.Fatalf("Expected 1 patch but got %v", patches)
+	}
+	var id string
+	for id = range patches {
+	}
+	for userId := 1; userId <= MEMORY_PATCH_APPROVE_VOTES; userId++ {
+		vote := `{"patch_id":` + id + `,"user_id":` + strconv.Itoa(userId) + `,"score":1}`
+		if reply := callSqliteProc(t, b, "cashpointVotePatch", vote); reply != "true" {
+			t.Fatalf("Unexpected reply %s of vote %s", reply, vote)
+		}
+	}
+	if reply := callSqliteProc(t, b, "cashpointVotePatch", `{"patch_id":`+id+`,"user_id":1,"score":1}`); reply != "false" {
+		t.Errorf("Expected second vote of user to be rejected but got %s", reply)
+	}
+	if reply := callSqliteProc(t, b, "deleteCashpointById", uint64(58552)); reply != "true" {
+		t.Errorf("Unexpected reply of cashpoint deletion: %s", reply)
+	}
+	b.Close()
+
+	b = f.open(t)
+	defer b.Close()
+
+	var cp models.Cashpoint
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointById", uint64(316412))), &cp)
+	if cp.Latitude != 55.7126 || cp.Version != 1 || cp.PatchCount != 1 || cp.Schedule.Sat == nil {
+		t.Errorf("Patch is not committed: %+v", cp)
+	}
+	if reply := callSqliteProc(t, b, "getCashpointById", uint64(58552)); reply != "" {
+		t.Errorf("Expected deleted cashpoint to be missing but got %s", reply)
+	}
+
+	nearby := func(req string) []uint32 {
+		var ids []uint32
+		json.Unmarshal([]byte(callSqliteProc(t, b, "getNearbyCashpoints", req)), &ids)
+		return ids
+	}
+	for _, id := range nearby(`{"topLeft":{"longitude":37.6,"latitude":55.77},"bottomRight":{"longitude":37.615,"latitude":55.755}}`) {
+		if id == 316412 {
+			t.Error("Patched cashpoint is found at old position")
+		}
+	}
+	if ids := nearby(`{"topLeft":{"longitude":37.575,"latitude":55.72},"bottomRight":{"longitude":37.585,"latitude":55.71}}`); !reflect.DeepEqual(ids, []uint32{316412}) {
+		t.Errorf("Expected patched cashpoint at new position instead of deleted one but got %v", ids)
+	}
+
+	// clusters are updated, single member cluster is replied as cashpoint
+	var clusters []map[string]interface{}
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getNearbyClusters",
+		`{"topLeft":{"longitude":37.575,"latitude":55.72},"bottomRight":{"longitude":37.585,"latitude":55.71},"zoom":15}`)), &clusters)
+	if len(clusters) != 1 || clusters[0]["id"] != 316412.0 {
+		t.Errorf("Expected patched cashpoint in clusters of new position but got %v", clusters)
+	}
+
+	sync.Cashpoints, sync.Deleted.Cashpoints = nil, nil
+	since.Kind, since.Id = "", 0
+	sinceJson, _ := json.Marshal(since)
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getSyncChanges", `{"since":`+string(sinceJson)+`}`)), &sync)
+	if len(sync.Cashpoints) != 1 || sync.Cashpoints[0].Id != 316412 || !reflect.DeepEqual(sync.Deleted.Cashpoints, []uint32{58552}) {
+		t.Errorf("Unexpected sync changes: %+v", sync)
+	}
+}
+
+func TestSqliteBackendSyncTown(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+
+	sync := struct {
+		Cashpoints []struct {
+			Id uint32 `json:"id"`
+		} `json:"cashpoints"`
+		Towns   []models.Town `json:"towns"`
+		Deleted struct {
+			Cashpoints []uint32 `json:"cashpoints"`
+		} `json:"deleted"`
+		Last SyncCursor `json:"last"`
+		More bool       `json:"more"`
+	}{}
+	getChanges := func(req string) {
+		sync.Cashpoints, sync.Towns, sync.Deleted.Cashpoints = nil, nil, nil
+		json.Unmarshal([]byte(callSqliteProc(t, b, "getSyncChanges", req)), &sync)
+	}
+
+	getChanges(`{"since":{"timestamp":0},"town_id":290}`)
+	if len(sync.Cashpoints) != 1 || len(sync.Towns) != 2 {
+		t.Errorf("Expected 1 cashpoint and all towns of Astrakhan sync but got %+v", sync)
+	}
+
+	// paging by cursor
+	seen := make(map[uint32]bool)
+	since := `{"timestamp":0}`
+	for i := 0; i < 100; i++ {
+		getChanges(`{"since":` + since + `,"limit":10}`)
+		for _, cp := range sync.Cashpoints {
+			seen[cp.Id] = true
+		}
+		cursor, _ := json.Marshal(sync.Last)
+		since = string(cursor)
+		if !sync.More {
+			break
+		}
+	}
+	if len(seen) != len(newFixtureBackend().cashpoints) {
+		t.Errorf("Expected all cashpoints synced by pages but got %d", len(seen))
+	}
+
+	// moved to Astrakhan: deleted for Moscow
+	callSqliteProc(t, b, "cashpointProposePatch", `{"user_id":1,"data":{"id":58552,"town_id":290}}`)
+	var patches map[string]json.RawMessage
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getCashpointPatches", uint64(58552))), &patches)
+	for id := range patches {
+		for userId := 1; userId <= MEMORY_PATCH_APPROVE_VOTES; userId++ {
+			callSqliteProc(t, b, "cashpointVotePatch", `{"patch_id":`+id+`,"user_id":`+strconv.Itoa(userId)+`,"score":1}`)
+		}
+	}
+	getChanges(`{"since":` + since + `,"town_id":4}`)
+	if len(sync.Cashpoints) != 0 || !reflect.DeepEqual(sync.Deleted.Cashpoints, []uint32{58552}) {
+		t.Errorf("Expected moved cashpoint deleted for old town but got %+v", sync)
+	}
+	getChanges(`{"since":` + since + `,"town_id":290}`)
+	if len(sync.Cashpoints) != 1 || sync.Cashpoints[0].Id != 58552 {
+		t.Errorf("Expected moved cashpoint in new town but got %+v", sync)
+	}
+
+	if _, err := b.Call("getSyncChanges", []interface{}{`{"since":{}}`}); err == nil {
+		t.Error("Expected error of sync request without timestamp")
+	}
+}
+
+func TestSqliteBackendAdmin(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	b := f.open(t)
+	defer b.Close()
+
+	check := func(expected AdminReply, proc string, args ...interface{}) {
+		var reply AdminReply
+		json.Unmarshal([]byte(callSqliteProc(t, b, proc, args...)), &reply)
+		if reply != expected {
+			t.Errorf("%s%v: expected %+v but got %+v", proc, args, expected, reply)
+		}
+	}
+
+	check(AdminReply{Id: 30001}, "adminCreate", "town", `{"id":30001,"name":"Тула","longitude":37.6,"latitude":54.2,"region_id":3,"population":470000}`)
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "town already exists with id 30001"}, "adminCreate", "town",
+		`{"id":30001,"name":"Тула","longitude":37.6,"latitude":54.2}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "missing required field: latitude"}, "adminCreate", "town", `{"name":"Тула","longitude":37.6}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "unknown field: cashpoints_count"}, "adminCreate", "town",
+		`{"name":"Тула","longitude":37.6,"latitude":54.2,"cashpoints_count":1}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "invalid type of field big, expected boolean"}, "adminUpdate", "town", uint64(30001), `{"big":1}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "no such region: 100500"}, "adminUpdate", "town", uint64(30001), `{"region_id":100500}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "id cannot be changed"}, "adminUpdate", "town", uint64(30001), `{"id":30002}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "malformed request json"}, "adminUpdate", "town", uint64(30001), `[1]`)
+	check(AdminReply{Id: 30001}, "adminUpdate", "town", uint64(30001), `{"name_tr":"Tula","big":true}`)
+
+	var town models.Town
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getTownById", uint64(30001))), &town)
+	if town.Name != "Тула" || town.NameTr != "Tula" || !town.Big || town.Zoom != 10 || town.RegionId != 3 {
+		t.Errorf("Unexpected town after update: %+v", town)
+	}
+
+	check(AdminReply{Id: 194276}, "adminCreate", "bank", `{"name":"Новый банк","partners":[322]}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "no such partner bank: 194276"}, "adminUpdate", "bank", uint64(194276), `{"partners":[194276]}`)
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "partners must contain bank ids"}, "adminUpdate", "bank", uint64(194276), `{"partners":["322"]}`)
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "bank is partner of bank 322"}, "adminDelete", "bank", uint64(325))
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "bank has cashpoints"}, "adminDelete", "bank", uint64(2764))
+
+	var bank models.Bank
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getBankById", uint64(194276))), &bank)
+	if bank.Name != "Новый банк" || !reflect.DeepEqual(bank.Partners, []uint32{322}) {
+		t.Errorf("Unexpected created bank: %+v", bank)
+	}
+
+	check(AdminReply{Error: ADMIN_ERR_INVALID, Message: "no such town: 100500"}, "adminCreate", "metro",
+		`{"town_id":100500,"station_name":"Центр","longitude":37.6,"latitude":54.2}`)
+	check(AdminReply{Id: 780}, "adminCreate", "metro", `{"town_id":30001,"station_name":"Центр","longitude":37.6,"latitude":54.2}`)
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "town has metro stations"}, "adminDelete", "town", uint64(30001))
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "town has cashpoints"}, "adminDelete", "town", uint64(290))
+	check(AdminReply{Error: ADMIN_ERR_CONFLICT, Message: "region has towns"}, "adminDelete", "region", uint64(30))
+	check(AdminReply{Id: 780}, "adminDelete", "metro", uint64(780))
+	check(AdminReply{Id: 30001}, "adminDelete", "town", uint64(30001))
+	check(AdminReply{Error: ADMIN_ERR_NOT_FOUND, Message: "town does not exist with id 30001"}, "adminDelete", "town", uint64(30001))
+	check(AdminReply{Id: 31}, "adminCreate", "region", `{"name":"Тульская область","longitude":37.6,"latitude":54.2}`)
+
+	if _, err := b.Call("adminDelete", []interface{}{"planet", uint64(1)}); err == nil {
+		t.Error("Expected error of unknown admin kind")
+	}
+
+	var towns []uint32
+	json.Unmarshal([]byte(callSqliteProc(t, b, "getTownsList")), &towns)
+	if !reflect.DeepEqual(towns, []uint32{4, 290}) {
+		t.Errorf("Unexpected towns after deletion: %v", towns)
+	}
+}
+
+// Endpoints are served by sqlite backend like by in-memory one
+func TestSqliteBackendHandlers(t *testing.T) {
+	t.Parallel()
+	f := newSqliteFixture(t)
+	defer f.remove()
+	hCtx := newHandlerContext(f.open(t))
+	defer hCtx.Close()
+	router := newRouter(hCtx, ServerConfig{})
+
+	for _, c := range []struct {
+		url      string
+		code     int
+		contains string
+	}{
+		{"/town/4", http.StatusOK, "Москва"},
+		{"/town/100500", http.StatusNotFound, models.Message(MSG_NO_SUCH_TOWN, DEFAULT_LANG)},
+		{"/bank/322/partners", http.StatusOK, "Тестовый партнер"},
+		{"/cashpoint/7243171", http.StatusOK, `"sat":{"f":600,"t":1020}`},
+	} {
+		req, _ := http.NewRequest("GET", c.url, nil)
+		req.Header.Add("Id", "1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		response, err := readResponse(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkHttpCode(t, response.Code, c.code) && !strings.Contains(string(response.Data), c.contains) {
+			t.Errorf("Expected %s in reply of %s but got %s", c.contains, c.url, string(response.Data))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package export
+
+import (
+	"bufio"
+	"errors"
+	"github.com/alexeyknyshev/models"
+	"io"
+	"sort"
+)
+
+// Export is a stream of cashpoints joined with names of their banks and
+// towns and decoded schedule in CSV, GeoJSON or KML. Towns and banks are
+// reference data and are kept in memory, cashpoints are read town by town
+// in batches and written right away, so the whole country is exported
+// without loading it into memory.
+
+// Cashpoints read at once, output is flushed after every batch
+const BATCH_SIZE = models.MAX_CASHPOINTS_BATCH_SIZE
+
+// Trailers of http export, response status is sent before the stream, so
+// readers tell complete export from broken one by status trailer
+const STATUS_TRAILER = "X-Export-Status"
+const COUNT_TRAILER = "X-Export-Count"
+
+const STATUS_COMPLETE = "complete"
+const STATUS_FAILED = "failed"
+
+var ErrUnknownFormat = errors.New("unknown export format")
+var ErrNoSuchTown = errors.New("no such town")
+
+// Cashpoints matching all non-zero fields are exported
+type Filter struct {
+	TownId   uint32
+	RegionId uint32
+	BankId   uint32
+	Type     string
+}
+
+func (f *Filter) matches(cp *models.Cashpoint) bool {
+	return (f.BankId == 0 || cp.BankId == f.BankId) && (f.Type == "" || cp.Type == f.Type)
+}
+
+type Info struct {
+	Format     string `json:"format"`
+	Cashpoints int    `json:"cashpoints"`
+	Towns      int    `json:"towns"` // towns having exported cashpoints
+	Banks      int    `json:"banks"`
+}
+
+// Exported cashpoint
+type Row struct {
+	Cashpoint *models.Cashpoint
+	Bank      *models.Bank // nil if there is no such bank
+	Town      *models.Town
+}
+
+func (r *Row) BankName() string {
+	if r.Bank == nil {
+		return ""
+	}
+	return r.Bank.Name
+}
+
+type townList []*models.Town
+
+func (l townList) Len() int           { return len(l) }
+func (l townList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l townList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+type cashpointList []*models.Cashpoint
+
+func (l cashpointList) Len() int           { return len(l) }
+func (l cashpointList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l cashpointList) Less(i, j int) bool { return l[i].Id < l[j].Id }
+
+type idList []uint32
+
+func (l idList) Len() int           { return len(l) }
+func (l idList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l idList) Less(i, j int) bool { return l[i] < l[j] }
+
+type Exporter struct {
+	src    Source
+	format *Format
+	filter Filter
+	towns  []*models.Town
+	// Cache of joined banks, nil for missing ones
+	banks map[uint32]*models.Bank
+}
+
+// Checks format and filter and loads towns to export, nothing is written
+// until Write, so errors can be replied before output starts
+func New(src Source, format string, filter Filter) (*Exporter, error) {
+	f, ok := FORMATS[format]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	e := &Exporter{src: src, format: f, filter: filter, banks: make(map[uint32]*models.Bank)}
+
+	var towns []*models.Town
+	if filter.TownId != 0 {
+		town, err := src.Town(filter.TownId)
+		if err != nil {
+			return nil, err
+		}
+		if town == nil {
+			return nil, ErrNoSuchTown
+		}
+		towns = []*models.Town{town}
+	} else {
+		ids, err := src.TownIds()
+		if err != nil {
+			return nil, err
+		}
+		towns, err = src.Towns(ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, town := range towns {
+		if filter.RegionId == 0 || town.RegionId == filter.RegionId {
+			e.towns = append(e.towns, town)
+		}
+	}
+	sort.Sort(townList(e.towns))
+	return e, nil
+}
+
+func (e *Exporter) Format() *Format {
+	return e.format
+}
+
+// Loads banks of cashpoints missing in cache
+func (e *Exporter) loadBanks(cashpoints []*models.Cashpoint) error {
+	missing := make([]uint32, 0)
+	for _, cp := range cashpoints {
+		if _, ok := e.banks[cp.BankId]; !ok {
+			e.banks[cp.BankId] = nil
+			missing = append(missing, cp.BankId)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	banks, err := e.src.Banks(missing)
+	if err != nil {
+		return err
+	}
+	for _, bank := range banks {
+		e.banks[bank.Id] = bank
+	}
+	return nil
+}
+
+// Flushes buffered output and http response if it is passed as w
+func flush(out *bufio.Writer, w io.Writer) error {
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if f, ok := w.(interface {
+		Flush()
+	}); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Writes cashpoints of towns ordered by town and cashpoint id
+func (e *Exporter) Write(w io.Writer) (*Info, error) {
+	info := &Info{Format: e.format.Name}
+	out := bufio.NewWriter(w)
+	fw := e.format.newWriter(out)
+	if err := fw.begin(); err != nil {
+		return info, err
+	}
+
+	banks := make(map[uint32]bool)
+	for _, town := range e.towns {
+		ids, err := e.src.TownCashpointIds(town.Id)
+		if err != nil {
+			return info, err
+		}
+		sort.Sort(idList(ids))
+
+		exported := 0
+		for from := 0; from < len(ids); from += BATCH_SIZE {
+			to := from + BATCH_SIZE
+			if to > len(ids) {
+				to = len(ids)
+			}
+			cashpoints, err := e.src.Cashpoints(ids[from:to])
+			if err != nil {
+				return info, err
+			}
+			sort.Sort(cashpointList(cashpoints))
+			if err = e.loadBanks(cashpoints); err != nil {
+				return info, err
+			}
+
+			for _, cp := range cashpoints {
+				if !e.filter.matches(cp) {
+					continue
+				}
+				row := &Row{Cashpoint: cp, Bank: e.banks[cp.BankId], Town: town}
+				if err = fw.write(row); err != nil {
+					return info, err
+				}
+				banks[cp.BankId] = true
+				exported++
+			}
+			if err = flush(out, w); err != nil {
+				return info, err
+			}
+		}
+
+		if exported > 0 {
+			info.Cashpoints += exported
+			info.Towns++
+		}
+	}
+	info.Banks = len(banks)
+
+	if err := fw.end(); err != nil {
+		return info, err
+	}
+	return info, flush(out, w)
+}
@@ -0,0 +1,315 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"github.com/alexeyknyshev/models"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSource struct {
+	towns      map[uint32]*models.Town
+	cashpoints []*models.Cashpoint
+	banks      map[uint32]*models.Bank
+	// Sizes of Cashpoints calls
+	batches []int
+}
+
+func (s *testSource) Town(id uint32) (*models.Town, error) {
+	return s.towns[id], nil
+}
+
+func (s *testSource) TownIds() ([]uint32, error) {
+	result := make([]uint32, 0)
+	for id := range s.towns {
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+func (s *testSource) Towns(ids []uint32) ([]*models.Town, error) {
+	result := make([]*models.Town, 0)
+	for _, id := range ids {
+		if town, ok := s.towns[id]; ok {
+			result = append(result, town)
+		}
+	}
+	return result, nil
+}
+
+func (s *testSource) TownCashpointIds(townId uint32) ([]uint32, error) {
+	result := make([]uint32, 0)
+	for i := len(s.cashpoints) - 1; i >= 0; i-- {
+		if s.cashpoints[i].TownId == townId {
+			result = append(result, s.cashpoints[i].Id)
+		}
+	}
+	return result, nil
+}
+
+func (s *testSource) Cashpoints(ids []uint32) ([]*models.Cashpoint, error) {
+	s.batches = append(s.batches, len(ids))
+	result := make([]*models.Cashpoint, 0)
+	for _, id := range ids {
+		for _, cp := range s.cashpoints {
+			if cp.Id == id {
+				result = append(result, cp)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *testSource) Banks(ids []uint32) ([]*models.Bank, error) {
+	result := make([]*models.Bank, 0)
+	for _, id := range ids {
+		if bank, ok := s.banks[id]; ok {
+			result = append(result, bank)
+		}
+	}
+	return result, nil
+}
+
+func getTestSource() *testSource {
+	breaks := []models.ScheduleBreak{{From: 780, To: 840}}
+	return &testSource{
+		towns: map[uint32]*models.Town{
+			4: {Id: 4, Name: "Москва", RegionId: 1},
+			5: {Id: 5, Name: "Санкт-Петербург", RegionId: 2},
+			6: {Id: 6, Name: "Химки", RegionId: 1},
+		},
+		cashpoints: []*models.Cashpoint{
+			{CashpointData: models.CashpointData{Id: 7, Type: "atm", BankId: 322, TownId: 4, Longitude: 37.64, Latitude: 55.75,
+				Address: "ул. Тверская, 1", RoundTheClock: true,
+				Schedule: models.Schedule{Mon: &models.ScheduleDay{From: 0, To: 1440}},
+				Currency: []uint32{643, 840, 156}}},
+			{CashpointData: models.CashpointData{Id: 3, Type: "office", BankId: 325, TownId: 4, Longitude: 37.62, Latitude: 55.76,
+				Address: "ул. Арбат, 2",
+				Schedule: models.Schedule{
+					Mon:    &models.ScheduleDay{From: 540, To: 1080},
+					Sat:    &models.ScheduleDay{From: 600, To: 960, Breaks: &[]models.ScheduleBreak{}},
+					Breaks: &breaks,
+				}}},
+			{CashpointData: models.CashpointData{Id: 5, Type: "atm", BankId: 1, TownId: 5, Longitude: 30.31, Latitude: 59.93}},
+			{CashpointData: models.CashpointData{Id: 9, Type: "atm", BankId: 404, TownId: 6, Longitude: 37.44, Latitude: 55.89}},
+		},
+		banks: map[uint32]*models.Bank{
+			322: {Id: 322, Name: "Сбербанк России"},
+			325: {Id: 325, Name: "ВТБ 24"},
+			1:   {Id: 1, Name: "Other"},
+		},
+	}
+}
+
+func export(t *testing.T, src Source, format string, filter Filter) (string, *Info) {
+	e, err := New(src, format, filter)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var buf bytes.Buffer
+	info, err := e.Write(&buf)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.String(), info
+}
+
+func TestFormatScheduleDay(t *testing.T) {
+	src := getTestSource()
+	tests := []struct {
+		cashpoint int
+		weekday   time.Weekday
+		expected  string
+	}{
+		{0, time.Monday, "00:00-24:00"},
+		{0, time.Tuesday, ""},
+		{1, time.Monday, "09:00-18:00 (13:00-14:00)"},
+		{1, time.Saturday, "10:00-16:00"}, // own empty breaks override common ones
+	}
+	for _, test := range tests {
+		got := FormatScheduleDay(&src.cashpoints[test.cashpoint].Schedule, test.weekday)
+		if got != test.expected {
+			t.Errorf("%d %s: expected %q, got %q", test.cashpoint, test.weekday, test.expected, got)
+		}
+	}
+}
+
+func TestExportCsv(t *testing.T) {
+	out, info := export(t, getTestSource(), FORMAT_CSV, Filter{})
+
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !reflect.DeepEqual(records[0], CSV_HEADER) {
+		t.Fatalf("unexpected header: %v", records[0])
+	}
+
+	ids := make([]string, 0)
+	for _, r := range records[1:] {
+		ids = append(ids, r[0])
+	}
+	// Ordered by town and cashpoint id
+	if !reflect.DeepEqual(ids, []string{"3", "7", "5", "9"}) {
+		t.Errorf("unexpected cashpoints: %v", ids)
+	}
+
+	row := make(map[string]string)
+	for i, column := range CSV_HEADER {
+		row[column] = records[2][i]
+	}
+	expected := map[string]string{
+		"bank_name":       "Сбербанк России",
+		"town_name":       "Москва",
+		"region_id":       "1",
+		"longitude":       "37.64",
+		"round_the_clock": "true",
+		"currency":        "RUB USD 156",
+		"mon":             "00:00-24:00",
+		"tue":             "",
+	}
+	for column, value := range expected {
+		if row[column] != value {
+			t.Errorf("%s: expected %q, got %q", column, value, row[column])
+		}
+	}
+	if records[4][3] != "" {
+		t.Errorf("unknown bank has name %q", records[4][3])
+	}
+
+	expectedInfo := Info{Format: FORMAT_CSV, Cashpoints: 4, Towns: 3, Banks: 4}
+	if *info != expectedInfo {
+		t.Errorf("expected %+v, got %+v", expectedInfo, *info)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	tests := []struct {
+		filter   Filter
+		expected []string
+		towns    int
+	}{
+		{Filter{TownId: 4}, []string{"3", "7"}, 1},
+		{Filter{RegionId: 1}, []string{"3", "7", "9"}, 2},
+		{Filter{BankId: 322}, []string{"7"}, 1},
+		{Filter{Type: "atm"}, []string{"7", "5", "9"}, 3},
+		{Filter{RegionId: 1, Type: "atm"}, []string{"7", "9"}, 2},
+		{Filter{TownId: 5, BankId: 322}, []string{}, 0},
+	}
+	for _, test := range tests {
+		out, info := export(t, getTestSource(), FORMAT_CSV, test.filter)
+		records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		ids := make([]string, 0)
+		for _, r := range records[1:] {
+			ids = append(ids, r[0])
+		}
+		if !reflect.DeepEqual(ids, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.filter, test.expected, ids)
+		}
+		if info.Cashpoints != len(test.expected) || info.Towns != test.towns {
+			t.Errorf("%+v: unexpected info %+v", test.filter, *info)
+		}
+	}
+}
+
+func TestExportGeoJson(t *testing.T) {
+	out, _ := export(t, getTestSource(), FORMAT_GEOJSON, Filter{TownId: 4})
+
+	var collection struct {
+		Type     string
+		Features []struct {
+			Type     string
+			Id       uint32
+			Geometry struct {
+				Type        string
+				Coordinates []float64
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal([]byte(out), &collection); err != nil {
+		t.Fatalf("Unmarshal: %v\n%s", err, out)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("unexpected collection: %s", out)
+	}
+
+	f := collection.Features[0]
+	if f.Type != "Feature" || f.Id != 3 || f.Geometry.Type != "Point" ||
+		!reflect.DeepEqual(f.Geometry.Coordinates, []float64{37.62, 55.76}) {
+		t.Errorf("unexpected feature: %+v", f)
+	}
+	if f.Properties["bank_name"] != "ВТБ 24" || f.Properties["town_name"] != "Москва" {
+		t.Errorf("unexpected properties: %v", f.Properties)
+	}
+	expectedSchedule := map[string]interface{}{"mon": "09:00-18:00 (13:00-14:00)", "sat": "10:00-16:00"}
+	if !reflect.DeepEqual(f.Properties["schedule"], expectedSchedule) {
+		t.Errorf("unexpected schedule: %v", f.Properties["schedule"])
+	}
+
+	out, _ = export(t, getTestSource(), FORMAT_GEOJSON, Filter{BankId: 100500})
+	if err := json.Unmarshal([]byte(out), &collection); err != nil || len(collection.Features) != 0 {
+		t.Errorf("unexpected empty collection: %s", out)
+	}
+}
+
+func TestExportKml(t *testing.T) {
+	out, _ := export(t, getTestSource(), FORMAT_KML, Filter{BankId: 322})
+
+	var kml struct {
+		XMLName    xml.Name
+		Placemarks []kmlPlacemark `xml:"Document>Placemark"`
+	}
+	if err := xml.Unmarshal([]byte(out), &kml); err != nil {
+		t.Fatalf("Unmarshal: %v\n%s", err, out)
+	}
+	if kml.XMLName.Space != "http://www.opengis.net/kml/2.2" || len(kml.Placemarks) != 1 {
+		t.Fatalf("unexpected kml: %s", out)
+	}
+
+	p := kml.Placemarks[0]
+	if p.Id != "cashpoint-7" || p.Name != "Сбербанк России" || p.Point.Coordinates != "37.64,55.75" {
+		t.Errorf("unexpected placemark: %+v", p)
+	}
+	if p.Description != "ул. Тверская, 1\nmon: 00:00-24:00" {
+		t.Errorf("unexpected description: %q", p.Description)
+	}
+	if p.ExtendedData[4] != (kmlData{Name: "town_name", Value: "Москва"}) {
+		t.Errorf("unexpected data: %+v", p.ExtendedData)
+	}
+}
+
+func TestExportBatches(t *testing.T) {
+	src := &testSource{
+		towns: map[uint32]*models.Town{4: {Id: 4}},
+		banks: map[uint32]*models.Bank{},
+	}
+	for id := uint32(1); id <= BATCH_SIZE+10; id++ {
+		src.cashpoints = append(src.cashpoints, &models.Cashpoint{CashpointData: models.CashpointData{Id: id, TownId: 4}})
+	}
+
+	_, info := export(t, src, FORMAT_GEOJSON, Filter{})
+	if info.Cashpoints != BATCH_SIZE+10 {
+		t.Errorf("expected %d cashpoints, got %d", BATCH_SIZE+10, info.Cashpoints)
+	}
+	if !reflect.DeepEqual(src.batches, []int{BATCH_SIZE, 10}) {
+		t.Errorf("unexpected batches: %v", src.batches)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	if _, err := New(getTestSource(), "xls", Filter{}); err != ErrUnknownFormat {
+		t.Errorf("expected ErrUnknownFormat, got %v", err)
+	}
+	if _, err := New(getTestSource(), FORMAT_CSV, Filter{TownId: 100500}); err != ErrNoSuchTown {
+		t.Errorf("expected ErrNoSuchTown, got %v", err)
+	}
+}
@@ -0,0 +1,372 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/alexeyknyshev/models"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FORMAT_CSV = "csv"
+const FORMAT_GEOJSON = "geojson"
+const FORMAT_KML = "kml"
+
+// Writes rows of export in some format
+type formatWriter interface {
+	begin() error
+	write(row *Row) error
+	end() error
+}
+
+type Format struct {
+	Name        string
+	ContentType string
+	Extension   string
+	newWriter   func(w io.Writer) formatWriter
+}
+
+var FORMATS = map[string]*Format{
+	FORMAT_CSV: &Format{
+		Name:        FORMAT_CSV,
+		ContentType: "text/csv; charset=utf-8",
+		Extension:   "csv",
+		newWriter:   newCsvWriter,
+	},
+	FORMAT_GEOJSON: &Format{
+		Name:        FORMAT_GEOJSON,
+		ContentType: "application/geo+json",
+		Extension:   "geojson",
+		newWriter:   newGeoJsonWriter,
+	},
+	FORMAT_KML: &Format{
+		Name:        FORMAT_KML,
+		ContentType: "application/vnd.google-earth.kml+xml",
+		Extension:   "kml",
+		newWriter:   newKmlWriter,
+	},
+}
+
+// ======== Decoding ========
+
+// Days of week in export order
+var WEEKDAYS = [...]time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday,
+	time.Friday, time.Saturday, time.Sunday,
+}
+
+var DAY_KEYS = [...]string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+var CURRENCY_CODES = map[uint32]string{
+	models.CURRENCY_RUB: "RUB",
+	models.CURRENCY_USD: "USD",
+	models.CURRENCY_EUR: "EUR",
+}
+
+// Formats minutes from 00:00 as HH:MM, end of day is 24:00
+func formatMinutes(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Formats working hours of day as "09:00-18:00 (13:00-14:00)" with breaks
+// in parentheses, breaks of schedule are used if day has no own ones.
+// Returns empty string if cashpoint does not work this day
+func FormatScheduleDay(s *models.Schedule, weekday time.Weekday) string {
+	day := s.Day(weekday)
+	if day == nil {
+		return ""
+	}
+
+	result := formatMinutes(day.From) + "-" + formatMinutes(day.To)
+	breaks := day.Breaks
+	if breaks == nil {
+		breaks = s.Breaks
+	}
+	if breaks != nil && len(*breaks) > 0 {
+		parts := make([]string, 0, len(*breaks))
+		for _, b := range *breaks {
+			parts = append(parts, formatMinutes(b.From)+"-"+formatMinutes(b.To))
+		}
+		result += " (" + strings.Join(parts, ", ") + ")"
+	}
+	return result
+}
+
+// Returns letter codes of currencies, unknown ones are left numeric
+func currencyCodes(currency []uint32) []string {
+	codes := make([]string, 0, len(currency))
+	for _, c := range currency {
+		if code, ok := CURRENCY_CODES[c]; ok {
+			codes = append(codes, code)
+		} else {
+			codes = append(codes, strconv.FormatUint(uint64(c), 10))
+		}
+	}
+	return codes
+}
+
+func formatCoordinate(c float64) string {
+	return strconv.FormatFloat(c, 'f', -1, 64)
+}
+
+// ======== CSV ========
+
+var CSV_HEADER = []string{
+	"id", "type", "bank_id", "bank_name", "town_id", "town_name", "region_id",
+	"longitude", "latitude", "address", "address_comment", "metro_name",
+	"free_access", "main_office", "without_weekend", "round_the_clock",
+	"works_as_shop", "cash_in", "currency", "tel", "additional",
+	"mon", "tue", "wed", "thu", "fri", "sat", "sun",
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCsvWriter(w io.Writer) formatWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) begin() error {
+	return c.flush(CSV_HEADER)
+}
+
+func (c *csvWriter) flush(record []string) error {
+	if err := c.w.Write(record); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvWriter) write(row *Row) error {
+	cp := row.Cashpoint
+	record := []string{
+		strconv.FormatUint(uint64(cp.Id), 10),
+		cp.Type,
+		strconv.FormatUint(uint64(cp.BankId), 10),
+		row.BankName(),
+		strconv.FormatUint(uint64(row.Town.Id), 10),
+		row.Town.Name,
+		strconv.FormatUint(uint64(row.Town.RegionId), 10),
+		formatCoordinate(cp.Longitude),
+		formatCoordinate(cp.Latitude),
+		cp.Address,
+		cp.AddressComment,
+		cp.MetroName,
+		strconv.FormatBool(cp.FreeAccess),
+		strconv.FormatBool(cp.MainOffice),
+		strconv.FormatBool(cp.WithoutWeekend),
+		strconv.FormatBool(cp.RoundTheClock),
+		strconv.FormatBool(cp.WorksAsShop),
+		strconv.FormatBool(cp.CashIn),
+		strings.Join(currencyCodes(cp.Currency), " "),
+		cp.Tel,
+		cp.Additional,
+	}
+	for _, weekday := range WEEKDAYS {
+		record = append(record, FormatScheduleDay(&cp.Schedule, weekday))
+	}
+	return c.flush(record)
+}
+
+func (c *csvWriter) end() error {
+	return nil
+}
+
+// ======== GeoJSON ========
+
+type geoJsonPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJsonProperties struct {
+	Type           string            `json:"type"`
+	BankId         uint32            `json:"bank_id"`
+	BankName       string            `json:"bank_name"`
+	TownId         uint32            `json:"town_id"`
+	TownName       string            `json:"town_name"`
+	RegionId       uint32            `json:"region_id"`
+	Address        string            `json:"address"`
+	AddressComment string            `json:"address_comment"`
+	MetroName      string            `json:"metro_name"`
+	FreeAccess     bool              `json:"free_access"`
+	MainOffice     bool              `json:"main_office"`
+	WithoutWeekend bool              `json:"without_weekend"`
+	RoundTheClock  bool              `json:"round_the_clock"`
+	WorksAsShop    bool              `json:"works_as_shop"`
+	CashIn         bool              `json:"cash_in"`
+	Currency       []string          `json:"currency"`
+	Tel            string            `json:"tel"`
+	Additional     string            `json:"additional"`
+	Schedule       map[string]string `json:"schedule"` // day => hours, missing days are days off
+}
+
+type geoJsonFeature struct {
+	Type       string            `json:"type"`
+	Id         uint32            `json:"id"`
+	Geometry   geoJsonPoint      `json:"geometry"`
+	Properties geoJsonProperties `json:"properties"`
+}
+
+// Features are written one by one into FeatureCollection
+type geoJsonWriter struct {
+	w     io.Writer
+	count int
+}
+
+func newGeoJsonWriter(w io.Writer) formatWriter {
+	return &geoJsonWriter{w: w}
+}
+
+func (g *geoJsonWriter) begin() error {
+	_, err := io.WriteString(g.w, `{"type":"FeatureCollection","features":[`)
+	return err
+}
+
+func (g *geoJsonWriter) write(row *Row) error {
+	cp := row.Cashpoint
+	schedule := make(map[string]string)
+	for i, weekday := range WEEKDAYS {
+		if hours := FormatScheduleDay(&cp.Schedule, weekday); hours != "" {
+			schedule[DAY_KEYS[i]] = hours
+		}
+	}
+
+	feature := geoJsonFeature{
+		Type:     "Feature",
+		Id:       cp.Id,
+		Geometry: geoJsonPoint{Type: "Point", Coordinates: [2]float64{cp.Longitude, cp.Latitude}},
+		Properties: geoJsonProperties{
+			Type:           cp.Type,
+			BankId:         cp.BankId,
+			BankName:       row.BankName(),
+			TownId:         row.Town.Id,
+			TownName:       row.Town.Name,
+			RegionId:       row.Town.RegionId,
+			Address:        cp.Address,
+			AddressComment: cp.AddressComment,
+			MetroName:      cp.MetroName,
+			FreeAccess:     cp.FreeAccess,
+			MainOffice:     cp.MainOffice,
+			WithoutWeekend: cp.WithoutWeekend,
+			RoundTheClock:  cp.RoundTheClock,
+			WorksAsShop:    cp.WorksAsShop,
+			CashIn:         cp.CashIn,
+			Currency:       currencyCodes(cp.Currency),
+			Tel:            cp.Tel,
+			Additional:     cp.Additional,
+			Schedule:       schedule,
+		},
+	}
+	data, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+
+	if g.count > 0 {
+		if _, err = io.WriteString(g.w, ",\n"); err != nil {
+			return err
+		}
+	} else if _, err = io.WriteString(g.w, "\n"); err != nil {
+		return err
+	}
+	g.count++
+	_, err = g.w.Write(data)
+	return err
+}
+
+func (g *geoJsonWriter) end() error {
+	_, err := io.WriteString(g.w, "\n]}\n")
+	return err
+}
+
+// ======== KML ========
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlPlacemark struct {
+	XMLName      xml.Name  `xml:"Placemark"`
+	Id           string    `xml:"id,attr"`
+	Name         string    `xml:"name"`
+	Description  string    `xml:"description"`
+	ExtendedData []kmlData `xml:"ExtendedData>Data"`
+	Point        kmlPoint  `xml:"Point"`
+}
+
+type kmlWriter struct {
+	w   io.Writer
+	enc *xml.Encoder
+}
+
+func newKmlWriter(w io.Writer) formatWriter {
+	return &kmlWriter{w: w, enc: xml.NewEncoder(w)}
+}
+
+func (k *kmlWriter) begin() error {
+	_, err := io.WriteString(k.w, xml.Header+`<kml xmlns="http://www.opengis.net/kml/2.2"><Document>`+"\n")
+	return err
+}
+
+func (k *kmlWriter) write(row *Row) error {
+	cp := row.Cashpoint
+
+	// Placemarks are labeled with bank name as most of them are in the same town
+	name := row.BankName()
+	if name == "" {
+		name = cp.Address
+	}
+	lines := []string{cp.Address}
+	if cp.AddressComment != "" {
+		lines = append(lines, cp.AddressComment)
+	}
+	for i, weekday := range WEEKDAYS {
+		if hours := FormatScheduleDay(&cp.Schedule, weekday); hours != "" {
+			lines = append(lines, DAY_KEYS[i]+": "+hours)
+		}
+	}
+
+	placemark := kmlPlacemark{
+		Id:          "cashpoint-" + strconv.FormatUint(uint64(cp.Id), 10),
+		Name:        name,
+		Description: strings.Join(lines, "\n"),
+		ExtendedData: []kmlData{
+			{Name: "type", Value: cp.Type},
+			{Name: "bank_id", Value: strconv.FormatUint(uint64(cp.BankId), 10)},
+			{Name: "bank_name", Value: row.BankName()},
+			{Name: "town_id", Value: strconv.FormatUint(uint64(row.Town.Id), 10)},
+			{Name: "town_name", Value: row.Town.Name},
+			{Name: "metro_name", Value: cp.MetroName},
+			{Name: "round_the_clock", Value: strconv.FormatBool(cp.RoundTheClock)},
+			{Name: "cash_in", Value: strconv.FormatBool(cp.CashIn)},
+			{Name: "currency", Value: strings.Join(currencyCodes(cp.Currency), " ")},
+			{Name: "tel", Value: cp.Tel},
+		},
+		Point: kmlPoint{Coordinates: formatCoordinate(cp.Longitude) + "," + formatCoordinate(cp.Latitude)},
+	}
+	if err := k.enc.Encode(placemark); err != nil {
+		return err
+	}
+	if err := k.enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(k.w, "\n")
+	return err
+}
+
+func (k *kmlWriter) end() error {
+	_, err := io.WriteString(k.w, "</Document></kml>\n")
+	return err
+}
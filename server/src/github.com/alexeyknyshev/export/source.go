@@ -0,0 +1,19 @@
+package export
+
+import (
+	"github.com/alexeyknyshev/models"
+)
+
+// Provides data of export
+type Source interface {
+	// Returns nil if there is no such town
+	Town(id uint32) (*models.Town, error)
+	TownIds() ([]uint32, error)
+	Towns(ids []uint32) ([]*models.Town, error)
+	TownCashpointIds(townId uint32) ([]uint32, error)
+	Cashpoints(ids []uint32) ([]*models.Cashpoint, error)
+	Banks(ids []uint32) ([]*models.Bank, error)
+}
+
+// Exports are made of tarantool data with models.NewRepository(tnt)
+var _ Source = (*models.Repository)(nil)
@@ -0,0 +1,50 @@
+package models
+
+// Translations of api messages by language. Keys are english messages
+// (MSG_* of cpsrv), messages space is seeded with them on migration and
+// backends without messages space fall back to them.
+var MESSAGES = map[string]map[string]string{
+	"ru": {
+		"Malformed request":                    "Некорректный запрос",
+		"Invalid request parameter":            "Недопустимый параметр запроса",
+		"Cashpoint does not exist with id":     "Не найдена точка с идентификатором",
+		"Town does not exist with id":          "Не найден город с идентификатором",
+		"Bank does not exist with id":          "Не найден банк с идентификатором",
+		"Metro station does not exist with id": "Не найдена станция метро с идентификатором",
+		"Region does not exist with id":        "Не найден регион с идентификатором",
+		"Bank icon does not exist with id":     "Не найдена иконка банка с идентификатором",
+		"Request body is too large":            "Слишком большой запрос",
+		"Authorization required":               "Требуется авторизация",
+		"Access denied":                        "Доступ запрещён",
+		"Conflict with existing data":          "Конфликт с существующими данными",
+
+		"missing required field":                       "отсутствует обязательное поле",
+		"unknown field":                                "неизвестное поле",
+		"wrong type, expected %s but got %s":           "неверный тип, ожидается %s, получен %s",
+		"wrong type, expected array of ids but got %s": "неверный тип, ожидается массив идентификаторов, получен %s",
+		"wrong type, expected object":                  "неверный тип, ожидается объект",
+		"wrong type, expected integer":                 "неверный тип, ожидается целое число",
+		"out of range [%d, %d]":                        "вне диапазона [%d, %d]",
+		"must not be empty":                            "не должно быть пустым",
+		"malformed json: %s":                           "некорректный json: %s",
+		"empty request":                                "пустой запрос",
+		"unexpected data after request json":           "лишние данные после json запроса",
+		"unsupported currency %d":                      "неподдерживаемая валюта %d",
+		"unknown cashpoint type '%s'":                  "неизвестный тип точки '%s'",
+		"too many banks %d, max %d":                    "слишком много банков %d, максимум %d",
+		"too many partners, max %d":                    "слишком много партнёров, максимум %d",
+		"too big region, max delta %v":                 "слишком большая область, максимальная разница %v",
+		"empty region":                                 "пустая область",
+		"too big batch %d, max %d":                     "слишком много объектов %d, максимум %d",
+		"malformed cursor":                             "некорректный курсор",
+		"cursor does not match sort order":             "курсор не соответствует сортировке",
+		"unsupported sort field '%s'":                  "неподдерживаемое поле сортировки '%s'",
+		"unknown field '%s'":                           "неизвестное поле '%s'",
+		"unsupported param":                            "неподдерживаемый параметр",
+	},
+}
+
+// Returns translation of message or empty string if there is no one
+func Message(key, lang string) string {
+	return MESSAGES[lang][key]
+}
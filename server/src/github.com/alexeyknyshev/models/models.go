@@ -0,0 +1,152 @@
+// Package models declares objects of cashpoints service shared by cpsrv,
+// tests and data migration tools. Json representation of every object is
+// the one returned by tarantool api (see tnt_workdir/api).
+package models
+
+// ISO 4217 currency codes
+const CURRENCY_RUB = 643
+const CURRENCY_USD = 840
+const CURRENCY_EUR = 978
+
+// Converts currency flags of sqlite databases to list of currency codes
+func CurrencyFromFlags(rub, usd, eur bool) []uint32 {
+	currency := make([]uint32, 0, 3)
+	if rub {
+		currency = append(currency, CURRENCY_RUB)
+	}
+	if usd {
+		currency = append(currency, CURRENCY_USD)
+	}
+	if eur {
+		currency = append(currency, CURRENCY_EUR)
+	}
+	return currency
+}
+
+type Region struct {
+	Id        uint32  `json:"id"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+	Name      string  `json:"name"`
+	NameTr    string  `json:"name_tr"`
+	Zoom      uint32  `json:"zoom"`
+}
+
+type Town struct {
+	Id             uint32  `json:"id"`
+	Longitude      float64 `json:"longitude"`
+	Latitude       float64 `json:"latitude"`
+	Name           string  `json:"name"`
+	NameTr         string  `json:"name_tr"`
+	RegionId       uint32  `json:"region_id"` // 0 if town has no region
+	RegionalCenter bool    `json:"regional_center"`
+	Zoom           uint32  `json:"zoom"`
+	Big            bool    `json:"big"`
+	HasMetro       bool    `json:"has_metro"`
+	// Stored in tarantool but not returned by api
+	CashpointsCount uint32 `json:"-"`
+	Population      uint32 `json:"-"`
+}
+
+type Bank struct {
+	Id        uint32   `json:"id"`
+	Name      string   `json:"name"`
+	NameTr    string   `json:"name_tr"`
+	NameTrAlt string   `json:"name_tr_alt"`
+	Partners  []uint32 `json:"partners"`
+	Town      string   `json:"town,omitempty"` // not returned by api
+	Licence   uint32   `json:"licence"`
+	Rating    uint32   `json:"rating"`
+	Tel       string   `json:"tel"`
+}
+
+type Metro struct {
+	Id              uint32  `json:"id"`
+	Longitude       float64 `json:"longitude"`
+	Latitude        float64 `json:"latitude"`
+	TownId          uint32  `json:"town_id"`
+	BranchId        uint32  `json:"branch_id"`
+	StationName     string  `json:"station_name"`
+	StationExitName string  `json:"station_exit_name"`
+}
+
+// Fields of cashpoint editable by users (data of new cashpoint request).
+// Id is omitted for cashpoints which are not created yet.
+type CashpointData struct {
+	Id             uint32   `json:"id,omitempty"`
+	Longitude      float64  `json:"longitude"`
+	Latitude       float64  `json:"latitude"`
+	Type           string   `json:"type"`
+	BankId         uint32   `json:"bank_id"`
+	TownId         uint32   `json:"town_id"`
+	Address        string   `json:"address"`
+	AddressComment string   `json:"address_comment"`
+	MetroName      string   `json:"metro_name"`
+	FreeAccess     bool     `json:"free_access"`
+	MainOffice     bool     `json:"main_office"`
+	WithoutWeekend bool     `json:"without_weekend"`
+	RoundTheClock  bool     `json:"round_the_clock"`
+	WorksAsShop    bool     `json:"works_as_shop"`
+	Schedule       Schedule `json:"schedule"`
+	Tel            string   `json:"tel"`
+	Additional     string   `json:"additional"`
+	Currency       []uint32 `json:"currency"`
+	CashIn         bool     `json:"cash_in"`
+}
+
+func (cp *CashpointData) HasCurrency(code uint32) bool {
+	for _, c := range cp.Currency {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+type Cashpoint struct {
+	CashpointData
+	Version    uint32 `json:"version"`
+	Timestamp  uint64 `json:"timestamp,omitempty"` // not set for imported cashpoints
+	Approved   bool   `json:"approved"`
+	PatchCount uint32 `json:"patch_count"`
+	UserId     uint32 `json:"user_id,omitempty"` // creator of not approved cashpoint
+}
+
+// Cluster of cashpoints in quadtree node, members are listed for small
+// clusters only
+type Cluster struct {
+	Id        string   `json:"id"`
+	Longitude float64  `json:"longitude"`
+	Latitude  float64  `json:"latitude"`
+	Members   []uint32 `json:"members,omitempty"`
+	Size      uint32   `json:"size"`
+}
+
+// Tuple counts of tarantool spaces
+type SpaceMetrics struct {
+	Banks                  uint32 `json:"banks"`
+	Towns                  uint32 `json:"towns"`
+	Regions                uint32 `json:"regions"`
+	Metro                  uint32 `json:"metro"`
+	Cashpoints             uint32 `json:"cashpoints"`
+	CashpointsPatches      uint32 `json:"cashpoints_patches"`
+	CashpointsPatchesVotes uint32 `json:"cashpoints_patches_votes"`
+	Clusters               uint32 `json:"clusters"`
+	ClustersCache          uint32 `json:"clusters_cache"`
+}
+
+// Pending change of cashpoint, data is json object of changed fields
+type CashpointPatch struct {
+	Id          uint64 `json:"id"`
+	CashpointId uint64 `json:"cashpoint_id"`
+	UserId      uint64 `json:"user_id"`
+	Data        string `json:"data"`
+	Timestamp   uint64 `json:"timestamp"`
+}
+
+type PatchVote struct {
+	PatchId   uint64 `json:"patch_id,omitempty"`
+	UserId    uint64 `json:"user_id"`
+	Score     int32  `json:"score"`
+	Timestamp uint64 `json:"timestamp,omitempty"`
+}
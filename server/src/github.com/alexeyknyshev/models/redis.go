@@ -0,0 +1,34 @@
+package models
+
+// Cashpoint as stored in redis by server_sqlite_to_redis and legacy server.
+// Schedule is text of sqlite database and currencies are flags, redis
+// scripts (bin/redis_scripts) filter cashpoints by them.
+type RedisCashpoint struct {
+	Id             uint32  `json:"id"`
+	Type           string  `json:"type"`
+	BankId         uint32  `json:"bank_id"`
+	TownId         uint32  `json:"town_id"`
+	Longitude      float64 `json:"longitude"`
+	Latitude       float64 `json:"latitude"`
+	Address        string  `json:"address"`
+	AddressComment string  `json:"address_comment"`
+	MetroName      string  `json:"metro_name"`
+	FreeAccess     bool    `json:"free_access"`
+	MainOffice     bool    `json:"main_office"`
+	WithoutWeekend bool    `json:"without_weekend"`
+	RoundTheClock  bool    `json:"round_the_clock"`
+	WorksAsShop    bool    `json:"works_as_shop"`
+	Schedule       string  `json:"schedule"`
+	Tel            string  `json:"tel"`
+	Additional     string  `json:"additional"`
+	Rub            bool    `json:"rub"`
+	Usd            bool    `json:"usd"`
+	Eur            bool    `json:"eur"`
+	CashIn         bool    `json:"cash_in"`
+	Timestamp      int64   `json:"timestamp"`
+	Version        uint32  `json:"version"`
+}
+
+func (cp *RedisCashpoint) Currency() []uint32 {
+	return CurrencyFromFlags(cp.Rub, cp.Usd, cp.Eur)
+}
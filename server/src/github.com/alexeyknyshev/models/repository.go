@@ -0,0 +1,272 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tarantool/go-tarantool"
+)
+
+// Batch size limits of tarantool api
+const MAX_CASHPOINTS_BATCH_SIZE = 1024
+const MAX_TOWNS_BATCH_SIZE = 1024
+const MAX_BANKS_BATCH_SIZE = 256
+const MAX_METRO_BATCH_SIZE = 1024
+
+// Caller of tarantool stored procedures, e.g. *tarantool.Connection
+type Caller interface {
+	Call(functionName string, args interface{}) (*tarantool.Response, error)
+}
+
+// Typed access to objects of tarantool api. Getters of single object
+// return nil if there is no such object, batch getters skip missing ones.
+type Repository struct {
+	tnt Caller
+}
+
+func NewRepository(tnt Caller) *Repository {
+	return &Repository{tnt: tnt}
+}
+
+// Calls procedure returning json string and decodes it to result.
+// Returns false if procedure returned nothing or empty string.
+func (r *Repository) callJson(proc string, args []interface{}, result interface{}) (bool, error) {
+	resp, err := r.tnt.Call(proc, args)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Data) == 0 {
+		return false, errors.New("empty " + proc + " reply")
+	}
+
+	values, ok := resp.Data[0].([]interface{})
+	if !ok {
+		return false, errors.New("unexpected " + proc + " reply")
+	}
+	if len(values) == 0 || values[0] == nil {
+		return false, nil
+	}
+	jsonStr, ok := values[0].(string)
+	if !ok {
+		return false, errors.New("cannot convert " + proc + " reply to json str")
+	}
+	if jsonStr == "" {
+		return false, nil
+	}
+	return true, json.Unmarshal([]byte(jsonStr), result)
+}
+
+// Calls batch procedure for every chunk of ids, req is json object with ids under key
+func (r *Repository) callBatch(proc, key string, ids []uint32, batchSize int, appendResult func(data []byte) error) error {
+	for from := 0; from < len(ids); from += batchSize {
+		to := from + batchSize
+		if to > len(ids) {
+			to = len(ids)
+		}
+		reqJson, _ := json.Marshal(map[string]interface{}{key: ids[from:to]})
+
+		var result json.RawMessage
+		found, err := r.callJson(proc, []interface{}{string(reqJson)}, &result)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		err = appendResult(result)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Repository) ids(proc string, args []interface{}) ([]uint32, error) {
+	ids := make([]uint32, 0)
+	_, err := r.callJson(proc, args, &ids)
+	return ids, err
+}
+
+// ======================================================================
+// Towns
+
+func (r *Repository) Town(id uint32) (*Town, error) {
+	var town *Town
+	_, err := r.callJson("getTownById", []interface{}{id}, &town)
+	return town, err
+}
+
+func (r *Repository) TownIds() ([]uint32, error) {
+	return r.ids("getTownsList", []interface{}{})
+}
+
+func (r *Repository) Towns(ids []uint32) ([]*Town, error) {
+	result := make([]*Town, 0, len(ids))
+	err := r.callBatch("getTownsBatch", "towns", ids, MAX_TOWNS_BATCH_SIZE, func(data []byte) error {
+		var batch []*Town
+		err := json.Unmarshal(data, &batch)
+		result = append(result, batch...)
+		return err
+	})
+	return result, err
+}
+
+func (r *Repository) Region(id uint32) (*Region, error) {
+	var region *Region
+	_, err := r.callJson("getRegionById", []interface{}{id}, &region)
+	return region, err
+}
+
+// Ids of approved cashpoints of town
+func (r *Repository) TownCashpointIds(townId uint32) ([]uint32, error) {
+	return r.ids("getTownCashpoints", []interface{}{townId})
+}
+
+func (r *Repository) TownCashpoints(townId uint32) ([]*Cashpoint, error) {
+	ids, err := r.TownCashpointIds(townId)
+	if err != nil {
+		return nil, err
+	}
+	return r.Cashpoints(ids)
+}
+
+func (r *Repository) TownMetro(townId uint32) ([]*Metro, error) {
+	ids, err := r.ids("getMetroList", []interface{}{townId})
+	if err != nil {
+		return nil, err
+	}
+	return r.MetroBatch(ids)
+}
+
+// ======================================================================
+// Banks
+
+func (r *Repository) Bank(id uint32) (*Bank, error) {
+	var bank *Bank
+	_, err := r.callJson("getBankById", []interface{}{id}, &bank)
+	return bank, err
+}
+
+func (r *Repository) BankIds() ([]uint32, error) {
+	return r.ids("getBanksList", []interface{}{})
+}
+
+func (r *Repository) Banks(ids []uint32) ([]*Bank, error) {
+	result := make([]*Bank, 0, len(ids))
+	err := r.callBatch("getBanksBatch", "banks", ids, MAX_BANKS_BATCH_SIZE, func(data []byte) error {
+		var batch []*Bank
+		err := json.Unmarshal(data, &batch)
+		result = append(result, batch...)
+		return err
+	})
+	return result, err
+}
+
+// Banks of partner network of bank excluding bank itself
+func (r *Repository) BankPartners(id uint32) ([]*Bank, error) {
+	result := make([]*Bank, 0)
+	_, err := r.callJson("getBankPartners", []interface{}{id}, &result)
+	return result, err
+}
+
+// ======================================================================
+// Metro
+
+func (r *Repository) Metro(id uint32) (*Metro, error) {
+	var metro *Metro
+	_, err := r.callJson("getMetroById", []interface{}{id}, &metro)
+	return metro, err
+}
+
+func (r *Repository) MetroBatch(ids []uint32) ([]*Metro, error) {
+	result := make([]*Metro, 0, len(ids))
+	err := r.callBatch("getMetroBatch", "metro", ids, MAX_METRO_BATCH_SIZE, func(data []byte) error {
+		var batch []*Metro
+		err := json.Unmarshal(data, &batch)
+		result = append(result, batch...)
+		return err
+	})
+	return result, err
+}
+
+// ======================================================================
+// Cashpoints
+
+func (r *Repository) Cashpoint(id uint32) (*Cashpoint, error) {
+	var cp *Cashpoint
+	_, err := r.callJson("getCashpointById", []interface{}{id}, &cp)
+	return cp, err
+}
+
+func (r *Repository) Cashpoints(ids []uint32) ([]*Cashpoint, error) {
+	result := make([]*Cashpoint, 0, len(ids))
+	err := r.callBatch("getCashpointsBatch", "cashpoints", ids, MAX_CASHPOINTS_BATCH_SIZE, func(data []byte) error {
+		var batch []*Cashpoint
+		err := json.Unmarshal(data, &batch)
+		result = append(result, batch...)
+		return err
+	})
+	return result, err
+}
+
+func (r *Repository) Cluster(id string) (*Cluster, error) {
+	var cluster *Cluster
+	_, err := r.callJson("getClusterById", []interface{}{id}, &cluster)
+	return cluster, err
+}
+
+// ======================================================================
+// Patches
+
+// Patch tuple is [id, cashpoint_id, user_id, data, timestamp]
+func (r *Repository) CashpointPatch(id uint64) (*CashpointPatch, error) {
+	resp, err := r.tnt.Call("getCashpointPatchByPatchId", []interface{}{id})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 || resp.Data[0] == nil {
+		return nil, nil
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) < 4 {
+		return nil, errors.New("unexpected getCashpointPatchByPatchId reply")
+	}
+
+	patch := &CashpointPatch{
+		Id:          tupleUint(tuple, 0),
+		CashpointId: tupleUint(tuple, 1),
+		UserId:      tupleUint(tuple, 2),
+		Timestamp:   tupleUint(tuple, 4),
+	}
+	patch.Data, _ = tuple[3].(string)
+	return patch, nil
+}
+
+func (r *Repository) CashpointPatchVotes(patchId uint64) ([]*PatchVote, error) {
+	result := make([]*PatchVote, 0)
+	_, err := r.callJson("getCashpointPatchVotes", []interface{}{patchId}, &result)
+	return result, err
+}
+
+func (r *Repository) SpaceMetrics() (*SpaceMetrics, error) {
+	metrics := new(SpaceMetrics)
+	_, err := r.callJson("getSpaceMetrics", []interface{}{}, metrics)
+	return metrics, err
+}
+
+// Msgpack decodes unsigned numbers of tuples to uint64 or int64
+func tupleUint(tuple []interface{}, i int) uint64 {
+	if i >= len(tuple) {
+		return 0
+	}
+	switch v := tuple[i].(type) {
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	}
+	return 0
+}
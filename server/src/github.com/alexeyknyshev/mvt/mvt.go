@@ -0,0 +1,309 @@
+package mvt
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Mapbox Vector Tile (spec v2) encoder limited to point layers,
+// which is all cashpoints and clusters need.
+
+const DEFAULT_EXTENT = 4096
+
+const MAX_ZOOM = 22
+
+// Web mercator latitude limit
+const MAX_LATITUDE = 85.0511287798
+
+const (
+	tileLayers = 3
+
+	layerName     = 1
+	layerFeatures = 2
+	layerKeys     = 3
+	layerValues   = 4
+	layerExtent   = 5
+	layerVersion  = 15
+
+	featureId       = 1
+	featureTags     = 2
+	featureType     = 3
+	featureGeometry = 4
+
+	valueString = 1
+	valueDouble = 3
+	valueInt    = 4
+	valueUint   = 5
+	valueBool   = 7
+
+	geomTypePoint = 1
+	cmdMoveTo     = 1
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+type feature struct {
+	id   uint64
+	tags []uint32
+	x    int32
+	y    int32
+}
+
+type Layer struct {
+	name       string
+	extent     uint32
+	features   []feature
+	keys       []string
+	keyIndex   map[string]uint32
+	values     []interface{}
+	valueIndex map[interface{}]uint32
+}
+
+type Tile struct {
+	layers []*Layer
+}
+
+func NewTile() *Tile {
+	return &Tile{layers: make([]*Layer, 0)}
+}
+
+// Returns layer with passed name, creates new one if tile has no such layer
+func (t *Tile) Layer(name string) *Layer {
+	for _, l := range t.layers {
+		if l.name == name {
+			return l
+		}
+	}
+	l := &Layer{
+		name:       name,
+		extent:     DEFAULT_EXTENT,
+		features:   make([]feature, 0),
+		keys:       make([]string, 0),
+		keyIndex:   make(map[string]uint32),
+		values:     make([]interface{}, 0),
+		valueIndex: make(map[interface{}]uint32),
+	}
+	t.layers = append(t.layers, l)
+	return l
+}
+
+func (l *Layer) Name() string {
+	return l.name
+}
+
+func (l *Layer) Extent() uint32 {
+	return l.extent
+}
+
+func (l *Layer) Len() int {
+	return len(l.features)
+}
+
+func normalizeValue(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string, bool, float64, int64, uint64:
+		return val, nil
+	case float32:
+		return float64(val), nil
+	case int:
+		return int64(val), nil
+	case int32:
+		return int64(val), nil
+	case uint:
+		return uint64(val), nil
+	case uint32:
+		return uint64(val), nil
+	}
+	return nil, errors.New("mvt: unsupported property value type")
+}
+
+// Adds point feature with coordinates in tile space (see Project)
+func (l *Layer) AddPoint(id uint64, x, y int32, props map[string]interface{}) error {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	// stable output for same input
+	sort.Strings(keys)
+
+	tags := make([]uint32, 0, len(keys)*2)
+	for _, k := range keys {
+		v, err := normalizeValue(props[k])
+		if err != nil {
+			return err
+		}
+
+		keyIdx, ok := l.keyIndex[k]
+		if !ok {
+			keyIdx = uint32(len(l.keys))
+			l.keys = append(l.keys, k)
+			l.keyIndex[k] = keyIdx
+		}
+
+		valueIdx, ok := l.valueIndex[v]
+		if !ok {
+			valueIdx = uint32(len(l.values))
+			l.values = append(l.values, v)
+			l.valueIndex[v] = valueIdx
+		}
+
+		tags = append(tags, keyIdx, valueIdx)
+	}
+
+	l.features = append(l.features, feature{id: id, tags: tags, x: x, y: y})
+	return nil
+}
+
+// Encodes tile into protobuf message. Empty layers are skipped.
+func (t *Tile) Marshal() []byte {
+	buf := make([]byte, 0, 1024)
+	for _, l := range t.layers {
+		if len(l.features) == 0 {
+			continue
+		}
+		buf = appendBytes(buf, tileLayers, l.marshal())
+	}
+	return buf
+}
+
+func (l *Layer) marshal() []byte {
+	buf := make([]byte, 0, 256)
+	buf = appendVarintField(buf, layerVersion, 2)
+	buf = appendBytes(buf, layerName, []byte(l.name))
+	for _, f := range l.features {
+		buf = appendBytes(buf, layerFeatures, f.marshal())
+	}
+	for _, k := range l.keys {
+		buf = appendBytes(buf, layerKeys, []byte(k))
+	}
+	for _, v := range l.values {
+		buf = appendBytes(buf, layerValues, marshalValue(v))
+	}
+	buf = appendVarintField(buf, layerExtent, uint64(l.extent))
+	return buf
+}
+
+func (f *feature) marshal() []byte {
+	buf := make([]byte, 0, 32)
+	buf = appendVarintField(buf, featureId, f.id)
+
+	if len(f.tags) > 0 {
+		tags := make([]byte, 0, len(f.tags)*2)
+		for _, tag := range f.tags {
+			tags = appendVarint(tags, uint64(tag))
+		}
+		buf = appendBytes(buf, featureTags, tags)
+	}
+
+	buf = appendVarintField(buf, featureType, geomTypePoint)
+
+	geom := make([]byte, 0, 12)
+	geom = appendVarint(geom, uint64(cmdMoveTo&0x7|1<<3))
+	geom = appendVarint(geom, uint64(zigzag(f.x)))
+	geom = appendVarint(geom, uint64(zigzag(f.y)))
+	buf = appendBytes(buf, featureGeometry, geom)
+
+	return buf
+}
+
+func marshalValue(v interface{}) []byte {
+	buf := make([]byte, 0, 16)
+	switch val := v.(type) {
+	case string:
+		buf = appendBytes(buf, valueString, []byte(val))
+	case float64:
+		buf = appendTag(buf, valueDouble, wireFixed64)
+		bits := math.Float64bits(val)
+		for i := uint(0); i < 8; i++ {
+			buf = append(buf, byte(bits>>(i*8)))
+		}
+	case int64:
+		buf = appendVarintField(buf, valueInt, uint64(val))
+	case uint64:
+		buf = appendVarintField(buf, valueUint, val)
+	case bool:
+		if val {
+			buf = appendVarintField(buf, valueBool, 1)
+		} else {
+			buf = appendVarintField(buf, valueBool, 0)
+		}
+	}
+	return buf
+}
+
+func zigzag(n int32) uint32 {
+	return uint32((n << 1) ^ (n >> 31))
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendTag(buf []byte, field, wireType uint64) []byte {
+	return appendVarint(buf, field<<3|wireType)
+}
+
+func appendVarintField(buf []byte, field, v uint64) []byte {
+	buf = appendTag(buf, field, wireVarint)
+	return appendVarint(buf, v)
+}
+
+func appendBytes(buf []byte, field uint64, data []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// ================= Tile geometry =================
+
+func IsValidTile(z, x, y uint32) bool {
+	if z > MAX_ZOOM {
+		return false
+	}
+	n := uint32(1) << z
+	return x < n && y < n
+}
+
+func tile2lon(x float64, z uint32) float64 {
+	return x/float64(uint32(1)<<z)*360.0 - 180.0
+}
+
+func tile2lat(y float64, z uint32) float64 {
+	n := math.Pi - 2.0*math.Pi*y/float64(uint32(1)<<z)
+	return 180.0 / math.Pi * math.Atan(math.Sinh(n))
+}
+
+// Returns geo bounding box of XYZ (web mercator) tile
+func Bounds(z, x, y uint32) (west, south, east, north float64) {
+	west = tile2lon(float64(x), z)
+	east = tile2lon(float64(x+1), z)
+	north = tile2lat(float64(y), z)
+	south = tile2lat(float64(y+1), z)
+	return
+}
+
+// Converts geo coordinate into tile space of XYZ tile z/x/y
+func Project(z, x, y, extent uint32, lon, lat float64) (int32, int32) {
+	if lat > MAX_LATITUDE {
+		lat = MAX_LATITUDE
+	} else if lat < -MAX_LATITUDE {
+		lat = -MAX_LATITUDE
+	}
+
+	scale := float64(uint32(1)<<z) * float64(extent)
+	latRad := lat * math.Pi / 180.0
+
+	worldX := (lon + 180.0) / 360.0 * scale
+	worldY := (1.0 - math.Log(math.Tan(latRad)+1.0/math.Cos(latRad))/math.Pi) / 2.0 * scale
+
+	px := math.Floor(worldX - float64(x)*float64(extent))
+	py := math.Floor(worldY - float64(y)*float64(extent))
+	return int32(px), int32(py)
+}
@@ -0,0 +1,247 @@
+package mvt
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+type pbField struct {
+	num   uint64
+	wire  uint64
+	value uint64
+	data  []byte
+}
+
+func readVarint(t *testing.T, buf []byte, pos *int) uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		if *pos >= len(buf) {
+			t.Fatalf("unexpected end of buffer while reading varint")
+		}
+		b := buf[*pos]
+		*pos++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+}
+
+func decodeMessage(t *testing.T, buf []byte) []pbField {
+	result := make([]pbField, 0)
+	pos := 0
+	for pos < len(buf) {
+		key := readVarint(t, buf, &pos)
+		f := pbField{num: key >> 3, wire: key & 0x7}
+		switch f.wire {
+		case wireVarint:
+			f.value = readVarint(t, buf, &pos)
+		case wireFixed64:
+			f.data = buf[pos : pos+8]
+			pos += 8
+		case wireBytes:
+			size := int(readVarint(t, buf, &pos))
+			f.data = buf[pos : pos+size]
+			pos += size
+		default:
+			t.Fatalf("unexpected wire type %d", f.wire)
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+func decodePacked(t *testing.T, buf []byte) []uint64 {
+	result := make([]uint64, 0)
+	pos := 0
+	for pos < len(buf) {
+		result = append(result, readVarint(t, buf, &pos))
+	}
+	return result
+}
+
+func unzigzag(v uint64) int32 {
+	return int32(v>>1) ^ -int32(v&1)
+}
+
+func TestMarshalPoints(t *testing.T) {
+	tile := NewTile()
+	layer := tile.Layer("cashpoints")
+	tile.Layer("empty")
+
+	err := layer.AddPoint(7138832, 100, -5, map[string]interface{}{
+		"bank_id": uint32(2764),
+		"type":    "atm",
+	})
+	if err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+	err = layer.AddPoint(7138833, 4095, 4100, map[string]interface{}{
+		"bank_id":         uint32(2764),
+		"round_the_clock": true,
+	})
+	if err != nil {
+		t.Fatalf("AddPoint failed: %v", err)
+	}
+
+	err = layer.AddPoint(1, 0, 0, map[string]interface{}{"bad": []int{1}})
+	if err == nil {
+		t.Errorf("Expected error for unsupported property type")
+	}
+
+	if layer.Len() != 2 {
+		t.Fatalf("Expected 2 features but got %d", layer.Len())
+	}
+
+	fields := decodeMessage(t, tile.Marshal())
+	if len(fields) != 1 || fields[0].num != tileLayers {
+		t.Fatalf("Expected exactly one non empty layer but got %d fields", len(fields))
+	}
+
+	var name string
+	var version, extent uint64
+	var keys []string
+	var values [][]byte
+	var features [][]byte
+	for _, f := range decodeMessage(t, fields[0].data) {
+		switch f.num {
+		case layerName:
+			name = string(f.data)
+		case layerVersion:
+			version = f.value
+		case layerExtent:
+			extent = f.value
+		case layerKeys:
+			keys = append(keys, string(f.data))
+		case layerValues:
+			values = append(values, f.data)
+		case layerFeatures:
+			features = append(features, f.data)
+		}
+	}
+
+	if name != "cashpoints" || version != 2 || extent != DEFAULT_EXTENT {
+		t.Errorf("Unexpected layer header: name = %s, version = %d, extent = %d", name, version, extent)
+	}
+
+	// keys and values are shared between features
+	if len(keys) != 3 || len(values) != 3 {
+		t.Fatalf("Expected 3 keys and 3 values but got %d and %d", len(keys), len(values))
+	}
+	if len(features) != 2 {
+		t.Fatalf("Expected 2 encoded features but got %d", len(features))
+	}
+
+	type expectedFeature struct {
+		id    uint64
+		x, y  int32
+		props map[string]string
+	}
+	expected := []expectedFeature{
+		{7138832, 100, -5, map[string]string{"bank_id": "uint:2764", "type": "string:atm"}},
+		{7138833, 4095, 4100, map[string]string{"bank_id": "uint:2764", "round_the_clock": "bool:1"}},
+	}
+
+	valueStr := func(data []byte) string {
+		f := decodeMessage(t, data)[0]
+		switch f.num {
+		case valueString:
+			return "string:" + string(f.data)
+		case valueUint:
+			return "uint:" + strconv.FormatUint(f.value, 10)
+		case valueBool:
+			return "bool:" + strconv.FormatUint(f.value, 10)
+		}
+		return "unknown"
+	}
+
+	for i, data := range features {
+		var id uint64
+		var geomType uint64
+		var tags, geom []uint64
+		for _, f := range decodeMessage(t, data) {
+			switch f.num {
+			case featureId:
+				id = f.value
+			case featureType:
+				geomType = f.value
+			case featureTags:
+				tags = decodePacked(t, f.data)
+			case featureGeometry:
+				geom = decodePacked(t, f.data)
+			}
+		}
+
+		exp := expected[i]
+		if id != exp.id {
+			t.Errorf("Expected feature id %d but got %d", exp.id, id)
+		}
+		if geomType != geomTypePoint {
+			t.Errorf("Expected point geometry but got %d", geomType)
+		}
+		if len(geom) != 3 || geom[0] != 9 {
+			t.Fatalf("Unexpected point geometry: %v", geom)
+		}
+		if x, y := unzigzag(geom[1]), unzigzag(geom[2]); x != exp.x || y != exp.y {
+			t.Errorf("Expected point (%d, %d) but got (%d, %d)", exp.x, exp.y, x, y)
+		}
+
+		props := make(map[string]string)
+		for j := 0; j+1 < len(tags); j += 2 {
+			props[keys[tags[j]]] = valueStr(values[tags[j+1]])
+		}
+		if len(props) != len(exp.props) {
+			t.Errorf("Expected %d properties but got %d", len(exp.props), len(props))
+		}
+		for k, v := range exp.props {
+			if props[k] != v {
+				t.Errorf("Expected property %s = %s but got %s", k, v, props[k])
+			}
+		}
+	}
+}
+
+func TestEmptyTile(t *testing.T) {
+	tile := NewTile()
+	tile.Layer("clusters")
+	if data := tile.Marshal(); len(data) != 0 {
+		t.Errorf("Expected empty tile but got %d bytes", len(data))
+	}
+}
+
+func TestBounds(t *testing.T) {
+	west, south, east, north := Bounds(0, 0, 0)
+	if west != -180.0 || east != 180.0 {
+		t.Errorf("Unexpected world longitude range: %f %f", west, east)
+	}
+	if math.Abs(north-MAX_LATITUDE) > 1e-6 || math.Abs(south+MAX_LATITUDE) > 1e-6 {
+		t.Errorf("Unexpected world latitude range: %f %f", south, north)
+	}
+
+	// Moscow center
+	west, south, east, north = Bounds(10, 619, 320)
+	lon, lat := 37.61775970459, 55.755771636963
+	if lon < west || lon > east || lat < south || lat > north {
+		t.Errorf("Moscow is out of tile 10/619/320: (%f, %f, %f, %f)", west, south, east, north)
+	}
+
+	x, y := Project(10, 619, 320, DEFAULT_EXTENT, lon, lat)
+	if x < 0 || x >= DEFAULT_EXTENT || y < 0 || y >= DEFAULT_EXTENT {
+		t.Errorf("Moscow projected out of tile extent: (%d, %d)", x, y)
+	}
+
+	x, y = Project(10, 619, 320, DEFAULT_EXTENT, west, north)
+	if x != 0 || y != 0 {
+		t.Errorf("Expected top left corner at (0, 0) but got (%d, %d)", x, y)
+	}
+}
+
+func TestIsValidTile(t *testing.T) {
+	if !IsValidTile(0, 0, 0) || !IsValidTile(16, 65535, 65535) {
+		t.Errorf("Valid tile reported as invalid")
+	}
+	if IsValidTile(1, 2, 0) || IsValidTile(3, 0, 8) || IsValidTile(MAX_ZOOM+1, 0, 0) {
+		t.Errorf("Invalid tile reported as valid")
+	}
+}
@@ -0,0 +1,261 @@
+package quadkey
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Quadkeys split geo rect (-180, -90, 180, 90) in halves by longitude
+// and latitude on each zoom level exactly like getQuadKey in
+// tnt_workdir/api/common.lua does:
+//
+//   2 | 3
+//   --+--
+//   0 | 1
+//
+// so '0' is the south west quarter and '3' is the north east one.
+
+const MIN_LON = -180.0
+const MAX_LON = 180.0
+const MIN_LAT = -90.0
+const MAX_LAT = 90.0
+
+// Latitude bound of Web Mercator. Legacy redis server and its migrator
+// split (-180, -85, 180, 85) rect instead (see EncodeIn).
+const MERCATOR_MAX_LAT = 85.0
+
+// Tile x and y have to fit into uint32
+const MAX_ZOOM = 30
+
+// Zoom range of clusters stored in tarantool (see tnt_workdir/init_common.lua)
+const CLUSTER_ZOOM_MIN = 10
+const CLUSTER_ZOOM_MAX = 16
+
+var ErrInvalidCoordinate = errors.New("quadkey: coordinate is out of range")
+var ErrInvalidZoom = errors.New("quadkey: zoom is out of range")
+var ErrInvalidQuadKey = errors.New("quadkey: invalid quadkey")
+var ErrInvalidTile = errors.New("quadkey: tile is out of range")
+
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// Geo rects split by quadkeys
+var WORLD = BBox{MinLon: MIN_LON, MinLat: MIN_LAT, MaxLon: MAX_LON, MaxLat: MAX_LAT}
+var MERCATOR_WORLD = BBox{MinLon: MIN_LON, MinLat: -MERCATOR_MAX_LAT, MaxLon: MAX_LON, MaxLat: MERCATOR_MAX_LAT}
+
+// Center of bounding box (not a centroid of cluster members)
+func (b BBox) Center() (lon, lat float64) {
+	return (b.MinLon + b.MaxLon) * 0.5, (b.MinLat + b.MaxLat) * 0.5
+}
+
+// Checks coordinate the same way as Encode assigns it to quadkey:
+// lower bounds are inclusive, upper ones are exclusive except world edges.
+func (b BBox) Contains(lon, lat float64) bool {
+	if lon < b.MinLon || lon > b.MaxLon || (lon == b.MaxLon && b.MaxLon != MAX_LON) {
+		return false
+	}
+	if lat < b.MinLat || lat > b.MaxLat || (lat == b.MaxLat && b.MaxLat != MAX_LAT) {
+		return false
+	}
+	return true
+}
+
+func IsValidCoordinate(lon, lat float64) bool {
+	// NaN fails all comparisons
+	return lon >= MIN_LON && lon <= MAX_LON && lat >= MIN_LAT && lat <= MAX_LAT
+}
+
+func IsValid(quadKey string) bool {
+	if len(quadKey) > MAX_ZOOM {
+		return false
+	}
+	for i := 0; i < len(quadKey); i++ {
+		if quadKey[i] < '0' || quadKey[i] > '3' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns quadkey of length zoom for coordinate
+func Encode(lon, lat float64, zoom uint32) (string, error) {
+	return EncodeIn(WORLD, lon, lat, zoom)
+}
+
+// Returns quadkey of length zoom for coordinate splitting world rect.
+// Coordinates outside of world rect fall into its border quadkeys.
+func EncodeIn(world BBox, lon, lat float64, zoom uint32) (string, error) {
+	if !IsValidCoordinate(lon, lat) {
+		return "", ErrInvalidCoordinate
+	}
+	if zoom > MAX_ZOOM {
+		return "", ErrInvalidZoom
+	}
+
+	minLon, maxLon := world.MinLon, world.MaxLon
+	minLat, maxLat := world.MinLat, world.MaxLat
+
+	quadKey := make([]byte, zoom)
+	for i := range quadKey {
+		midLon := (minLon + maxLon) * 0.5
+		midLat := (minLat + maxLat) * 0.5
+
+		var digit byte = '0'
+		if lat < midLat {
+			maxLat = midLat
+		} else {
+			minLat = midLat
+			digit += 2
+		}
+		if lon < midLon {
+			maxLon = midLon
+		} else {
+			minLon = midLon
+			digit += 1
+		}
+		quadKey[i] = digit
+	}
+	return string(quadKey), nil
+}
+
+// Returns geo rect covered by quadkey
+func Decode(quadKey string) (BBox, error) {
+	if !IsValid(quadKey) {
+		return BBox{}, ErrInvalidQuadKey
+	}
+
+	b := BBox{MinLon: MIN_LON, MinLat: MIN_LAT, MaxLon: MAX_LON, MaxLat: MAX_LAT}
+	for i := 0; i < len(quadKey); i++ {
+		// same arithmetic as Encode to get bit exact borders
+		midLon := (b.MinLon + b.MaxLon) * 0.5
+		midLat := (b.MinLat + b.MaxLat) * 0.5
+
+		digit := quadKey[i] - '0'
+		if digit&2 == 0 {
+			b.MaxLat = midLat
+		} else {
+			b.MinLat = midLat
+		}
+		if digit&1 == 0 {
+			b.MaxLon = midLon
+		} else {
+			b.MinLon = midLon
+		}
+	}
+	return b, nil
+}
+
+// Returns tile column (grows eastwards) and row (grows southwards like
+// in XYZ tiles) of quadkey in the equirectangular quadkey grid.
+func TileXY(quadKey string) (x, y, zoom uint32, err error) {
+	if !IsValid(quadKey) {
+		return 0, 0, 0, ErrInvalidQuadKey
+	}
+
+	zoom = uint32(len(quadKey))
+	var row uint32 = 0 // grows northwards
+	for i := 0; i < len(quadKey); i++ {
+		digit := uint32(quadKey[i] - '0')
+		x = x<<1 | digit&1
+		row = row<<1 | digit>>1
+	}
+	y = (uint32(1)<<zoom - 1) - row
+	return x, y, zoom, nil
+}
+
+// Inverse of TileXY
+func FromTileXY(x, y, zoom uint32) (string, error) {
+	if zoom > MAX_ZOOM {
+		return "", ErrInvalidZoom
+	}
+	n := uint32(1) << zoom
+	if x >= n || y >= n {
+		return "", ErrInvalidTile
+	}
+
+	row := n - 1 - y
+	quadKey := make([]byte, zoom)
+	for i := range quadKey {
+		shift := zoom - 1 - uint32(i)
+		quadKey[i] = byte('0' + (x>>shift)&1 + ((row>>shift)&1)<<1)
+	}
+	return string(quadKey), nil
+}
+
+func Parent(quadKey string) (string, error) {
+	if !IsValid(quadKey) || len(quadKey) == 0 {
+		return "", ErrInvalidQuadKey
+	}
+	return quadKey[:len(quadKey)-1], nil
+}
+
+func Children(quadKey string) ([]string, error) {
+	if !IsValid(quadKey) || len(quadKey) == MAX_ZOOM {
+		return nil, ErrInvalidQuadKey
+	}
+	return []string{quadKey + "0", quadKey + "1", quadKey + "2", quadKey + "3"}, nil
+}
+
+// Returns up to 8 quadkeys of the same zoom sharing edge or corner with
+// passed one. Longitude wraps around antimeridian, latitude does not.
+// Order: rows north to south, columns west to east.
+func Neighbours(quadKey string) ([]string, error) {
+	x, y, zoom, err := TileXY(quadKey)
+	if err != nil {
+		return nil, err
+	}
+
+	n := int64(1) << zoom
+	result := make([]string, 0, 8)
+	seen := map[string]bool{quadKey: true}
+	for dy := int64(-1); dy <= 1; dy++ {
+		ny := int64(y) + dy
+		if ny < 0 || ny >= n {
+			continue
+		}
+		for dx := int64(-1); dx <= 1; dx++ {
+			nx := (int64(x) + dx + n) % n
+			neighbour, _ := FromTileXY(uint32(nx), uint32(ny), zoom)
+			// low zoom grids wrap onto themselves
+			if seen[neighbour] {
+				continue
+			}
+			seen[neighbour] = true
+			result = append(result, neighbour)
+		}
+	}
+	return result, nil
+}
+
+// Returns prefixes of quadkey with length in range [minZoom, maxZoom],
+// i.e. all clusters of quad tree branch containing quadkey.
+func Prefixes(quadKey string, minZoom, maxZoom uint32) []string {
+	if maxZoom > uint32(len(quadKey)) {
+		maxZoom = uint32(len(quadKey))
+	}
+	result := make([]string, 0)
+	for zoom := minZoom; zoom <= maxZoom; zoom++ {
+		result = append(result, quadKey[:zoom])
+	}
+	return result
+}
+
+// Packs quadkey into integer unique among all quadkeys of any zoom
+func ToUint64(quadKey string) (uint64, error) {
+	if !IsValid(quadKey) {
+		return 0, ErrInvalidQuadKey
+	}
+	if len(quadKey) == 0 {
+		return 1, nil
+	}
+	v, err := strconv.ParseUint(quadKey, 4, 64)
+	if err != nil {
+		return 0, ErrInvalidQuadKey
+	}
+	// leading 1 keeps zoom
+	return uint64(1)<<(2*uint(len(quadKey))) | v, nil
+}
@@ -0,0 +1,317 @@
+package quadkey
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+type luaQuadKey struct {
+	Longitude float64
+	Latitude  float64
+	Zoom      uint32
+	QuadKey   string
+}
+
+// Outputs of getQuadKey from tnt_workdir/api/common.lua
+var LUA_QUAD_KEYS = []luaQuadKey{
+	{56.6, 34.84, 16, "3032100220113311"},
+	{37.61775970459, 55.755771636963, 16, "3201323213002200"},
+	{30.315868, 59.939095, 16, "3203030310223332"},
+	{0, 0, 16, "3000000000000000"},
+	{-180, -90, 16, "0000000000000000"},
+	{180, 90, 16, "3333333333333333"},
+	{180, -90, 16, "1111111111111111"},
+	{-180, 90, 16, "2222222222222222"},
+	{90, 45, 16, "3300000000000000"},
+	{-90, -45, 16, "0300000000000000"},
+	{-1e-07, -1e-07, 16, "0333333333333333"},
+	{135, 67.5, 16, "3330000000000000"},
+	{37.6171875, 55.72265625, 16, "3201323213000000"},
+	{37.617187499999, 55.722656249999, 16, "3201323210333333"},
+	{-74.006, 40.7128, 16, "2122301323211333"},
+	{151.2093, -33.8688, 16, "1310323332020310"},
+	{-43.1729, -22.9068, 16, "0312222303203122"},
+	{179.9999999, 89.9999999, 16, "3333333333333333"},
+	{-179.9999999, -89.9999999, 16, "0000000000000000"},
+	{82.92043, 55.030199, 16, "3211323013110133"},
+	{131.885485, 43.115536, 16, "3123330313021003"},
+	{20.507307, 54.710426, 16, "3200331232012323"},
+	{-45.70979, -78.11991, 16, "0103111123311312"},
+	{37.473786, -52.412633, 16, "1023121212320303"},
+	{-164.225354, -21.025206, 16, "0220103100132111"},
+	{112.635768, -20.799747, 16, "1321002002213022"},
+	{-42.103924, 26.347743, 16, "2130021202223111"},
+	{84.826554, -50.770516, 16, "1033132223012032"},
+	{-49.794205, -68.177142, 16, "0103332210012113"},
+	{59.043941, -6.083348, 16, "1232122313133102"},
+	{76.451712, 38.863094, 16, "3033033203011303"},
+	{159.001637, 84.740511, 16, "3333200120010203"},
+	{-137.040553, -28.769951, 16, "0203133210021302"},
+	{-76.827917, -49.117998, 16, "0122302101211301"},
+	{37.61775970459, 55.755771636963, 10, "3201323213"},
+	{37.61775970459, 55.755771636963, 11, "32013232130"},
+	{37.61775970459, 55.755771636963, 12, "320132321300"},
+	{37.61775970459, 55.755771636963, 13, "3201323213002"},
+	{37.61775970459, 55.755771636963, 14, "32013232130022"},
+	{37.61775970459, 55.755771636963, 15, "320132321300220"},
+	{37.61775970459, 55.755771636963, 16, "3201323213002200"},
+}
+
+func TestEncodeMatchesLua(t *testing.T) {
+	for _, v := range LUA_QUAD_KEYS {
+		quadKey, err := Encode(v.Longitude, v.Latitude, v.Zoom)
+		if err != nil {
+			t.Errorf("Encode(%v, %v, %d) failed: %v", v.Longitude, v.Latitude, v.Zoom, err)
+			continue
+		}
+		if quadKey != v.QuadKey {
+			t.Errorf("Encode(%v, %v, %d) = %s but lua returns %s", v.Longitude, v.Latitude, v.Zoom, quadKey, v.QuadKey)
+		}
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	invalid := [][2]float64{{181, 0}, {-180.5, 0}, {0, 90.5}, {0, -91}}
+	for _, c := range invalid {
+		if _, err := Encode(c[0], c[1], CLUSTER_ZOOM_MAX); err != ErrInvalidCoordinate {
+			t.Errorf("Expected invalid coordinate error for (%v, %v) but got %v", c[0], c[1], err)
+		}
+	}
+	if _, err := Encode(0, 0, MAX_ZOOM+1); err != ErrInvalidZoom {
+		t.Errorf("Expected invalid zoom error but got %v", err)
+	}
+}
+
+// Quadkeys of getQuadKey in legacy server/cash_points_srv.go
+var LEGACY_QUAD_KEYS = []struct {
+	Longitude float64
+	Latitude  float64
+	QuadKey   string
+}{
+	{37.61775970459, 55.755771636963, "3203103233220220"},
+	{-73.985, 40.758, "2122321303300011"},
+	{151.2093, -33.8688, "1310321132222332"},
+	{0, 87.5, "3222222222222222"},
+}
+
+func TestEncodeInMercator(t *testing.T) {
+	for _, v := range LEGACY_QUAD_KEYS {
+		quadKey, err := EncodeIn(MERCATOR_WORLD, v.Longitude, v.Latitude, CLUSTER_ZOOM_MAX)
+		if err != nil {
+			t.Errorf("EncodeIn(%v, %v) failed: %v", v.Longitude, v.Latitude, err)
+			continue
+		}
+		if quadKey != v.QuadKey {
+			t.Errorf("EncodeIn(%v, %v) = %s but legacy server returns %s", v.Longitude, v.Latitude, quadKey, v.QuadKey)
+		}
+	}
+}
+
+func randomCoordinate(r *rand.Rand) (float64, float64) {
+	return r.Float64()*(MAX_LON-MIN_LON) + MIN_LON, r.Float64()*(MAX_LAT-MIN_LAT) + MIN_LAT
+}
+
+type coordinate struct {
+	Longitude float64
+	Latitude  float64
+	Zoom      uint32
+}
+
+func (coordinate) Generate(r *rand.Rand, size int) reflect.Value {
+	lon, lat := randomCoordinate(r)
+	return reflect.ValueOf(coordinate{Longitude: lon, Latitude: lat, Zoom: uint32(r.Intn(MAX_ZOOM + 1))})
+}
+
+func quickConfig() *quick.Config {
+	return &quick.Config{MaxCount: 5000, Rand: rand.New(rand.NewSource(1))}
+}
+
+func TestEncodePrefixProperty(t *testing.T) {
+	property := func(c coordinate) bool {
+		full, err := Encode(c.Longitude, c.Latitude, MAX_ZOOM)
+		if err != nil {
+			return false
+		}
+		quadKey, err := Encode(c.Longitude, c.Latitude, c.Zoom)
+		return err == nil && uint32(len(quadKey)) == c.Zoom && strings.HasPrefix(full, quadKey)
+	}
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeContainsProperty(t *testing.T) {
+	property := func(c coordinate) bool {
+		quadKey, err := Encode(c.Longitude, c.Latitude, c.Zoom)
+		if err != nil {
+			return false
+		}
+		bbox, err := Decode(quadKey)
+		if err != nil || !bbox.Contains(c.Longitude, c.Latitude) {
+			return false
+		}
+		// center of quadkey rect is encoded into the same quadkey
+		lon, lat := bbox.Center()
+		centerQuadKey, err := Encode(lon, lat, c.Zoom)
+		return err == nil && centerQuadKey == quadKey
+	}
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeBorders(t *testing.T) {
+	// borders of lua quadkeys have to be reproduced bit exact
+	for _, v := range LUA_QUAD_KEYS {
+		bbox, err := Decode(v.QuadKey)
+		if err != nil {
+			t.Fatalf("Decode(%s) failed: %v", v.QuadKey, err)
+		}
+		if !bbox.Contains(v.Longitude, v.Latitude) {
+			t.Errorf("Decode(%s) = %+v does not contain (%v, %v)", v.QuadKey, bbox, v.Longitude, v.Latitude)
+		}
+		quadKey, _ := Encode(bbox.MinLon, bbox.MinLat, v.Zoom)
+		if quadKey != v.QuadKey {
+			t.Errorf("South west corner of %s is encoded into %s", v.QuadKey, quadKey)
+		}
+	}
+
+	if _, err := Decode("0124"); err != ErrInvalidQuadKey {
+		t.Errorf("Expected invalid quadkey error but got %v", err)
+	}
+}
+
+func TestTileXYProperty(t *testing.T) {
+	property := func(c coordinate) bool {
+		quadKey, err := Encode(c.Longitude, c.Latitude, c.Zoom)
+		if err != nil {
+			return false
+		}
+		x, y, zoom, err := TileXY(quadKey)
+		if err != nil || zoom != c.Zoom {
+			return false
+		}
+		restored, err := FromTileXY(x, y, zoom)
+		return err == nil && restored == quadKey
+	}
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	x, y, zoom, _ := TileXY("2")
+	if x != 0 || y != 0 || zoom != 1 {
+		t.Errorf("Expected north west tile (0, 0) for quadkey 2 but got (%d, %d)", x, y)
+	}
+	x, y, _, _ = TileXY("1")
+	if x != 1 || y != 1 {
+		t.Errorf("Expected south east tile (1, 1) for quadkey 1 but got (%d, %d)", x, y)
+	}
+	if _, err := FromTileXY(4, 0, 2); err != ErrInvalidTile {
+		t.Errorf("Expected invalid tile error but got %v", err)
+	}
+}
+
+func TestParentChildren(t *testing.T) {
+	property := func(c coordinate) bool {
+		if c.Zoom == MAX_ZOOM {
+			c.Zoom--
+		}
+		quadKey, _ := Encode(c.Longitude, c.Latitude, c.Zoom)
+		children, err := Children(quadKey)
+		if err != nil || len(children) != 4 {
+			return false
+		}
+		bbox, _ := Decode(quadKey)
+		for _, child := range children {
+			parent, err := Parent(child)
+			if err != nil || parent != quadKey {
+				return false
+			}
+			// child rect lies inside of parent one
+			childBBox, _ := Decode(child)
+			if childBBox.MinLon < bbox.MinLon || childBBox.MaxLon > bbox.MaxLon ||
+				childBBox.MinLat < bbox.MinLat || childBBox.MaxLat > bbox.MaxLat {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Parent(""); err != ErrInvalidQuadKey {
+		t.Errorf("Expected invalid quadkey error for parent of root but got %v", err)
+	}
+	if _, err := Children(strings.Repeat("3", MAX_ZOOM)); err != ErrInvalidQuadKey {
+		t.Errorf("Expected invalid quadkey error for children of max zoom quadkey but got %v", err)
+	}
+}
+
+func TestNeighbours(t *testing.T) {
+	property := func(c coordinate) bool {
+		quadKey, _ := Encode(c.Longitude, c.Latitude, c.Zoom)
+		neighbours, err := Neighbours(quadKey)
+		if err != nil {
+			return false
+		}
+		x, y, _, _ := TileXY(quadKey)
+		n := int64(1) << c.Zoom
+		for _, neighbour := range neighbours {
+			if neighbour == quadKey || len(neighbour) != len(quadKey) {
+				return false
+			}
+			nx, ny, _, _ := TileXY(neighbour)
+			dx := (int64(nx) - int64(x) + n) % n
+			dy := int64(ny) - int64(y)
+			if (dx > 1 && dx != n-1) || dy < -1 || dy > 1 {
+				return false
+			}
+		}
+		return len(neighbours) <= 8
+	}
+	if err := quick.Check(property, quickConfig()); err != nil {
+		t.Error(err)
+	}
+
+	// Moscow quadkey is far from world edges
+	neighbours, _ := Neighbours("3201323213")
+	if len(neighbours) != 8 {
+		t.Errorf("Expected 8 neighbours but got %d", len(neighbours))
+	}
+
+	// north west corner: east, west (through antimeridian) and 3 to the south
+	neighbours, _ = Neighbours("2222")
+	expected := []string{"3333", "2223", "3331", "2220", "2221"}
+	if !reflect.DeepEqual(neighbours, expected) {
+		t.Errorf("Expected neighbours %v but got %v", expected, neighbours)
+	}
+}
+
+func TestPrefixes(t *testing.T) {
+	expected := []string{"3201323213", "32013232130", "320132321300", "3201323213002", "32013232130022", "320132321300220", "3201323213002200"}
+	got := Prefixes("3201323213002200", CLUSTER_ZOOM_MIN, CLUSTER_ZOOM_MAX)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected prefixes %v but got %v", expected, got)
+	}
+	if got = Prefixes("320", CLUSTER_ZOOM_MIN, CLUSTER_ZOOM_MAX); len(got) != 0 {
+		t.Errorf("Expected no prefixes for short quadkey but got %v", got)
+	}
+}
+
+func TestToUint64(t *testing.T) {
+	seen := make(map[uint64]string)
+	for _, quadKey := range []string{"", "0", "00", "000", "3", "33", "1", "01", "10", "3201323213002200"} {
+		v, err := ToUint64(quadKey)
+		if err != nil {
+			t.Fatalf("ToUint64(%s) failed: %v", quadKey, err)
+		}
+		if other, ok := seen[v]; ok {
+			t.Errorf("Quadkeys '%s' and '%s' are packed into same value %d", quadKey, other, v)
+		}
+		seen[v] = quadKey
+	}
+}
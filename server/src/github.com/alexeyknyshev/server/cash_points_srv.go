@@ -10,6 +10,8 @@ import (
 	"os"
 	"strings"
 	//"github.com/fiam/gounidecode/unidecode"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
 	"github.com/go-fsnotify/fsnotify"
 	"github.com/gorilla/mux"
 	"github.com/mediocregopher/radix.v2/pool"
@@ -469,22 +471,6 @@ type Session struct {
 	Key string `json:"key"`
 }
 
-type Town struct {
-	Id        uint32  `json:"id"`
-	Name      string  `json:"name"`
-	NameTr    string  `json:"name_tr"`
-	Latitude  float32 `json:"latitude"`
-	Longitude float32 `json:"longitude"`
-	Zoom      uint32  `json:"zoom"`
-}
-
-type Bank struct {
-	Id       uint32 `json:"id"`
-	Name     string `json:"name"`
-	NameTr   string `json:"name_tr"`
-	RegionId uint32 `json:"region_id"`
-}
-
 type BankCreateRequest struct {
 	Name     string `json:"name"`
 	Licence  uint32 `json:"licence"`
@@ -522,33 +508,7 @@ func (req *SearchNearbyRequest) Validate() error {
 	return nil
 }
 
-type CashPoint struct {
-	Id             uint32  `json:"id"`
-	Type           string  `json:"type"`
-	BankId         uint32  `json:"bank_id"`
-	TownId         uint32  `json:"town_id"`
-	Longitude      float32 `json:"longitude"`
-	Latitude       float32 `json:"latitude"`
-	Address        string  `json:"address"`
-	AddressComment string  `json:"address_comment"`
-	MetroName      string  `json:"metro_name"`
-	FreeAccess     bool    `json:"free_access"`
-	MainOffice     bool    `json:"main_office"`
-	WithoutWeekend bool    `json:"without_weekend"`
-	RoundTheClock  bool    `json:"round_the_clock"`
-	WorksAsShop    bool    `json:"works_as_shop"`
-	Schedule       string  `json:"schedule"`
-	Tel            string  `json:"tel"`
-	Additional     string  `json:"additional"`
-	Rub            bool    `json:"rub"`
-	Usd            bool    `json:"usd"`
-	Eur            bool    `json:"eur"`
-	CashIn         bool    `json:"cash_in"`
-	Timestamp      int64   `json:"timestamp"`
-	Version        uint32  `json:"version"`
-}
-
-func (cp *CashPoint) Validate() error {
+func validateCashpoint(cp *models.RedisCashpoint) error {
 	if cp.TownId == 0 {
 		return errors.New("No required field 'town_id'")
 	}
@@ -1321,31 +1281,6 @@ func getNextCashpointId(redisCli *redis.Client) (uint32, error) {
 	return uint32(res), nil
 }
 
-func getGeoRectPart(minLon, maxLon, minLat, maxLat *float32, lon, lat float32) string {
-	midLon := (*minLon + *maxLon) * 0.5
-	midLat := (*minLat + *maxLat) * 0.5
-
-	if lat < midLat {
-		*maxLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "0"
-		} else {
-			*minLon = midLon
-			return "1"
-		}
-	} else {
-		*minLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "2"
-		} else {
-			*minLon = midLon
-			return "3"
-		}
-	}
-}
-
 func isGeoCoordValid(lon, lat float32) error {
 	if math.Abs(float64(lon)) > 180.0 {
 		return errors.New("longitude is out of range")
@@ -1355,20 +1290,6 @@ func isGeoCoordValid(lon, lat float32) error {
 	return nil
 }
 
-func getQuadKey(lon, lat float32, maxZoom uint32) string {
-	var minLon float32 = -180.0
-	var maxLon float32 = 180.0
-
-	var minLat float32 = -85.0
-	var maxLat float32 = 85.0
-
-	quadKey := ""
-	for zoom := uint32(0); zoom < maxZoom; zoom++ {
-		quadKey += getGeoRectPart(&minLon, &maxLon, &minLat, &maxLat, lon, lat)
-	}
-	return quadKey
-}
-
 func handlerCashpointCreate(redisCliPool *pool.Pool) EndpointCallback {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ok, requestId := prepareResponse(w, r)
@@ -1396,7 +1317,7 @@ func handlerCashpointCreate(redisCliPool *pool.Pool) EndpointCallback {
 		}
 		defer redisCliPool.Put(redisCli)
 
-		cpData := CashPoint{
+		cpData := models.RedisCashpoint{
 			Id:        0,
 			TownId:    0,
 			BankId:    0,
@@ -1413,7 +1334,7 @@ func handlerCashpointCreate(redisCliPool *pool.Pool) EndpointCallback {
 			return
 		}
 
-		err = cpData.Validate()
+		err = validateCashpoint(&cpData)
 		if err != nil {
 			log.Printf("%s: invalid cashpoint data: %v", context, err)
 			w.WriteHeader(500)
@@ -1480,7 +1401,12 @@ func handlerCashpointCreate(redisCliPool *pool.Pool) EndpointCallback {
 			return
 		}
 
-		quadKey := getQuadKey(cpData.Longitude, cpData.Latitude, MAX_VALID_ZOOM)
+		quadKey, err := quadkey.EncodeIn(quadkey.MERCATOR_WORLD, float64(cpData.Longitude), float64(cpData.Latitude), MAX_VALID_ZOOM)
+		if err != nil {
+			log.Printf("%s: cannot get quadkey for new cashpoint: %v\n", context, err)
+			w.WriteHeader(500)
+			return
+		}
 		for i := 0; i < len(quadKey); i++ {
 			clusterName := "cluster:" + quadKey[:(i+1)]
 			result = redisCli.Cmd("SADD", clusterName, cpData.Id)
@@ -1555,7 +1481,7 @@ func handlerCashpointDelete(redisCliPool *pool.Pool) EndpointCallback {
 			return
 		}
 
-		cp := CashPoint{Id: 0}
+		cp := models.RedisCashpoint{Id: 0}
 		json.Unmarshal([]byte(cpData), &cp)
 		if cp.Id == 0 {
 			log.Printf("%s: cannot parse cashpoint json data for id = %s", context, idStr)
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/bundle"
+	"github.com/alexeyknyshev/models"
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Exports data of one town into self-contained sqlite file for offline use.
+// Prints bundle info in json.
+//
+// Usage: cpbundle [-ico dir] [-o town.sqlite] <tarantool url> <town id>
+
+func main() {
+	context := "cpbundle"
+
+	icoDir := flag.String("ico", "", "directory with bank icons (<bank id>.svg)")
+	outputPath := flag.String("o", "", "bundle file path (town_<id>.sqlite by default)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <tarantool url> <town id>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	townId, err := strconv.ParseUint(flag.Arg(1), 10, 32)
+	if err != nil {
+		log.Fatalf("%s: invalid town id: %s", context, flag.Arg(1))
+	}
+	if *outputPath == "" {
+		*outputPath = "town_" + flag.Arg(1) + ".sqlite"
+	}
+
+	opts := tarantool.Opts{
+		Reconnect:     1 * time.Second,
+		MaxReconnects: 3,
+		User:          "admin",
+		Pass:          "admin",
+	}
+	tnt, err := tarantool.Connect(flag.Arg(0), opts)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+	defer tnt.Close()
+
+	info, err := bundle.Build(models.NewRepository(tnt), uint32(townId), *outputPath, bundle.Options{IcoDir: *icoDir})
+	if err != nil {
+		log.Fatalf("%s: cannot build bundle: %v", context, err)
+	}
+
+	infoJson, _ := json.MarshalIndent(info, "", "  ")
+	fmt.Println(string(infoJson))
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/alexeyknyshev/quadkey"
+	"github.com/tarantool/go-tarantool"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Cross-checks cashpoints, clusters, towns counters and patches references
+// stored in tarantool. Prints report in json, fixes found issues with -repair.
+//
+// Usage: cpcheck [-repair] [-o report.json] <tarantool url>
+
+const SELECT_BATCH_SIZE = 1024
+
+// Tuple columns (zero based)
+const COL_CP_ID = 0
+const COL_CP_COORD = 1
+const COL_CP_BANK_ID = 3
+const COL_CP_TOWN_ID = 4
+const COL_CP_APPROVED = 20
+
+const COL_TOWN_ID = 0
+const COL_TOWN_CP_COUNT = 8
+
+const COL_PATCH_ID = 0
+const COL_PATCH_CP_ID = 1
+
+const COL_VOTE_ID = 0
+const COL_VOTE_PATCH_ID = 1
+
+const ISSUE_CLUSTER_MISSING = "cluster_missing"
+const ISSUE_CLUSTER_MISMATCH = "cluster_mismatch"
+const ISSUE_CLUSTER_STALE = "cluster_stale"
+const ISSUE_TOWN_COUNT_MISMATCH = "town_count_mismatch"
+const ISSUE_CASHPOINT_INVALID_COORD = "cashpoint_invalid_coord"
+const ISSUE_CASHPOINT_UNKNOWN_TOWN = "cashpoint_unknown_town"
+const ISSUE_CASHPOINT_UNKNOWN_BANK = "cashpoint_unknown_bank"
+const ISSUE_PATCH_ORPHAN = "patch_orphan"
+const ISSUE_VOTE_ORPHAN = "vote_orphan"
+
+type Cashpoint struct {
+	Id       uint32
+	TownId   uint32
+	BankId   uint32
+	Approved bool
+	Point    cluster.Point
+}
+
+// Data loaded from tarantool
+type Snapshot struct {
+	Cashpoints []Cashpoint
+	Clusters   map[string]*cluster.Cluster
+	Towns      map[uint32]uint64 // town id => cashpoints count
+	Banks      map[uint32]bool
+	Patches    map[uint64]uint32 // patch id => cashpoint id
+	Votes      map[uint64]uint64 // vote id => patch id
+}
+
+type ClusterState struct {
+	Size      int     `json:"size"`
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+type Issue struct {
+	Type     string      `json:"type"`
+	Id       uint64      `json:"id,omitempty"`
+	QuadKey  string      `json:"quadkey,omitempty"`
+	Expected interface{} `json:"expected,omitempty"`
+	Got      interface{} `json:"got,omitempty"`
+	Repaired bool        `json:"repaired"`
+
+	cluster *cluster.Cluster
+	// difference of expected and stored counter, applied as is on repair
+	// so cashpoints committed after snapshot are still counted
+	delta int64
+}
+
+type Counts struct {
+	Cashpoints int `json:"cashpoints"`
+	Clusters   int `json:"clusters"`
+	Towns      int `json:"towns"`
+	Banks      int `json:"banks"`
+	Patches    int `json:"patches"`
+	Votes      int `json:"votes"`
+}
+
+type Report struct {
+	Timestamp  string         `json:"timestamp"`
+	Repair     bool           `json:"repair"`
+	Counts     Counts         `json:"counts"`
+	Summary    map[string]int `json:"summary"`
+	Unrepaired int            `json:"unrepaired"`
+	Issues     []*Issue       `json:"issues"`
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch val := v.(type) {
+	case uint64:
+		return val, true
+	case int64:
+		return uint64(val), val >= 0
+	case uint32:
+		return uint64(val), true
+	case int32:
+		return uint64(val), val >= 0
+	case uint:
+		return uint64(val), true
+	case int:
+		return uint64(val), val >= 0
+	case uint16:
+		return uint64(val), true
+	case uint8:
+		return uint64(val), true
+	case int16:
+		return uint64(val), val >= 0
+	case int8:
+		return uint64(val), val >= 0
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	}
+	u, ok := toUint64(v)
+	return float64(u), ok
+}
+
+func tupleUint(tuple []interface{}, col int) uint64 {
+	if col >= len(tuple) {
+		return 0
+	}
+	v, _ := toUint64(tuple[col])
+	return v
+}
+
+func getTntSpaceId(tnt *tarantool.Connection, name string) (uint32, error) {
+	resp, err := tnt.Call("getSpaceId", []interface{}{name})
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Data) == 0 {
+		return 0, errors.New("empty getSpaceId reply")
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) == 0 {
+		return 0, errors.New("unexpected getSpaceId reply")
+	}
+	id, ok := toUint64(tuple[0])
+	if !ok || id == 0 {
+		return 0, errors.New("no such tarantool space: " + name)
+	}
+	return uint32(id), nil
+}
+
+// Iterates over space with unsigned primary key in first field
+func scanSpace(tnt *tarantool.Connection, name string, callback func(tuple []interface{})) error {
+	spaceId, err := getTntSpaceId(tnt, name)
+	if err != nil {
+		return err
+	}
+
+	iterator := tarantool.IterAll
+	key := []interface{}{}
+	for {
+		resp, err := tnt.Select(spaceId, 0, 0, SELECT_BATCH_SIZE, iterator, key)
+		if err != nil {
+			return err
+		}
+		tuples := resp.Tuples()
+		for _, tuple := range tuples {
+			callback(tuple)
+		}
+		if len(tuples) < SELECT_BATCH_SIZE {
+			return nil
+		}
+		iterator = tarantool.IterGt
+		key = []interface{}{tupleUint(tuples[len(tuples)-1], 0)}
+	}
+}
+
+func tupleToCashpoint(tuple []interface{}) Cashpoint {
+	cp := Cashpoint{
+		Id:       uint32(tupleUint(tuple, COL_CP_ID)),
+		TownId:   uint32(tupleUint(tuple, COL_CP_TOWN_ID)),
+		BankId:   uint32(tupleUint(tuple, COL_CP_BANK_ID)),
+		Approved: true, // nil approved means approved
+	}
+	cp.Point.Id = cp.Id
+
+	cp.Point.Longitude, cp.Point.Latitude = 1000.0, 1000.0 // invalid by default
+	if len(tuple) > COL_CP_COORD {
+		if coord, ok := tuple[COL_CP_COORD].([]interface{}); ok && len(coord) >= 2 {
+			lon, okLon := toFloat64(coord[0])
+			lat, okLat := toFloat64(coord[1])
+			if okLon && okLat {
+				cp.Point.Longitude, cp.Point.Latitude = lon, lat
+			}
+		}
+	}
+
+	if len(tuple) > COL_CP_APPROVED {
+		if approved, ok := tuple[COL_CP_APPROVED].(bool); ok {
+			cp.Approved = approved
+		}
+	}
+	return cp
+}
+
+func loadSnapshot(tnt *tarantool.Connection, store *cluster.Store) (*Snapshot, error) {
+	s := &Snapshot{
+		Cashpoints: make([]Cashpoint, 0),
+		Clusters:   make(map[string]*cluster.Cluster),
+		Towns:      make(map[uint32]uint64),
+		Banks:      make(map[uint32]bool),
+		Patches:    make(map[uint64]uint32),
+		Votes:      make(map[uint64]uint64),
+	}
+
+	err := store.ForEachCashpoint(func(tuple []interface{}) error {
+		s.Cashpoints = append(s.Cashpoints, tupleToCashpoint(tuple))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.ForEachCluster(func(c *cluster.Cluster) error {
+		s.Clusters[c.QuadKey] = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanSpace(tnt, "towns", func(tuple []interface{}) {
+		s.Towns[uint32(tupleUint(tuple, COL_TOWN_ID))] = tupleUint(tuple, COL_TOWN_CP_COUNT)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanSpace(tnt, "banks", func(tuple []interface{}) {
+		s.Banks[uint32(tupleUint(tuple, 0))] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanSpace(tnt, "cashpoints_patches", func(tuple []interface{}) {
+		s.Patches[tupleUint(tuple, COL_PATCH_ID)] = uint32(tupleUint(tuple, COL_PATCH_CP_ID))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanSpace(tnt, "cashpoints_patches_votes", func(tuple []interface{}) {
+		s.Votes[tupleUint(tuple, COL_VOTE_ID)] = tupleUint(tuple, COL_VOTE_PATCH_ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func getClusterState(c *cluster.Cluster) ClusterState {
+	return ClusterState{Size: c.Size(), Longitude: c.Longitude, Latitude: c.Latitude}
+}
+
+func checkClusters(s *Snapshot) []*Issue {
+	points := make([]cluster.Point, 0, len(s.Cashpoints))
+	for _, cp := range s.Cashpoints {
+		points = append(points, cp.Point)
+	}
+	expected := cluster.BuildAll(points)
+
+	issues := make([]*Issue, 0)
+	for quadKey, c := range expected {
+		existing, ok := s.Clusters[quadKey]
+		if !ok {
+			issues = append(issues, &Issue{Type: ISSUE_CLUSTER_MISSING, QuadKey: quadKey, Expected: getClusterState(c), cluster: c})
+		} else if !c.Equal(existing) {
+			issues = append(issues, &Issue{Type: ISSUE_CLUSTER_MISMATCH, QuadKey: quadKey, Expected: getClusterState(c), Got: getClusterState(existing), cluster: c})
+		}
+	}
+	for quadKey, c := range s.Clusters {
+		if _, ok := expected[quadKey]; !ok {
+			issues = append(issues, &Issue{Type: ISSUE_CLUSTER_STALE, QuadKey: quadKey, Got: getClusterState(c)})
+		}
+	}
+	return issues
+}
+
+func checkCashpoints(s *Snapshot) []*Issue {
+	issues := make([]*Issue, 0)
+	townCount := make(map[uint32]uint64)
+	for _, cp := range s.Cashpoints {
+		if !quadkey.IsValidCoordinate(cp.Point.Longitude, cp.Point.Latitude) {
+			issues = append(issues, &Issue{Type: ISSUE_CASHPOINT_INVALID_COORD, Id: uint64(cp.Id)})
+		}
+		if _, ok := s.Towns[cp.TownId]; !ok {
+			issues = append(issues, &Issue{Type: ISSUE_CASHPOINT_UNKNOWN_TOWN, Id: uint64(cp.Id), Got: cp.TownId})
+		}
+		if !s.Banks[cp.BankId] {
+			issues = append(issues, &Issue{Type: ISSUE_CASHPOINT_UNKNOWN_BANK, Id: uint64(cp.Id), Got: cp.BankId})
+		}
+		// only approved cashpoints are counted (see cashpointCommit)
+		if cp.Approved {
+			townCount[cp.TownId]++
+		}
+	}
+
+	for townId, count := range s.Towns {
+		if townCount[townId] != count {
+			issues = append(issues, &Issue{
+				Type: ISSUE_TOWN_COUNT_MISMATCH, Id: uint64(townId), Expected: townCount[townId], Got: count,
+				delta: int64(townCount[townId]) - int64(count),
+			})
+		}
+	}
+	return issues
+}
+
+func checkPatches(s *Snapshot) []*Issue {
+	cashpoints := make(map[uint32]bool, len(s.Cashpoints))
+	for _, cp := range s.Cashpoints {
+		cashpoints[cp.Id] = true
+	}
+
+	issues := make([]*Issue, 0)
+	for patchId, cpId := range s.Patches {
+		if !cashpoints[cpId] {
+			issues = append(issues, &Issue{Type: ISSUE_PATCH_ORPHAN, Id: patchId, Got: cpId})
+		}
+	}
+	// votes of orphan patches are orphans too, they go away before patch
+	for voteId, patchId := range s.Votes {
+		cpId, ok := s.Patches[patchId]
+		if !ok || !cashpoints[cpId] {
+			issues = append(issues, &Issue{Type: ISSUE_VOTE_ORPHAN, Id: voteId, Got: patchId})
+		}
+	}
+	return issues
+}
+
+func check(s *Snapshot) []*Issue {
+	issues := checkClusters(s)
+	issues = append(issues, checkCashpoints(s)...)
+	issues = append(issues, checkPatches(s)...)
+
+	sort.Sort(issueList(issues))
+	return issues
+}
+
+type issueList []*Issue
+
+func (l issueList) Len() int {
+	return len(l)
+}
+
+func (l issueList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l issueList) Less(i, j int) bool {
+	if l[i].Type != l[j].Type {
+		return l[i].Type < l[j].Type
+	}
+	if l[i].QuadKey != l[j].QuadKey {
+		return l[i].QuadKey < l[j].QuadKey
+	}
+	return l[i].Id < l[j].Id
+}
+
+// Fixes repairable issues, marks them as repaired
+func repair(tnt *tarantool.Connection, store *cluster.Store, issues []*Issue) error {
+	townsSpaceId, err := getTntSpaceId(tnt, "towns")
+	if err != nil {
+		return err
+	}
+	patchesSpaceId, err := getTntSpaceId(tnt, "cashpoints_patches")
+	if err != nil {
+		return err
+	}
+	votesSpaceId, err := getTntSpaceId(tnt, "cashpoints_patches_votes")
+	if err != nil {
+		return err
+	}
+
+	for _, issue := range issues {
+		switch issue.Type {
+		case ISSUE_CLUSTER_MISSING, ISSUE_CLUSTER_MISMATCH:
+			err = store.ReplaceCluster(issue.cluster)
+		case ISSUE_CLUSTER_STALE:
+			err = store.DeleteCluster(issue.QuadKey)
+		case ISSUE_TOWN_COUNT_MISMATCH:
+			_, err = tnt.Update(townsSpaceId, 0, []interface{}{issue.Id}, []interface{}{
+				[]interface{}{"+", COL_TOWN_CP_COUNT, issue.delta},
+			})
+		case ISSUE_PATCH_ORPHAN:
+			_, err = tnt.Delete(patchesSpaceId, 0, []interface{}{issue.Id})
+		case ISSUE_VOTE_ORPHAN:
+			_, err = tnt.Delete(votesSpaceId, 0, []interface{}{issue.Id})
+		default: // cannot be fixed automatically
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("cannot repair %s (id = %d, quadkey = %s): %v", issue.Type, issue.Id, issue.QuadKey, err)
+		}
+		issue.Repaired = true
+	}
+	return nil
+}
+
+func makeReport(s *Snapshot, issues []*Issue, repaired bool) *Report {
+	report := &Report{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Repair:    repaired,
+		Counts: Counts{
+			Cashpoints: len(s.Cashpoints),
+			Clusters:   len(s.Clusters),
+			Towns:      len(s.Towns),
+			Banks:      len(s.Banks),
+			Patches:    len(s.Patches),
+			Votes:      len(s.Votes),
+		},
+		Summary: make(map[string]int),
+		Issues:  issues,
+	}
+	for _, issue := range issues {
+		report.Summary[issue.Type]++
+		if !issue.Repaired {
+			report.Unrepaired++
+		}
+	}
+	return report
+}
+
+func writeReport(report *Report, path string) error {
+	reportJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	reportJson = append(reportJson, '\n')
+
+	if path == "" {
+		_, err = os.Stdout.Write(reportJson)
+		return err
+	}
+	return ioutil.WriteFile(path, reportJson, 0644)
+}
+
+func main() {
+	context := "cpcheck"
+
+	repairFlag := flag.Bool("repair", false, "fix found issues")
+	outputPath := flag.String("o", "", "write report into file instead of stdout")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <tarantool url>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := tarantool.Opts{
+		Reconnect:     1 * time.Second,
+		MaxReconnects: 3,
+		User:          "admin",
+		Pass:          "admin",
+	}
+	tnt, err := tarantool.Connect(flag.Arg(0), opts)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+	defer tnt.Close()
+
+	store, err := cluster.NewStore(tnt)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	snapshot, err := loadSnapshot(tnt, store)
+	if err != nil {
+		log.Fatalf("%s: cannot load data: %v", context, err)
+	}
+
+	issues := check(snapshot)
+	log.Printf("%s: found %d issues", context, len(issues))
+
+	if *repairFlag && len(issues) > 0 {
+		err = repair(tnt, store, issues)
+		if err != nil {
+			log.Printf("%s: %v", context, err)
+		}
+	}
+
+	report := makeReport(snapshot, issues, *repairFlag)
+	err = writeReport(report, *outputPath)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	if report.Unrepaired > 0 {
+		tnt.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/alexeyknyshev/cluster"
+	"testing"
+)
+
+func getTestSnapshot() *Snapshot {
+	cashpoints := []Cashpoint{
+		{Id: 1, TownId: 4, BankId: 322, Approved: true, Point: cluster.Point{Id: 1, Longitude: 37.64, Latitude: 55.75}},
+		{Id: 2, TownId: 4, BankId: 322, Approved: false, Point: cluster.Point{Id: 2, Longitude: 37.62, Latitude: 55.76}},
+	}
+	points := []cluster.Point{cashpoints[0].Point, cashpoints[1].Point}
+
+	return &Snapshot{
+		Cashpoints: cashpoints,
+		Clusters:   cluster.BuildAll(points),
+		Towns:      map[uint32]uint64{4: 1},
+		Banks:      map[uint32]bool{322: true},
+		Patches:    map[uint64]uint32{10: 2},
+		Votes:      map[uint64]uint64{100: 10},
+	}
+}
+
+func countIssues(issues []*Issue) map[string]int {
+	result := make(map[string]int)
+	for _, issue := range issues {
+		result[issue.Type]++
+	}
+	return result
+}
+
+func TestCheckConsistent(t *testing.T) {
+	issues := check(getTestSnapshot())
+	if len(issues) != 0 {
+		t.Errorf("Expected no issues but got %v", countIssues(issues))
+	}
+}
+
+func TestCheckClusters(t *testing.T) {
+	s := getTestSnapshot()
+	delete(s.Clusters, "3201323213")
+	s.Clusters["32013232130"].Members = []uint32{1}
+	s.Clusters["0000000000"] = &cluster.Cluster{QuadKey: "0000000000", Members: []uint32{1}}
+
+	counts := countIssues(check(s))
+	if counts[ISSUE_CLUSTER_MISSING] != 1 || counts[ISSUE_CLUSTER_MISMATCH] != 1 || counts[ISSUE_CLUSTER_STALE] != 1 {
+		t.Errorf("Unexpected issues: %v", counts)
+	}
+}
+
+func TestCheckCashpoints(t *testing.T) {
+	s := getTestSnapshot()
+	s.Towns[4] = 2
+	s.Cashpoints = append(s.Cashpoints, Cashpoint{
+		Id: 3, TownId: 5, BankId: 1, Approved: true,
+		Point: cluster.Point{Id: 3, Longitude: 1000.0, Latitude: 1000.0},
+	})
+
+	issues := check(s)
+	counts := countIssues(issues)
+	if counts[ISSUE_TOWN_COUNT_MISMATCH] != 1 || counts[ISSUE_CASHPOINT_UNKNOWN_TOWN] != 1 ||
+		counts[ISSUE_CASHPOINT_UNKNOWN_BANK] != 1 || counts[ISSUE_CASHPOINT_INVALID_COORD] != 1 {
+		t.Errorf("Unexpected issues: %v", counts)
+	}
+
+	for _, issue := range issues {
+		if issue.Type == ISSUE_TOWN_COUNT_MISMATCH && (issue.Expected != uint64(1) || issue.delta != -1) {
+			t.Errorf("Expected town count 1 (delta -1) but got %v (delta %d)", issue.Expected, issue.delta)
+		}
+	}
+}
+
+func TestCheckPatches(t *testing.T) {
+	s := getTestSnapshot()
+	s.Patches[11] = 42
+	s.Votes[101] = 11 // vote of orphan patch
+	s.Votes[102] = 12 // vote of missing patch
+
+	counts := countIssues(check(s))
+	if counts[ISSUE_PATCH_ORPHAN] != 1 || counts[ISSUE_VOTE_ORPHAN] != 2 {
+		t.Errorf("Unexpected issues: %v", counts)
+	}
+}
+
+func TestMakeReport(t *testing.T) {
+	s := getTestSnapshot()
+	issues := []*Issue{
+		{Type: ISSUE_CLUSTER_STALE, QuadKey: "0000000000", Repaired: true},
+		{Type: ISSUE_CASHPOINT_UNKNOWN_BANK, Id: 1},
+	}
+	report := makeReport(s, issues, true)
+	if report.Unrepaired != 1 {
+		t.Errorf("Expected 1 unrepaired issue but got %d", report.Unrepaired)
+	}
+	if report.Counts.Cashpoints != 2 || report.Counts.Votes != 1 {
+		t.Errorf("Unexpected counts: %+v", report.Counts)
+	}
+	if report.Summary[ISSUE_CLUSTER_STALE] != 1 || report.Summary[ISSUE_CASHPOINT_UNKNOWN_BANK] != 1 {
+		t.Errorf("Unexpected summary: %v", report.Summary)
+	}
+}
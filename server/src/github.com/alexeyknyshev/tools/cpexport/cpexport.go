@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/export"
+	"github.com/alexeyknyshev/models"
+	"github.com/tarantool/go-tarantool"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exports cashpoints with bank and town names and decoded schedule into
+// csv, geojson or kml file. Prints export info in json, to stderr if export
+// is written to stdout.
+//
+// Cashpoints are read from tarantool directly or downloaded from
+// /admin/export of cpsrv if url is http(s) one. Download is complete only
+// if X-Export-Status trailer says so.
+//
+// Usage: cpexport [-format csv|geojson|kml] [-town id] [-region id] [-bank id] [-type atm] [-o file]
+//                 [-user name -pass password | -key api_key] <tarantool url | cpsrv url>
+
+func exportTarantool(tntUrl, user, pass, format string, filter export.Filter, w io.Writer) (*export.Info, error) {
+	opts := tarantool.Opts{
+		Reconnect:     1 * time.Second,
+		MaxReconnects: 3,
+		User:          user,
+		Pass:          pass,
+	}
+	tnt, err := tarantool.Connect(tntUrl, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tnt.Close()
+
+	exporter, err := export.New(models.NewRepository(tnt), format, filter)
+	if err != nil {
+		return nil, errors.New("cannot export: " + err.Error())
+	}
+	return exporter.Write(w)
+}
+
+func exportServer(serverUrl, apiKey, format string, filter export.Filter, w io.Writer) (*export.Info, error) {
+	query := url.Values{}
+	query.Set("format", format)
+	for name, id := range map[string]uint32{"town_id": filter.TownId, "region_id": filter.RegionId, "bank_id": filter.BankId} {
+		if id != 0 {
+			query.Set(name, strconv.FormatUint(uint64(id), 10))
+		}
+	}
+	if filter.Type != "" {
+		query.Set("type", filter.Type)
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(serverUrl, "/")+"/admin/export?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("export failed with code %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return nil, err
+	}
+
+	// trailers are known after body is read
+	if status := resp.Trailer.Get(export.STATUS_TRAILER); status != export.STATUS_COMPLETE {
+		return nil, fmt.Errorf("export is incomplete (%s: '%s')", export.STATUS_TRAILER, status)
+	}
+	info := &export.Info{Format: format}
+	info.Cashpoints, err = strconv.Atoi(resp.Trailer.Get(export.COUNT_TRAILER))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s trailer: %v", export.COUNT_TRAILER, err)
+	}
+	return info, nil
+}
+
+func main() {
+	context := "cpexport"
+
+	format := flag.String("format", export.FORMAT_CSV, "export format: csv, geojson or kml")
+	townId := flag.Uint("town", 0, "export cashpoints of town")
+	regionId := flag.Uint("region", 0, "export cashpoints of region")
+	bankId := flag.Uint("bank", 0, "export cashpoints of bank")
+	cpType := flag.String("type", "", "export cashpoints of type")
+	outputPath := flag.String("o", "", "export file path (cashpoints.<format> by default, - for stdout)")
+	user := flag.String("user", os.Getenv("TARANTOOL_USER_NAME"), "tarantool user (TARANTOOL_USER_NAME by default)")
+	pass := flag.String("pass", os.Getenv("TARANTOOL_USER_PASSWORD"), "tarantool password (TARANTOOL_USER_PASSWORD by default)")
+	apiKey := flag.String("key", os.Getenv("CPSRV_API_KEY"), "cpsrv api key with export permission (CPSRV_API_KEY by default)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <tarantool url | cpsrv url>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, ok := export.FORMATS[*format]
+	if !ok {
+		log.Fatalf("%s: unknown format: %s", context, *format)
+	}
+	if *outputPath == "" {
+		*outputPath = "cashpoints." + f.Extension
+	}
+
+	filter := export.Filter{
+		TownId:   uint32(*townId),
+		RegionId: uint32(*regionId),
+		BankId:   uint32(*bankId),
+		Type:     *cpType,
+	}
+
+	var output io.Writer = os.Stdout
+	infoOutput := os.Stdout
+	var file *os.File
+	if *outputPath == "-" {
+		infoOutput = os.Stderr
+	} else {
+		var err error
+		if file, err = os.Create(*outputPath); err != nil {
+			log.Fatalf("%s: %v", context, err)
+		}
+		output = file
+	}
+
+	var info *export.Info
+	var err error
+	if srcUrl := flag.Arg(0); strings.HasPrefix(srcUrl, "http://") || strings.HasPrefix(srcUrl, "https://") {
+		info, err = exportServer(srcUrl, *apiKey, *format, filter, output)
+	} else {
+		info, err = exportTarantool(srcUrl, *user, *pass, *format, filter, output)
+	}
+	// log.Fatalf skips deferred calls, so file is closed before exit
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("%s: %v", context, err)
+		os.Exit(1)
+	}
+
+	infoJson, _ := json.MarshalIndent(info, "", "  ")
+	fmt.Fprintln(infoOutput, string(infoJson))
+}
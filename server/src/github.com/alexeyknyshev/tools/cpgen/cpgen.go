@@ -0,0 +1,589 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/models"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Generates synthetic towns, regions, metro, banks and cashpoints into sqlite
+// databases of server_sqlite_to_tarantool layout (towns.db, cp.db, banks.db).
+// Same seed and sizes give same dataset. Prints dataset counts in json.
+//
+// Usage: cpgen [-n cashpoints] [-towns n] [-banks n] [-seed n] [-o dir]
+//
+// then: server_sqlite_to_tarantool dir/towns.db dir/cp.db dir/banks.db <tarantool url>
+
+type Options struct {
+	Towns      int
+	Banks      int
+	Cashpoints int
+	Seed       int64
+}
+
+type Cashpoint struct {
+	models.CashpointData
+	ScheduleText string // schedule_general of sqlite database
+}
+
+type Dataset struct {
+	Regions    []*models.Region
+	Towns      []*models.Town
+	Metro      []*models.Metro
+	Banks      []*models.Bank
+	Cashpoints []*Cashpoint
+}
+
+type Counts struct {
+	Regions    int `json:"regions"`
+	Towns      int `json:"towns"`
+	Metro      int `json:"metro"`
+	Banks      int `json:"banks"`
+	Partners   int `json:"partners"`
+	Cashpoints int `json:"cashpoints"`
+}
+
+func (d *Dataset) counts() Counts {
+	partners := 0
+	for _, bank := range d.Banks {
+		partners += len(bank.Partners)
+	}
+	return Counts{
+		Regions:    len(d.Regions),
+		Towns:      len(d.Towns),
+		Metro:      len(d.Metro),
+		Banks:      len(d.Banks),
+		Partners:   partners,
+		Cashpoints: len(d.Cashpoints),
+	}
+}
+
+// Names are pairs of russian and transliterated parts
+type name struct {
+	Ru string
+	Tr string
+}
+
+var TOWN_PREFIXES = []name{
+	{"Ново", "Novo"}, {"Старо", "Staro"}, {"Верхне", "Verkhne"}, {"Нижне", "Nizhne"},
+	{"Красно", "Krasno"}, {"Бело", "Belo"}, {"Черно", "Cherno"}, {"Зелено", "Zeleno"},
+	{"Светло", "Svetlo"}, {"Каменно", "Kamenno"}, {"Солне", "Solne"}, {"Лесо", "Leso"},
+}
+
+var TOWN_SUFFIXES = []name{
+	{"горск", "gorsk"}, {"дольск", "dolsk"}, {"речинск", "rechinsk"}, {"полье", "polye"},
+	{"озёрск", "ozyorsk"}, {"град", "grad"}, {"борск", "borsk"}, {"мостовск", "mostovsk"},
+	{"ярск", "yarsk"}, {"водск", "vodsk"},
+}
+
+var BANK_NAMES = []name{
+	{"Сбер", "Sber"}, {"Альфа", "Alfa"}, {"Вега", "Vega"}, {"Орион", "Orion"},
+	{"Заря", "Zarya"}, {"Восток", "Vostok"}, {"Север", "Sever"}, {"Меридиан", "Meridian"},
+	{"Гранит", "Granit"}, {"Прайм", "Praym"}, {"Капитал", "Kapital"}, {"Развитие", "Razvitiye"},
+	{"Союз", "Soyuz"}, {"Держава", "Derzhava"}, {"Визит", "Vizit"}, {"Кредит", "Kredit"},
+}
+
+var STREETS = []string{
+	"ул. Ленина", "ул. Мира", "пр-т Победы", "ул. Садовая", "ул. Советская",
+	"ул. Гагарина", "ул. Пушкина", "наб. Речная", "ул. Школьная", "пр-т Строителей",
+}
+
+var PLACES = []string{"ТЦ «Радуга»", "ТРК «Европа»", "БЦ «Плаза»", "вокзал", "гипермаркет", "поликлиника"}
+
+// Cashpoint types with probabilities
+var CASHPOINT_TYPES = []string{"atm", "office", "branch", "cash"}
+var CASHPOINT_TYPE_WEIGHTS = []float64{0.7, 0.15, 0.1, 0.05}
+
+// Typical schedules of offices and atms inside shops
+var OFFICE_SCHEDULES = []string{
+	"пн.-пт.: 09:00-18:00",
+	"пн.-пт.: 09:00-19:00\nсб.: 10:00-17:00",
+	"пн.-пт.: 10:00-20:00\nсб.-вс.: 10:00-18:00",
+	"пн.-чт.: 09:30-18:00\nпт.: 09:30-16:45",
+}
+
+var SHOP_SCHEDULES = []string{
+	"пн.-вс.: 08:00-22:00",
+	"пн.-вс.: 10:00-22:00",
+	"пн.-сб.: 09:00-21:00\nвс.: 10:00-20:00",
+	"пн.-вс.: 07:00-23:00",
+}
+
+const ROUND_THE_CLOCK_SCHEDULE = "пн.-вс.: круглосуточно"
+
+// Town with population above has metro
+const METRO_MIN_POPULATION = 1000000
+
+const KM_PER_DEGREE = 111.0
+
+type Generator struct {
+	r       *rand.Rand
+	opts    Options
+	dataset *Dataset
+
+	bankWeights []float64
+	townWeights []float64
+	townMetro   map[uint32][]*models.Metro
+}
+
+func newGenerator(opts Options) *Generator {
+	return &Generator{
+		r:         rand.New(rand.NewSource(opts.Seed)),
+		opts:      opts,
+		dataset:   &Dataset{},
+		townMetro: make(map[uint32][]*models.Metro),
+	}
+}
+
+func (g *Generator) chance(p float64) bool {
+	return g.r.Float64() < p
+}
+
+// Index of weights picked proportionally to weight
+func (g *Generator) pick(weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	v := g.r.Float64() * total
+	for i, w := range weights {
+		if v < w {
+			return i
+		}
+		v -= w
+	}
+	return len(weights) - 1
+}
+
+// Point at normally distributed distance (sigma in km) from centre
+func (g *Generator) near(lon, lat, sigmaKm float64) (float64, float64) {
+	dLat := g.r.NormFloat64() * sigmaKm / KM_PER_DEGREE
+	dLon := g.r.NormFloat64() * sigmaKm / (KM_PER_DEGREE * math.Cos(lat*math.Pi/180))
+	return lon + dLon, lat + dLat
+}
+
+func (g *Generator) uniqueName(used map[string]int, n name) name {
+	used[n.Ru]++
+	if count := used[n.Ru]; count > 1 {
+		suffix := "-" + strconv.Itoa(count)
+		return name{n.Ru + suffix, n.Tr + suffix}
+	}
+	return n
+}
+
+// Towns grouped by regions around european part of Russia. First town of
+// every region is its centre, first town of dataset is the biggest one.
+func (g *Generator) generateTowns() {
+	regionsCount := (g.opts.Towns + 4) / 5
+	used := make(map[string]int)
+
+	for i := 0; i < g.opts.Towns; i++ {
+		prefix := TOWN_PREFIXES[g.r.Intn(len(TOWN_PREFIXES))]
+		suffix := TOWN_SUFFIXES[g.r.Intn(len(TOWN_SUFFIXES))]
+		townName := g.uniqueName(used, name{prefix.Ru + suffix.Ru, prefix.Tr + suffix.Tr})
+
+		regionIdx := i % regionsCount
+		var population uint32
+		if i == 0 {
+			population = 12000000
+		} else {
+			// log-uniform from 10 thousands to 3 millions
+			population = uint32(math.Exp(math.Log(1e4) + g.r.Float64()*(math.Log(3e6)-math.Log(1e4))))
+		}
+
+		town := &models.Town{
+			Id:         uint32(i + 1),
+			Name:       townName.Ru,
+			NameTr:     townName.Tr,
+			RegionId:   uint32(regionIdx + 1),
+			Population: population,
+			Big:        population >= 500000,
+		}
+		switch {
+		case population >= METRO_MIN_POPULATION:
+			town.Zoom = 10
+		case population >= 300000:
+			town.Zoom = 11
+		default:
+			town.Zoom = 12
+		}
+
+		if i < regionsCount {
+			town.RegionalCenter = true
+			town.Longitude = 30 + g.r.Float64()*30
+			town.Latitude = 45 + g.r.Float64()*15
+			g.dataset.Regions = append(g.dataset.Regions, &models.Region{
+				Id:        town.RegionId,
+				Name:      "Область " + town.Name,
+				NameTr:    town.NameTr + " oblast",
+				Longitude: town.Longitude,
+				Latitude:  town.Latitude,
+				Zoom:      8,
+			})
+		} else {
+			center := g.dataset.Towns[regionIdx]
+			town.Longitude, town.Latitude = g.near(center.Longitude, center.Latitude, 80)
+		}
+
+		g.dataset.Towns = append(g.dataset.Towns, town)
+		g.townWeights = append(g.townWeights, float64(population))
+	}
+}
+
+// Straight lines crossing centres of big towns
+func (g *Generator) generateMetro() {
+	var branchId uint32
+	for _, town := range g.dataset.Towns {
+		if town.Population < METRO_MIN_POPULATION {
+			continue
+		}
+		town.HasMetro = true
+
+		lines := 3 + g.r.Intn(6)
+		for l := 0; l < lines; l++ {
+			branchId++
+			angle := g.r.Float64() * math.Pi
+			stations := 8 + g.r.Intn(13)
+			stepKm := 1.0 + g.r.Float64()
+			for s := 0; s < stations; s++ {
+				distKm := (float64(s) - float64(stations)/2) * stepKm
+				lat := town.Latitude + distKm*math.Sin(angle)/KM_PER_DEGREE
+				lon := town.Longitude + distKm*math.Cos(angle)/(KM_PER_DEGREE*math.Cos(town.Latitude*math.Pi/180))
+
+				metro := &models.Metro{
+					Id:              uint32(len(g.dataset.Metro) + 1),
+					Longitude:       lon,
+					Latitude:        lat,
+					TownId:          town.Id,
+					BranchId:        branchId,
+					StationName:     fmt.Sprintf("Станция %d-%d", l+1, s+1),
+					StationExitName: "вход-выход " + strconv.Itoa(1+g.r.Intn(4)),
+				}
+				g.dataset.Metro = append(g.dataset.Metro, metro)
+				g.townMetro[town.Id] = append(g.townMetro[town.Id], metro)
+			}
+		}
+	}
+}
+
+// Few big banks own most cashpoints (weight 1/rank). Partner networks are
+// groups of banks, every bank of group is partner of the others.
+func (g *Generator) generateBanks() {
+	used := make(map[string]int)
+	capital := g.dataset.Towns[0].Name
+
+	for i := 0; i < g.opts.Banks; i++ {
+		bankName := g.uniqueName(used, BANK_NAMES[g.r.Intn(len(BANK_NAMES))])
+		bank := &models.Bank{
+			Id:        uint32(i + 1),
+			Name:      bankName.Ru + "банк",
+			NameTr:    bankName.Tr + "bank",
+			NameTrAlt: bankName.Tr + "bank",
+			Partners:  []uint32{},
+			Town:      capital,
+			Licence:   uint32(1000 + i*7),
+			Rating:    uint32(i + 1),
+			Tel:       fmt.Sprintf("8800%07d", g.r.Intn(10000000)),
+		}
+		g.dataset.Banks = append(g.dataset.Banks, bank)
+		g.bankWeights = append(g.bankWeights, 1/float64(i+1))
+	}
+
+	// about half of banks are members of networks of 3-6 banks
+	members := g.r.Perm(len(g.dataset.Banks))
+	members = members[:len(members)/2]
+	for len(members) >= 3 {
+		size := 3 + g.r.Intn(4)
+		if size > len(members) {
+			size = len(members)
+		}
+		group := members[:size]
+		members = members[size:]
+		for _, i := range group {
+			for _, j := range group {
+				if i != j {
+					g.dataset.Banks[i].Partners = append(g.dataset.Banks[i].Partners, g.dataset.Banks[j].Id)
+				}
+			}
+		}
+	}
+}
+
+func (g *Generator) generateSchedule(cp *Cashpoint) {
+	switch {
+	case cp.RoundTheClock:
+		cp.ScheduleText = ROUND_THE_CLOCK_SCHEDULE
+	case g.chance(0.1):
+		cp.ScheduleText = "" // unknown
+	case cp.Type == "atm" && cp.WorksAsShop:
+		cp.ScheduleText = SHOP_SCHEDULES[g.r.Intn(len(SHOP_SCHEDULES))]
+	default:
+		cp.ScheduleText = OFFICE_SCHEDULES[g.r.Intn(len(OFFICE_SCHEDULES))]
+	}
+
+	schedule, _ := models.ParseSchedule(cp.ScheduleText)
+	cp.WithoutWeekend = schedule.Sat != nil && schedule.Sun != nil
+}
+
+// Cashpoints are spread over towns by population, around town centre
+// and metro stations
+func (g *Generator) generateCashpoint(id uint32) *Cashpoint {
+	town := g.dataset.Towns[g.pick(g.townWeights)]
+	bank := g.dataset.Banks[g.pick(g.bankWeights)]
+
+	cp := &Cashpoint{}
+	cp.Id = id
+	cp.TownId = town.Id
+	cp.BankId = bank.Id
+	cp.Type = CASHPOINT_TYPES[g.pick(CASHPOINT_TYPE_WEIGHTS)]
+
+	stations := g.townMetro[town.Id]
+	if len(stations) > 0 && g.chance(0.4) {
+		station := stations[g.r.Intn(len(stations))]
+		cp.Longitude, cp.Latitude = g.near(station.Longitude, station.Latitude, 0.3)
+		cp.MetroName = station.StationName
+	} else {
+		sigmaKm := 1 + 10*math.Sqrt(float64(town.Population)/12e6)
+		cp.Longitude, cp.Latitude = g.near(town.Longitude, town.Latitude, sigmaKm)
+	}
+
+	cp.Address = fmt.Sprintf("г. %s, %s, д. %d", town.Name, STREETS[g.r.Intn(len(STREETS))], 1+g.r.Intn(150))
+	if g.chance(0.2) {
+		cp.AddressComment = PLACES[g.r.Intn(len(PLACES))]
+	}
+
+	cp.Currency = []uint32{models.CURRENCY_RUB}
+	if cp.Type == "atm" {
+		cp.FreeAccess = g.chance(0.7)
+		cp.WorksAsShop = g.chance(0.3)
+		cp.RoundTheClock = g.chance(0.4)
+		cp.CashIn = g.chance(0.3)
+		if g.chance(0.1) {
+			cp.Currency = append(cp.Currency, models.CURRENCY_USD)
+		}
+		if g.chance(0.05) {
+			cp.Currency = append(cp.Currency, models.CURRENCY_EUR)
+		}
+	} else {
+		cp.FreeAccess = true
+		cp.CashIn = true
+		cp.MainOffice = cp.Type == "office" && g.chance(0.02)
+		cp.Tel = bank.Tel
+		if g.chance(0.6) {
+			cp.Currency = append(cp.Currency, models.CURRENCY_USD)
+		}
+		if g.chance(0.5) {
+			cp.Currency = append(cp.Currency, models.CURRENCY_EUR)
+		}
+	}
+	g.generateSchedule(cp)
+	return cp
+}
+
+func (g *Generator) generate() *Dataset {
+	g.generateTowns()
+	g.generateMetro()
+	g.generateBanks()
+	for i := 0; i < g.opts.Cashpoints; i++ {
+		g.dataset.Cashpoints = append(g.dataset.Cashpoints, g.generateCashpoint(uint32(i+1)))
+	}
+	return g.dataset
+}
+
+func generate(opts Options) *Dataset {
+	return newGenerator(opts).generate()
+}
+
+// ======================================================================
+// Sqlite
+
+const TOWNS_SCHEMA = `
+DROP TABLE IF EXISTS regions;
+DROP TABLE IF EXISTS towns;
+DROP TABLE IF EXISTS metro;
+DROP TABLE IF EXISTS tr;
+CREATE TABLE regions (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT,
+                      latitude REAL, longitude REAL, zoom INTEGER);
+CREATE TABLE towns (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT, region_id INTEGER,
+                    regional_center INTEGER, latitude REAL, longitude REAL, zoom INTEGER,
+                    has_emblem INTEGER, population INTEGER);
+CREATE TABLE metro (id INTEGER PRIMARY KEY AUTOINCREMENT, latitude REAL, longitude REAL,
+                    town_id INTEGER, branch_id INTEGER, name TEXT, ext TEXT);
+CREATE TABLE tr (msg TEXT, ru TEXT, en TEXT);`
+
+const CASHPOINTS_SCHEMA = `
+DROP TABLE IF EXISTS cashpoints;
+CREATE TABLE cashpoints (id INTEGER PRIMARY KEY, type TEXT, bank_id INTEGER, town_id INTEGER,
+                         longitude REAL, latitude REAL, address TEXT, address_comment TEXT,
+                         metro_name TEXT, free_access INTEGER, main_office INTEGER,
+                         without_weekend INTEGER, round_the_clock INTEGER, works_as_shop INTEGER,
+                         schedule_general TEXT, tel TEXT, additional TEXT,
+                         rub INTEGER, usd INTEGER, eur INTEGER, cash_in INTEGER, hidden INTEGER);
+CREATE INDEX cashpoints_town_id ON cashpoints (town_id);`
+
+const BANKS_SCHEMA = `
+DROP TABLE IF EXISTS banks;
+DROP TABLE IF EXISTS partners;
+CREATE TABLE banks (id INTEGER PRIMARY KEY, name TEXT, name_tr TEXT, name_tr_alt TEXT,
+                    town TEXT, licence INTEGER, rating INTEGER, tel TEXT);
+CREATE TABLE partners (id INTEGER, partner_id INTEGER);`
+
+// Creates schema and runs inserts in one transaction
+func writeDb(path, schema string, insert func(tx *sql.Tx) error) error {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	err = insert(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Runs prepared statement for every row
+func insertRows(tx *sql.Tx, query string, count int, row func(i int) []interface{}) error {
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < count; i++ {
+		_, err = stmt.Exec(row(i)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTownsDb(path string, d *Dataset) error {
+	return writeDb(path, TOWNS_SCHEMA, func(tx *sql.Tx) error {
+		err := insertRows(tx, `INSERT INTO regions VALUES (?, ?, ?, ?, ?, ?)`, len(d.Regions), func(i int) []interface{} {
+			r := d.Regions[i]
+			return []interface{}{r.Id, r.Name, r.NameTr, r.Latitude, r.Longitude, r.Zoom}
+		})
+		if err != nil {
+			return err
+		}
+		err = insertRows(tx, `INSERT INTO towns VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, len(d.Towns), func(i int) []interface{} {
+			t := d.Towns[i]
+			return []interface{}{t.Id, t.Name, t.NameTr, t.RegionId, t.RegionalCenter,
+				t.Latitude, t.Longitude, t.Zoom, t.Big, t.Population}
+		})
+		if err != nil {
+			return err
+		}
+		return insertRows(tx, `INSERT INTO metro VALUES (?, ?, ?, ?, ?, ?, ?)`, len(d.Metro), func(i int) []interface{} {
+			m := d.Metro[i]
+			return []interface{}{m.Id, m.Latitude, m.Longitude, m.TownId, m.BranchId, m.StationName, m.StationExitName}
+		})
+	})
+}
+
+func writeCashpointsDb(path string, d *Dataset) error {
+	return writeDb(path, CASHPOINTS_SCHEMA, func(tx *sql.Tx) error {
+		query := `INSERT INTO cashpoints VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,
+		                                         ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`
+		return insertRows(tx, query, len(d.Cashpoints), func(i int) []interface{} {
+			cp := d.Cashpoints[i]
+			return []interface{}{cp.Id, cp.Type, cp.BankId, cp.TownId,
+				cp.Longitude, cp.Latitude, cp.Address, cp.AddressComment,
+				cp.MetroName, cp.FreeAccess, cp.MainOffice,
+				cp.WithoutWeekend, cp.RoundTheClock, cp.WorksAsShop,
+				cp.ScheduleText, cp.Tel, cp.Additional,
+				cp.HasCurrency(models.CURRENCY_RUB), cp.HasCurrency(models.CURRENCY_USD),
+				cp.HasCurrency(models.CURRENCY_EUR), cp.CashIn}
+		})
+	})
+}
+
+func writeBanksDb(path string, d *Dataset) error {
+	return writeDb(path, BANKS_SCHEMA, func(tx *sql.Tx) error {
+		err := insertRows(tx, `INSERT INTO banks VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, len(d.Banks), func(i int) []interface{} {
+			b := d.Banks[i]
+			return []interface{}{b.Id, b.Name, b.NameTr, b.NameTrAlt, b.Town, b.Licence, b.Rating, b.Tel}
+		})
+		if err != nil {
+			return err
+		}
+
+		stmt, err := tx.Prepare(`INSERT INTO partners VALUES (?, ?)`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, bank := range d.Banks {
+			for _, partnerId := range bank.Partners {
+				_, err = stmt.Exec(bank.Id, partnerId)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func writeDataset(dir string, d *Dataset) error {
+	err := writeTownsDb(filepath.Join(dir, "towns.db"), d)
+	if err != nil {
+		return err
+	}
+	err = writeCashpointsDb(filepath.Join(dir, "cp.db"), d)
+	if err != nil {
+		return err
+	}
+	return writeBanksDb(filepath.Join(dir, "banks.db"), d)
+}
+
+func main() {
+	context := "cpgen"
+
+	opts := Options{}
+	flag.IntVar(&opts.Cashpoints, "n", 10000, "number of cashpoints")
+	flag.IntVar(&opts.Towns, "towns", 100, "number of towns")
+	flag.IntVar(&opts.Banks, "banks", 50, "number of banks")
+	flag.Int64Var(&opts.Seed, "seed", 1, "random seed")
+	outputDir := flag.String("o", ".", "output directory of towns.db, cp.db and banks.db")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 || opts.Towns < 1 || opts.Banks < 1 || opts.Cashpoints < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	dataset := generate(opts)
+	err := writeDataset(*outputDir, dataset)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	countsJson, _ := json.MarshalIndent(dataset.counts(), "", "  ")
+	fmt.Println(string(countsJson))
+}
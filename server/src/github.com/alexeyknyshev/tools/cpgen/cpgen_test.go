@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/alexeyknyshev/models"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var TEST_OPTIONS = Options{Towns: 12, Banks: 10, Cashpoints: 2000, Seed: 42}
+
+func TestGenerateDeterministic(t *testing.T) {
+	d1 := generate(TEST_OPTIONS)
+	d2 := generate(TEST_OPTIONS)
+	if !reflect.DeepEqual(d1, d2) {
+		t.Errorf("Expected same dataset of same seed")
+	}
+
+	opts := TEST_OPTIONS
+	opts.Seed++
+	if reflect.DeepEqual(d1.Cashpoints, generate(opts).Cashpoints) {
+		t.Errorf("Expected different cashpoints of different seed")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	d := generate(TEST_OPTIONS)
+
+	counts := d.counts()
+	if counts.Towns != 12 || counts.Regions != 3 || counts.Banks != 10 || counts.Cashpoints != 2000 {
+		t.Fatalf("Unexpected counts %+v", counts)
+	}
+	if counts.Partners == 0 {
+		t.Errorf("Expected partner networks")
+	}
+	if counts.Metro == 0 || !d.Towns[0].HasMetro {
+		t.Errorf("Expected metro in the biggest town")
+	}
+
+	towns := make(map[uint32]*models.Town)
+	for _, town := range d.Towns {
+		towns[town.Id] = town
+	}
+	banks := make(map[uint32]*models.Bank)
+	for _, bank := range d.Banks {
+		banks[bank.Id] = bank
+	}
+
+	for _, bank := range d.Banks {
+		for _, partnerId := range bank.Partners {
+			partner := banks[partnerId]
+			if partner == nil || partnerId == bank.Id {
+				t.Fatalf("Unexpected partner %d of bank %d", partnerId, bank.Id)
+			}
+			found := false
+			for _, id := range partner.Partners {
+				found = found || id == bank.Id
+			}
+			if !found {
+				t.Errorf("Expected bank %d to be partner of its partner %d", bank.Id, partnerId)
+			}
+		}
+	}
+
+	types := make(map[string]int)
+	for _, cp := range d.Cashpoints {
+		types[cp.Type]++
+		town := towns[cp.TownId]
+		if town == nil || banks[cp.BankId] == nil {
+			t.Fatalf("Cashpoint %d references unknown town or bank", cp.Id)
+		}
+		if math.Abs(cp.Longitude-town.Longitude) > 2 || math.Abs(cp.Latitude-town.Latitude) > 1 {
+			t.Errorf("Cashpoint %d is too far from its town", cp.Id)
+		}
+
+		schedule, err := models.ParseSchedule(cp.ScheduleText)
+		if err != nil {
+			t.Fatalf("Cannot parse schedule of cashpoint %d: %v", cp.Id, err)
+		}
+		if cp.RoundTheClock && (schedule.Sun == nil || schedule.Sun.From != 0 || schedule.Sun.To != 1439) {
+			t.Errorf("Expected round the clock schedule of cashpoint %d", cp.Id)
+		}
+		if !cp.HasCurrency(models.CURRENCY_RUB) {
+			t.Errorf("Expected rub currency of cashpoint %d", cp.Id)
+		}
+	}
+	for _, cpType := range CASHPOINT_TYPES {
+		if types[cpType] == 0 {
+			t.Errorf("Expected cashpoints of type %s", cpType)
+		}
+	}
+}
+
+// Reads databases by queries of server_sqlite_to_tarantool
+func TestWriteDataset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cpgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := generate(TEST_OPTIONS)
+	err = writeDataset(dir, d)
+	if err != nil {
+		t.Fatalf("writeDataset failed: %v", err)
+	}
+	// rewriting replaces previous dataset
+	err = writeDataset(dir, d)
+	if err != nil {
+		t.Fatalf("writeDataset failed on existing databases: %v", err)
+	}
+
+	open := func(name string) *sql.DB {
+		db, err := sql.Open("sqlite3", filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	townsDb := open("towns.db")
+	defer townsDb.Close()
+	cpDb := open("cp.db")
+	defer cpDb.Close()
+	banksDb := open("banks.db")
+	defer banksDb.Close()
+
+	var town models.Town
+	var population interface{}
+	err = townsDb.QueryRow(`SELECT id, name, name_tr, region_id,
+	                               regional_center, latitude,
+	                               longitude, zoom, has_emblem, population FROM towns WHERE id = 1`).Scan(
+		&town.Id, &town.Name, &town.NameTr, &town.RegionId, &town.RegionalCenter,
+		&town.Latitude, &town.Longitude, &town.Zoom, &town.Big, &population)
+	if err != nil {
+		t.Fatalf("Cannot read town: %v", err)
+	}
+	expected := *d.Towns[0]
+	expected.Population = 0
+	expected.HasMetro = false
+	if !reflect.DeepEqual(town, expected) || population != int64(d.Towns[0].Population) {
+		t.Errorf("Expected town %+v but got %+v (population %v)", expected, town, population)
+	}
+
+	var count int
+	err = townsDb.QueryRow(`SELECT COUNT(*) FROM metro`).Scan(&count)
+	if err != nil || count != len(d.Metro) {
+		t.Errorf("Expected %d metro stations but got %d (%v)", len(d.Metro), count, err)
+	}
+	rows, err := townsDb.Query(`SELECT * FROM tr`)
+	if err != nil {
+		t.Errorf("Cannot read messages: %v", err)
+	} else {
+		rows.Close()
+	}
+
+	var cp models.Cashpoint
+	var schedule string
+	var rub, usd, eur bool
+	err = cpDb.QueryRow(`SELECT id, type, bank_id, town_id,
+	                            longitude, latitude,
+	                            address, address_comment,
+	                            metro_name, free_access,
+	                            main_office, without_weekend,
+	                            round_the_clock, works_as_shop,
+	                            schedule_general, tel, additional,
+	                            rub, usd, eur, cash_in FROM cashpoints WHERE hidden = 0 AND id = 1`).Scan(
+		&cp.Id, &cp.Type, &cp.BankId, &cp.TownId,
+		&cp.Longitude, &cp.Latitude,
+		&cp.Address, &cp.AddressComment,
+		&cp.MetroName, &cp.FreeAccess,
+		&cp.MainOffice, &cp.WithoutWeekend,
+		&cp.RoundTheClock, &cp.WorksAsShop,
+		&schedule, &cp.Tel, &cp.Additional,
+		&rub, &usd, &eur, &cp.CashIn)
+	if err != nil {
+		t.Fatalf("Cannot read cashpoint: %v", err)
+	}
+	cp.Currency = models.CurrencyFromFlags(rub, usd, eur)
+	if !reflect.DeepEqual(cp.CashpointData, d.Cashpoints[0].CashpointData) || schedule != d.Cashpoints[0].ScheduleText {
+		t.Errorf("Expected cashpoint %+v but got %+v", d.Cashpoints[0], cp)
+	}
+
+	err = banksDb.QueryRow(`SELECT COUNT(*) FROM partners`).Scan(&count)
+	if err != nil || count != d.counts().Partners {
+		t.Errorf("Expected %d partners but got %d (%v)", d.counts().Partners, count, err)
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/models"
+	"github.com/tarantool/go-tarantool"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replays mix of client requests against cpsrv: map viewports over town
+// centres, nearby cashpoints with random filters and batch fetches.
+// Prints latency percentiles and error rates per endpoint in json,
+// exits with 1 if any endpoint exceeds given thresholds.
+//
+// Usage: cpload [options] <cpsrv url>
+
+const ENDPOINT_CLUSTERS = "POST /nearby/clusters"
+const ENDPOINT_CASHPOINTS = "POST /nearby/cashpoints"
+const ENDPOINT_CASHPOINTS_BATCH = "POST /cashpoints"
+const ENDPOINT_TOWNS_BATCH = "POST /towns"
+const ENDPOINT_BANKS_BATCH = "POST /banks"
+
+// Limits of cpsrv api
+const NEARBY_MAX_COORD_DELTA = 0.02
+const MAX_TOWNS_BATCH_SIZE = 1024
+const MAX_ZOOM = 22
+
+// Phone screen in map tiles (about 1080x1920 px)
+const VIEWPORT_WIDTH = 4.0
+const VIEWPORT_HEIGHT = 7.5
+
+const MAX_BATCH_SIZE = 32
+
+// Nearby cashpoints ids remembered for batch requests
+const ID_POOL_SIZE = 4096
+
+var CASHPOINT_TYPES = []string{"atm", "office", "branch", "cash"}
+var CURRENCIES = []uint32{models.CURRENCY_RUB, models.CURRENCY_USD, models.CURRENCY_EUR}
+
+type Coord struct {
+	Longitude float64 `json:"longitude"`
+	Latitude  float64 `json:"latitude"`
+}
+
+type NearbyRequest struct {
+	TopLeft     Coord                  `json:"topLeft"`
+	BottomRight Coord                  `json:"bottomRight"`
+	Zoom        *uint32                `json:"zoom,omitempty"`
+	Filter      map[string]interface{} `json:"filter,omitempty"`
+}
+
+type LoadRequest struct {
+	Endpoint string
+	Method   string
+	Path     string
+	Body     interface{}
+
+	// called with body of successful response
+	onResponse func(data []byte)
+}
+
+// Ids seen in responses, replaced at random when pool is full
+type IdPool struct {
+	mutex sync.Mutex
+	ids   []uint32
+}
+
+func (p *IdPool) add(ids []uint32, r *rand.Rand) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, id := range ids {
+		if len(p.ids) < ID_POOL_SIZE {
+			p.ids = append(p.ids, id)
+		} else {
+			p.ids[r.Intn(len(p.ids))] = id
+		}
+	}
+}
+
+func (p *IdPool) sample(n int, r *rand.Rand) []uint32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.ids) == 0 {
+		return nil
+	}
+	result := make([]uint32, n)
+	for i := range result {
+		result[i] = p.ids[r.Intn(len(p.ids))]
+	}
+	return result
+}
+
+type Workload struct {
+	Towns      []*models.Town
+	Banks      []uint32
+	Cashpoints IdPool
+}
+
+type Scenario func(w *Workload, r *rand.Rand) *LoadRequest
+
+var SCENARIOS = map[string]Scenario{
+	"clusters":   clustersRequest,
+	"cashpoints": cashpointsRequest,
+	"batch":      batchRequest,
+}
+
+// ======================================================================
+// Requests
+
+func clamp(v, min, max float64) float64 {
+	return math.Max(min, math.Min(max, v))
+}
+
+// Region of given size in degrees around point
+func getRegion(lon, lat, lonSpan, latSpan float64) (Coord, Coord) {
+	topLeft := Coord{
+		Longitude: clamp(lon-lonSpan/2, -180, 180),
+		Latitude:  clamp(lat+latSpan/2, -85, 85),
+	}
+	bottomRight := Coord{
+		Longitude: clamp(lon+lonSpan/2, -180, 180),
+		Latitude:  clamp(lat-latSpan/2, -85, 85),
+	}
+	return topLeft, bottomRight
+}
+
+// Size of phone screen in degrees at map zoom
+func getViewportSpan(lat float64, zoom uint32) (float64, float64) {
+	lonSpan := 360.0 * VIEWPORT_WIDTH / math.Pow(2, float64(zoom))
+	latSpan := lonSpan * VIEWPORT_HEIGHT / VIEWPORT_WIDTH * math.Cos(lat*math.Pi/180)
+	return lonSpan, latSpan
+}
+
+func randomTown(w *Workload, r *rand.Rand) *models.Town {
+	return w.Towns[r.Intn(len(w.Towns))]
+}
+
+// Zoom from whole town to street level
+func randomZoom(town *models.Town, r *rand.Rand) uint32 {
+	minZoom := int(town.Zoom) - 2
+	if minZoom < 0 {
+		minZoom = 0
+	}
+	maxZoom := 17
+	if minZoom > maxZoom {
+		minZoom = maxZoom
+	}
+	return uint32(minZoom + r.Intn(maxZoom-minZoom+1))
+}
+
+func randomFilter(w *Workload, r *rand.Rand) map[string]interface{} {
+	filter := make(map[string]interface{})
+	if len(w.Banks) > 0 && r.Intn(3) == 0 {
+		ids := make([]uint32, 1+r.Intn(3))
+		for i := range ids {
+			ids[i] = w.Banks[r.Intn(len(w.Banks))]
+		}
+		filter["bank_id"] = ids
+	}
+	if r.Intn(4) == 0 {
+		filter["type"] = CASHPOINT_TYPES[r.Intn(len(CASHPOINT_TYPES))]
+	}
+	for _, name := range []string{"free_access", "round_the_clock", "without_weekend", "cash_in"} {
+		if r.Intn(6) == 0 {
+			filter[name] = r.Intn(2) == 0
+		}
+	}
+	if r.Intn(4) == 0 {
+		filter["currency"] = []uint32{CURRENCIES[r.Intn(len(CURRENCIES))]}
+	}
+	if r.Intn(5) == 0 {
+		filter["schedule"] = map[string]interface{}{
+			"time":  time.Now().Unix(),
+			"delta": r.Intn(5) * 15 * 60,
+		}
+	}
+	if len(filter) == 0 {
+		return nil
+	}
+	return filter
+}
+
+// Map viewport somewhere in town
+func clustersRequest(w *Workload, r *rand.Rand) *LoadRequest {
+	town := randomTown(w, r)
+	zoom := randomZoom(town, r)
+	lonSpan, latSpan := getViewportSpan(town.Latitude, zoom)
+	lon := town.Longitude + (r.Float64()-0.5)*math.Min(lonSpan, 0.2)
+	lat := town.Latitude + (r.Float64()-0.5)*math.Min(latSpan, 0.1)
+
+	req := &NearbyRequest{Zoom: &zoom}
+	req.TopLeft, req.BottomRight = getRegion(lon, lat, lonSpan, latSpan)
+	return &LoadRequest{Endpoint: ENDPOINT_CLUSTERS, Method: "POST", Path: "/nearby/clusters", Body: req}
+}
+
+// Street level region near town centre with random filter
+func cashpointsRequest(w *Workload, r *rand.Rand) *LoadRequest {
+	town := randomTown(w, r)
+	lon := town.Longitude + (r.Float64()-0.5)*0.1
+	lat := town.Latitude + (r.Float64()-0.5)*0.1
+	lonSpan := NEARBY_MAX_COORD_DELTA * (0.25 + 0.75*r.Float64())
+	latSpan := lonSpan * VIEWPORT_HEIGHT / VIEWPORT_WIDTH * math.Cos(lat*math.Pi/180)
+	if latSpan > NEARBY_MAX_COORD_DELTA {
+		latSpan = NEARBY_MAX_COORD_DELTA
+	}
+
+	req := &NearbyRequest{Filter: randomFilter(w, r)}
+	req.TopLeft, req.BottomRight = getRegion(lon, lat, lonSpan, latSpan)
+	return &LoadRequest{
+		Endpoint: ENDPOINT_CASHPOINTS,
+		Method:   "POST",
+		Path:     "/nearby/cashpoints",
+		Body:     req,
+		onResponse: func(data []byte) {
+			var ids []uint32
+			if json.Unmarshal(data, &ids) == nil {
+				w.Cashpoints.add(ids, r)
+			}
+		},
+	}
+}
+
+// Cashpoints seen in nearby responses, towns or banks by id
+func batchRequest(w *Workload, r *rand.Rand) *LoadRequest {
+	size := 1 + r.Intn(MAX_BATCH_SIZE)
+	kind := r.Intn(3)
+	if kind == 0 {
+		if ids := w.Cashpoints.sample(size, r); ids != nil {
+			return &LoadRequest{Endpoint: ENDPOINT_CASHPOINTS_BATCH, Method: "POST", Path: "/cashpoints", Body: map[string][]uint32{"cashpoints": ids}}
+		}
+		kind = 1 + r.Intn(2)
+	}
+	if kind == 2 && len(w.Banks) > 0 {
+		ids := make([]uint32, size)
+		for i := range ids {
+			ids[i] = w.Banks[r.Intn(len(w.Banks))]
+		}
+		return &LoadRequest{Endpoint: ENDPOINT_BANKS_BATCH, Method: "POST", Path: "/banks", Body: map[string][]uint32{"banks": ids}}
+	}
+	ids := make([]uint32, size)
+	for i := range ids {
+		ids[i] = randomTown(w, r).Id
+	}
+	return &LoadRequest{Endpoint: ENDPOINT_TOWNS_BATCH, Method: "POST", Path: "/towns", Body: map[string][]uint32{"towns": ids}}
+}
+
+// Parses weights like "clusters=5,cashpoints=3,batch=2"
+func parseMix(mix string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, part := range strings.Split(mix, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if _, ok := SCENARIOS[kv[0]]; !ok {
+			return nil, errors.New("unknown scenario '" + kv[0] + "'")
+		}
+		weight := 1
+		if len(kv) == 2 {
+			w, err := strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return nil, errors.New("invalid weight of scenario '" + kv[0] + "'")
+			}
+			weight = int(w)
+		}
+		weights[kv[0]] = weight
+	}
+
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.New("empty scenarios mix")
+	}
+	return weights, nil
+}
+
+// Picks scenarios at random proportionally to weights
+type Mixer struct {
+	scenarios []Scenario
+	weights   []int
+	total     int
+}
+
+func newMixer(weights map[string]int) *Mixer {
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	m := &Mixer{}
+	for _, name := range names {
+		m.scenarios = append(m.scenarios, SCENARIOS[name])
+		m.weights = append(m.weights, weights[name])
+		m.total += weights[name]
+	}
+	return m
+}
+
+func (m *Mixer) pick(r *rand.Rand) Scenario {
+	n := r.Intn(m.total)
+	for i, weight := range m.weights {
+		if n < weight {
+			return m.scenarios[i]
+		}
+		n -= weight
+	}
+	return m.scenarios[len(m.scenarios)-1]
+}
+
+// ======================================================================
+// Stats
+
+type durationList []time.Duration
+
+func (l durationList) Len() int           { return len(l) }
+func (l durationList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l durationList) Less(i, j int) bool { return l[i] < l[j] }
+
+type EndpointStats struct {
+	Latencies durationList
+	Errors    int
+	Codes     map[int]int // 0 for transport errors
+}
+
+type Stats struct {
+	mutex     sync.Mutex
+	endpoints map[string]*EndpointStats
+}
+
+func newStats() *Stats {
+	return &Stats{endpoints: make(map[string]*EndpointStats)}
+}
+
+func (s *Stats) add(endpoint string, latency time.Duration, code int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, ok := s.endpoints[endpoint]
+	if !ok {
+		stats = &EndpointStats{Codes: make(map[int]int)}
+		s.endpoints[endpoint] = stats
+	}
+	stats.Latencies = append(stats.Latencies, latency)
+	stats.Codes[code]++
+	if code != http.StatusOK {
+		stats.Errors++
+	}
+}
+
+// Nearest rank percentile of sorted latencies
+func percentile(sorted durationList, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type EndpointReport struct {
+	Endpoint  string         `json:"endpoint"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	ErrorRate float64        `json:"error_rate"`
+	Rps       float64        `json:"rps"`
+	P50       float64        `json:"p50_ms"`
+	P95       float64        `json:"p95_ms"`
+	P99       float64        `json:"p99_ms"`
+	Max       float64        `json:"max_ms"`
+	Codes     map[string]int `json:"codes"`
+}
+
+type Report struct {
+	Timestamp   string            `json:"timestamp"`
+	Url         string            `json:"url"`
+	Duration    string            `json:"duration"`
+	Concurrency int               `json:"concurrency"`
+	Endpoints   []*EndpointReport `json:"endpoints"`
+	Violations  []string          `json:"violations"`
+}
+
+func (s *Stats) report(elapsed time.Duration) []*EndpointReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0, len(s.endpoints))
+	for name := range s.endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make([]*EndpointReport, 0, len(names))
+	for _, name := range names {
+		stats := s.endpoints[name]
+		sorted := make(durationList, len(stats.Latencies))
+		copy(sorted, stats.Latencies)
+		sort.Sort(sorted)
+
+		codes := make(map[string]int)
+		for code, count := range stats.Codes {
+			codes[strconv.Itoa(code)] = count
+		}
+
+		result = append(result, &EndpointReport{
+			Endpoint:  name,
+			Requests:  len(sorted),
+			Errors:    stats.Errors,
+			ErrorRate: float64(stats.Errors) / float64(len(sorted)),
+			Rps:       float64(len(sorted)) / elapsed.Seconds(),
+			P50:       toMs(percentile(sorted, 50)),
+			P95:       toMs(percentile(sorted, 95)),
+			P99:       toMs(percentile(sorted, 99)),
+			Max:       toMs(sorted[len(sorted)-1]),
+			Codes:     codes,
+		})
+	}
+	return result
+}
+
+// Zero latency or negative error rate disables threshold
+type Thresholds struct {
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+	ErrorRate float64
+}
+
+func checkThresholds(endpoints []*EndpointReport, th Thresholds) []string {
+	violations := make([]string, 0)
+	checkLatency := func(e *EndpointReport, name string, got float64, max time.Duration) {
+		if max > 0 && got > toMs(max) {
+			violations = append(violations, fmt.Sprintf("%s: %s %.1fms > %v", e.Endpoint, name, got, max))
+		}
+	}
+	for _, e := range endpoints {
+		checkLatency(e, "p50", e.P50, th.P50)
+		checkLatency(e, "p95", e.P95, th.P95)
+		checkLatency(e, "p99", e.P99, th.P99)
+		if th.ErrorRate >= 0 && e.ErrorRate > th.ErrorRate {
+			violations = append(violations, fmt.Sprintf("%s: error rate %.4f > %v", e.Endpoint, e.ErrorRate, th.ErrorRate))
+		}
+	}
+	return violations
+}
+
+// ======================================================================
+// Load
+
+type Loader struct {
+	Url         string
+	Client      *http.Client
+	Concurrency int
+	Duration    time.Duration
+	Mixer       *Mixer
+	Workload    *Workload
+	Seed        int64
+
+	requestId int64
+}
+
+// Latency includes reading of response body
+func (l *Loader) do(req *LoadRequest) (int, []byte, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = json.Marshal(req.Body)
+	}
+	httpReq, err := http.NewRequest(req.Method, l.Url+req.Path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	httpReq.Header.Set("Id", strconv.FormatInt(atomic.AddInt64(&l.requestId, 1), 10))
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.Client.Do(httpReq)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+func (l *Loader) worker(r *rand.Rand, deadline time.Time, stats *Stats) {
+	for time.Now().Before(deadline) {
+		req := l.Mixer.pick(r)(l.Workload, r)
+		start := time.Now()
+		code, data, err := l.do(req)
+		stats.add(req.Endpoint, time.Since(start), code)
+		if err == nil && code == http.StatusOK && req.onResponse != nil {
+			req.onResponse(data)
+		}
+	}
+}
+
+func (l *Loader) run() ([]*EndpointReport, time.Duration) {
+	stats := newStats()
+	start := time.Now()
+	deadline := start.Add(l.Duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < l.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			l.worker(rand.New(rand.NewSource(seed)), deadline, stats)
+		}(l.Seed + int64(i))
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	return stats.report(elapsed), elapsed
+}
+
+func (l *Loader) getJson(method, path string, body interface{}, result interface{}) error {
+	code, data, err := l.do(&LoadRequest{Method: method, Path: path, Body: body})
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status %d", method, path, code)
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Towns of cpsrv api when towns space is not available
+func (l *Loader) loadTowns() ([]*models.Town, error) {
+	var ids []uint32
+	err := l.getJson("GET", "/towns", nil, &ids)
+	if err != nil {
+		return nil, err
+	}
+	towns := make([]*models.Town, 0, len(ids))
+	for from := 0; from < len(ids); from += MAX_TOWNS_BATCH_SIZE {
+		to := from + MAX_TOWNS_BATCH_SIZE
+		if to > len(ids) {
+			to = len(ids)
+		}
+		var batch []*models.Town
+		err = l.getJson("POST", "/towns", map[string][]uint32{"towns": ids[from:to]}, &batch)
+		if err != nil {
+			return nil, err
+		}
+		towns = append(towns, batch...)
+	}
+	return towns, nil
+}
+
+func loadTntTowns(url string) ([]*models.Town, error) {
+	opts := tarantool.Opts{
+		Reconnect:     1 * time.Second,
+		MaxReconnects: 3,
+		User:          "admin",
+		Pass:          "admin",
+	}
+	tnt, err := tarantool.Connect(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer tnt.Close()
+
+	repo := models.NewRepository(tnt)
+	ids, err := repo.TownIds()
+	if err != nil {
+		return nil, err
+	}
+	return repo.Towns(ids)
+}
+
+func writeReport(report *Report, path string) error {
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if path == "" {
+		fmt.Println(string(data))
+		return nil
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func main() {
+	context := "cpload"
+
+	concurrency := flag.Int("c", 8, "number of concurrent clients")
+	duration := flag.Duration("d", 30*time.Second, "duration of load")
+	mix := flag.String("mix", "clusters=5,cashpoints=3,batch=2", "weights of scenarios (clusters, cashpoints, batch)")
+	tntUrl := flag.String("tnt", "", "tarantool url to read towns from towns space (cpsrv api by default)")
+	seed := flag.Int64("seed", 0, "random seed (current time by default)")
+	outputPath := flag.String("o", "", "report file path (stdout by default)")
+	maxP50 := flag.Duration("max-p50", 0, "fail if p50 latency of any endpoint exceeds")
+	maxP95 := flag.Duration("max-p95", 0, "fail if p95 latency of any endpoint exceeds")
+	maxP99 := flag.Duration("max-p99", 0, "fail if p99 latency of any endpoint exceeds")
+	maxErrors := flag.Float64("max-errors", -1, "fail if error rate of any endpoint exceeds (0..1)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <cpsrv url>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || *concurrency < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	weights, err := parseMix(*mix)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	loader := &Loader{
+		Url: strings.TrimSuffix(flag.Arg(0), "/"),
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		},
+		Concurrency: *concurrency,
+		Duration:    *duration,
+		Mixer:       newMixer(weights),
+		Workload:    &Workload{},
+		Seed:        *seed,
+	}
+
+	if *tntUrl != "" {
+		loader.Workload.Towns, err = loadTntTowns(*tntUrl)
+	} else {
+		loader.Workload.Towns, err = loader.loadTowns()
+	}
+	if err != nil {
+		log.Fatalf("%s: cannot load towns: %v", context, err)
+	}
+	if len(loader.Workload.Towns) == 0 {
+		log.Fatalf("%s: no towns", context)
+	}
+	err = loader.getJson("GET", "/banks", nil, &loader.Workload.Banks)
+	if err != nil {
+		log.Fatalf("%s: cannot load banks: %v", context, err)
+	}
+
+	log.Printf("%s: %d clients for %v over %d towns", context, *concurrency, *duration, len(loader.Workload.Towns))
+	endpoints, elapsed := loader.run()
+
+	report := &Report{
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Url:         loader.Url,
+		Duration:    elapsed.String(),
+		Concurrency: *concurrency,
+		Endpoints:   endpoints,
+		Violations: checkThresholds(endpoints, Thresholds{
+			P50:       *maxP50,
+			P95:       *maxP95,
+			P99:       *maxP99,
+			ErrorRate: *maxErrors,
+		}),
+	}
+	err = writeReport(report, *outputPath)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	if len(report.Violations) > 0 {
+		log.Printf("%s: %d thresholds exceeded", context, len(report.Violations))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/alexeyknyshev/models"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getTestWorkload() *Workload {
+	return &Workload{
+		Towns: []*models.Town{
+			{Id: 4, Longitude: 37.61775970459, Latitude: 55.755771636963, Zoom: 10},
+			{Id: 290, Longitude: 48.0336, Latitude: 46.3497, Zoom: 12},
+		},
+		Banks: []uint32{322, 325, 2764},
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make(durationList, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	cases := map[float64]time.Duration{
+		50: 50 * time.Millisecond,
+		95: 95 * time.Millisecond,
+		99: 99 * time.Millisecond,
+		0:  1 * time.Millisecond,
+	}
+	for p, expected := range cases {
+		if got := percentile(sorted, p); got != expected {
+			t.Errorf("Expected p%v %v but got %v", p, expected, got)
+		}
+	}
+	if got := percentile(durationList{7 * time.Millisecond}, 99); got != 7*time.Millisecond {
+		t.Errorf("Expected single latency but got %v", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("Expected zero percentile of no latencies but got %v", got)
+	}
+}
+
+func TestParseMix(t *testing.T) {
+	weights, err := parseMix("clusters=5,cashpoints,batch=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights["clusters"] != 5 || weights["cashpoints"] != 1 || weights["batch"] != 0 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+
+	for _, mix := range []string{"", "batch=0", "tiles=1", "clusters=-1"} {
+		if _, err := parseMix(mix); err == nil {
+			t.Errorf("Expected error of mix '%s'", mix)
+		}
+	}
+}
+
+func TestMixer(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	m := newMixer(map[string]int{"cashpoints": 1, "batch": 0})
+	w := getTestWorkload()
+	for i := 0; i < 100; i++ {
+		if req := m.pick(r)(w, r); req.Endpoint != ENDPOINT_CASHPOINTS {
+			t.Fatalf("Unexpected endpoint %s of zero weight scenario", req.Endpoint)
+		}
+	}
+}
+
+func TestCashpointsRequest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	w := getTestWorkload()
+	filtered := 0
+	for i := 0; i < 1000; i++ {
+		req := cashpointsRequest(w, r).Body.(*NearbyRequest)
+		if math.Abs(req.TopLeft.Longitude-req.BottomRight.Longitude) > NEARBY_MAX_COORD_DELTA ||
+			math.Abs(req.TopLeft.Latitude-req.BottomRight.Latitude) > NEARBY_MAX_COORD_DELTA {
+			t.Fatalf("Region exceeds nearby limit: %+v", req)
+		}
+		if req.TopLeft.Latitude < req.BottomRight.Latitude || req.TopLeft.Longitude > req.BottomRight.Longitude {
+			t.Fatalf("Unexpected region orientation: %+v", req)
+		}
+		if req.Zoom != nil {
+			t.Fatalf("Unexpected zoom of nearby cashpoints request")
+		}
+		if req.Filter != nil {
+			filtered++
+		}
+	}
+	if filtered == 0 || filtered == 1000 {
+		t.Errorf("Expected mix of filtered and unfiltered requests but got %d filtered", filtered)
+	}
+}
+
+func TestClustersRequest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	w := getTestWorkload()
+	for i := 0; i < 1000; i++ {
+		req := clustersRequest(w, r).Body.(*NearbyRequest)
+		if req.Zoom == nil || *req.Zoom > MAX_ZOOM {
+			t.Fatalf("Unexpected zoom of clusters request: %+v", req)
+		}
+		if req.TopLeft.Latitude <= req.BottomRight.Latitude || req.TopLeft.Longitude >= req.BottomRight.Longitude {
+			t.Fatalf("Unexpected region: %+v", req)
+		}
+	}
+}
+
+func TestBatchRequest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	w := getTestWorkload()
+	endpoints := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		endpoints[batchRequest(w, r).Endpoint]++
+	}
+	if endpoints[ENDPOINT_CASHPOINTS_BATCH] != 0 {
+		t.Errorf("Unexpected cashpoints batch without known cashpoints")
+	}
+
+	w.Cashpoints.add([]uint32{1, 2, 3}, r)
+	for i := 0; i < 100; i++ {
+		req := batchRequest(w, r)
+		endpoints[req.Endpoint]++
+		ids := req.Body.(map[string][]uint32)
+		for _, batch := range ids {
+			if len(batch) == 0 || len(batch) > MAX_BATCH_SIZE {
+				t.Fatalf("Unexpected batch size %d", len(batch))
+			}
+		}
+	}
+	for _, endpoint := range []string{ENDPOINT_CASHPOINTS_BATCH, ENDPOINT_TOWNS_BATCH, ENDPOINT_BANKS_BATCH} {
+		if endpoints[endpoint] == 0 {
+			t.Errorf("Expected %s requests", endpoint)
+		}
+	}
+}
+
+func TestCheckThresholds(t *testing.T) {
+	endpoints := []*EndpointReport{
+		{Endpoint: ENDPOINT_CLUSTERS, ErrorRate: 0, P50: 10, P95: 40, P99: 120},
+		{Endpoint: ENDPOINT_CASHPOINTS, ErrorRate: 0.05, P50: 5, P95: 20, P99: 30},
+	}
+
+	if violations := checkThresholds(endpoints, Thresholds{ErrorRate: -1}); len(violations) != 0 {
+		t.Errorf("Expected no violations without thresholds but got %v", violations)
+	}
+
+	violations := checkThresholds(endpoints, Thresholds{P99: 100 * time.Millisecond, ErrorRate: 0.01})
+	if len(violations) != 2 {
+		t.Errorf("Expected p99 and error rate violations but got %v", violations)
+	}
+
+	violations = checkThresholds(endpoints, Thresholds{P50: 10 * time.Millisecond, P95: 50 * time.Millisecond, ErrorRate: 0.05})
+	if len(violations) != 0 {
+		t.Errorf("Expected thresholds to be inclusive but got %v", violations)
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Id") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/nearby/cashpoints":
+			json.NewEncoder(w).Encode([]uint32{1, 2, 3})
+		case "/nearby/clusters":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer server.Close()
+
+	loader := &Loader{
+		Url:         server.URL,
+		Client:      &http.Client{},
+		Concurrency: 4,
+		Duration:    200 * time.Millisecond,
+		Mixer:       newMixer(map[string]int{"clusters": 1, "cashpoints": 1, "batch": 1}),
+		Workload:    getTestWorkload(),
+		Seed:        1,
+	}
+	endpoints, _ := loader.run()
+
+	byName := make(map[string]*EndpointReport)
+	for _, e := range endpoints {
+		byName[e.Endpoint] = e
+		if e.Requests == 0 || e.P50 > e.P95 || e.P95 > e.P99 || e.P99 > e.Max {
+			t.Errorf("Unexpected stats of %s: %+v", e.Endpoint, e)
+		}
+	}
+
+	clusters := byName[ENDPOINT_CLUSTERS]
+	if clusters == nil || clusters.ErrorRate != 1 || clusters.Codes["500"] != clusters.Requests {
+		t.Errorf("Expected failed clusters requests but got %+v", clusters)
+	}
+	for _, name := range []string{ENDPOINT_CASHPOINTS, ENDPOINT_CASHPOINTS_BATCH} {
+		if e := byName[name]; e == nil || e.Errors != 0 {
+			t.Errorf("Expected successful %s requests but got %+v", name, e)
+		}
+	}
+
+	violations := checkThresholds(endpoints, Thresholds{ErrorRate: 0})
+	if len(violations) != 1 {
+		t.Errorf("Expected clusters error rate violation but got %v", violations)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mediocregopher/radix.v2/redis"
 	"log"
@@ -22,65 +24,6 @@ func boolToInt(val bool) uint {
 	return 0
 }
 
-type Town struct {
-	Id             uint32  `json:"id"`
-	Name           string  `json:"name"`
-	NameTr         string  `json:"name_tr"`
-	RegionId       *uint32 `json:"region_id"`
-	RegionalCenter bool    `json:"regional_center"`
-	Latitude       float32 `json:"latitude"`
-	Longitude      float32 `json:"longitude"`
-	Zoom           uint32  `json:"zoom"`
-	Big            bool    `json:"big"`
-}
-
-type Region struct {
-	Id        uint32  `json:"id"`
-	Name      string  `json:"name"`
-	NameTr    string  `json:"name_tr"`
-	Latitude  float32 `json:"latitude"`
-	Longitude float32 `json:"longitude"`
-	Zoom      uint32  `json:"zoom"`
-}
-
-type Bank struct {
-	Id        uint32   `json:"id"`
-	Name      string   `json:"name"`
-	NameTr    string   `json:"name_tr"`
-	NameTrAlt string   `json:"name_tr_alt"`
-	Town      string   `json:"town"`
-	Licence   uint32   `json:"licence"`
-	Rating    uint32   `json:"rating"`
-	Tel       string   `json:"tel"`
-	Partners  []uint32 `json:"partners"`
-}
-
-type CashPoint struct {
-	Id             uint32  `json:"id"`
-	Type           string  `json:"type"`
-	BankId         uint32  `json:"bank_id"`
-	TownId         uint32  `json:"town_id"`
-	Longitude      float32 `json:"longitude"`
-	Latitude       float32 `json:"latitude"`
-	Address        string  `json:"address"`
-	AddressComment string  `json:"address_comment"`
-	MetroName      string  `json:"metro_name"`
-	FreeAccess     bool    `json:"free_access"`
-	MainOffice     bool    `json:"main_office"`
-	WithoutWeekend bool    `json:"without_weekend"`
-	RoundTheClock  bool    `json:"round_the_clock"`
-	WorksAsShop    bool    `json:"works_as_shop"`
-	Schedule       string  `json:"schedule"`
-	Tel            string  `json:"tel"`
-	Additional     string  `json:"additional"`
-	Rub            bool    `json:"rub"`
-	Usd            bool    `json:"usd"`
-	Eur            bool    `json:"eur"`
-	CashIn         bool    `json:"cash_in"`
-	Version        uint32  `json:"version"`
-	Timestamp      uint32  `json:"timestamp"`
-}
-
 type ClusterData struct {
 	QuadKey   string  `json:"quadkey"`
 	Longitude float32 `json:"longitude"`
@@ -152,10 +95,9 @@ func migrateTowns(townsDb *sql.DB, redisCli *redis.Client) {
 	currentTownIdx := 1
 	var lastTownId uint32 = 0
 	for rows.Next() {
-		town := new(Town)
-		var regionId uint32 = 0
+		town := new(models.Town)
 		err = rows.Scan(&town.Id, &town.Name, &town.NameTr,
-			&regionId, &town.RegionalCenter,
+			&town.RegionId, &town.RegionalCenter,
 			&town.Latitude, &town.Longitude,
 			&town.Zoom, &town.Big)
 		if err != nil {
@@ -166,11 +108,6 @@ func migrateTowns(townsDb *sql.DB, redisCli *redis.Client) {
 			lastTownId = town.Id
 		}
 
-		if regionId != 0 {
-			town.RegionId = new(uint32)
-			*town.RegionId = regionId
-		}
-
 		jsonData, err := json.Marshal(town)
 		if err != nil {
 			log.Fatal(err)
@@ -221,7 +158,7 @@ func migrateRegions(townsDb *sql.DB, redisCli *redis.Client) {
 
 	currentRegionIdx := 1
 	for rows.Next() {
-		region := new(Region)
+		region := new(models.Region)
 		err = rows.Scan(&region.Id, &region.Name, &region.NameTr,
 			&region.Latitude, &region.Longitude, &region.Zoom)
 		if err != nil {
@@ -267,12 +204,12 @@ func migrateBanks(banksDb *sql.DB, redisCli *redis.Client) {
 		log.Fatalf("migrate: banks: %v", err)
 	}
 
-	bankList := make([]Bank, 0)
+	bankList := make([]models.Bank, 0)
 
 	currentBankIdx := 1
 	var lastBankId uint32 = 0
 	for rows.Next() {
-		bank := Bank{}
+		bank := models.Bank{}
 		bank.Partners = make([]uint32, 0)
 
 		var nameTr sql.NullString
@@ -373,7 +310,7 @@ func migrateCashpoints(cpDb *sql.DB, redisCli *redis.Client) {
 	currentCashpointIndex := 1
 	var lastCashpointId uint32 = 0
 	for rows.Next() {
-		cp := new(CashPoint)
+		cp := new(models.RedisCashpoint)
 		cp.Version = 0
 		cp.Timestamp = 0
 		err = rows.Scan(&cp.Id, &cp.Type, &cp.BankId, &cp.TownId,
@@ -444,153 +381,6 @@ func migrateCashpoints(cpDb *sql.DB, redisCli *redis.Client) {
 	log.Printf("[%d/%d] Cashpoints processed\n", cashpointsCount, cashpointsCount)
 }
 
-func uintPow(x, y uint32) uint32 {
-	var result uint32 = 1
-	for pow := uint32(0); pow < y; pow++ {
-		result = result * x
-	}
-	return result
-}
-
-type Task struct {
-	Zoom     uint32
-	TopLat   float32
-	BotLat   float32
-	LeftLon  float32
-	RightLon float32
-	QuadKey  string
-}
-
-type TaskResult struct {
-	Zoom      uint32
-	Points    []uint32
-	Longitude float32
-	Latitude  float32
-	QuadKey   string
-}
-
-func newTask(zoom uint32, topLat, botLat, leftLon, rightLon float32, quadKey string) *Task {
-	return &Task{Zoom: zoom, TopLat: topLat, BotLat: botLat, LeftLon: leftLon, RightLon: rightLon, QuadKey: quadKey}
-}
-
-func getRegionIdList(topLat, botLat, leftLon, rightLon float32, stmt *sql.Stmt, mutex *sync.Mutex) (TaskResult, error) {
-	context := "getRegionIdList"
-	result := TaskResult{}
-
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	rows, err := stmt.Query(topLat, botLat, leftLon, rightLon)
-	if err != nil {
-		return result, err
-	}
-
-	result.Points = make([]uint32, 0)
-	result.Longitude = 0.0
-	result.Latitude = 0.0
-
-	for rows.Next() {
-		var id uint32 = 0
-		var longitude float32 = 0.0
-		var latitude float32 = 0.0
-
-		err = rows.Scan(&id, &longitude, &latitude)
-		if err != nil {
-			log.Fatalf("%s: sql scan error: %v\n", context, err)
-		}
-
-		result.Longitude += longitude
-		result.Latitude += latitude
-
-		result.Points = append(result.Points, id)
-	}
-
-	count := len(result.Points)
-	if count > 0 {
-		result.Longitude = result.Longitude / float32(count)
-		result.Latitude = result.Latitude / float32(count)
-	}
-
-	return result, nil
-}
-
-func doTask(task *Task, maxZoom uint32, asyncSubCount int, stmt *sql.Stmt, dbMutex *sync.Mutex, wg *sync.WaitGroup, c chan TaskResult) {
-	context := "doTask"
-	if asyncSubCount > 0 {
-		asyncSubCount--
-		defer wg.Done()
-	}
-
-	//log.Printf("%s: added task for quadkey = %s", context, task.QuadKey)
-
-	result, err := getRegionIdList(task.TopLat, task.BotLat, task.LeftLon, task.RightLon, stmt, dbMutex)
-	if err != nil {
-		log.Fatalf("%s: cannot get cp ids for task (quadKey = %s): sql error: %v", context, task.QuadKey, err)
-		return
-	}
-
-	count := len(result.Points)
-	if count != 0 {
-
-		// prepare subtasks
-
-		if task.Zoom < maxZoom {
-			nextZoom := task.Zoom + 1
-
-			var midLat float32 = (task.TopLat + task.BotLat) * 0.5
-			var midLon float32 = (task.LeftLon + task.RightLon) * 0.5
-
-			taskList := make([]*Task, 0)
-			taskList = append(taskList, newTask(nextZoom, task.TopLat, midLat, task.LeftLon, midLon, task.QuadKey+"0"))
-			taskList = append(taskList, newTask(nextZoom, midLat, task.BotLat, task.LeftLon, midLon, task.QuadKey+"2"))
-			taskList = append(taskList, newTask(nextZoom, task.TopLat, midLat, midLon, task.RightLon, task.QuadKey+"1"))
-			taskList = append(taskList, newTask(nextZoom, midLat, task.BotLat, midLon, task.RightLon, task.QuadKey+"3"))
-
-			asyncSubCount /= len(taskList)
-			for _, task := range taskList {
-				if asyncSubCount > 0 {
-					wg.Add(1)
-					go doTask(task, maxZoom, asyncSubCount, stmt, dbMutex, wg, c)
-				} else {
-					doTask(task, maxZoom, asyncSubCount, stmt, dbMutex, wg, c)
-				}
-			}
-		}
-
-		// write cluster data
-
-		//		log.Printf("%s: finished task (quadkey = %s): count = %d, lon = %f, lat = %f\n", context, task.QuadKey, count, avgLon, avgLat)
-		result.Zoom = task.Zoom
-		result.QuadKey = task.QuadKey
-		c <- result
-	}
-}
-
-func getGeoRectPart(minLon, maxLon, minLat, maxLat *float32, lon, lat float32) string {
-	midLon := (*minLon + *maxLon) * 0.5
-	midLat := (*minLat + *maxLat) * 0.5
-
-	if lat < midLat {
-		*maxLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "0"
-		} else {
-			*minLon = midLon
-			return "1"
-		}
-	} else {
-		*minLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "2"
-		} else {
-			*minLon = midLon
-			return "3"
-		}
-	}
-}
-
 const CHAN_BUFFER_SIZE = 512
 
 type CPClusteringRequest struct {
@@ -614,21 +404,16 @@ func clusteringWorker(in chan CPClusteringRequest, minZoom, maxZoom uint32) chan
 			// 			log.Printf("%s: got task: id = %d, lon = %f, lat = %f", context, request.Id, request.Longitude, request.Latitude)
 			response := CPClusteringResponse{Id: request.Id}
 
-			var minLon float32 = -180.0
-			var maxLon float32 = 180.0
-
-			var minLat float32 = -85.0
-			var maxLat float32 = 85.0
-
-			quadKey := ""
-			for zoom := uint32(0); zoom < maxZoom; zoom++ {
-				quadKey += getGeoRectPart(&minLon, &maxLon, &minLat, &maxLat, request.Longitude, request.Latitude)
-				if zoom >= minZoom {
-					response.QuadKey = quadKey
-					response.Zoom = zoom
-					//log.Printf("%s: response ready: id = %d, quadkey = %s", context, response.Id, response.QuadKey)
-					out <- response
-				}
+			quadKey, err := quadkey.EncodeIn(quadkey.MERCATOR_WORLD, float64(request.Longitude), float64(request.Latitude), maxZoom)
+			if err != nil {
+				log.Printf("%s: cannot get quadkey for cashpoint: id = %d, lon = %f, lat = %f", context, request.Id, request.Longitude, request.Latitude)
+				continue
+			}
+			for _, quadKeyPrefix := range quadkey.Prefixes(quadKey, minZoom+1, maxZoom) {
+				response.QuadKey = quadKeyPrefix
+				response.Zoom = uint32(len(quadKeyPrefix)) - 1
+				//log.Printf("%s: response ready: id = %d, quadkey = %s", context, response.Id, response.QuadKey)
+				out <- response
 			}
 			// 			log.Printf("%s: clustering finished for cashpoint: %d", context, request.Id)
 		}
@@ -913,96 +698,12 @@ func migrateClustersNewGeo(redisCli *redis.Client, quadKeySet map[string]struct{
 	log.Printf("%s: geo sorting of clusters finished", context)
 }
 
-func migrateClusters(cpDb *sql.DB, redisCli *redis.Client) {
-	context := "migrateClusters"
-
-	var minLonWorld float32 = -180.0
-	var maxLonWorld float32 = 180.0
-
-	var minLatWorld float32 = -85.0
-	var maxLatWorld float32 = 85.0
-
-	minLon := minLonWorld
-	maxLon := maxLonWorld
-
-	minLat := minLatWorld
-	maxLat := maxLatWorld
-
-	err := cpDb.QueryRow("SELECT MIN(longitude), MAX(longitude), MIN(latitude), MAX(latitude) FROM cashpoints WHERE hidden = 0").Scan(&minLon, &maxLon, &minLat, &maxLat)
-	if err != nil {
-		log.Fatal("%s: cannot get region bounds: sql error: %v\n", context, err)
-		return
-	}
-
-	minLon -= 1.0
-	maxLon += 1.0
-
-	minLat -= 1.0
-	maxLat += 1.0
-
-	log.Printf("%s: bounds = { [%f, %f], [%f, %f] }", context, minLon, maxLon, minLat, maxLat)
-
-	stmt, err := cpDb.Prepare(`SELECT id, longitude, latitude FROM cashpoints
-					WHERE hidden = 0 AND latitude > ? AND latitude <= ? AND
-					longitude > ? AND longitude <= ?`)
-	if err != nil {
-		log.Fatalf("%s: sql prepare error: %v\n", context, err)
-		return
-	}
-	defer stmt.Close()
-
-	var zoom uint32 = 0
-	quadKey := ""
-	var maxZoom uint32 = 16
-	asyncSubCount := 5
-
-	// beta ||
-	task := newTask(zoom, minLatWorld, maxLatWorld, minLonWorld, maxLonWorld, quadKey)
-	c := make(chan TaskResult)
-	var wg sync.WaitGroup
-	var dbMutex sync.Mutex
-
-	wg.Add(1)
-	go doTask(task, maxZoom, asyncSubCount, stmt, &dbMutex, &wg, c)
-
-	go func() {
-		clusterIndex := 0
-		for t := range c {
-			clusterIndex++
-
-			if t.QuadKey != "" {
-				// write cluster data
-
-				log.Printf("%s: got task result: size = %d, quadkey = %s, lon = %f, lat = %f", context, len(t.Points), t.QuadKey, t.Longitude, t.Latitude)
-
-				clusterGroupName := "zcluster:" + strconv.FormatUint(uint64(t.Zoom), 10)
-				result := redisCli.Cmd("GEOADD", clusterGroupName, t.Longitude, t.Latitude, t.QuadKey)
-				if result.Err != nil {
-					log.Fatalf("%s: cannot add cluster group = %s: redis => %v\n", context, clusterGroupName, result.Err)
-					return
-				}
-
-				clusterName := "cluster:" + t.QuadKey
-				err = redisCli.Cmd("SADD", clusterName, t.Points).Err
-				if err != nil {
-					log.Printf("%s: cannot add ids into %s, redis => %v\n", context, clusterName, result.Err)
-				}
-			}
-
-			log.Printf("%s: [%d] Clustering finished\n", context, clusterIndex)
-		}
-	}()
-
-	wg.Wait()
-}
-
 func migrate(townsDb, cpDb, banksDb *sql.DB, redisCli *redis.Client) {
 	migrateMessages(townsDb, redisCli)
 	migrateTowns(townsDb, redisCli)
 	migrateRegions(townsDb, redisCli)
 	migrateCashpoints(cpDb, redisCli)
 	migrateBanks(banksDb, redisCli)
-	//migrateClusters(cpDb, redisCli)
 	quadKeyList, err := migrateClustersNew(cpDb, redisCli)
 	if err != nil {
 		log.Fatalf("migrateClustersNew: cannot get list of quadkeys")
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/alexeyknyshev/models"
+	"github.com/tarantool/go-tarantool"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Merge mode imports fresh cashpoints dump without truncating tarantool spaces.
+// Incoming cashpoint is matched to existing one by id (bank has to be the same)
+// or by bank and nearby coordinates. Differences of matched cashpoints are not
+// applied directly, they are proposed as patches of import user, so user edits
+// are preserved and changes are reviewed by votes as usual. Unknown cashpoints
+// are inserted, existing cashpoints missing in dump are only reported.
+
+const DEFAULT_IMPORT_USER = "import"
+const DEFAULT_MATCH_RADIUS = 50.0 // meters
+
+const EARTH_RADIUS = 6371000.0 // meters
+const COORD_EPSILON = 1e-5
+
+// Cashpoints space columns (zero based)
+const COL_CP_ID = 0
+const COL_CP_COORD = 1
+const COL_CP_BANK_ID = 3
+const COL_CP_TOWN_ID = 4
+const COL_CP_APPROVED = 20
+const COL_CP_CREATOR = 21
+
+const COL_TOWN_CP_COUNT = 8
+
+// Cashpoints patches space columns (zero based)
+const COL_PATCH_ID = 0
+const COL_PATCH_DATA = 3
+
+// Cashpoints patches space indexes
+const PATCHES_INDEX_PRIMARY = 0
+const PATCHES_INDEX_TARGET = 1
+
+// Cashpoints patches votes space indexes
+const VOTES_INDEX_PATCH = 1
+
+// Patchable cashpoint fields stored in columns 2..17 (zero based)
+// in same order as in cashpoints space
+var CASHPOINT_TUPLE_FIELDS = []string{
+	"type", "bank_id", "town_id",
+	"address", "address_comment", "metro_name",
+	"free_access", "main_office", "without_weekend",
+	"round_the_clock", "works_as_shop", "schedule",
+	"tel", "additional", "currency", "cash_in",
+}
+
+// Cashpoint loaded from tarantool
+type TntCashpoint struct {
+	Id        uint32
+	BankId    uint32
+	TownId    uint32
+	Longitude float64
+	Latitude  float64
+	Approved  bool
+	Creator   string
+	Fields    map[string]interface{}
+}
+
+type MergeMissing struct {
+	Id       uint32 `json:"id"`
+	BankId   uint32 `json:"bank_id"`
+	TownId   uint32 `json:"town_id"`
+	Approved bool   `json:"approved"`
+	Creator  string `json:"creator,omitempty"`
+}
+
+type MergeReport struct {
+	Timestamp       string         `json:"timestamp"`
+	DryRun          bool           `json:"dry_run"`
+	ImportUser      string         `json:"import_user"`
+	Source          int            `json:"source"`
+	MatchedById     int            `json:"matched_by_id"`
+	MatchedByCoord  int            `json:"matched_by_coord"`
+	Unchanged       int            `json:"unchanged"`
+	Patched         []uint32       `json:"patched"`
+	AlreadyProposed []uint32       `json:"already_proposed"`
+	Created         []uint32       `json:"created"`
+	Conflicts       []uint32       `json:"conflicts"`
+	Missing         []MergeMissing `json:"missing"`
+}
+
+// Returns distance between two points in meters (haversine formula)
+func distance(lon1, lat1, lon2, lat2 float64) float64 {
+	toRad := func(deg float64) float64 {
+		return deg * math.Pi / 180.0
+	}
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS * math.Asin(math.Sqrt(math.Min(1.0, a)))
+}
+
+// Converts value to its json representation (numbers become float64,
+// json strings are decoded) so values of different origin can be compared
+func normalizeValue(v interface{}) interface{} {
+	if str, ok := v.(string); ok {
+		var decoded interface{}
+		if json.Unmarshal([]byte(str), &decoded) == nil {
+			switch decoded.(type) {
+			case map[string]interface{}, []interface{}:
+				return decoded
+			}
+		}
+		return str
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var result interface{}
+	if json.Unmarshal(data, &result) != nil {
+		return v
+	}
+	if result == nil { // empty currency list is stored as nil
+		return []interface{}{}
+	}
+	return result
+}
+
+func cashpointToFields(cp *models.Cashpoint) map[string]interface{} {
+	values := []interface{}{
+		cp.Type, cp.BankId, cp.TownId,
+		cp.Address, cp.AddressComment, cp.MetroName,
+		cp.FreeAccess, cp.MainOffice, cp.WithoutWeekend,
+		cp.RoundTheClock, cp.WorksAsShop, scheduleJson(cp),
+		cp.Tel, cp.Additional, cp.Currency, cp.CashIn,
+	}
+	fields := make(map[string]interface{}, len(values))
+	for i, name := range CASHPOINT_TUPLE_FIELDS {
+		fields[name] = normalizeValue(values[i])
+	}
+	return fields
+}
+
+func tupleUint(tuple []interface{}, col int) uint32 {
+	if col >= len(tuple) {
+		return 0
+	}
+	v, _ := toUint64(tuple[col])
+	return uint32(v)
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch val := v.(type) {
+	case uint64:
+		return val, true
+	case int64:
+		return uint64(val), val >= 0
+	case uint32:
+		return uint64(val), true
+	case int32:
+		return uint64(val), val >= 0
+	case uint:
+		return uint64(val), true
+	case int:
+		return uint64(val), val >= 0
+	case uint16:
+		return uint64(val), true
+	case int16:
+		return uint64(val), val >= 0
+	case uint8:
+		return uint64(val), true
+	case int8:
+		return uint64(val), val >= 0
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	}
+	u, ok := toUint64(v)
+	return float64(u), ok
+}
+
+func tupleToTntCashpoint(tuple []interface{}) *TntCashpoint {
+	cp := &TntCashpoint{
+		Id:       tupleUint(tuple, COL_CP_ID),
+		BankId:   tupleUint(tuple, COL_CP_BANK_ID),
+		TownId:   tupleUint(tuple, COL_CP_TOWN_ID),
+		Approved: true, // nil approved means approved
+		Fields:   make(map[string]interface{}, len(CASHPOINT_TUPLE_FIELDS)),
+	}
+
+	if coord, ok := tuple[COL_CP_COORD].([]interface{}); ok && len(coord) >= 2 {
+		cp.Longitude, _ = toFloat64(coord[0])
+		cp.Latitude, _ = toFloat64(coord[1])
+	}
+	for i, name := range CASHPOINT_TUPLE_FIELDS {
+		if COL_CP_COORD+1+i < len(tuple) {
+			cp.Fields[name] = normalizeValue(tuple[COL_CP_COORD+1+i])
+		}
+	}
+	if len(tuple) > COL_CP_APPROVED {
+		if approved, ok := tuple[COL_CP_APPROVED].(bool); ok {
+			cp.Approved = approved
+		}
+	}
+	if len(tuple) > COL_CP_CREATOR {
+		cp.Creator, _ = tuple[COL_CP_CREATOR].(string)
+	}
+	return cp
+}
+
+// Returns patch with changed fields of existing cashpoint or nil if
+// incoming cashpoint has the same data
+func diffCashpoint(existing *TntCashpoint, cp *models.Cashpoint) map[string]interface{} {
+	patch := make(map[string]interface{})
+	fields := cashpointToFields(cp)
+	for _, name := range CASHPOINT_TUPLE_FIELDS {
+		if !reflect.DeepEqual(existing.Fields[name], fields[name]) {
+			patch[name] = fields[name]
+		}
+	}
+
+	lon, lat := float64(cp.Longitude), float64(cp.Latitude)
+	if math.Abs(existing.Longitude-lon) > COORD_EPSILON || math.Abs(existing.Latitude-lat) > COORD_EPSILON {
+		patch["longitude"] = lon
+		patch["latitude"] = lat
+	}
+
+	if len(patch) == 0 {
+		return nil
+	}
+	patch["id"] = existing.Id
+	return patch
+}
+
+// Matches incoming cashpoints to existing ones
+type Matcher struct {
+	Radius  float64
+	byId    map[uint32]*TntCashpoint
+	byBank  map[uint32][]*TntCashpoint
+	matched map[uint32]bool
+}
+
+func NewMatcher(cashpoints []*TntCashpoint, radius float64) *Matcher {
+	m := &Matcher{
+		Radius:  radius,
+		byId:    make(map[uint32]*TntCashpoint, len(cashpoints)),
+		byBank:  make(map[uint32][]*TntCashpoint),
+		matched: make(map[uint32]bool),
+	}
+	for _, cp := range cashpoints {
+		m.byId[cp.Id] = cp
+		m.byBank[cp.BankId] = append(m.byBank[cp.BankId], cp)
+	}
+	return m
+}
+
+// Returns matched existing cashpoint and true if it was matched by id.
+// Returns nil if there is no match.
+func (m *Matcher) Match(cp *models.Cashpoint) (*TntCashpoint, bool) {
+	lon, lat := float64(cp.Longitude), float64(cp.Latitude)
+
+	if existing, ok := m.byId[cp.Id]; ok && !m.matched[cp.Id] && existing.BankId == cp.BankId {
+		m.matched[cp.Id] = true
+		return existing, true
+	}
+
+	var nearest *TntCashpoint
+	nearestDist := m.Radius
+	for _, existing := range m.byBank[cp.BankId] {
+		if m.matched[existing.Id] {
+			continue
+		}
+		dist := distance(lon, lat, existing.Longitude, existing.Latitude)
+		if dist <= nearestDist {
+			nearest = existing
+			nearestDist = dist
+		}
+	}
+	if nearest != nil {
+		m.matched[nearest.Id] = true
+	}
+	return nearest, false
+}
+
+// Returns true if incoming cashpoint id is used by another existing cashpoint
+func (m *Matcher) IdTaken(id uint32) bool {
+	_, ok := m.byId[id]
+	return ok
+}
+
+// Returns existing cashpoints not matched to any incoming one sorted by id
+func (m *Matcher) Unmatched() []*TntCashpoint {
+	result := make([]*TntCashpoint, 0)
+	for id, cp := range m.byId {
+		if !m.matched[id] {
+			result = append(result, cp)
+		}
+	}
+	sort.Sort(tntCashpointList(result))
+	return result
+}
+
+type tntCashpointList []*TntCashpoint
+
+func (l tntCashpointList) Len() int {
+	return len(l)
+}
+
+func (l tntCashpointList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+func (l tntCashpointList) Less(i, j int) bool {
+	return l[i].Id < l[j].Id
+}
+
+type Merger struct {
+	tnt             *tarantool.Connection
+	store           *cluster.Store
+	user            string
+	dryRun          bool
+	cashpointsSpace uint32
+	townsSpace      uint32
+	patchesSpace    uint32
+	votesSpace      uint32
+	timestamp       uint64
+}
+
+func NewMerger(tnt *tarantool.Connection, user string, dryRun bool) (*Merger, error) {
+	m := &Merger{tnt: tnt, user: user, dryRun: dryRun}
+
+	var err error
+	m.store, err = cluster.NewStore(tnt)
+	if err != nil {
+		return nil, err
+	}
+	spaces := map[string]*uint32{
+		"cashpoints":               &m.cashpointsSpace,
+		"towns":                    &m.townsSpace,
+		"cashpoints_patches":       &m.patchesSpace,
+		"cashpoints_patches_votes": &m.votesSpace,
+	}
+	for name, spaceId := range spaces {
+		*spaceId, err = getTntSpaceId(tnt, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// same units as fiber.time64()
+	m.timestamp = uint64(time.Now().UnixNano() / 1000)
+	return m, nil
+}
+
+func (m *Merger) loadCashpoints() ([]*TntCashpoint, error) {
+	result := make([]*TntCashpoint, 0)
+	err := m.store.ForEachCashpoint(func(tuple []interface{}) error {
+		result = append(result, tupleToTntCashpoint(tuple))
+		return nil
+	})
+	return result, err
+}
+
+// Proposes patch of import user. Pending patch of import user for same
+// cashpoint is replaced (with its votes). Returns false if the same patch
+// has been already proposed.
+func (m *Merger) proposePatch(cpId uint32, patch map[string]interface{}) (bool, error) {
+	patchJson, err := json.Marshal(patch)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := m.tnt.Select(m.patchesSpace, PATCHES_INDEX_TARGET, 0, math.MaxUint32, tarantool.IterEq, []interface{}{cpId, m.user})
+	if err != nil {
+		return false, err
+	}
+	for _, tuple := range resp.Tuples() {
+		var data interface{}
+		if str, ok := tuple[COL_PATCH_DATA].(string); ok && json.Unmarshal([]byte(str), &data) == nil {
+			if reflect.DeepEqual(data, normalizeValue(patch)) {
+				return false, nil
+			}
+		}
+
+		if m.dryRun {
+			continue
+		}
+		patchId, _ := toUint64(tuple[COL_PATCH_ID])
+		err = m.deletePatch(patchId)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if m.dryRun {
+		return true, nil
+	}
+	// patch id is allocated by tarantool, ids of concurrently proposed patches
+	// do not collide
+	resp, err = m.tnt.Call("cashpointInsertPatch", []interface{}{cpId, m.user, string(patchJson), m.timestamp})
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Data) == 0 {
+		return false, errors.New("empty cashpointInsertPatch reply")
+	}
+	tuple, ok := resp.Data[0].([]interface{})
+	if !ok || len(tuple) == 0 {
+		return false, errors.New("unexpected cashpointInsertPatch reply")
+	}
+	if _, ok = toUint64(tuple[0]); !ok {
+		return false, errors.New("invalid id of inserted patch")
+	}
+	return true, nil
+}
+
+// Same as _deleteCashpointPatches in tarantool api: votes go first
+func (m *Merger) deletePatch(patchId uint64) error {
+	resp, err := m.tnt.Select(m.votesSpace, VOTES_INDEX_PATCH, 0, math.MaxUint32, tarantool.IterEq, []interface{}{patchId})
+	if err != nil {
+		return err
+	}
+	for _, tuple := range resp.Tuples() {
+		_, err = m.tnt.Delete(m.votesSpace, 0, []interface{}{tuple[0]})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = m.tnt.Delete(m.patchesSpace, PATCHES_INDEX_PRIMARY, []interface{}{patchId})
+	return err
+}
+
+// Inserts new approved cashpoint created by import user
+func (m *Merger) insertCashpoint(cp *models.Cashpoint) error {
+	if m.dryRun {
+		return nil
+	}
+	var version uint32 = 0
+	approved := true
+	_, err := m.tnt.Insert(m.cashpointsSpace, []interface{}{
+		cp.Id, []float32{float32(cp.Longitude), float32(cp.Latitude)}, cp.Type, cp.BankId, cp.TownId,
+		cp.Address, cp.AddressComment,
+		cp.MetroName, cp.FreeAccess,
+		cp.MainOffice, cp.WithoutWeekend,
+		cp.RoundTheClock, cp.WorksAsShop,
+		scheduleJson(cp), cp.Tel, cp.Additional,
+		cp.Currency, cp.CashIn,
+		version, m.timestamp, approved, m.user,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.tnt.Update(m.townsSpace, 0, []interface{}{cp.TownId}, []interface{}{
+		[]interface{}{"+", COL_TOWN_CP_COUNT, 1},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = m.tnt.Call("syncLogTouch", []interface{}{"cashpoint", cp.Id, cp.TownId, m.timestamp})
+	return err
+}
+
+func (m *Merger) Merge(cpDb *sql.DB, radius float64) (*MergeReport, error) {
+	context := "merge"
+
+	report := &MergeReport{
+		Timestamp:       time.Now().UTC().Format(time.RFC3339),
+		DryRun:          m.dryRun,
+		ImportUser:      m.user,
+		Patched:         make([]uint32, 0),
+		AlreadyProposed: make([]uint32, 0),
+		Created:         make([]uint32, 0),
+		Conflicts:       make([]uint32, 0),
+		Missing:         make([]MergeMissing, 0),
+	}
+
+	existing, err := m.loadCashpoints()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("%s: loaded %d cashpoints from tarantool", context, len(existing))
+	matcher := NewMatcher(existing, radius)
+
+	rows, err := cpDb.Query(CASHPOINTS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cp, err := scanCashpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		report.Source++
+
+		old, byId := matcher.Match(cp)
+		if old == nil {
+			if matcher.IdTaken(cp.Id) {
+				// id is used by cashpoint of another bank
+				report.Conflicts = append(report.Conflicts, cp.Id)
+				continue
+			}
+			err = m.insertCashpoint(cp)
+			if err != nil {
+				return nil, fmt.Errorf("cannot insert cashpoint %d: %v", cp.Id, err)
+			}
+			report.Created = append(report.Created, cp.Id)
+			continue
+		}
+
+		if byId {
+			report.MatchedById++
+		} else {
+			report.MatchedByCoord++
+		}
+
+		patch := diffCashpoint(old, cp)
+		if patch == nil {
+			report.Unchanged++
+			continue
+		}
+
+		proposed, err := m.proposePatch(old.Id, patch)
+		if err != nil {
+			return nil, fmt.Errorf("cannot propose patch for cashpoint %d: %v", old.Id, err)
+		}
+		if proposed {
+			report.Patched = append(report.Patched, old.Id)
+		} else {
+			report.AlreadyProposed = append(report.AlreadyProposed, old.Id)
+		}
+
+		if report.Source%500 == 0 {
+			log.Printf("%s: %d cashpoints processed", context, report.Source)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, cp := range matcher.Unmatched() {
+		report.Missing = append(report.Missing, MergeMissing{
+			Id:       cp.Id,
+			BankId:   cp.BankId,
+			TownId:   cp.TownId,
+			Approved: cp.Approved,
+			Creator:  cp.Creator,
+		})
+	}
+
+	// new cashpoints have to get into clusters
+	if len(report.Created) > 0 && !m.dryRun {
+		reclusterReport, err := cluster.Recluster(m.store, report.Created, false)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("%s: clusters: created = %d, updated = %d", context, len(reclusterReport.Created), len(reclusterReport.Updated))
+	}
+
+	return report, nil
+}
+
+// server_sqlite_to_tarantool merge [-user import] [-radius 50] [-dry-run] [-o report.json] <cashpoints db> <tarantool url>
+func merge(args []string) {
+	context := "merge"
+
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	user := flags.String("user", DEFAULT_IMPORT_USER, "user id patches are attributed to")
+	radius := flags.Float64("radius", DEFAULT_MATCH_RADIUS, "max distance in meters to match cashpoints of the same bank")
+	dryRun := flags.Bool("dry-run", false, "do not modify tarantool, only print report")
+	outputPath := flags.String("o", "", "write report into file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s merge [options] <cashpoints db> <tarantool url>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cpDb, err := sql.Open("sqlite3", flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cpDb.Close()
+
+	tnt, err := connectTnt(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tnt.Close()
+
+	merger, err := NewMerger(tnt, *user, *dryRun)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	report, err := merger.Merge(cpDb, *radius)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	log.Printf("%s: source = %d, unchanged = %d, patched = %d, created = %d, conflicts = %d, missing = %d", context,
+		report.Source, report.Unchanged, len(report.Patched), len(report.Created), len(report.Conflicts), len(report.Missing))
+
+	reportJson, _ := json.MarshalIndent(report, "", "  ")
+	reportJson = append(reportJson, '\n')
+	if *outputPath != "" {
+		err = ioutil.WriteFile(*outputPath, reportJson, 0644)
+		if err != nil {
+			log.Fatalf("%s: %v", context, err)
+		}
+	} else {
+		os.Stdout.Write(reportJson)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/alexeyknyshev/models"
+	"math"
+	"testing"
+)
+
+func getMergeTestCashpoint() *models.Cashpoint {
+	cp := &models.Cashpoint{
+		CashpointData: models.CashpointData{
+			Id:            10,
+			Type:          "atm",
+			BankId:        322,
+			TownId:        4,
+			Longitude:     37.6177,
+			Latitude:      55.7557,
+			Address:       "ул. Тверская, д. 1",
+			FreeAccess:    true,
+			RoundTheClock: true,
+			Schedule:      models.Schedule{Mon: &models.ScheduleDay{From: 0, To: 1440}},
+			Currency:      []uint32{models.CURRENCY_RUB, models.CURRENCY_USD},
+			CashIn:        true,
+		},
+	}
+	return cp
+}
+
+// Tuple as stored by migrateCashpoints
+func getMergeTestTuple(cp *models.Cashpoint) []interface{} {
+	currency := make([]interface{}, 0)
+	for _, code := range cp.Currency {
+		currency = append(currency, uint64(code))
+	}
+	return []interface{}{
+		uint64(cp.Id), []interface{}{float64(cp.Longitude), float64(cp.Latitude)}, cp.Type, uint64(cp.BankId), uint64(cp.TownId),
+		cp.Address, cp.AddressComment,
+		cp.MetroName, cp.FreeAccess,
+		cp.MainOffice, cp.WithoutWeekend,
+		cp.RoundTheClock, cp.WorksAsShop,
+		scheduleJson(cp), cp.Tel, cp.Additional,
+		currency, cp.CashIn,
+		uint64(0),
+	}
+}
+
+func TestDistance(t *testing.T) {
+	if d := distance(37.6177, 55.7557, 37.6177, 55.7557); d != 0.0 {
+		t.Errorf("Expected zero distance but got %f", d)
+	}
+	// 0.001 degree of latitude is about 111 meters
+	if d := distance(37.6177, 55.7557, 37.6177, 55.7567); math.Abs(d-111.2) > 0.5 {
+		t.Errorf("Expected distance about 111.2 meters but got %f", d)
+	}
+}
+
+func TestDiffCashpoint(t *testing.T) {
+	cp := getMergeTestCashpoint()
+	existing := tupleToTntCashpoint(getMergeTestTuple(cp))
+	if !existing.Approved {
+		t.Errorf("Expected cashpoint without approved column to be approved")
+	}
+
+	if patch := diffCashpoint(existing, cp); patch != nil {
+		t.Errorf("Expected no patch for same cashpoint but got %v", patch)
+	}
+
+	cp.Tel = "+7 495 000-00-00"
+	cp.Currency = append(cp.Currency, models.CURRENCY_EUR)
+	cp.Latitude += 0.001
+	patch := diffCashpoint(existing, cp)
+	if len(patch) != 5 {
+		t.Fatalf("Expected patch with id, tel, currency and coordinates but got %v", patch)
+	}
+	if patch["id"] != uint32(10) || patch["tel"] != cp.Tel {
+		t.Errorf("Unexpected patch: %v", patch)
+	}
+	if currency, ok := patch["currency"].([]interface{}); !ok || len(currency) != 3 {
+		t.Errorf("Expected 3 currencies in patch but got %v", patch["currency"])
+	}
+	if _, ok := patch["latitude"]; !ok {
+		t.Errorf("Expected coordinates in patch: %v", patch)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	cp := getMergeTestCashpoint()
+	byIdTuple := getMergeTestTuple(cp)
+
+	near := *cp
+	near.Id = 20
+	near.Latitude += 0.0002 // ~22 meters
+	nearTuple := getMergeTestTuple(&near)
+	nearTuple[0] = uint64(1020) // user created cashpoint with another id
+
+	otherBank := *cp
+	otherBank.Id = 30
+	otherBank.BankId = 100
+	otherBankTuple := getMergeTestTuple(&otherBank)
+
+	matcher := NewMatcher([]*TntCashpoint{
+		tupleToTntCashpoint(byIdTuple),
+		tupleToTntCashpoint(nearTuple),
+		tupleToTntCashpoint(otherBankTuple),
+	}, DEFAULT_MATCH_RADIUS)
+
+	if existing, byId := matcher.Match(cp); existing == nil || existing.Id != 10 || !byId {
+		t.Errorf("Expected match by id: %+v %v", existing, byId)
+	}
+	if existing, byId := matcher.Match(&near); existing == nil || existing.Id != 1020 || byId {
+		t.Errorf("Expected match by coordinates: %+v %v", existing, byId)
+	}
+
+	// id 30 is used by cashpoint of another bank
+	conflict := *cp
+	conflict.Id = 30
+	conflict.Longitude += 0.01
+	if existing, _ := matcher.Match(&conflict); existing != nil {
+		t.Errorf("Expected no match but got %+v", existing)
+	}
+	if !matcher.IdTaken(30) {
+		t.Errorf("Expected id 30 to be taken")
+	}
+
+	unmatched := matcher.Unmatched()
+	if len(unmatched) != 1 || unmatched[0].Id != 30 {
+		t.Errorf("Expected only cashpoint 30 to be unmatched but got %v", unmatched)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/alexeyknyshev/cluster"
+	"github.com/tarantool/go-tarantool"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func parseIdList(s string) ([]uint32, error) {
+	result := make([]uint32, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, errors.New("invalid cashpoint id: " + part)
+		}
+		result = append(result, uint32(id))
+	}
+	return result, nil
+}
+
+// Accepts unix time in seconds or RFC3339 time, returns microseconds
+// like fiber.time64() used for cashpoints timestamps
+func parseSince(s string) (uint64, error) {
+	if seconds, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return seconds * 1000000, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.New("invalid since timestamp: " + s)
+	}
+	if t.Unix() < 0 {
+		return 0, errors.New("since timestamp is before unix epoch: " + s)
+	}
+	return uint64(t.UnixNano() / 1000), nil
+}
+
+func printReclusterReport(report *cluster.Report, verbose bool) {
+	fmt.Printf("cashpoints: %d\n", report.Cashpoints)
+	fmt.Printf("clusters: created = %d, updated = %d, deleted = %d, unchanged = %d\n",
+		len(report.Created), len(report.Updated), len(report.Deleted), len(report.Unchanged))
+
+	byZoom := report.TouchedByZoom()
+	zoomList := make([]int, 0, len(byZoom))
+	for zoom := range byZoom {
+		zoomList = append(zoomList, zoom)
+	}
+	sort.Ints(zoomList)
+	for _, zoom := range zoomList {
+		fmt.Printf("  zoom %2d: %d touched\n", zoom, byZoom[zoom])
+	}
+
+	if verbose {
+		for _, quadKey := range report.Created {
+			fmt.Printf("created %s\n", quadKey)
+		}
+		for _, quadKey := range report.Updated {
+			fmt.Printf("updated %s\n", quadKey)
+		}
+		for _, quadKey := range report.Deleted {
+			fmt.Printf("deleted %s\n", quadKey)
+		}
+	}
+}
+
+// Remembers positions of migrated cashpoints clusters are built from,
+// so recluster finds clusters moved and deleted cashpoints are left in
+func migrateClusteredCashpoints(tnt *tarantool.Connection) {
+	context := "migrateClusteredCashpoints"
+
+	store, err := cluster.NewStore(tnt)
+	if err != nil {
+		log.Fatalf("%s: %v\n", context, err)
+	}
+	err = store.ResetClustered()
+	if err != nil {
+		log.Fatalf("%s: cannot save clustered positions: %v\n", context, err)
+	}
+	log.Printf("%s: clustered positions saved\n", context)
+}
+
+// server_sqlite_to_tarantool recluster [-ids 1,2,3] [-since time] [-dry-run] [-v] <tarantool url>
+func recluster(args []string) {
+	context := "recluster"
+
+	flags := flag.NewFlagSet("recluster", flag.ExitOnError)
+	idsStr := flags.String("ids", "", "comma separated list of changed cashpoints ids")
+	sinceStr := flags.String("since", "", "recluster cashpoints changed or deleted since unix time (seconds) or RFC3339 time")
+	dryRun := flags.Bool("dry-run", false, "do not modify clusters, only print summary")
+	verbose := flags.Bool("v", false, "print every touched cluster")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s recluster [options] <tarantool url>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if (*idsStr == "") == (*sinceStr == "") {
+		log.Fatalf("%s: exactly one of -ids or -since has to be specified", context)
+	}
+
+	tnt, err := connectTnt(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tnt.Close()
+
+	store, err := cluster.NewStore(tnt)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	var ids []uint32
+	if *idsStr != "" {
+		ids, err = parseIdList(*idsStr)
+	} else {
+		var since uint64
+		since, err = parseSince(*sinceStr)
+		if err == nil {
+			ids, err = store.CashpointsChangedSince(since)
+		}
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	log.Printf("%s: reclustering %d cashpoints", context, len(ids))
+
+	report, err := cluster.Recluster(store, ids, *dryRun)
+	if err != nil {
+		log.Fatalf("%s: %v", context, err)
+	}
+
+	printReclusterReport(report, *verbose)
+}
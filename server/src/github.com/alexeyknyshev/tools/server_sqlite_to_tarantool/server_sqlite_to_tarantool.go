@@ -4,7 +4,8 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"github.com/alexeyknyshev/models"
+	"github.com/alexeyknyshev/quadkey"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/tarantool/go-tarantool"
 	"log"
@@ -14,7 +15,7 @@ import (
 	"strings"
 	"sync"
 	//"bytes"
-	//"sort"
+	"sort"
 	"time"
 	//"io"
 	"unicode"
@@ -27,395 +28,6 @@ func boolToInt(val bool) uint {
 	return 0
 }
 
-type Town struct {
-	Id              uint32  `json:"id"`
-	Name            string  `json:"name"`
-	NameTr          string  `json:"name_tr"`
-	RegionId        *uint32 `json:"region_id"`
-	RegionalCenter  bool    `json:"regional_center"`
-	Latitude        float32 `json:"latitude"`
-	Longitude       float32 `json:"longitude"`
-	Zoom            uint32  `json:"zoom"`
-	Big             bool    `json:"big"`
-	CashpointsCount uint32  `json:"cashpoints_count"`
-}
-
-type Region struct {
-	Id        uint32  `json:"id"`
-	Name      string  `json:"name"`
-	NameTr    string  `json:"name_tr"`
-	Latitude  float32 `json:"latitude"`
-	Longitude float32 `json:"longitude"`
-	Zoom      uint32  `json:"zoom"`
-}
-
-type Bank struct {
-	Id        uint32   `json:"id"`
-	Name      string   `json:"name"`
-	NameTr    string   `json:"name_tr"`
-	NameTrAlt string   `json:"name_tr_alt"`
-	Town      string   `json:"town"`
-	Licence   uint32   `json:"licence"`
-	Rating    uint32   `json:"rating"`
-	Tel       string   `json:"tel"`
-	Partners  []uint32 `json:"partners"`
-}
-
-type CashPoint struct {
-	Id             uint32  `json:"id"`
-	Type           string  `json:"type"`
-	BankId         uint32  `json:"bank_id"`
-	TownId         uint32  `json:"town_id"`
-	Longitude      float32 `json:"longitude"`
-	Latitude       float32 `json:"latitude"`
-	Address        string  `json:"address"`
-	AddressComment string  `json:"address_comment"`
-	MetroName      string  `json:"metro_name"`
-	FreeAccess     bool    `json:"free_access"`
-	MainOffice     bool    `json:"main_office"`
-	WithoutWeekend bool    `json:"without_weekend"`
-	RoundTheClock  bool    `json:"round_the_clock"`
-	WorksAsShop    bool    `json:"works_as_shop"`
-	Schedule       string  `json:"schedule"`
-	Tel            string  `json:"tel"`
-	Additional     string  `json:"additional"`
-	Rub            bool    `json:"rub"`
-	Usd            bool    `json:"usd"`
-	Eur            bool    `json:"eur"`
-	CashIn         bool    `json:"cash_in"`
-	Version        uint32  `json:"version"`
-	Timestamp      uint32  `json:"timestamp"`
-}
-
-type ClusterData struct {
-	QuadKey   string  `json:"quadkey"`
-	Longitude float32 `json:"longitude"`
-	Latitude  float32 `json:"latitude"`
-	Size      uint32  `json:"size"`
-}
-
-// ================= Schedule =================
-
-type ScheduleBreak struct {
-	From int `json:"f"`
-	To   int `json:"t"`
-}
-
-type ScheduleDay struct {
-	Day   int `json:"-"`
-	From  int `json:"f"`
-	To    int `json:"t"`
-	Breaks *[]ScheduleBreak `json:"b,omitempty"`
-}
-
-type Schedule struct {
-	Mon *ScheduleDay `json:"mon,omitempty"`
-	Tue *ScheduleDay `json:"tue,omitempty"`
-	Wed *ScheduleDay `json:"wed,omitempty"`
-	Thu *ScheduleDay `json:"thu,omitempty"`
-	Fri *ScheduleDay `json:"fri,omitempty"`
-	Sat *ScheduleDay `json:"sat,omitempty"`
-	Sun *ScheduleDay `json:"sun,omitempty"`
-	Breaks *[]ScheduleBreak `json:"b,omitempty"`
-}
-
-func (s *Schedule) SetCommonTime(from, to int) {
-	if s.Mon != nil {
-		s.Mon.From = from
-		s.Mon.To = to
-	}
-	if s.Tue != nil {
-		s.Tue.From = from
-		s.Tue.To = to
-	}
-	if s.Wed != nil {
-		s.Wed.From = from
-		s.Wed.To = to
-	}
-	if s.Thu != nil {
-		s.Thu.From = from
-		s.Thu.To = to
-	}
-	if s.Fri != nil {
-		s.Fri.From = from
-		s.Fri.To = to
-	}
-	if s.Sat != nil {
-		s.Sat.From = from
-		s.Sat.To = to
-	}
-	if s.Sun != nil {
-		s.Sun.From = from
-		s.Sun.To = to
-	}
-
-// 	b := &ScheduleBreak{
-// 		From: from,
-// 		To:   to,
-// 	}
-// 	s.Breaks = append(b)
-}
-
-func (s *Schedule) Clear() {
-	s.Mon = nil
-	s.Tue = nil
-	s.Wed = nil
-	s.Thu = nil
-	s.Fri = nil
-	s.Sat = nil
-	s.Sun = nil
-
-	s.Breaks = nil
-}
-
-func (s *Schedule) Merge(o *Schedule) {
-// 	sj, _ := json.Marshal(s)
-// 	oj, _ := json.Marshal(o)
-// 	log.Printf("merging %s with %s", string(sj), string(oj))
-
-	if s.Mon == nil { s.Mon = o.Mon }
-	if s.Tue == nil { s.Tue = o.Tue }
-	if s.Wed == nil { s.Wed = o.Wed }
-	if s.Thu == nil { s.Thu = o.Thu }
-	if s.Fri == nil { s.Fri = o.Fri }
-	if s.Sat == nil { s.Sat = o.Sat }
-	if s.Sun == nil { s.Sun = o.Sun }
-
-	if o.Breaks != nil {
-		if s.Breaks != nil {
-			*s.Breaks = append(*s.Breaks, *o.Breaks...)
-		} else {
-			s.Breaks = o.Breaks
-		}
-	}
-}
-
-func (s *Schedule) AppendDayRange(dayRange []int) {
-	for _, d := range dayRange {
-		switch (d) {
-			case 0: if s.Mon == nil { s.Mon = new(ScheduleDay) }
-			case 1: if s.Tue == nil { s.Tue = new(ScheduleDay) }
-			case 2: if s.Wed == nil { s.Wed = new(ScheduleDay) }
-			case 3: if s.Thu == nil { s.Thu = new(ScheduleDay) }
-			case 4: if s.Fri == nil { s.Fri = new(ScheduleDay) }
-			case 5: if s.Sat == nil { s.Sat = new(ScheduleDay) }
-			case 6: if s.Sun == nil { s.Sun = new(ScheduleDay) }
-		}
-	}
-}
-
-var Days = [...]string{  "пн.", "вт.", "ср.", "чт.", "пт.", "сб.", "вс." }
-
-const KT_INVALID = -1
-const KT_BREAK = 0
-const KT_DAY_RANGE = 1
-const KT_DAY_SINGLE = 2
-
-func keyType(s string) int {
-	if (s == "перерыв") {
-		return KT_BREAK // break
-	} else if strings.IndexAny(s, "-—") != -1 {
-		return KT_DAY_RANGE // day range
-	} else {
-		for _, d := range Days {
-			if s == d {
-				return KT_DAY_SINGLE
-			}
-		}
-		return KT_INVALID // single day
-	}
-}
-
-func parseDay(s string) int {
-	for i, d := range Days {
-		if d == s {
-			return i
-		}
-	}
-	return -1
-}
-
-func ParseDayRange(s string) ([]int, error) {
-	result := make([]int, 0)
-	s = strings.TrimRight(s, ":")
-	s = strings.Replace(s, "—", "-", -1)
-	s = strings.Replace(s, "–", "-", -1)
-	parts := strings.Split(s, ",")
-	for _, p := range parts {
-		dayRange := strings.Split(p, "-")
-		if len(dayRange) == 2 {
-			rangeStart := parseDay(dayRange[0])
-			rangeEnd := parseDay(dayRange[1])
-
-			if rangeStart == -1 {
-				return result, fmt.Errorf("invalid day range start: %s => %s", p, dayRange[0])
-			} else if rangeEnd == -1 {
-				return result, fmt.Errorf("invalid day range end: %s => %s", p, dayRange[1])
-			} else if rangeStart >= rangeEnd {
-				return result, fmt.Errorf("invalid day range, start gt end: %s", p)
-			} else {
-				for i := rangeStart; i <= rangeEnd; i++ {
-					result = append(result, i)
-				}
-			}
-		} else {
-			day := parseDay(p)
-			if day != -1 {
-				result = append(result, day)
-			} else {
-				return result, fmt.Errorf("unknown day range format: %s", p)
-			}
-		}
-	}
-	return result, nil
-}
-
-func ParseTime(s string) (min int, ok bool) {
-	parts := strings.Split(s, ":")
-	if len(parts) != 2 {
-		log.Printf("wrong time format: %s", s)
-		min = 0; ok = false
-		return
-	}
-
-	h, err := strconv.Atoi(parts[0])
-	if err != nil {
-		log.Printf("wrong time format: %s", s)
-		min = 0; ok = false
-		return
-	}
-
-	min, err = strconv.Atoi(parts[1])
-	if err != nil {
-		log.Printf("wrong time format: %s", s)
-		min = 0; ok = false
-		return
-	}
-
-	min = h * 60 + min
-	ok = true
-	return
-}
-
-// Splits strings like: 09:00—15:30. Return range in minutes from 00:00
-func SplitTime(s string) (from int, to int, ok bool) {
-	if (s == "круглосуточно") {
-		from = 0; to = 1439; ok = true
-		return
-	}
-
-	s = strings.Replace(s, "—", "-", -1)
-	s = strings.Replace(s, "–", "-", -1)
-	parts := strings.Split(s, "-")
-	if len(parts) != 2 {
-		log.Printf("wrong parts count in time range: %s", s)
-		from = 0; to = 0; ok = false
-		return
-	}
-
-	from, ok = ParseTime(parts[0])
-	if !ok {
-		from = 0; to = 0
-		return
-	}
-
-	to, ok = ParseTime(parts[1])
-	if !ok {
-		from = 0; to = 0
-		return
-	}
-
-	ok = true
-	return
-}
-
-func ParseSchedule(schedule string) (Schedule, error) {
-	var result Schedule
-	if schedule == "" {
-		return result, nil
-	}
-
-	strings.Replace(schedule, "<br/>", "\n", -1)
-
-	parseKey := func(key string) (Schedule, error) {
-		var result Schedule
-		fields := strings.Split(key, ",")
-
-		kType := -1
-		for _, f := range fields {
-// 			log.Printf("parsing dayRange part %s", f)
-			kType = keyType(f)
-// 			log.Printf("detected key type: %d", kType)
-
-			if kType == KT_INVALID {
-				continue
-			} else if kType == KT_BREAK {
-				// TODO: support parsing breaks
-			} else if kType == KT_DAY_RANGE || kType == KT_DAY_SINGLE {
-				dayRange, err := ParseDayRange(f)
-// 				log.Printf("dayRange: %v", dayRange)
-				if err != nil {
-					return result, err
-				}
-				result.AppendDayRange(dayRange)
-			}
-		}
-
-		return result, nil
-	}
-
-	lineList := strings.Split(schedule, "\n")
-	for _, line := range lineList {
-		fields := strings.Fields(line)
-// 		fJson, _ := json.Marshal(fields)
-// 		log.Printf("fields: %s", string(fJson))
-		var tmpSchedule Schedule
-		var err error
-		for _, f := range fields {
-			if strings.LastIndex(f, ":") == len(f) - 1 { // key
-				f = f[:len(f) - 1]
-// 				log.Printf("parsing key: %s", f)
-				tmpSchedule, err = parseKey(f)
-				if err != nil {
-					return result, fmt.Errorf("cannot parse key: %s => %v", f, err)
-				}
-			} else { // value
-				from, to, ok := SplitTime(f)
-				if ok {
-					tmpSchedule.SetCommonTime(from, to)
-					j, _ := json.Marshal(tmpSchedule)
-					log.Printf("%s", string(j))
-					result.Merge(&tmpSchedule)
-					tmpSchedule.Clear()
-				} else {
-					return result, fmt.Errorf("cannot split time: %s", f)
-				}
-			}
-		}
-	}
-
-	return result, nil
-}
-
-// ================= Schedule =================
-
-type Task struct {
-	Zoom     uint32
-	TopLat   float32
-	BotLat   float32
-	LeftLon  float32
-	RightLon float32
-	QuadKey  string
-}
-
-type TaskResult struct {
-	Zoom      uint32
-	Points    []uint32
-	Longitude float32
-	Latitude  float32
-	QuadKey   string
-}
-
 func StringClear(r rune) rune {
 	if r == '\n' {
 		return ','
@@ -426,143 +38,57 @@ func StringClear(r rune) rune {
 	return -1
 }
 
-func (cp *CashPoint) Postprocess() {
+// Cleans text fields and parses schedule text of sqlite database
+func postprocessCashpoint(cp *models.Cashpoint, schedule string) {
 	cp.Address = strings.Map(StringClear, cp.Address)
 	cp.AddressComment = strings.Map(StringClear, cp.AddressComment)
-	//cp.Schedule = strings.Map(StringClear, cp.Schedule)
-	schedule, err := ParseSchedule(cp.Schedule)
+	var err error
+	cp.Schedule, err = models.ParseSchedule(schedule)
 	if err != nil {
 		log.Printf("Cannot parse schedule for cashpoint with id: %d", cp.Id)
-		return
 	}
-	scheduleJson, _ := json.Marshal(schedule)
-// 	log.Printf("%s", string(scheduleJson))
-	cp.Schedule = string(scheduleJson)
 
 	cp.Tel = strings.Map(StringClear, cp.Tel)
 	cp.Additional = strings.Map(StringClear, cp.Additional)
 }
 
-func newTask(zoom uint32, topLat, botLat, leftLon, rightLon float32, quadKey string) *Task {
-	return &Task{Zoom: zoom, TopLat: topLat, BotLat: botLat, LeftLon: leftLon, RightLon: rightLon, QuadKey: quadKey}
+// Schedule is stored in tarantool as json string
+func scheduleJson(cp *models.Cashpoint) string {
+	data, _ := json.Marshal(cp.Schedule)
+	return string(data)
 }
 
-func getRegionIdList(topLat, botLat, leftLon, rightLon float32, stmt *sql.Stmt, mutex *sync.Mutex) (TaskResult, error) {
-	context := "getRegionIdList"
-	result := TaskResult{}
+const CASHPOINTS_QUERY = `SELECT id, type, bank_id, town_id,
+                                 longitude, latitude,
+                                 address, address_comment,
+                                 metro_name, free_access,
+                                 main_office, without_weekend,
+                                 round_the_clock, works_as_shop,
+                                 schedule_general, tel, additional,
+                                 rub, usd, eur, cash_in FROM cashpoints`
 
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	rows, err := stmt.Query(topLat, botLat, leftLon, rightLon)
+// Scans row of CASHPOINTS_QUERY
+func scanCashpoint(rows *sql.Rows) (*models.Cashpoint, error) {
+	cp := new(models.Cashpoint)
+	cp.Version = 0
+	cp.Timestamp = 0
+	var schedule string
+	var rub, usd, eur bool
+	err := rows.Scan(&cp.Id, &cp.Type, &cp.BankId, &cp.TownId,
+		&cp.Longitude, &cp.Latitude,
+		&cp.Address, &cp.AddressComment,
+		&cp.MetroName, &cp.FreeAccess,
+		&cp.MainOffice, &cp.WithoutWeekend,
+		&cp.RoundTheClock, &cp.WorksAsShop,
+		&schedule, &cp.Tel, &cp.Additional,
+		&rub, &usd, &eur, &cp.CashIn)
 	if err != nil {
-		return result, err
+		return nil, err
 	}
 
-	result.Points = make([]uint32, 0)
-	result.Longitude = 0.0
-	result.Latitude = 0.0
-
-	for rows.Next() {
-		var id uint32 = 0
-		var longitude float32 = 0.0
-		var latitude float32 = 0.0
-
-		err = rows.Scan(&id, &longitude, &latitude)
-		if err != nil {
-			log.Fatalf("%s: sql scan error: %v\n", context, err)
-		}
-
-		result.Longitude += longitude
-		result.Latitude += latitude
-
-		result.Points = append(result.Points, id)
-	}
-
-	count := len(result.Points)
-	if count > 0 {
-		result.Longitude = result.Longitude / float32(count)
-		result.Latitude = result.Latitude / float32(count)
-	}
-
-	return result, nil
-}
-
-func doTask(task *Task, maxZoom uint32, asyncSubCount int, stmt *sql.Stmt, dbMutex *sync.Mutex, wg *sync.WaitGroup, c chan TaskResult) {
-	context := "doTask"
-	if asyncSubCount > 0 {
-		asyncSubCount--
-		defer wg.Done()
-	}
-
-	//log.Printf("%s: added task for quadkey = %s", context, task.QuadKey)
-
-	result, err := getRegionIdList(task.TopLat, task.BotLat, task.LeftLon, task.RightLon, stmt, dbMutex)
-	if err != nil {
-		log.Fatalf("%s: cannot get cp ids for task (quadKey = %s): sql error: %v", context, task.QuadKey, err)
-		return
-	}
-
-	count := len(result.Points)
-	if count != 0 {
-
-		// prepare subtasks
-
-		if task.Zoom < maxZoom {
-			nextZoom := task.Zoom + 1
-
-			var midLat float32 = (task.TopLat + task.BotLat) * 0.5
-			var midLon float32 = (task.LeftLon + task.RightLon) * 0.5
-
-			taskList := make([]*Task, 0)
-			taskList = append(taskList, newTask(nextZoom, task.TopLat, midLat, task.LeftLon, midLon, task.QuadKey+"0"))
-			taskList = append(taskList, newTask(nextZoom, midLat, task.BotLat, task.LeftLon, midLon, task.QuadKey+"2"))
-			taskList = append(taskList, newTask(nextZoom, task.TopLat, midLat, midLon, task.RightLon, task.QuadKey+"1"))
-			taskList = append(taskList, newTask(nextZoom, midLat, task.BotLat, midLon, task.RightLon, task.QuadKey+"3"))
-
-			asyncSubCount /= len(taskList)
-			for _, task := range taskList {
-				if asyncSubCount > 0 {
-					wg.Add(1)
-					go doTask(task, maxZoom, asyncSubCount, stmt, dbMutex, wg, c)
-				} else {
-					doTask(task, maxZoom, asyncSubCount, stmt, dbMutex, wg, c)
-				}
-			}
-		}
-
-		// write cluster data
-
-		//		log.Printf("%s: finished task (quadkey = %s): count = %d, lon = %f, lat = %f\n", context, task.QuadKey, count, avgLon, avgLat)
-		result.Zoom = task.Zoom
-		result.QuadKey = task.QuadKey
-		c <- result
-	}
-}
-
-func getGeoRectPart(minLon, maxLon, minLat, maxLat *float64, lon, lat float64) string {
-	midLon := (*minLon + *maxLon) * 0.5
-	midLat := (*minLat + *maxLat) * 0.5
-
-	if lat < midLat {
-		*maxLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "0"
-		} else {
-			*minLon = midLon
-			return "1"
-		}
-	} else {
-		*minLat = midLat
-		if lon < midLon {
-			*maxLon = midLon
-			return "2"
-		} else {
-			*minLon = midLon
-			return "3"
-		}
-	}
+	cp.Currency = models.CurrencyFromFlags(rub, usd, eur)
+	postprocessCashpoint(cp, schedule)
+	return cp, nil
 }
 
 const CHAN_BUFFER_SIZE = 512
@@ -588,21 +114,16 @@ func clusteringWorker(in chan CPClusteringRequest, minZoom, maxZoom uint32) chan
 			// 			log.Printf("%s: got task: id = %d, lon = %f, lat = %f", context, request.Id, request.Longitude, request.Latitude)
 			response := CPClusteringResponse{Id: request.Id}
 
-			var minLon float64 = -180.0
-			var maxLon float64 = 180.0
-
-			var minLat float64 = -90.0
-			var maxLat float64 = 90.0
-
-			quadKey := ""
-			for zoom := uint32(0); zoom < maxZoom; zoom++ {
-				quadKey += getGeoRectPart(&minLon, &maxLon, &minLat, &maxLat, request.Longitude, request.Latitude)
-				if zoom >= minZoom {
-					response.QuadKey = quadKey
-					response.Zoom = zoom
-					//log.Printf("%s: response ready: id = %d, quadkey = %s", context, response.Id, response.QuadKey)
-					out <- response
-				}
+			quadKey, err := quadkey.Encode(request.Longitude, request.Latitude, maxZoom)
+			if err != nil {
+				log.Printf("%s: cannot get quadkey for cashpoint: id = %d, lon = %f, lat = %f", context, request.Id, request.Longitude, request.Latitude)
+				continue
+			}
+			for _, quadKeyPrefix := range quadkey.Prefixes(quadKey, minZoom, maxZoom) {
+				response.QuadKey = quadKeyPrefix
+				response.Zoom = uint32(len(quadKeyPrefix))
+				//log.Printf("%s: response ready: id = %d, quadkey = %s", context, response.Id, response.QuadKey)
+				out <- response
 			}
 			// 			log.Printf("%s: clustering finished for cashpoint: %d", context, request.Id)
 		}
@@ -664,8 +185,109 @@ func tntSpaceClear(tnt *tarantool.Connection, spaceId uint32) error {
 	return nil
 }
 
+type TrMessage struct {
+	Key  string
+	Lang string
+	Text string
+}
+
+// Reads translations from 'tr' table: first column is message key,
+// other columns are named by language and contain translations or NULL
+func readMessages(townsDb *sql.DB) ([]TrMessage, error) {
+	rows, err := townsDb.Query(`SELECT * FROM tr`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	langList, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if len(langList) < 2 {
+		return nil, errors.New("tr table has no language columns")
+	}
+
+	rawResult := make([]sql.NullString, len(langList))
+	values := make([]interface{}, len(langList))
+	for i := range rawResult {
+		values[i] = &rawResult[i]
+	}
+
+	result := make([]TrMessage, 0)
+	for rows.Next() {
+		err = rows.Scan(values...)
+		if err != nil {
+			return nil, err
+		}
+		key := rawResult[0]
+		if !key.Valid || key.String == "" {
+			continue
+		}
+		for i := 1; i < len(langList); i++ {
+			if rawResult[i].Valid {
+				result = append(result, TrMessage{Key: key.String, Lang: langList[i], Text: rawResult[i].String})
+			}
+		}
+	}
+	return result, rows.Err()
+}
+
+// Appends default translations of api messages (see models.MESSAGES)
+// missing in legacy messages, so translations of 'tr' table win
+func withDefaultMessages(messages []TrMessage) []TrMessage {
+	known := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		known[msg.Lang+"\n"+msg.Key] = true
+	}
+
+	langs := make([]string, 0, len(models.MESSAGES))
+	for lang := range models.MESSAGES {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+
+	for _, lang := range langs {
+		keys := make([]string, 0, len(models.MESSAGES[lang]))
+		for key := range models.MESSAGES[lang] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if !known[lang+"\n"+key] {
+				messages = append(messages, TrMessage{Key: key, Lang: lang, Text: models.MESSAGES[lang][key]})
+			}
+		}
+	}
+	return messages
+}
+
 func migrateMessages(townsDb *sql.DB, tnt *tarantool.Connection) {
-	
+	spaceId, err := getTntSpaceId(tnt, "messages")
+	if err != nil {
+		log.Fatalf("cannot get space id: %v", err)
+	}
+
+	err = tntSpaceClear(tnt, spaceId)
+	if err != nil {
+		log.Fatalf("cannot drop space '%s': %v", "messages", err)
+	}
+
+	context := "migrateMessages"
+	messages, err := readMessages(townsDb)
+	if err != nil {
+		log.Fatalf("%s: %v\n", context, err)
+	}
+	messages = withDefaultMessages(messages)
+
+	for _, msg := range messages {
+		_, err = tnt.Replace(spaceId, []interface{}{msg.Key, msg.Lang, msg.Text})
+		if err != nil {
+			log.Fatalf("%s: cannot insert message '%s' (%s): %v\n", context, msg.Key, msg.Lang, err)
+		}
+	}
+	log.Printf("%d messages processed\n", len(messages))
 }
 
 func migrateTowns(townsDb, cpDb *sql.DB, tnt *tarantool.Connection) {
@@ -704,10 +326,9 @@ func migrateTowns(townsDb, cpDb *sql.DB, tnt *tarantool.Connection) {
 	currentTownIdx := 1
 	for rows.Next() {
 		var population interface{}
-		town := Town{}
-		var regionId uint32 = 0
+		town := models.Town{}
 		err = rows.Scan(&town.Id, &town.Name, &town.NameTr,
-			&regionId, &town.RegionalCenter,
+			&town.RegionId, &town.RegionalCenter,
 			&town.Latitude, &town.Longitude,
 			&town.Zoom, &town.Big, &population)
 		if err != nil {
@@ -719,16 +340,11 @@ func migrateTowns(townsDb, cpDb *sql.DB, tnt *tarantool.Connection) {
 			log.Fatal(err)
 		}
 
-		if regionId != 0 {
-			town.RegionId = new(uint32)
-			*town.RegionId = regionId
-		}
-
-		coord := []float32{ town.Longitude, town.Latitude }
+		coord := []float32{ float32(town.Longitude), float32(town.Latitude) }
 
 		resp, err := tnt.Insert(spaceId, []interface{}{
 			uint(town.Id), coord, town.Name,
-			town.NameTr, regionId, town.RegionalCenter,
+			town.NameTr, town.RegionId, town.RegionalCenter,
 			town.Zoom, town.Big, town.CashpointsCount, population,
 		})
 		if err != nil {
@@ -775,14 +391,14 @@ func migrateRegions(townsDb *sql.DB, tnt *tarantool.Connection) {
 	}
 
 	for rows.Next() {
-		region := Region{}
+		region := models.Region{}
 		err = rows.Scan(&region.Id, &region.Name, &region.NameTr,
 			&region.Latitude, &region.Longitude, &region.Zoom)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		coord := []float32{ region.Longitude, region.Latitude }
+		coord := []float32{ float32(region.Longitude), float32(region.Latitude) }
 
 		resp, err := tnt.Insert(spaceId, []interface{}{
 			uint32(region.Id), coord, region.Name, region.NameTr, region.Zoom,
@@ -825,12 +441,12 @@ func migrateBanks(banksDb *sql.DB, tnt *tarantool.Connection) {
 		log.Fatalf("%s: %v", context, err)
 	}
 
-	bankList := make([]Bank, 0)
+	bankList := make([]models.Bank, 0)
 
 	currentBankIdx := 1
 	var lastBankId uint32 = 0
 	for rows.Next() {
-		bank := Bank{}
+		bank := models.Bank{}
 		bank.Partners = make([]uint32, 0)
 
 		var nameTr sql.NullString
@@ -924,14 +540,7 @@ func migrateCashpoints(cpDb *sql.DB, tnt *tarantool.Connection) {
 		log.Fatalf("%s: cashpoints: %v\n", context, err)
 	}
 
-	rows, err := cpDb.Query(`SELECT id, type, bank_id, town_id,
-                                    longitude, latitude,
-                                    address, address_comment,
-                                    metro_name, free_access,
-                                    main_office, without_weekend,
-                                    round_the_clock, works_as_shop,
-                                    schedule_general, tel, additional,
-                                    rub, usd, eur, cash_in FROM cashpoints`)
+	rows, err := cpDb.Query(CASHPOINTS_QUERY)
 	if err != nil {
 		log.Fatalf("%s: cashpoints: %v\n", context, err)
 	}
@@ -939,23 +548,11 @@ func migrateCashpoints(cpDb *sql.DB, tnt *tarantool.Connection) {
 	currentCashpointIndex := 1
 	var lastCashpointId uint32 = 0
 	for rows.Next() {
-		cp := new(CashPoint)
-		cp.Version = 0
-		cp.Timestamp = 0
-		err = rows.Scan(&cp.Id, &cp.Type, &cp.BankId, &cp.TownId,
-			&cp.Longitude, &cp.Latitude,
-			&cp.Address, &cp.AddressComment,
-			&cp.MetroName, &cp.FreeAccess,
-			&cp.MainOffice, &cp.WithoutWeekend,
-			&cp.RoundTheClock, &cp.WorksAsShop,
-			&cp.Schedule, &cp.Tel, &cp.Additional,
-			&cp.Rub, &cp.Usd, &cp.Eur, &cp.CashIn)
+		cp, err := scanCashpoint(rows)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		cp.Postprocess()
-
 		if cp.Id > lastCashpointId {
 			lastCashpointId = cp.Id
 		}
@@ -969,25 +566,15 @@ func migrateCashpoints(cpDb *sql.DB, tnt *tarantool.Connection) {
 // 			log.Fatal(err)
 // 		}
 
-		coord := []float32{ cp.Longitude, cp.Latitude }
-		var currency []int
-		if cp.Rub {//RUB_CODE = 643
-			currency = append(currency, 643)
-		}
-		if cp.Usd {//USD_CODE = 840
-			currency = append(currency, 840)
-		}
-		if cp.Eur {//EUR_CODE = 978
-			currency = append(currency, 978)
-		}
+		coord := []float32{ float32(cp.Longitude), float32(cp.Latitude) }
 		resp, err := tnt.Insert(spaceId, []interface{}{
 			uint32(cp.Id), coord, cp.Type, cp.BankId, cp.TownId,
 			cp.Address, cp.AddressComment,
 			cp.MetroName, cp.FreeAccess,
 			cp.MainOffice, cp.WithoutWeekend,
 			cp.RoundTheClock, cp.WorksAsShop,
-			cp.Schedule, cp.Tel, cp.Additional,
-			currency, cp.CashIn,
+			scheduleJson(cp), cp.Tel, cp.Additional,
+			cp.Currency, cp.CashIn,
 			cp.Version,
 		})
 
@@ -1016,8 +603,8 @@ func migrateClusters(cpDb *sql.DB, tnt *tarantool.Connection) (map[string][]uint
 	channelsRequest := make([]chan CPClusteringRequest, taskCount)
 	channelsResponse := make([]chan CPClusteringResponse, taskCount)
 
-	var minZoom uint32 = 10
-	var maxZoom uint32 = 16
+	var minZoom uint32 = quadkey.CLUSTER_ZOOM_MIN
+	var maxZoom uint32 = quadkey.CLUSTER_ZOOM_MAX
 
 	for i := 0; i < taskCount; i++ {
 		channelsRequest[i] = make(chan CPClusteringRequest, CHAN_BUFFER_SIZE)
@@ -1052,7 +639,7 @@ func migrateClusters(cpDb *sql.DB, tnt *tarantool.Connection) (map[string][]uint
 			
 			cashpointIndex++
 
-			newProgress := math.Floor(float64(cashpointIndex) / float64(cashpointsCount) / float64(maxZoom - minZoom) * 100.0)
+			newProgress := math.Floor(float64(cashpointIndex) / float64(cashpointsCount) / float64(maxZoom - minZoom + 1) * 100.0)
 			if newProgress > progress {
 				progress = newProgress
 				log.Printf("%s: [%3d%%] clustering done", context, int(progress))
@@ -1170,16 +757,6 @@ func migrateClustersGeo(tnt *tarantool.Connection, quadKeySet map[string][]uint3
 	}
 }
 
-type Metro struct {
-	Id        uint32
-	Latitude  float64
-	Longitude float64
-	Town_id   uint32
-	Branch_id uint32
-	Name      string
-	Ext       string
-}
-
 func migrateMetro(townsDb *sql.DB, tnt *tarantool.Connection) {
 	SpaceId, err := getTntSpaceId(tnt, "metro")
 	if err != nil {
@@ -1197,22 +774,22 @@ func migrateMetro(townsDb *sql.DB, tnt *tarantool.Connection) {
 	if err != nil {
 		log.Fatalf("%s: metro: %v\n", context, err)
 	}
-	var metroT Metro
+	var metroT models.Metro
 	rows, err := townsDb.Query(`SELECT id, latitude, longitude, town_id, branch_id, name, ext FROM metro`)
 	if err != nil {
 		log.Fatalf("%s: %v\n", context, err)
 	}
 	currentMetroIndex := 0
 	for rows.Next() {
-		err = rows.Scan(&metroT.Id, &metroT.Latitude, &metroT.Longitude, &metroT.Town_id, &metroT.Branch_id, &metroT.Name, &metroT.Ext)
+		err = rows.Scan(&metroT.Id, &metroT.Latitude, &metroT.Longitude, &metroT.TownId, &metroT.BranchId, &metroT.StationName, &metroT.StationExitName)
 		if err != nil {
 			log.Fatalf("%s: sql scan error: %v\n", err)
 			return
 		}
 
 		resp, err := tnt.Insert(SpaceId, []interface{}{
-			metroT.Id, []float64{metroT.Longitude, metroT.Latitude}, metroT.Town_id,
-			metroT.Branch_id, metroT.Name, metroT.Ext})
+			metroT.Id, []float64{metroT.Longitude, metroT.Latitude}, metroT.TownId,
+			metroT.BranchId, metroT.StationName, metroT.StationExitName})
 
 		if err != nil {
 			log.Println("Insert")
@@ -1243,11 +820,42 @@ func migrate(townsDb, cpDb, banksDb *sql.DB, tnt *tarantool.Connection) {
 		return
 	}
 	migrateClustersGeo(tnt, quadKeyList)
+	migrateClusteredCashpoints(tnt)
+	rebuildSyncLog(tnt)
+}
+
+// Every object has been reimported, so delta sync clients have to reset
+func rebuildSyncLog(tnt *tarantool.Connection) {
+	resp, err := tnt.Call("syncLogRebuild", []interface{}{})
+	if err != nil {
+		log.Fatalf("rebuildSyncLog: %v", err)
+	}
+	log.Printf("rebuildSyncLog: %v entries", resp.Data[0].([]interface{})[0])
+}
+
+func connectTnt(tntUrl string) (*tarantool.Connection, error) {
+	opts := tarantool.Opts{
+		Reconnect:     1 * time.Second,
+		MaxReconnects: 3,
+		User:          "admin",
+		Pass:          "admin",
+	}
+	return tarantool.Connect(tntUrl, opts)
 }
 
 func main() {
 	args := os.Args[1:]
 
+	if len(args) > 0 && args[0] == "recluster" {
+		recluster(args[1:])
+		return
+	}
+
+	if len(args) > 0 && args[0] == "merge" {
+		merge(args[1:])
+		return
+	}
+
 	if len(args) == 0 {
 		log.Fatal("Towns db file path is not specified")
 	}
@@ -1287,13 +895,7 @@ func main() {
 	}
 	defer banksDb.Close()
 
-	opts := tarantool.Opts{
-		Reconnect: 1 * time.Second,
-		MaxReconnects: 3,
-		User: "admin",
- 		Pass: "admin",
-	}
-	tnt, err := tarantool.Connect(tntUrl, opts)
+	tnt, err := connectTnt(tntUrl)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -1,168 +1,89 @@
 package main
 
 import (
-	"encoding/json"
-// 	"fmt"
+	"database/sql"
+	"github.com/alexeyknyshev/models"
 	"testing"
 	"reflect"
-	"github.com/alexeyknyshev/gojsondiff"
-	"github.com/alexeyknyshev/gojsondiff/formatter"
 )
 
-func TestSplitTime(t *testing.T) {
-	checkSplitTime := func(s string, expFrom, expTo int, expOk bool) {
-		from, to, ok := SplitTime(s)
-		if ok != expOk {
-			t.Errorf("Expected '%v' but got '%v' => %s", expOk, ok, s)
-		}
-
-		if from != expFrom {
-			t.Errorf("Expected from '%d' but got '%d' => %s", expFrom, from, s)
-		}
-
-		if to != expTo {
-			t.Errorf("Expected to '%d' but got '%d' => %s", expTo, to, s)
-		}
+func TestParseIdList(t *testing.T) {
+	ids, err := parseIdList("1, 2,,42")
+	if err != nil {
+		t.Fatalf("parseIdList failed: %v", err)
+	}
+	if !reflect.DeepEqual(ids, []uint32{1, 2, 42}) {
+		t.Errorf("Expected [1 2 42] but got %v", ids)
 	}
 
-	checkSplitTime("10:00-10:01", 600, 601, true)
-	checkSplitTime("00:00-23:59", 0, 1439, true)
-	checkSplitTime("15:30-20:30", 930, 1230, true)
-	checkSplitTime("08:30—21:10", 510, 1270, true)
-	checkSplitTime("01:31-01:31", 91, 91, true)
-	checkSplitTime("blah-blah", 0, 0, false)
-	checkSplitTime("20:30—20:30", 1230, 1230, true)
-	checkSplitTime("20:15-03:40", 1215, 220, true)
+	if _, err = parseIdList("1,x"); err == nil {
+		t.Errorf("Expected error for invalid id list")
+	}
 }
 
-func TestDayRange(t *testing.T) {
-	checkDayRange := func(s string, expRange []int, expOk bool) {
-		result, err := ParseDayRange(s)
-		if expOk && err != nil {
-			t.Errorf("Expected right day range %v but got wrong %v => %v", expRange, result, err)
-		}
+func TestParseSince(t *testing.T) {
+	since, err := parseSince("1462060800")
+	if err != nil || since != 1462060800000000 {
+		t.Errorf("Expected 1462060800000000 but got %d (%v)", since, err)
+	}
 
-		if !reflect.DeepEqual(result, expRange) {
-			t.Errorf("Diff day ranges. Expected %v got %v", expRange, result)
-		}
+	since, err = parseSince("2016-05-01T00:00:00Z")
+	if err != nil || since != 1462060800000000 {
+		t.Errorf("Expected 1462060800000000 but got %d (%v)", since, err)
 	}
 
-	checkDayRange("пн.", []int{ 0 }, true)
-	checkDayRange("сб.", []int{ 5 }, true)
-	checkDayRange("пн.-пт.", []int{ 0, 1, 2, 3, 4 }, true)
-	checkDayRange("чт.-сб.", []int{ 3, 4, 5 }, true)
-	checkDayRange("сб.-вс.", []int{ 5, 6 }, true)
-	checkDayRange("пн.,ср.,пт.", []int{ 0, 2, 4 }, true)
-	checkDayRange("вт.,чт.-сб.", []int{ 1, 3, 4, 5 }, true)
-	checkDayRange("вт.—ср.", []int{ 1, 2 }, true)
-	checkDayRange("пн.,ср.,чт.,вс.,вт.,пт.-сб.", []int{ 0, 2, 3, 6, 1, 4, 5 }, true)
-	checkDayRange("пон.", []int{ }, false)
-	checkDayRange("пн.-пн.", []int{ }, false)
-	checkDayRange("чт.-вт.", []int{ }, false)
+	if _, err = parseSince("yesterday"); err == nil {
+		t.Errorf("Expected error for invalid timestamp")
+	}
 }
 
-func TestSchedule(t *testing.T) {
-	checkSchedule := func(s string, expSchedule *Schedule) {
-		schedule, err := ParseSchedule(s)
-		if err != nil {
-			t.Errorf("Cannot parse schedule: %v => %s", err, s)
-		}
-
-		scheduleJson, _  := json.Marshal(schedule)
-		expScheduleJson, _ := json.Marshal(expSchedule)
-
-		differ := gojsondiff.New()
+func TestReadMessages(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE tr (msg text, ru text, en text);
+	                  INSERT INTO tr VALUES ('Empty bank name', 'Пустое название банка', 'Empty bank name');
+	                  INSERT INTO tr VALUES ('Invalid session token', 'Неверный токен сессии', NULL);
+	                  INSERT INTO tr VALUES (NULL, 'Пусто', NULL);`)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		conf := &gojsondiff.CompareConfig{FloatEpsilon: 0.0001}
-		d, err := differ.Compare(expScheduleJson, scheduleJson, conf)
-		if err != nil {
-			t.Errorf("Cannot compare json data: %v", err)
-			return
-		}
+	messages, err := readMessages(db)
+	if err != nil {
+		t.Fatalf("readMessages failed: %v", err)
+	}
+	expected := []TrMessage{
+		{Key: "Empty bank name", Lang: "ru", Text: "Пустое название банка"},
+		{Key: "Empty bank name", Lang: "en", Text: "Empty bank name"},
+		{Key: "Invalid session token", Lang: "ru", Text: "Неверный токен сессии"},
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected %v but got %v", expected, messages)
+	}
+}
 
-		if !d.Modified() {
-			return
-		}
+func TestWithDefaultMessages(t *testing.T) {
+	legacy := []TrMessage{{Key: "Malformed request", Lang: "ru", Text: "Неверный запрос"}}
+	messages := withDefaultMessages(legacy)
+	if len(messages) != len(models.MESSAGES["ru"]) {
+		t.Fatalf("Expected %d messages but got %d", len(models.MESSAGES["ru"]), len(messages))
+	}
 
-		var expectedJson map[string]interface{}
-		json.Unmarshal(expScheduleJson, &expectedJson)
-		formatter := formatter.NewAsciiFormatter(expectedJson)
-		formatter.ShowArrayIndex = true
-		diffString, err := formatter.Format(d)
-		if err != nil {
-			// No error can occur
+	texts := make(map[string]string)
+	for _, msg := range messages {
+		if msg.Lang != "ru" {
+			t.Errorf("Unexpected message language: %v", msg)
 		}
-
-		t.Errorf("json diff:\n%s", diffString)
+		texts[msg.Key] = msg.Text
+	}
+	if texts["Malformed request"] != "Неверный запрос" {
+		t.Errorf("Expected legacy translation to win but got %s", texts["Malformed request"])
+	}
+	if texts["Invalid request parameter"] != models.MESSAGES["ru"]["Invalid request parameter"] {
+		t.Errorf("Expected default translation but got %s", texts["Invalid request parameter"])
 	}
-
-	checkSchedule("пн.: 08:30-21:00", &Schedule{
-		Mon: &ScheduleDay{
-			From: 510,
-			To:   1260,
-		},
-	})
-
-	sDay := &ScheduleDay{}
-
-	sDay.From = 540
-	sDay.To = 1110
-	checkSchedule("пн.-пт.: 09:00-18:30", &Schedule{
-		Mon: sDay,
-		Tue: sDay,
-		Wed: sDay,
-		Thu: sDay,
-		Fri: sDay,
-	})
-
-	sDay.From = 615
-	sDay.To = 870
-	checkSchedule("пн.,ср.-сб.: 10:15-14:30", &Schedule{
-		Mon: sDay,
-		Wed: sDay,
-		Thu: sDay,
-		Fri: sDay,
-		Sat: sDay,
-	})
-
-	checkSchedule("пн.: 10:30-17:00\nср.: 10:30-18:00", &Schedule{
-		Mon: &ScheduleDay{
-			From: 630,
-			To:   1020,
-		},
-		Wed: &ScheduleDay{
-			From: 630,
-			To:   1080,
-		},
-	})
-
-	sDay.From = 720
-	sDay.To = 1260
-	checkSchedule("пн.,ср.,пт.: 12:00-21:00\nсб.: 15:00-16:00", &Schedule{
-		Mon: sDay,
-		Wed: sDay,
-		Fri: sDay,
-		Sat: &ScheduleDay{
-			From: 900,
-			To:   960,
-		},
-	})
-
-	sDay.From = 600
-	sDay.To = 1080
-	checkSchedule("вт.: 11:00-18:40\n" +
-		      "ср.-пт.: 10:00-18:00\n" +
-		      "вс.: 12:00-16:30", &Schedule{
-		Tue: &ScheduleDay{
-			From: 660,
-			To:   1120,
-		},
-		Wed: sDay,
-		Thu: sDay,
-		Fri: sDay,
-		Sun: &ScheduleDay{
-			From: 720,
-			To:   990,
-		},
-	})
 }
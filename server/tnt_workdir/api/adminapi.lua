@@ -0,0 +1,294 @@
+json = require('json')
+
+-- Reference spaces editable by admins. Field 'col' is tuple column,
+-- 'coord' is index in coordinate array of column 2. Fields without
+-- default value are required for creation.
+local ADMIN_KINDS = {
+    bank = {
+        space = 'banks',
+        size = 9,
+        fields = {
+            name = { col = 2, type = 'string' },
+            name_tr = { col = 3, type = 'string', default = '' },
+            name_tr_alt = { col = 4, type = 'string', default = '' },
+            partners = { col = 5, type = 'table', default = {} },
+            town = { col = 6, type = 'string', default = '' },
+            licence = { col = 7, type = 'number', default = 0 },
+            rating = { col = 8, type = 'number', default = 0 },
+            tel = { col = 9, type = 'string', default = '' },
+        },
+    },
+    town = {
+        space = 'towns',
+        size = 10,
+        fields = {
+            longitude = { coord = 1, type = 'number' },
+            latitude = { coord = 2, type = 'number' },
+            name = { col = 3, type = 'string' },
+            name_tr = { col = 4, type = 'string', default = '' },
+            region_id = { col = 5, type = 'number', default = 0 },
+            regional_center = { col = 6, type = 'boolean', default = false },
+            zoom = { col = 7, type = 'number', default = 10 },
+            big = { col = 8, type = 'boolean', default = false },
+            cashpoints_count = { col = 9, readonly = true, default = 0 },
+            population = { col = 10, type = 'number', default = 0 },
+        },
+    },
+    region = {
+        space = 'regions',
+        size = 5,
+        fields = {
+            longitude = { coord = 1, type = 'number' },
+            latitude = { coord = 2, type = 'number' },
+            name = { col = 3, type = 'string' },
+            name_tr = { col = 4, type = 'string', default = '' },
+            zoom = { col = 5, type = 'number', default = 7 },
+        },
+    },
+    metro = {
+        space = 'metro',
+        size = 6,
+        fields = {
+            longitude = { coord = 1, type = 'number' },
+            latitude = { coord = 2, type = 'number' },
+            town_id = { col = 3, type = 'number' },
+            branch_id = { col = 4, type = 'number', default = 0 },
+            station_name = { col = 5, type = 'string' },
+            station_exit_name = { col = 6, type = 'string', default = '' },
+        },
+    },
+}
+
+local ADMIN_ERR_INVALID = 'invalid'
+local ADMIN_ERR_NOT_FOUND = 'not_found'
+local ADMIN_ERR_CONFLICT = 'conflict'
+
+local function _adminError(err, message)
+    return json.encode({ error = err, message = message })
+end
+
+local function _exists(space, id)
+    return box.space[space].index[0]:get(id) ~= nil
+end
+
+-- Checks references of object to other spaces
+local function _checkReferences(kind, id, obj)
+    if kind == 'bank' then
+        for _, partnerId in ipairs(obj[5]) do
+            if type(partnerId) ~= 'number' then
+                return 'partners must contain bank ids'
+            end
+            if partnerId == id or not _exists('banks', partnerId) then
+                return 'no such partner bank: ' .. tostring(partnerId)
+            end
+        end
+    elseif kind == 'town' then
+        if obj[5] ~= 0 and not _exists('regions', obj[5]) then
+            return 'no such region: ' .. tostring(obj[5])
+        end
+    elseif kind == 'metro' then
+        if not _exists('towns', obj[3]) then
+            return 'no such town: ' .. tostring(obj[3])
+        end
+    end
+    return nil
+end
+
+-- Checks whether pending cashpoint patches set field to id. Patches are
+-- not indexed by their data, so all of them are scanned.
+local function _patchesRefer(field, id)
+    local found = scanSpace(box.space.cashpoints_patches, function(t)
+        local ok, data = pcall(json.decode, t[4])
+        if ok and type(data) == 'table' and data[field] == id then
+            return true
+        end
+        return nil
+    end)
+    return found == true
+end
+
+-- Returns description of objects referencing object or nil if there are none
+local function _findReferrers(kind, id)
+    if kind == 'bank' then
+        if box.space.cashpoints.index.bank:count(id) > 0 then
+            return 'bank has cashpoints'
+        end
+        for _, t in box.space.banks.index[0]:pairs() do
+            for _, partnerId in ipairs(t[5]) do
+                if partnerId == id then
+                    return 'bank is partner of bank ' .. tostring(t[1])
+                end
+            end
+        end
+        if _patchesRefer('bank_id', id) then
+            return 'bank has pending cashpoint patches'
+        end
+    elseif kind == 'town' then
+        if box.space.cashpoints.index[2]:count(id) > 0 then
+            return 'town has cashpoints'
+        end
+        if box.space.metro.index[2]:count(id) > 0 then
+            return 'town has metro stations'
+        end
+        if _patchesRefer('town_id', id) then
+            return 'town has pending cashpoint patches'
+        end
+    elseif kind == 'region' then
+        for _, t in box.space.towns.index[0]:pairs() do
+            if t[5] == id then
+                return 'region has towns'
+            end
+        end
+    end
+    return nil
+end
+
+local function _syncTouch(kind, tuple, deleted)
+    if kind == 'bank' or kind == 'town' then
+        syncLogTouch(kind, tuple[1], 0, nil, deleted)
+    elseif kind == 'metro' then
+        syncLogTouch(kind, tuple[1], tuple[3], nil, deleted)
+    end
+end
+
+-- Applies fields of data to obj (tuple as table), missing fields are taken
+-- from defaults if obj is created
+local function _applyFields(spec, obj, data, create)
+    for name, value in pairs(data) do
+        local field = spec.fields[name]
+        if not field or field.readonly then
+            return 'unknown field: ' .. name
+        end
+        if type(value) ~= field.type then
+            return 'invalid type of field ' .. name .. ', expected ' .. field.type
+        end
+    end
+
+    for name, field in pairs(spec.fields) do
+        local value = data[name]
+        if value == nil and create then
+            if field.default == nil then
+                return 'missing required field: ' .. name
+            end
+            value = field.default
+        end
+        if value ~= nil then
+            if field.coord then
+                obj[2][field.coord] = value
+            else
+                obj[field.col] = value
+            end
+        end
+    end
+    return nil
+end
+
+local function _getKindSpec(kind)
+    local spec = ADMIN_KINDS[kind]
+    if not spec then
+        box.error(malformedRequest("unknown kind: " .. tostring(kind), "admin"))
+    end
+    return spec
+end
+
+-- Creates object of kind (bank, town, region, metro). Id is assigned
+-- automatically unless passed in data. Returns json {id} or {error, message}.
+function adminCreate(kind, reqJson)
+    local spec = _getKindSpec(kind)
+    local data = json.decode(reqJson)
+    if type(data) ~= 'table' then
+        return _adminError(ADMIN_ERR_INVALID, 'malformed request json')
+    end
+
+    local id = data.id
+    data.id = nil
+    if id ~= nil and type(id) ~= 'number' then
+        return _adminError(ADMIN_ERR_INVALID, 'invalid type of field id, expected number')
+    end
+
+    local obj = { id or 0, {} }
+    for i = 3, spec.size do
+        obj[i] = 0
+    end
+    local err = _applyFields(spec, obj, data, true)
+    if not err then
+        err = _checkReferences(kind, id, obj)
+    end
+    if err then
+        return _adminError(ADMIN_ERR_INVALID, err)
+    end
+
+    local tuple = nil
+    box.begin()
+    if id then
+        if _exists(spec.space, id) then
+            box.rollback()
+            return _adminError(ADMIN_ERR_CONFLICT, kind .. ' already exists with id ' .. tostring(id))
+        end
+        tuple = box.space[spec.space]:insert(obj)
+    else
+        table.remove(obj, 1)
+        tuple = box.space[spec.space]:auto_increment(obj)
+    end
+    _syncTouch(kind, tuple, false)
+    box.commit()
+
+    return json.encode({ id = tuple[1] })
+end
+
+-- Updates fields passed in data of existing object
+function adminUpdate(kind, id, reqJson)
+    local spec = _getKindSpec(kind)
+    local data = json.decode(reqJson)
+    if type(data) ~= 'table' then
+        return _adminError(ADMIN_ERR_INVALID, 'malformed request json')
+    end
+    if data.id ~= nil and data.id ~= id then
+        return _adminError(ADMIN_ERR_INVALID, 'id cannot be changed')
+    end
+    data.id = nil
+
+    local old = box.space[spec.space].index[0]:get(id)
+    if not old then
+        return _adminError(ADMIN_ERR_NOT_FOUND, kind .. ' does not exist with id ' .. tostring(id))
+    end
+
+    local obj = old:totable()
+    obj[2] = { obj[2][1], obj[2][2] }
+    local err = _applyFields(spec, obj, data, false)
+    if not err then
+        err = _checkReferences(kind, id, obj)
+    end
+    if err then
+        return _adminError(ADMIN_ERR_INVALID, err)
+    end
+
+    box.begin()
+    local tuple = box.space[spec.space]:replace(obj)
+    _syncTouch(kind, tuple, false)
+    box.commit()
+
+    return json.encode({ id = id })
+end
+
+-- Deletes object unless other objects refer to it
+function adminDelete(kind, id)
+    local spec = _getKindSpec(kind)
+
+    local old = box.space[spec.space].index[0]:get(id)
+    if not old then
+        return _adminError(ADMIN_ERR_NOT_FOUND, kind .. ' does not exist with id ' .. tostring(id))
+    end
+
+    local referrer = _findReferrers(kind, id)
+    if referrer then
+        return _adminError(ADMIN_ERR_CONFLICT, referrer)
+    end
+
+    box.begin()
+    box.space[spec.space]:delete(id)
+    _syncTouch(kind, old, true)
+    box.commit()
+
+    return json.encode({ id = id })
+end
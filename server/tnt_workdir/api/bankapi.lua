@@ -11,7 +11,7 @@ local COL_BANK_TEL = 9
 
 local MAX_BANKS_BATCH_SIZE = 256
 
-local function _getBankById(bankId)
+function _getBankById(bankId)
     local t = box.space.banks.index[0]:select(bankId)
     if #t == 0 then
         return nil
@@ -76,3 +76,113 @@ function getBanksList()
 
     return json.encode(setmetatable(result, { __serialize = "seq" }))
 end
+
+local COL_CP_BANK_ID = 4
+
+local function _getBanksCashpointsCount()
+    local result = {}
+    for _, tuple in box.space.cashpoints.index[0]:pairs() do
+        local bankId = tuple[COL_CP_BANK_ID]
+        result[bankId] = (result[bankId] or 0) + 1
+    end
+    return result
+end
+
+-- req: { limit, after, sort, desc, fields } (see getListPage)
+-- cashpoints_count requires full scan of cashpoints, so it is
+-- computed only if it is requested as sort or projection field
+function getBanksPage(reqJson)
+    local func = "getBanksPage"
+    local req = json.decode(reqJson)
+    if not req then
+        box.error(malformedRequest("malformed request json", func))
+        return nil
+    end
+
+    local needCount = req.sort == 'cashpoints_count'
+    for _, field in ipairs(req.fields or {}) do
+        if field == 'cashpoints_count' then
+            needCount = true
+        end
+    end
+    local counts = {}
+    if needCount then
+        counts = _getBanksCashpointsCount()
+    end
+
+    local items = {}
+    for _, tuple in box.space.banks.index[0]:pairs() do
+        local bank = _getBankById(tuple[COL_BANK_ID])
+        if needCount then
+            bank.cashpoints_count = counts[bank.id] or 0
+        end
+        items[#items + 1] = bank
+    end
+
+    return getListPage(items, req, func)
+end
+
+-- Returns ids of bank itself and its partners or nil if there is no such
+-- bank. Cards of bank are served without commission by partners ATMs.
+function _getBankPartnerNetwork(bankId)
+    local t = box.space.banks.index[0]:select(bankId)
+    if #t == 0 then
+        return nil
+    end
+
+    local result = { bankId }
+    local partnersTuple = t[1][COL_BANK_PARTNERS]
+    for i = 1, #partnersTuple do
+        if partnersTuple[i] ~= bankId then
+            result[#result + 1] = partnersTuple[i]
+        end
+    end
+    return result
+end
+
+function getBankPartners(bankId)
+    local network = _getBankPartnerNetwork(bankId)
+    if not network then
+        return ""
+    end
+
+    local result = {}
+    for i = 2, #network do
+        result[#result + 1] = _getBankById(network[i])
+    end
+    return json.encode(setmetatable(result, { __serialize = "seq" }))
+end
+
+-- Replaces filter.partner_of with bank_id filter of partner network.
+-- If filter has bank_id too, only banks matching both are left.
+function applyPartnerFilter(filter, func)
+    if filter.partner_of == nil then
+        return nil
+    end
+    if type(filter.partner_of) ~= 'number' then
+        return malformedRequest("filter.partner_of must be a bank id", func)
+    end
+
+    local network = _getBankPartnerNetwork(filter.partner_of)
+    if not network then
+        return malformedRequest("no such bank for filter.partner_of: " .. tostring(filter.partner_of), func)
+    end
+
+    if filter.bank_id then
+        local inNetwork = {}
+        for _, id in ipairs(network) do
+            inNetwork[id] = true
+        end
+        local bankIds = {}
+        for _, id in ipairs(filter.bank_id) do
+            if inNetwork[id] then
+                bankIds[#bankIds + 1] = id
+            end
+        end
+        network = bankIds
+    end
+
+    filter.bank_id = network
+    filter.partner_of = nil
+    return nil
+end
@@ -35,6 +35,12 @@ function getNearbyClusters(reqJson, countLimit)
         return nil
     end
 
+    err = applyPartnerFilter(req.filter, func)
+    if err then
+        box.error(err)
+        return nil
+    end
+
     if not req.zoom then
         box.error{ code = 400, reason = func .. ": missing required argument => req.zoom"}
         return nil
@@ -206,7 +212,7 @@ function _getNearbyTownClusters(req, countLimit)
         return size
     end
 
-    if req.filter.bank_id and #req.filter.bank_id > 0 then
+    if req.filter.bank_id then -- empty list matches nothing (e.g. filtered partner network)
         -- drop size cached value
         for i = 1, #result do
             result[i].size = 0
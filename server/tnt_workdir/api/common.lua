@@ -1,4 +1,5 @@
 json = require('json')
+local fiber = require('fiber')
 local COL_CP_ID = 1
 local COL_CP_COORD = 2
 local COL_CP_TYPE = 3
@@ -158,6 +159,7 @@ function deleteCashpointById(cpId)
         end
 
         _deleteCashpointPatches(cpId)
+        syncLogTouch('cashpoint', cpId, tuple[COL_CP_TOWN_ID], nil, true)
         return true
     end
     print("Cannot find cashpoint by id: " .. tostring(cpId))
@@ -785,3 +787,112 @@ function validateCashpoint(cp, checkRequired, func)
 
     return nil
 end
+
+local MAX_LIST_PAGE_SIZE = 1000
+local DEFAULT_LIST_PAGE_SIZE = 100
+
+-- Returns page of objects sorted by (req.sort, id) which follow req.after
+-- cursor { value = <sort field value>, id = <object id> }. Objects without
+-- sort field are sorted as if it was empty.
+function getListPage(items, req, func)
+    local sortField = req.sort or 'id'
+    local desc = req.desc == true
+
+    local limit = DEFAULT_LIST_PAGE_SIZE
+    if req.limit ~= nil then
+        if type(req.limit) ~= 'number' or req.limit <= 0 or req.limit > MAX_LIST_PAGE_SIZE then
+            box.error(malformedRequest("limit is out of range", func))
+            return nil
+        end
+        limit = req.limit
+    end
+
+    local emptyValue = 0
+    for _, item in ipairs(items) do
+        if type(item[sortField]) == 'string' then
+            emptyValue = ''
+            break
+        end
+    end
+
+    local key = function(obj)
+        local value = obj[sortField]
+        if value == nil then
+            return emptyValue
+        end
+        return value
+    end
+
+    local less = function(a, b)
+        local ka, kb = key(a), key(b)
+        if ka ~= kb then
+            if desc then
+                return ka > kb
+            end
+            return ka < kb
+        end
+        return a.id < b.id
+    end
+
+    table.sort(items, less)
+
+    local first = 1
+    if req.after then
+        if type(req.after.id) ~= 'number' or (#items > 0 and type(req.after.value) ~= type(emptyValue)) then
+            box.error(malformedRequest("malformed cursor", func))
+            return nil
+        end
+        local cursor = { id = req.after.id }
+        cursor[sortField] = req.after.value
+        while first <= #items and not less(cursor, items[first]) do
+            first = first + 1
+        end
+    end
+
+    local result = {}
+    local last = nil
+    for i = first, math.min(first + limit - 1, #items) do
+        local item = items[i]
+        last = { value = key(item), id = item.id }
+
+        if req.fields then
+            local projected = { id = item.id }
+            for _, field in ipairs(req.fields) do
+                projected[field] = item[field]
+            end
+            item = projected
+        end
+        result[#result + 1] = item
+    end
+
+    return json.encode({
+        items = setmetatable(result, { __serialize = "seq" }),
+        last = last,
+        more = first + limit - 1 < #items,
+    })
+end
+
+local SCAN_BATCH_SIZE = 1000
+
+-- Calls func for every tuple of space in order of primary key (single field).
+-- Space is selected in batches and fiber yields between them, so full scan
+-- of big space does not block other requests. Scan stops as soon as func
+-- returns not nil value, the value is returned then.
+function scanSpace(space, func)
+    local batch = space.index[0]:select({}, { limit = SCAN_BATCH_SIZE })
+    while #batch > 0 do
+        for _, tuple in ipairs(batch) do
+            local result = func(tuple)
+            if result ~= nil then
+                return result
+            end
+        end
+        if #batch < SCAN_BATCH_SIZE then
+            return nil
+        end
+        fiber.yield()
+        local last = batch[#batch][1]
+        batch = space.index[0]:select({ last }, { iterator = 'GT', limit = SCAN_BATCH_SIZE })
+    end
+    return nil
+end
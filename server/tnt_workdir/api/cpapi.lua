@@ -109,6 +109,12 @@ function getNearbyCashpoints(reqJson)
         return nil
     end
 
+    err = applyPartnerFilter(req.filter, func)
+    if err then
+        box.error(err)
+        return nil
+    end
+
     local t = box.space.cashpoints.index[1]:select({ req.topLeft.longitude, req.topLeft.latitude,
                                                      req.bottomRight.longitude, req.bottomRight.latitude },
                                                    { iterator = "le" })
@@ -195,8 +201,9 @@ function cashpointCommit(reqJson, userId)
         end
 
         if not isCashpointPatchTable(cp) then -- req is not patch, it is mark of new cashpoint
-            box.space.cashpoints:update(cp.id, {{ "=", COL_CP_APPROVED, true }})
+            box.space.cashpoints:update(cp.id, {{ "=", COL_CP_APPROVED, true }, { "=", COL_CP_TIMESTAMP, timestamp }})
             box.space.towns:update(oldCp.town_id, {{ '+', COL_TOWN_CP_COUNT, 1 }})
+            syncLogTouch('cashpoint', cp.id, oldCp.town_id, timestamp)
             return cp.id
         end
 
@@ -232,6 +239,7 @@ function cashpointCommit(reqJson, userId)
             cp.main_office, cp.without_weekend, cp.round_the_clock,
             cp.works_as_shop, cp.schedule, cp.tel, cp.additional, cp.currency, cp.cash_in, cp.version, timestamp, approved, cp.creator
         }
+        syncLogTouch('cashpoint', cp.id, cp.town_id, timestamp)
 
         return cp.id
     else -- creating new cashpoint
@@ -261,6 +269,7 @@ function cashpointCommit(reqJson, userId)
         cp.id = tuple[COL_CP_ID]
 
         _insertCashpointIntoQuadTree(cp, quadKey)
+        syncLogTouch('cashpoint', cp.id, cp.town_id, timestamp)
 
         --box.space.towns:update(cp.town_id, {{ '+', COL_TOWN_CP_COUNT, 1 }})
         local patch = { id = cp.id }
@@ -343,6 +352,13 @@ function cashpointProposePatch(reqJson)
     end
 end
 
+-- Inserts patch proposed by import user (see merge mode of
+-- server_sqlite_to_tarantool), patch id is allocated in the same transaction
+function cashpointInsertPatch(cpId, userId, patchJson, timestamp)
+    local t = box.space.cashpoints_patches:auto_increment{ cpId, userId, patchJson, timestamp }
+    return t[COL_CP_PATCH_ID]
+end
+
 function getCashpointPatchesCount(cpId)
     if not cpId then
         return nil
@@ -0,0 +1,172 @@
+json = require('json')
+local fiber = require('fiber')
+
+local CP_COORD = 2
+
+local CLUSTER_ID = 1
+local CLUSTER_COORD = 2
+local CLUSTER_MEMBERS = 3
+local CLUSTER_SIZE = 4
+
+local CLUSTER_ZOOM_MIN = 10
+local CLUSTER_ZOOM_MAX = 16
+
+local HEATMAP_MAX_GRID_SIZE = 256
+local HEATMAP_MAX_BANK_ID_FILTER = 16
+local HEATMAP_YIELD_EVERY = 1000
+
+-- Picks zoom of quadkey clusters fine enough for cell of cellWidth degrees:
+-- tile must be at least twice narrower than cell, so placing whole cluster
+-- into cell by its centroid is accurate enough. Returns nil if even the
+-- finest clusters are too coarse, raw cashpoints have to be used then.
+-- Clusters of zoom have ids of zoom + 1 length (see _getNearbyQuadClusters),
+-- so the finest zoom is CLUSTER_ZOOM_MAX - 1.
+local function _getHeatmapZoom(cellWidth)
+    for zoom = CLUSTER_ZOOM_MIN, CLUSTER_ZOOM_MAX - 1 do
+        local tileWidth = 360.0 / math.pow(2, zoom)
+        if tileWidth * 2 <= cellWidth then
+            return zoom
+        end
+    end
+    return nil
+end
+
+local function _isMatching(tuple, filtersList, filter)
+    for _, f in ipairs(filtersList) do
+        if not f(tuple, filter) then
+            return false
+        end
+    end
+    return true
+end
+
+-- req: { topLeft, bottomRight, cols, rows, filter }
+-- Returns non-empty cells of cols x rows grid over bbox with cashpoints count
+function getHeatmap(reqJson)
+    local func = "getHeatmap"
+    local req = json.decode(reqJson)
+    if not req then
+        box.error(malformedRequest("malformed request json", func))
+        return nil
+    end
+
+    req.filter = req.filter or {}
+    local err = validateRequest(req, func)
+    if err then
+        box.error(err)
+        return nil
+    end
+
+    for _, field in ipairs({ 'cols', 'rows' }) do
+        local value = req[field]
+        if type(value) ~= 'number' or value < 1 or value > HEATMAP_MAX_GRID_SIZE then
+            box.error(malformedRequest(field .. " is out of range [1, " .. HEATMAP_MAX_GRID_SIZE .. "]", func))
+            return nil
+        end
+    end
+
+    if #(req.filter.bank_id or {}) > HEATMAP_MAX_BANK_ID_FILTER then
+        box.error(malformedRequest("Receive " .. #req.filter.bank_id .. " bank_id filter. But max filter amount " .. HEATMAP_MAX_BANK_ID_FILTER, func))
+        return nil
+    end
+
+    err = applyPartnerFilter(req.filter, func)
+    if err then
+        box.error(err)
+        return nil
+    end
+
+    local minLon = math.min(req.topLeft.longitude, req.bottomRight.longitude)
+    local maxLon = math.max(req.topLeft.longitude, req.bottomRight.longitude)
+    local minLat = math.min(req.topLeft.latitude, req.bottomRight.latitude)
+    local maxLat = math.max(req.topLeft.latitude, req.bottomRight.latitude)
+
+    local cellWidth = (maxLon - minLon) / req.cols
+    local cellHeight = (maxLat - minLat) / req.rows
+    if cellWidth <= 0 or cellHeight <= 0 then
+        box.error(malformedRequest("empty bbox", func))
+        return nil
+    end
+
+    local cells = {}
+    local addToCell = function(longitude, latitude, count)
+        if count == 0 or longitude < minLon or longitude > maxLon or
+           latitude < minLat or latitude > maxLat then
+            return
+        end
+        local col = math.min(math.floor((longitude - minLon) / cellWidth), req.cols - 1)
+        -- rows go from top to bottom
+        local row = math.min(math.floor((maxLat - latitude) / cellHeight), req.rows - 1)
+        local key = row * req.cols + col
+        local cell = cells[key]
+        if not cell then
+            cell = { col = col, row = row, count = 0 }
+            cells[key] = cell
+        end
+        cell.count = cell.count + count
+    end
+
+    local bbox = { minLon, minLat, maxLon, maxLat }
+    local filtered = next(req.filter) ~= nil
+    local filtersList = _getFiltersList()
+    local zoom = _getHeatmapZoom(cellWidth)
+
+    -- bbox may cover whole country, so tuples are selected before scan
+    -- and fiber yields while scanning them not to block other requests
+    local scanned = 0
+    local yieldSometimes = function()
+        scanned = scanned + 1
+        if scanned % HEATMAP_YIELD_EVERY == 0 then
+            fiber.yield()
+        end
+    end
+
+    if zoom then
+        local clusters = box.space.clusters.index[1]:select(bbox, { iterator = "le" })
+        for _, tuple in ipairs(clusters) do
+            if tuple[CLUSTER_ID]:len() == zoom + 1 then
+                local count = tuple[CLUSTER_SIZE]
+                if filtered then
+                    count = 0
+                    for _, cpId in pairs(tuple[CLUSTER_MEMBERS]) do
+                        local cpTuple = box.space.cashpoints.index[0]:get(cpId)
+                        if cpTuple and _isMatching(cpTuple, filtersList, req.filter) then
+                            count = count + 1
+                        end
+                        yieldSometimes()
+                    end
+                end
+                addToCell(tuple[CLUSTER_COORD][1], tuple[CLUSTER_COORD][2], count)
+            end
+            yieldSometimes()
+        end
+    else
+        local cashpoints = box.space.cashpoints.index[1]:select(bbox, { iterator = "le" })
+        for _, tuple in ipairs(cashpoints) do
+            if not filtered or _isMatching(tuple, filtersList, req.filter) then
+                addToCell(tuple[CP_COORD][1], tuple[CP_COORD][2], 1)
+            end
+            yieldSometimes()
+        end
+    end
+
+    local result = {}
+    for _, cell in pairs(cells) do
+        cell.longitude = minLon + (cell.col + 0.5) * cellWidth
+        cell.latitude = maxLat - (cell.row + 0.5) * cellHeight
+        result[#result + 1] = cell
+    end
+    table.sort(result, function(a, b)
+        if a.row ~= b.row then
+            return a.row < b.row
+        end
+        return a.col < b.col
+    end)
+
+    return json.encode({
+        cell_width = cellWidth,
+        cell_height = cellHeight,
+        zoom = zoom,
+        cells = setmetatable(result, { __serialize = "seq" }),
+    })
+end
@@ -0,0 +1,21 @@
+-- [key] [lang] [text]
+local COL_MSG_KEY = 1
+local COL_MSG_LANG = 2
+local COL_MSG_TEXT = 3
+
+-- Returns translation of message or message key itself if there is
+-- no translation for lang (keys are english messages)
+function getMessage(key, lang)
+    if type(key) ~= 'string' then
+        return ''
+    end
+    if type(lang) ~= 'string' or lang == '' then
+        return key
+    end
+
+    local t = box.space.messages.index[0]:select{ key, lang }
+    if #t == 0 then
+        return key
+    end
+    return t[1][COL_MSG_TEXT]
+end
@@ -0,0 +1,158 @@
+json = require('json')
+local fiber = require('fiber')
+
+local COL_CP_TYPE = 3
+local COL_CP_BANK_ID = 4
+local COL_CP_TOWN_ID = 5
+local COL_CP_ROUND_THE_CLOCK = 12
+local COL_CP_CURRENCY = 17
+local COL_CP_APPROVED = 21
+
+local COL_TOWN_ID = 1
+local COL_TOWN_NAME = 3
+local COL_TOWN_NAME_TR = 4
+local COL_TOWN_REGION_ID = 5
+local COL_TOWN_POPULATION = 10
+
+local COL_REGION_ID = 1
+local COL_REGION_NAME = 3
+local COL_REGION_NAME_TR = 4
+
+local function _townPopulation(tuple)
+    local population = tuple[COL_TOWN_POPULATION]
+    if type(population) == 'number' and population > 0 then
+        return population
+    end
+    return nil
+end
+
+local function _countToList(counts, keyName)
+    local result = {}
+    for key, count in pairs(counts) do
+        result[#result + 1] = { [keyName] = key, count = count }
+    end
+    table.sort(result, function(a, b)
+        if a.count ~= b.count then
+            return a.count > b.count
+        end
+        return a[keyName] < b[keyName]
+    end)
+    return setmetatable(result, { __serialize = "seq" })
+end
+
+-- Aggregates approved cashpoints of towns, towns = nil means all towns.
+-- Density is calculated over towns with known population only.
+local function _collectStats(towns)
+    local stats = {
+        cashpoints_count = 0,
+        round_the_clock = 0,
+        population = 0,
+    }
+    local byBank = {}
+    local byType = {}
+    local byCurrency = {}
+    local populated = {}
+    local populatedCount = 0
+
+    local function addCashpoint(tuple)
+        -- legacy cashpoints have no approved field and are approved
+        if tuple[COL_CP_APPROVED] == false then
+            return
+        end
+
+        stats.cashpoints_count = stats.cashpoints_count + 1
+
+        local bankId = tuple[COL_CP_BANK_ID]
+        byBank[bankId] = (byBank[bankId] or 0) + 1
+
+        local cpType = tuple[COL_CP_TYPE]
+        byType[cpType] = (byType[cpType] or 0) + 1
+
+        local currencies = tuple[COL_CP_CURRENCY]
+        if type(currencies) == 'table' then
+            for _, currency in pairs(currencies) do
+                byCurrency[currency] = (byCurrency[currency] or 0) + 1
+            end
+        end
+
+        if tuple[COL_CP_ROUND_THE_CLOCK] == true then
+            stats.round_the_clock = stats.round_the_clock + 1
+        end
+
+        if populated[tuple[COL_CP_TOWN_ID]] then
+            populatedCount = populatedCount + 1
+        end
+    end
+
+    if towns then
+        for _, town in ipairs(towns) do
+            local population = _townPopulation(town)
+            if population then
+                populated[town[COL_TOWN_ID]] = true
+                stats.population = stats.population + population
+            end
+            for _, tuple in box.space.cashpoints.index[2]:pairs{ town[COL_TOWN_ID] } do
+                addCashpoint(tuple)
+            end
+            fiber.yield()
+        end
+    else
+        scanSpace(box.space.towns, function(town)
+            local population = _townPopulation(town)
+            if population then
+                populated[town[COL_TOWN_ID]] = true
+                stats.population = stats.population + population
+            end
+        end)
+        scanSpace(box.space.cashpoints, addCashpoint)
+    end
+
+    if stats.population > 0 then
+        stats.density_per_10k = populatedCount * 10000 / stats.population
+    end
+    stats.by_bank = _countToList(byBank, 'bank_id')
+    stats.by_currency = _countToList(byCurrency, 'currency')
+    stats.by_type = setmetatable(byType, { __serialize = "map" })
+    return stats
+end
+
+-- Returns cashpoints statistics json of town, region or whole country
+-- (scope 'country', id is ignored) or "" if town or region does not exist
+function getCashpointsStats(scope, id)
+    local stats = nil
+    if scope == 'town' then
+        local t = box.space.towns.index[0]:select(id)
+        if #t == 0 then
+            return ""
+        end
+        stats = _collectStats({ t[1] })
+        stats.id = id
+        stats.name = t[1][COL_TOWN_NAME]
+        stats.name_tr = t[1][COL_TOWN_NAME_TR]
+        stats.region_id = t[1][COL_TOWN_REGION_ID]
+    elseif scope == 'region' then
+        local t = box.space.regions.index[0]:select(id)
+        if #t == 0 then
+            return ""
+        end
+        local towns = {}
+        for _, town in box.space.towns.index[0]:pairs() do
+            if town[COL_TOWN_REGION_ID] == id then
+                towns[#towns + 1] = town
+            end
+        end
+        stats = _collectStats(towns)
+        stats.id = t[1][COL_REGION_ID]
+        stats.name = t[1][COL_REGION_NAME]
+        stats.name_tr = t[1][COL_REGION_NAME_TR]
+        stats.towns_count = #towns
+    elseif scope == 'country' then
+        stats = _collectStats(nil)
+    else
+        box.error(malformedRequest("unknown stats scope", "getCashpointsStats"))
+        return nil
+    end
+
+    stats.scope = scope
+    return json.encode(stats)
+end
@@ -0,0 +1,193 @@
+local json = require('json')
+local fiber = require('fiber')
+
+-- [kind] [id] [town_id] [old_town_id] [timestamp] [deleted]
+local COL_SYNC_KIND = 1
+local COL_SYNC_ID = 2
+local COL_SYNC_TOWN_ID = 3
+local COL_SYNC_OLD_TOWN_ID = 4
+local COL_SYNC_TIMESTAMP = 5
+local COL_SYNC_DELETED = 6
+
+local COL_CP_ID = 1
+local COL_CP_TOWN_ID = 5
+
+local COL_METRO_ID = 1
+local COL_METRO_TOWN_ID = 3
+
+local SYNC_KIND_CASHPOINT = 'cashpoint'
+local SYNC_KIND_BANK = 'bank'
+local SYNC_KIND_TOWN = 'town'
+local SYNC_KIND_METRO = 'metro'
+-- special entry with timestamp of last log rebuild
+local SYNC_KIND_EPOCH = 'epoch'
+
+local MAX_SYNC_BATCH_SIZE = 1000
+
+-- response list names
+local SYNC_LISTS = {
+    [SYNC_KIND_CASHPOINT] = 'cashpoints',
+    [SYNC_KIND_BANK] = 'banks',
+    [SYNC_KIND_TOWN] = 'towns',
+    [SYNC_KIND_METRO] = 'metro',
+}
+
+local SYNC_GETTERS = {
+    [SYNC_KIND_CASHPOINT] = function(id) return _getCashpointById(id) end,
+    [SYNC_KIND_BANK] = function(id) return _getBankById(id) end,
+    [SYNC_KIND_TOWN] = function(id) return _getTownById(id) end,
+    [SYNC_KIND_METRO] = function(id) return _getMetroById(id) end,
+}
+
+-- only these kinds are filtered by town
+local SYNC_TOWN_KINDS = {
+    [SYNC_KIND_CASHPOINT] = true,
+    [SYNC_KIND_METRO] = true,
+}
+
+-- Records change of object for delta sync. Cashpoints pass timestamp
+-- stored in COL_CP_TIMESTAMP. Town of moved object is remembered, so clients
+-- syncing old town get it as deleted.
+function syncLogTouch(kind, id, townId, timestamp, deleted)
+    townId = townId or 0
+    timestamp = timestamp or fiber.time64()
+
+    local oldTownId = 0
+    local t = box.space.sync_log.index[0]:select{ kind, id }
+    if #t > 0 then
+        if t[1][COL_SYNC_TOWN_ID] ~= townId then
+            oldTownId = t[1][COL_SYNC_TOWN_ID]
+        else
+            oldTownId = t[1][COL_SYNC_OLD_TOWN_ID]
+        end
+    end
+
+    box.space.sync_log:replace{ kind, id, townId, oldTownId, timestamp, deleted == true }
+end
+
+local function _getSyncEpoch()
+    local t = box.space.sync_log.index[0]:select{ SYNC_KIND_EPOCH, 0 }
+    if #t == 0 then
+        return 0
+    end
+    return t[1][COL_SYNC_TIMESTAMP]
+end
+
+-- Fills sync log from scratch after full import (tombstones are lost).
+-- Clients with cursor older than rebuild get reset flag and full data.
+function syncLogRebuild()
+    local timestamp = fiber.time64()
+    box.space.sync_log:truncate()
+
+    for _, t in box.space.cashpoints.index[0]:pairs() do
+        box.space.sync_log:replace{ SYNC_KIND_CASHPOINT, t[COL_CP_ID], t[COL_CP_TOWN_ID], 0, timestamp, false }
+    end
+    for _, t in box.space.banks.index[0]:pairs() do
+        box.space.sync_log:replace{ SYNC_KIND_BANK, t[1], 0, 0, timestamp, false }
+    end
+    for _, t in box.space.towns.index[0]:pairs() do
+        box.space.sync_log:replace{ SYNC_KIND_TOWN, t[1], 0, 0, timestamp, false }
+    end
+    for _, t in box.space.metro.index[0]:pairs() do
+        box.space.sync_log:replace{ SYNC_KIND_METRO, t[COL_METRO_ID], t[COL_METRO_TOWN_ID], 0, timestamp, false }
+    end
+
+    box.space.sync_log:replace{ SYNC_KIND_EPOCH, 0, 0, 0, timestamp, false }
+    return box.space.sync_log.index[0]:count() - 1
+end
+
+local function _appendSyncEntry(result, t, townId)
+    local kind = t[COL_SYNC_KIND]
+    local id = t[COL_SYNC_ID]
+    local deleted = t[COL_SYNC_DELETED]
+
+    if townId and SYNC_TOWN_KINDS[kind] and t[COL_SYNC_TOWN_ID] ~= townId then
+        if t[COL_SYNC_OLD_TOWN_ID] ~= townId then
+            return
+        end
+        deleted = true -- moved out of requested town
+    end
+
+    local list = SYNC_LISTS[kind]
+    if not deleted then
+        local obj = SYNC_GETTERS[kind](id)
+        if obj then
+            table.insert(result[list], obj)
+            return
+        end
+    end
+    table.insert(result.deleted[list], id)
+end
+
+--[[
+  request:
+  {
+     since: { timestamp: %ts%, kind: %kind%, id: %id% } -- kind and id are optional
+     town_id: %id%, -- optional
+     limit: %n%
+  }
+]]--
+function getSyncChanges(reqJson)
+    local func = "getSyncChanges"
+    local req = json.decode(reqJson)
+    if not req or type(req.since) ~= 'table' or type(req.since.timestamp) ~= 'number' then
+        box.error(malformedRequest("missing since timestamp", func))
+        return nil
+    end
+    if req.town_id ~= nil and type(req.town_id) ~= 'number' then
+        box.error(malformedRequest("wrong type of town_id", func))
+        return nil
+    end
+
+    local limit = MAX_SYNC_BATCH_SIZE
+    if type(req.limit) == 'number' and req.limit > 0 and req.limit < MAX_SYNC_BATCH_SIZE then
+        limit = req.limit
+    end
+
+    local since = req.since
+    local reset = since.timestamp > 0 and since.timestamp < _getSyncEpoch()
+
+    local key = { since.timestamp }
+    local iterator = 'GT'
+    if reset then
+        key = {}
+        iterator = 'ALL'
+    elseif since.kind and since.id then
+        key = { since.timestamp, since.kind, since.id }
+    end
+
+    local result = {}
+    local deleted = {}
+    for _, list in pairs(SYNC_LISTS) do
+        result[list] = setmetatable({}, { __serialize = "seq" })
+        deleted[list] = setmetatable({}, { __serialize = "seq" })
+    end
+    result.deleted = deleted
+
+    local last = nil
+    local count = 0
+    local more = false
+    for _, t in box.space.sync_log.index.timestamp:pairs(key, { iterator = iterator }) do
+        if t[COL_SYNC_KIND] ~= SYNC_KIND_EPOCH then
+            if count == limit then
+                more = true
+                break
+            end
+            count = count + 1
+            last = { timestamp = t[COL_SYNC_TIMESTAMP], kind = t[COL_SYNC_KIND], id = t[COL_SYNC_ID] }
+            _appendSyncEntry(result, t, req.town_id)
+        end
+    end
+
+    if not last then -- nothing changed, keep cursor
+        last = since
+        if reset then
+            last = { timestamp = _getSyncEpoch() }
+        end
+    end
+
+    result.last = last
+    result.more = more
+    result.reset = reset
+    return json.encode(result)
+end
@@ -10,6 +10,12 @@ local COL_TOWN_ZOOM = 7
 local COL_TOWN_BIG = 8
 local COL_TOWN_CP_COUNT = 9
 
+local COL_REGION_ID = 1
+local COL_REGION_COORD = 2
+local COL_REGION_NAME = 3
+local COL_REGION_NAME_TR = 4
+local COL_REGION_ZOOM = 5
+
 local MAX_TOWNS_BATCH_SIZE = 1024
 
 local TOWN_HAS_METRO = {[4] = true}
@@ -21,7 +27,7 @@ local function _doTownHasMetro(townId)
     return false
 end
 
-local function _getTownById(townId)
+function _getTownById(townId)
     local t = box.space.towns.index[0]:select(townId)
     if #t == 0 then
         return nil
@@ -54,6 +60,23 @@ function getTownById(townId)
     return ""
 end
 
+function getRegionById(regionId)
+    local t = box.space.regions.index[0]:select(regionId)
+    if #t == 0 then
+        return ""
+    end
+
+    t = t[1]
+    return json.encode({
+        id = t[COL_REGION_ID],
+        longitude = t[COL_REGION_COORD][1],
+        latitude = t[COL_REGION_COORD][2],
+        name = t[COL_REGION_NAME],
+        name_tr = t[COL_REGION_NAME_TR],
+        zoom = t[COL_REGION_ZOOM],
+    })
+end
+
 function getTownsBatch(reqJson)
     local req = json.decode(reqJson)
     if not req or not req.towns then
@@ -82,3 +105,36 @@ function getTownsList()
 
     return json.encode(setmetatable(result, { __serialize = "seq" }))
 end
+
+function getTownCashpoints(townId)
+    local t = box.space.cashpoints.index[2]:select{ townId }
+
+    local result = {}
+    for _, tuple in ipairs(t) do
+        result[#result + 1] = tuple[1]
+    end
+
+    return json.encode(setmetatable(result, { __serialize = "seq" }))
+end
+
+local COL_TOWN_POPULATION = 10
+
+-- req: { limit, after, sort, desc, fields } (see getListPage)
+function getTownsPage(reqJson)
+    local func = "getTownsPage"
+    local req = json.decode(reqJson)
+    if not req then
+        box.error(malformedRequest("malformed request json", func))
+        return nil
+    end
+
+    local items = {}
+    for _, tuple in box.space.towns.index[0]:pairs() do
+        local town = _getTownById(tuple[COL_TOWN_ID])
+        town.population = tuple[COL_TOWN_POPULATION]
+        town.cashpoints_count = tuple[COL_TOWN_CP_COUNT]
+        items[#items + 1] = town
+    end
+
+    return getListPage(items, req, func)
+end
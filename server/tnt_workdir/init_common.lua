@@ -23,6 +23,11 @@ local bankapi = require('bankapi')
 local clusterapi = require('clusterapi')
 local metrics = require('metrics')
 local metroapi = require('metroapi')
+local syncapi = require('syncapi')
+local messageapi = require('messageapi')
+local statsapi = require('statsapi')
+local heatmapapi = require('heatmapapi')
+local adminapi = require('adminapi')
 
 function init()
     if not box.space.banks then
@@ -85,6 +90,15 @@ function init()
         log.info('space already exists: cashpoints')
     end
 
+    if not box.space.cashpoints.index.bank then
+        box.space.cashpoints:create_index('bank', { -- bank_id
+            type = 'TREE',
+            parts = { 4, 'NUM' },
+            unique = false,
+        })
+        log.info('created index: cashpoints.bank')
+    end
+
     -- [patch_id] [cp_id] [user_id] [json_data_string] [timestamp]
     if not box.space.cashpoints_patches then
         local patches = box.schema.space.create('cashpoints_patches')
@@ -134,6 +148,18 @@ function init()
         log.info('space already exists: clusters')
     end
 
+    -- [cp_id] [coord] positions clusters are built from (see cluster.Store)
+    if not box.space.clustered_cashpoints then
+        local clustered = box.schema.space.create('clustered_cashpoints')
+        clustered:create_index('primary', {
+            type = 'TREE',
+            parts = { 1, 'NUM' },
+        })
+        log.info('created space: clustered_cashpoints')
+    else
+        log.info('space already exists: clustered_cashpoints')
+    end
+
     if not box.space.clusters_cache then
         local clusters_cache = box.schema.space.create('clusters_cache')
         clusters_cache:create_index('primary', {
@@ -166,6 +192,35 @@ function init()
         log.info('space already exists: metro')
     end
 
+    -- [kind] [id] [town_id] [old_town_id] [timestamp] [deleted]
+    if not box.space.sync_log then
+        local syncLog = box.schema.space.create('sync_log')
+        syncLog:create_index('primary', {
+            type = 'TREE',
+            parts = { 1, 'STR', 2, 'NUM' },
+        })
+        syncLog:create_index('timestamp', {
+            type = 'TREE',
+            parts = { 5, 'NUM', 1, 'STR', 2, 'NUM' },
+        })
+        log.info('created space: sync_log')
+        log.info('sync_log filled with ' .. tostring(syncLogRebuild()) .. ' entries')
+    else
+        log.info('space already exists: sync_log')
+    end
+
+    -- [key] [lang] [text]
+    if not box.space.messages then
+        local messages = box.schema.space.create('messages')
+        messages:create_index('primary', {
+            type = 'TREE',
+            parts = { 1, 'STR', 2, 'STR' },
+        })
+        log.info('created space: messages')
+    else
+        log.info('space already exists: messages')
+    end
+
     local console = require('console')
     console.listen('127.0.0.1:3302')
 end